@@ -0,0 +1,244 @@
+package warppipe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/perangel/warp-pipe/internal/store"
+)
+
+// Number of changeset IDs below the highest delivered ID that are remembered
+// for deduplication, when no poll resets the delivered changesets.
+const dedupeWindow = 10000
+
+// deliveryTracker tracks the changesets delivered by an audit listener, so that
+// each changeset is delivered exactly once.
+type deliveryTracker struct {
+	// snapshot is the transaction snapshot up to which all committed
+	// changesets have been delivered. It is nil if the changesets table does
+	// not track transaction IDs.
+	snapshot *store.Snapshot
+	// polled is true once the snapshot was advanced by a poll. The initial
+	// snapshot also covers the changesets committed before the listener
+	// started, which are only delivered by the backlog.
+	polled bool
+	// delivered holds the IDs of changesets delivered ahead of the snapshot.
+	delivered       map[int64]bool
+	lastDeliveredID int64
+	// windowed is true if delivered is trimmed to the dedupe window, as no
+	// poll advances the snapshot and resets it.
+	windowed bool
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{
+		delivered: make(map[int64]bool),
+	}
+}
+
+// start takes the initial snapshot, if the changesets table tracks transaction IDs.
+func (t *deliveryTracker) start(ctx context.Context, s store.EventStore) error {
+	hasTxID, err := s.HasTxID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to inspect the changesets table: %w", err)
+	}
+
+	if !hasTxID {
+		t.windowed = true
+		return nil
+	}
+
+	t.snapshot, err = s.GetSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the current transaction snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// isDelivered returns true if the changeset has already been delivered, either
+// because it was delivered ahead of the snapshot, or because it was committed
+// before the snapshot of a poll.
+func (t *deliveryTracker) isDelivered(event *store.Event) bool {
+	if t.delivered[event.ID] {
+		return true
+	}
+
+	// Changesets committed before a polled snapshot were delivered by the
+	// backlog or a poll, or predate the listener and were not requested.
+	return t.polled && t.snapshot.Visible(event.TxID)
+}
+
+// markDelivered records a changeset delivered ahead of the snapshot.
+func (t *deliveryTracker) markDelivered(event *store.Event) {
+	if event.ID > t.lastDeliveredID {
+		t.lastDeliveredID = event.ID
+	}
+
+	// Changesets visible in the snapshot are never polled, nor notified, as
+	// the snapshot is taken before listening, so only the backlog delivers
+	// them, once.
+	if t.snapshot != nil && t.snapshot.Visible(event.TxID) {
+		return
+	}
+
+	t.delivered[event.ID] = true
+	if t.windowed && len(t.delivered) > 2*dedupeWindow {
+		for id := range t.delivered {
+			if id < t.lastDeliveredID-dedupeWindow {
+				delete(t.delivered, id)
+			}
+		}
+	}
+}
+
+// poll returns all changesets committed since the snapshot that have not been
+// delivered yet, and advances the snapshot.
+func (t *deliveryTracker) poll(ctx context.Context, s store.EventStore) ([]*store.Event, error) {
+	snapshot, err := s.GetSnapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current transaction snapshot: %w", err)
+	}
+
+	events, err := s.GetCommittedBetween(ctx, t.snapshot, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get committed changesets: %w", err)
+	}
+
+	var undelivered []*store.Event
+	for _, event := range events {
+		if t.delivered[event.ID] {
+			continue
+		}
+		undelivered = append(undelivered, event)
+		if event.ID > t.lastDeliveredID {
+			t.lastDeliveredID = event.ID
+		}
+	}
+
+	// Every changeset delivered ahead of the previous snapshot was committed
+	// before the new one was taken, so the new snapshot covers them all.
+	t.snapshot = snapshot
+	t.polled = true
+	t.delivered = make(map[int64]bool)
+
+	return undelivered, nil
+}
+
+// newChangesetFromEvent converts an audit event into a Changeset, decoding its
+// values with the column types recorded by the trigger. If the event values
+// cannot be parsed or decoded, the error is returned along with the changeset.
+func newChangesetFromEvent(event *store.Event) (*Changeset, error) {
+	cs := &Changeset{
+		ID:        event.ID,
+		Kind:      ParseChangesetKind(event.Action),
+		Schema:    event.SchemaName,
+		Table:     event.TableName,
+		Timestamp: event.Timestamp,
+	}
+
+	var types map[string]string
+	if event.ColumnTypes != nil {
+		err := json.Unmarshal(event.ColumnTypes, &types)
+		if err != nil {
+			return cs, fmt.Errorf("failed to unmarshal column types: %w", err)
+		}
+	}
+
+	var err error
+	if event.NewValues != nil {
+		cs.NewValues, err = parseEventValues(event.NewValues, types)
+		if err != nil {
+			return cs, fmt.Errorf("failed to unmarshal new values: %w", err)
+		}
+
+		err = decodeColumns(cs.NewValues)
+		if err != nil {
+			return cs, fmt.Errorf("failed to decode new values: %w", err)
+		}
+	}
+
+	if event.OldValues != nil {
+		cs.OldValues, err = parseEventValues(event.OldValues, types)
+		if err != nil {
+			return cs, fmt.Errorf("failed to unmarshal old values: %w", err)
+		}
+
+		err = decodeColumns(cs.OldValues)
+		if err != nil {
+			return cs, fmt.Errorf("failed to decode old values: %w", err)
+		}
+	}
+
+	return cs, nil
+}
+
+// parseEventValues parses the JSON object of the values of a row, typing them
+// with the types of their columns, if known. JSON objects, and the values of
+// json and jsonb columns, are kept as a json.RawMessage of their original
+// text, since marshaling them again could break checksum validation.
+func parseEventValues(values []byte, types map[string]string) ([]*ChangesetColumn, error) {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(values, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var cols []*ChangesetColumn
+	for k, data := range raw {
+		var v interface{}
+		err := unmarshalJSON(data, &v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal column %s: %w", k, err)
+		}
+
+		name, dims := parseTypeName(types[k])
+		_, isObject := v.(map[string]interface{})
+		switch {
+		case v == nil:
+		case name == "json" || name == "jsonb":
+			v, err = rawJSONArray(data, dims)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal column %s: %w", k, err)
+			}
+		case isObject:
+			v = json.RawMessage(data)
+		}
+
+		cols = append(cols, &ChangesetColumn{
+			Column: k,
+			Value:  v,
+			Type:   types[k],
+		})
+	}
+
+	return cols, nil
+}
+
+// rawJSONArray returns the raw JSON of the elements of an array of json or
+// jsonb values with the given dimensions, or the raw JSON of the value itself
+// if it is not an array.
+func rawJSONArray(data json.RawMessage, dims int) (interface{}, error) {
+	if dims == 0 {
+		return data, nil
+	}
+
+	var elems []json.RawMessage
+	err := json.Unmarshal(data, &elems)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		if string(elem) == "null" {
+			continue
+		}
+		values[i], err = rawJSONArray(elem, dims-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
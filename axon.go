@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/jmoiron/sqlx"
@@ -15,6 +15,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func getDBConnString(host string, port int, name, user, pass string) string {
 	return fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%d sslmode=%s",
 		user,
@@ -29,10 +31,16 @@ func getDBConnString(host string, port int, name, user, pass string) string {
 // Axon listens for Warp-Pipe change sets events. Then converts them into SQL statements, executing
 // them on the remote target.
 type Axon struct {
-	Config     *AxonConfig
-	Logger     *logrus.Logger
+	Config *AxonConfig
+	Logger *logrus.Logger
+	// DeadLetter receives the changesets of the dead_letter apply policy. If
+	// nil, the changesets are appended to Config.DeadLetterFile.
+	DeadLetter DeadLetterSink
 	shutdownCh chan os.Signal
 	pipeline   *Pipeline
+	conflicts  *ConflictsConfig
+	mapping    *MappingConfig
+	err        error
 }
 
 // NewAxonConfigFromEnv loads the Axon configuration from environment variables.
@@ -53,11 +61,67 @@ func (a *Axon) Run() {
 
 	signal.Notify(a.shutdownCh, os.Interrupt, syscall.SIGTERM)
 
+	if a.Config.ShutdownTimeout <= 0 {
+		a.Config.ShutdownTimeout = defaultShutdownTimeout
+	}
+
 	if a.Logger == nil {
 		a.Logger = logrus.New()
 		a.Logger.SetFormatter(&logrus.JSONFormatter{})
 	}
 
+	if a.DeadLetter == nil && a.Config.DeadLetterFile != "" {
+		f, err := os.OpenFile(a.Config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			a.Logger.WithError(err).Fatal("unable to open the dead-letter file")
+		}
+		defer f.Close()
+		a.DeadLetter = NewJSONDeadLetterSink(f)
+	}
+
+	err := a.checkApplyPolicies()
+	if err != nil {
+		a.Logger.WithError(err).Fatal("invalid apply policy")
+	}
+
+	if a.Config.ConflictPolicy != "" {
+		err = (&ConflictRule{Policy: a.Config.ConflictPolicy}).validate()
+		if err != nil {
+			a.Logger.WithError(err).Fatal("invalid conflict policy")
+		}
+	}
+
+	if a.Config.ConflictsConfig != "" {
+		a.conflicts, err = LoadConflictsConfig(a.Config.ConflictsConfig)
+		if err != nil {
+			a.Logger.WithError(err).Fatal("unable to load conflicts config")
+		}
+	}
+
+	if a.Config.MappingConfig != "" {
+		a.mapping, err = LoadMappingConfig(a.Config.MappingConfig)
+		if err != nil {
+			a.Logger.WithError(err).Fatal("unable to load mapping config")
+		}
+	}
+
+	if a.Config.PipelineConfig != "" {
+		pipelineConfig, err := LoadPipelineConfig(a.Config.PipelineConfig)
+		if err != nil {
+			a.Logger.WithError(err).Fatal("unable to load pipeline config")
+		}
+
+		if a.pipeline == nil {
+			a.pipeline = NewPipeline()
+		}
+		for _, stage := range pipelineConfig.Stages {
+			err = a.pipeline.AddStageConfig(stage)
+			if err != nil {
+				a.Logger.WithError(err).Fatal("unable to add pipeline stage")
+			}
+		}
+	}
+
 	// TODO: Refactor to use just one connection to the sourceDB
 	sourceDBConn, err := sqlx.Open("postgres", getDBConnString(
 		a.Config.SourceDBHost,
@@ -81,29 +145,46 @@ func (a *Axon) Run() {
 		a.Logger.WithError(err).Fatal("unable to connect to target database")
 	}
 
-	err = checkTargetVersion(targetDBConn)
+	err = checkTargetVersion(a.Logger, targetDBConn)
 	if err != nil {
 		a.Logger.WithError(err).Fatal("unable to check target database version")
 	}
 
 	// TODO: (1) add support for selecting the warp-pipe mode
 	// TODO: (2) only print the source stats if that is audit
-	err = printSourceStats(sourceDBConn)
+	err = printSourceStats(a.Logger, sourceDBConn)
 	if err != nil {
 		a.Logger.WithError(err).Fatal("unable to get source db stats")
 	}
 
+	err = createConflictsTable(targetDBConn)
+	if err != nil {
+		a.Logger.WithError(err).Fatal("unable to create the target DB conflicts table")
+	}
+
 	err = loadPrimaryKeys(targetDBConn)
 	if err != nil {
 		a.Logger.WithError(err).Fatal("unable to load target DB primary keys")
 	}
 
-	err = loadColumnSequences(targetDBConn)
+	targetSchemas := a.mapping.targetSchemas(a.Config.TargetDBSchema)
+
+	err = loadUniqueKeys(targetDBConn, targetSchemas)
+	if err != nil {
+		a.Logger.WithError(err).Fatal("unable to load target DB unique keys")
+	}
+
+	err = loadColumnTypes(targetDBConn, targetSchemas)
+	if err != nil {
+		a.Logger.WithError(err).Fatal("unable to load target DB column types")
+	}
+
+	err = loadColumnSequences(a.Logger, targetDBConn, targetSchemas)
 	if err != nil {
 		a.Logger.WithError(err).Fatal("unable to load target DB column sequences")
 	}
 
-	err = loadOrphanSequences(sourceDBConn)
+	err = loadOrphanSequences(a.Logger, sourceDBConn)
 	if err != nil {
 		a.Logger.WithError(err).Fatal("unable to load source DB orphan sequences")
 	}
@@ -137,30 +218,80 @@ func (a *Axon) Run() {
 	changes, errs := wp.ListenForChanges(ctx)
 
 	if a.pipeline != nil {
-		changes, errs = a.pipeline.Start(ctx, changes)
+		var pipelineErrs <-chan error
+		changes, pipelineErrs = a.pipeline.Start(ctx, changes)
+		errs = mergeErrors(ctx, errs, pipelineErrs)
+	}
+
+	// On shutdown, the listener stops and the changesets in flight are written
+	// to the target until the changes channel is closed or the drain times out.
+	var drainDeadline time.Time
+	var drainTimeout <-chan time.Time
+	shutdown := func() {
+		if drainDeadline.IsZero() {
+			drainDeadline = time.Now().Add(a.Config.ShutdownTimeout)
+		}
+		drainCtx, cancelDrain := context.WithDeadline(context.Background(), drainDeadline)
+		defer cancelDrain()
+
+		err := wp.Shutdown(drainCtx)
+		if err != nil {
+			a.Logger.WithError(err).
+				WithField("component", "warp_pipe").
+				Error("failed to gracefully shutdown")
+		}
+		cancel()
+		sourceDBConn.Close()
+		targetDBConn.Close()
 	}
 
 	for {
 		select {
 		case <-a.shutdownCh:
-			a.Logger.Error("shutting down...")
-			cancel()
-			wp.Close()
-			sourceDBConn.Close()
-			targetDBConn.Close()
+			if !drainDeadline.IsZero() {
+				// a second signal stops without waiting for the drain
+				drainDeadline = time.Now()
+				shutdown()
+				return
+			}
+			a.Logger.Info("shutting down, draining the pipeline...")
+			drainDeadline = time.Now().Add(a.Config.ShutdownTimeout)
+			drainTimeout = time.After(a.Config.ShutdownTimeout)
+			wp.stop()
+		case <-drainTimeout:
+			shutdown()
 			return
 		case err := <-errs:
 			a.Logger.WithError(err).
 				WithField("component", "warp_pipe").
 				Error("received an error")
-		case change := <-changes:
-			a.processChange(sourceDBConn, targetDBConn, a.Config.TargetDBSchema, change)
-			if a.Config.ShutdownAfterLastChangeset {
-				isLatest, err := wp.IsLatestChangeSet(change.ID)
+		case change, ok := <-changes:
+			if !ok {
+				shutdown()
+				return
+			}
+			err := a.applyChange(ctx, sourceDBConn, targetDBConn, change)
+			if err != nil {
+				a.halt(err)
+				drainDeadline = time.Now()
+				shutdown()
+				return
+			}
+			if a.Config.ConsumerName != "" {
+				err := wp.Acknowledge(ctx, a.Config.ConsumerName, change.ID)
 				if err != nil {
 					a.Logger.WithError(err).
 						WithField("component", "warp_pipe").
-						Fatal("failed to determine if the sync is complete")
+						Error("failed to acknowledge changeset")
+				}
+			}
+			if a.Config.ShutdownAfterLastChangeset {
+				isLatest, err := wp.IsLatestChangeSet(change.ID)
+				if err != nil {
+					a.halt(fmt.Errorf("failed to determine if the sync is complete: %w", err))
+					drainDeadline = time.Now()
+					shutdown()
+					return
 				}
 				if isLatest {
 					a.Logger.
@@ -196,6 +327,13 @@ func (a *Axon) Verify(schemas, includeTables, excludeTables []string) error {
 		return fmt.Errorf("unable to connect to source database: %w", err)
 	}
 
+	if a.mapping == nil && a.Config.MappingConfig != "" {
+		a.mapping, err = LoadMappingConfig(a.Config.MappingConfig)
+		if err != nil {
+			return fmt.Errorf("unable to load mapping config: %w", err)
+		}
+	}
+
 	err = db.PrepareForDataIntegrityChecks(sourceDBConn)
 	if err != nil {
 		return fmt.Errorf("unable to prepare source database for Integrity checks: %w", err)
@@ -223,47 +361,65 @@ func (a *Axon) Verify(schemas, includeTables, excludeTables []string) error {
 	}
 
 	for _, table := range tables {
+		name := db.QuoteIdentifier(table.Schema, table.Name)
 
 		a.Logger.
-			WithField("table", fmt.Sprintf(`"%s"."%s"`, table.Schema, table.Name)).
+			WithField("table", name).
 			Info("Verifying checksum")
 
-		if len(table.PKeyFields) < 1 {
-			return fmt.Errorf(`table "%s"."%s" has no primary key, cannot guarantee checksum match.`, table.Schema, table.Name)
+		var columns []string
+		rows, err := sourceDBConn.Query(`
+			SELECT attname FROM pg_attribute
+			WHERE attrelid = CAST($1 AS regclass) AND attnum > 0 AND NOT attisdropped
+			ORDER BY attnum`, name)
+		if err != nil {
+			return fmt.Errorf("failed to get the columns of table %s.%s: %w", table.Schema, table.Name, err)
+		}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to get the columns of table %s.%s: %w", table.Schema, table.Name, err)
+			}
+			columns = append(columns, column)
 		}
+		rows.Close()
+		if rows.Err() != nil {
+			return fmt.Errorf("failed to get the columns of table %s.%s: %w", table.Schema, table.Name, rows.Err())
+		}
+
+		// the target table, and its columns, are resolved through the mapping
+		// as changesets are applied
+		target := a.mapping.mapTable(table.Schema, table.Name, columns, a.Config.TargetDBSchema)
 
-		orderByClause := ""
-		pkColumns := make([]string, len(table.PKeyFields))
-		for position, column := range table.PKeyFields {
-			pkColumns[position-1] = fmt.Sprintf(`"%s"."%s"."%s"`, table.Schema, table.Name, column)
+		var keyColumns []string
+		if len(table.PKeyFields) > 0 {
+			keyColumns = make([]string, len(table.PKeyFields))
+			for position, column := range table.PKeyFields {
+				keyColumns[position-1] = column
+			}
+		} else if len(table.UniqueIndexFields) > 0 {
+			keyColumns = table.UniqueIndexFields
 		}
-		orderByClause = fmt.Sprintf(`ORDER BY %s`, strings.Join(pkColumns, ","))
 
-		sql := fmt.Sprintf(
-			`SELECT pg_md5_hashagg(md5(CAST(("%s"."%s".*)AS TEXT))%s) FROM "%s"."%s"`,
-			table.Schema,
-			table.Name,
-			orderByClause,
-			table.Schema,
-			table.Name,
-		)
+		sourceSQL, targetSQL := target.checksumSQL(keyColumns)
 
 		sourceChecksum := ""
-		row := sourceDBConn.QueryRow(sql)
-		err := row.Scan(&sourceChecksum)
+		row := sourceDBConn.QueryRow(sourceSQL)
+		err = row.Scan(&sourceChecksum)
 		if err != nil {
 			return fmt.Errorf("failed to scan the source checksum for table %s.%s: %w", table.Schema, table.Name, err)
 		}
 
 		targetChecksum := ""
-		row = targetDBConn.QueryRow(sql)
+		row = targetDBConn.QueryRow(targetSQL)
 		err = row.Scan(&targetChecksum)
 		if err != nil {
-			return fmt.Errorf("failed to scan the target checksum for table %s.%s: %w", table.Schema, table.Name, err)
+			return fmt.Errorf("failed to scan the target checksum for table %s.%s: %w", target.TargetSchema, target.TargetTable, err)
 		}
 
 		if sourceChecksum != targetChecksum {
-			return fmt.Errorf("checksums differ for table %s.%s", table.Schema, table.Name)
+			return fmt.Errorf("checksums differ for table %s.%s and target table %s.%s", table.Schema, table.Name, target.TargetSchema, target.TargetTable)
 		}
 	}
 	return nil
@@ -274,49 +430,100 @@ func (a *Axon) Shutdown() {
 	a.shutdownCh <- syscall.SIGTERM
 }
 
-func (a *Axon) processChange(sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset) {
+// Err returns the error that halted the Axon, if any, once Run has returned.
+func (a *Axon) Err() error {
+	return a.err
+}
+
+// halt records the error that stops the Axon.
+func (a *Axon) halt(err error) {
+	a.err = err
+	a.Logger.WithError(err).
+		WithField("component", "axon").
+		Error("halting")
+}
+
+// applyChange writes a changeset to its mapped target table, applying the
+// configured apply policy if it fails. It returns an error if the Axon must
+// halt.
+func (a *Axon) applyChange(ctx context.Context, sourceDB *sqlx.DB, targetDB *sqlx.DB, change *Changeset) error {
+	mapped := a.mapping.mapChange(change, a.Config.TargetDBSchema)
+	apply := func() error {
+		return a.processChange(sourceDB, targetDB, mapped.Schema, mapped)
+	}
+
+	err := apply()
+	if err != nil {
+		return a.handleApplyError(ctx, change, err, apply)
+	}
+	return nil
+}
+
+func (a *Axon) processChange(sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset) error {
+	logger := a.Logger.WithField("table", change.Table)
+
+	var err error
 	switch change.Kind {
 	case ChangesetKindInsert:
-		a.processInsert(sourceDB, targetDB, schema, change)
+		err = a.processInsert(logger, sourceDB, targetDB, schema, change)
 	case ChangesetKindUpdate:
-		a.processUpdate(targetDB, schema, change)
+		err = a.processUpdate(logger, targetDB, schema, change)
 	case ChangesetKindDelete:
-		a.processDelete(targetDB, schema, change)
+		err = a.processDelete(logger, targetDB, schema, change)
+	}
+	if err != nil {
+		return err
 	}
+
+	return a.processLargeObjects(logger, sourceDB, targetDB, schema, change)
 }
 
-func (a *Axon) processDelete(targetDB *sqlx.DB, schema string, change *Changeset) {
-	pk, err := getPrimaryKeyForChange(change)
-	if err != nil {
-		a.Logger.WithError(err).WithField("table", change.Table).
-			Errorf("unable to process DELETE for table '%s', changeset has no primary key", change.Table)
+func (a *Axon) processDelete(logger logrus.FieldLogger, targetDB *sqlx.DB, schema string, change *Changeset) error {
+	pk, err := getPrimaryKeyForChange(schema, change)
+	if err != nil && len(change.OldValues) == 0 {
+		// tables without a key are matched by their old values
+		return fmt.Errorf("unable to process DELETE for table '%s': %w", change.Table, err)
 	}
 
-	err = deleteRow(targetDB, schema, change, pk)
+	err = deleteRow(logger, targetDB, schema, change, pk)
 	if err != nil {
-		a.Logger.WithError(err).WithField("table", change.Table).
-			Errorf("failed to DELETE row for table '%s' (pk: %s)", change.Table, pk)
+		return fmt.Errorf("failed to DELETE row for table '%s' (pk: %s): %w", change.Table, pk, err)
 	}
+	return nil
 }
 
-func (a *Axon) processInsert(sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset) {
-	err := insertRow(sourceDB, targetDB, schema, change)
+func (a *Axon) processInsert(logger logrus.FieldLogger, sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset) error {
+	err := insertRow(logger, sourceDB, targetDB, schema, change, a.conflictRule(change.Table))
 	if err != nil {
-		a.Logger.WithError(err).WithField("table", change.Table).
-			Errorf("failed to INSERT row for table '%s'", change.Table)
+		return fmt.Errorf("failed to INSERT row for table '%s': %w", change.Table, err)
 	}
+	return nil
 }
 
-func (a *Axon) processUpdate(targetDB *sqlx.DB, schema string, change *Changeset) {
-	pk, err := getPrimaryKeyForChange(change)
+func (a *Axon) processUpdate(logger logrus.FieldLogger, targetDB *sqlx.DB, schema string, change *Changeset) error {
+	pk, err := getPrimaryKeyForChange(schema, change)
+	if err != nil && len(change.OldValues) == 0 {
+		// tables without a key are matched by their old values
+		return fmt.Errorf("unable to process UPDATE for table '%s': %w", change.Table, err)
+	}
+
+	err = updateRow(logger, targetDB, schema, change, pk, a.conflictRule(change.Table))
 	if err != nil {
-		a.Logger.WithError(err).WithField("table", change.Table).
-			Errorf("unable to process UPDATE for table '%s', changeset has no primary key", change.Table)
+		return fmt.Errorf("failed to UPDATE row for table '%s' (pk: %s): %w", change.Table, pk, err)
 	}
+	return nil
+}
 
-	err = updateRow(targetDB, schema, change, pk)
+// processLargeObjects copies the large objects referenced by the changed
+// columns of a changeset, if enabled.
+func (a *Axon) processLargeObjects(logger logrus.FieldLogger, sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset) error {
+	if !a.Config.ReplicateLargeObjects {
+		return nil
+	}
+
+	err := replicateLargeObjects(logger, sourceDB, targetDB, schema, change)
 	if err != nil {
-		a.Logger.WithError(err).WithField("table", change.Table).
-			Errorf("failed to UPDATE row for table '%s' (pk: %s)", change.Table, pk)
+		return fmt.Errorf("failed to copy large objects for table '%s': %w", change.Table, err)
 	}
+	return nil
 }
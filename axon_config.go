@@ -1,5 +1,7 @@
 package warppipe
 
+import "time"
+
 // AxonConfig store configuration for axon
 type AxonConfig struct {
 	// source db credentials
@@ -17,6 +19,49 @@ type AxonConfig struct {
 	TargetDBPass   string `envconfig:"target_db_pass"`
 	TargetDBSchema string `envconfig:"target_db_schema" default:"public"`
 
+	// name under which the Axon acknowledges processed changesets, so they can
+	// be pruned from the source
+	ConsumerName string `envconfig:"consumer_name" default:"axon"`
+
+	// path to a YAML or JSON file of built-in pipeline stages, applied to
+	// changesets before they are written to the target
+	PipelineConfig string `envconfig:"pipeline_config"`
+
+	// resolution of the changesets that conflict with the rows of the target:
+	// target_wins, source_wins or error. Tables can have their own policy in
+	// the conflicts config, a YAML or JSON file
+	ConflictPolicy  ConflictPolicy `envconfig:"conflict_policy" default:"target_wins"`
+	ConflictsConfig string         `envconfig:"conflicts_config"`
+
+	// target schemas, tables and columns of the source tables, a YAML or JSON
+	// file. Unmapped tables are written to TargetDBSchema under their own name
+	MappingConfig string `envconfig:"mapping_config"`
+
+	// copy the large objects referenced by oid and lo columns from the source
+	// when the columns change
+	ReplicateLargeObjects bool `envconfig:"replicate_large_objects"`
+
+	// handling of the changesets that fail to be written to the target, by
+	// error: skip, retry, halt or dead_letter. The policies of specific errors
+	// default to OnError.
+	OnError            ApplyPolicy `envconfig:"on_error" default:"skip"`
+	OnNoPrimaryKey     ApplyPolicy `envconfig:"on_no_primary_key"`
+	OnUnsupportedType  ApplyPolicy `envconfig:"on_unsupported_type"`
+	OnTargetConstraint ApplyPolicy `envconfig:"on_target_constraint"`
+
+	// retries of the retry policy, waiting RetryBackoff before the first retry
+	// and doubling the wait after each one
+	Retries      int           `envconfig:"retries" default:"3"`
+	RetryBackoff time.Duration `envconfig:"retry_backoff" default:"1s"`
+
+	// path of a file to append the changesets of the dead_letter policy to, as
+	// lines of JSON
+	DeadLetterFile string `envconfig:"dead_letter_file"`
+
+	// maximum time to wait on shutdown for the changesets in flight to be
+	// written to the target
+	ShutdownTimeout time.Duration `envconfig:"shutdown_timeout" default:"30s"`
+
 	// force Axon to shutdown after processing the latest changeset
 	ShutdownAfterLastChangeset bool `envconfig:"shutdown_after_last_changeset"`
 }
@@ -0,0 +1,278 @@
+package warppipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// ConflictPolicy is the resolution of the changesets that conflict with the
+// rows of the target: inserts of rows that already exist, and writes that
+// violate a unique constraint of the target.
+type ConflictPolicy string
+
+// ConflictPolicy constants
+const (
+	// Keep the row of the target, and skip the changeset. This is the default.
+	ConflictPolicyTargetWins ConflictPolicy = "target_wins"
+	// Overwrite the row of the target with the changeset, by primary key.
+	ConflictPolicySourceWins ConflictPolicy = "source_wins"
+	// Overwrite the row of the target only if the changeset has a later value
+	// of the rule's TimestampColumn. Updates are also only applied to older
+	// rows.
+	ConflictPolicyLastWriterWins ConflictPolicy = "last_writer_wins"
+	// Fail the changeset with ErrTargetConstraint, handled by the apply policy.
+	ConflictPolicyError ConflictPolicy = "error"
+	// Run the rule's SQL on the target.
+	ConflictPolicyCustom ConflictPolicy = "custom"
+)
+
+// resolutions of conflicts, as recorded in the conflicts table
+const (
+	conflictResolutionTarget = "target"
+	conflictResolutionSource = "source"
+	conflictResolutionCustom = "custom"
+	conflictResolutionError  = "error"
+)
+
+// ConflictsConfig is the configuration of the conflict policies of the Axon.
+type ConflictsConfig struct {
+	// Tables maps table names to their conflict rule. The tables without a
+	// rule use AxonConfig.ConflictPolicy.
+	Tables map[string]*ConflictRule `yaml:"tables" json:"tables"`
+}
+
+// ConflictRule is the conflict policy of a table.
+type ConflictRule struct {
+	// Policy is one of the ConflictPolicy constants.
+	Policy ConflictPolicy `yaml:"policy" json:"policy"`
+	// Column ordering the writes of a row, such as an updated_at timestamp.
+	// (last_writer_wins)
+	TimestampColumn string `yaml:"timestamp_column" json:"timestamp_column"`
+	// Statement run on the target, with the new values of the changeset bound
+	// as named parameters, such as :id. (custom)
+	SQL string `yaml:"sql" json:"sql"`
+}
+
+// LoadConflictsConfig reads a conflicts configuration from a YAML or JSON file.
+func LoadConflictsConfig(path string) (*ConflictsConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conflicts config: %w", err)
+	}
+
+	return ParseConflictsConfig(data)
+}
+
+// ParseConflictsConfig parses a conflicts configuration in YAML or JSON, and
+// validates its rules.
+func ParseConflictsConfig(data []byte) (*ConflictsConfig, error) {
+	var config ConflictsConfig
+	err := yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse conflicts config: %w", err)
+	}
+
+	for table, rule := range config.Tables {
+		if rule == nil {
+			return nil, fmt.Errorf("table %s has no conflict rule", table)
+		}
+		err := rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid conflict rule for table %s: %w", table, err)
+		}
+	}
+
+	return &config, nil
+}
+
+func (r *ConflictRule) validate() error {
+	switch r.Policy {
+	case ConflictPolicyTargetWins, ConflictPolicySourceWins, ConflictPolicyError:
+	case ConflictPolicyLastWriterWins:
+		if r.TimestampColumn == "" {
+			return fmt.Errorf("%s requires a timestamp_column", r.Policy)
+		}
+	case ConflictPolicyCustom:
+		if r.SQL == "" {
+			return fmt.Errorf("%s requires sql", r.Policy)
+		}
+	default:
+		return fmt.Errorf("'%s' is not a valid conflict policy. Must be one of `target_wins`, `source_wins`, `last_writer_wins`, `error` or `custom`", r.Policy)
+	}
+	return nil
+}
+
+// conflictRule returns the conflict rule of a table.
+func (a *Axon) conflictRule(table string) *ConflictRule {
+	if a.conflicts != nil {
+		if rule, ok := a.conflicts.Tables[table]; ok {
+			return rule
+		}
+	}
+
+	policy := a.Config.ConflictPolicy
+	if policy == "" {
+		policy = ConflictPolicyTargetWins
+	}
+	return &ConflictRule{Policy: policy}
+}
+
+// createConflictsTable creates the table recording the conflicts on the
+// target, if it does not exist.
+func createConflictsTable(conn *sqlx.DB) error {
+	_, err := conn.Exec(`
+		CREATE SCHEMA IF NOT EXISTS warp_pipe;
+		CREATE TABLE IF NOT EXISTS warp_pipe.conflicts (
+			id BIGSERIAL PRIMARY KEY,
+			ts TIMESTAMPTZ NOT NULL DEFAULT now(),
+			changeset_id BIGINT,
+			schema_name TEXT NOT NULL,
+			table_name TEXT NOT NULL,
+			action TEXT NOT NULL,
+			policy TEXT NOT NULL,
+			resolution TEXT NOT NULL,
+			error TEXT,
+			changeset JSON
+		)`,
+	)
+	if err != nil {
+		return fmt.Errorf("createConflictsTable: %w", err)
+	}
+	return nil
+}
+
+// recordConflict records a conflict and its resolution in the conflicts table.
+func recordConflict(logger logrus.FieldLogger, conn *sqlx.DB, schema string, change *Changeset, rule *ConflictRule, resolution string, cause error) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("recordConflict: failed to marshal changeset: %w", err)
+	}
+
+	var causeText *string
+	if cause != nil {
+		text := cause.Error()
+		causeText = &text
+	}
+
+	_, err = conn.Exec(`
+		INSERT INTO warp_pipe.conflicts (changeset_id, schema_name, table_name, action, policy, resolution, error, changeset)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		change.ID, schema, change.Table, change.Kind, rule.Policy, resolution, causeText, string(data),
+	)
+	if err != nil {
+		return fmt.Errorf("recordConflict: %w", err)
+	}
+
+	logger.Infof("conflict resolved by %s (%s): %s", rule.Policy, resolution, change)
+	return nil
+}
+
+// resolveConflict resolves a changeset that violated a unique constraint of
+// the target, according to the conflict rule of its table.
+func resolveConflict(logger logrus.FieldLogger, targetDB *sqlx.DB, schema string, change *Changeset, rule *ConflictRule, pqe *pq.Error) error {
+	resolution := conflictResolutionTarget
+	var resolveErr error
+
+	switch rule.Policy {
+	case ConflictPolicySourceWins, ConflictPolicyLastWriterWins:
+		if change.Kind != ChangesetKindInsert {
+			// updates are already written by primary key, so the violation is of
+			// another unique constraint, which the changeset cannot overwrite.
+			resolution = conflictResolutionError
+			resolveErr = targetError(pqe)
+			break
+		}
+
+		var won bool
+		won, resolveErr = upsertRow(targetDB, schema, change, rule)
+		if resolveErr != nil {
+			resolution = conflictResolutionError
+		} else if won {
+			resolution = conflictResolutionSource
+		}
+	case ConflictPolicyError:
+		resolution = conflictResolutionError
+		resolveErr = targetError(pqe)
+	case ConflictPolicyCustom:
+		resolution = conflictResolutionCustom
+		resolveErr = runConflictSQL(targetDB, schema, change, rule)
+		if resolveErr != nil {
+			resolution = conflictResolutionError
+		}
+	}
+
+	cause := resolveErr
+	if cause == nil {
+		cause = pqe
+	}
+	err := recordConflict(logger, targetDB, schema, change, rule, resolution, cause)
+	if err != nil {
+		return err
+	}
+	return resolveErr
+}
+
+// upsertRow writes the row of a changeset by primary key, over the existing
+// row. It returns false if the existing row is kept by last_writer_wins.
+func upsertRow(targetDB *sqlx.DB, schema string, change *Changeset, rule *ConflictRule) (bool, error) {
+	pk, err := getPrimaryKeyForChange(schema, change)
+	if err != nil {
+		return false, err
+	}
+
+	query, args, err := prepareUpdateQuery(schema, pk, change, rule)
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare the upsert of %s: %w", change, err)
+	}
+	result, err := targetDB.NamedExec(query, args)
+	if err != nil {
+		if pqe, ok := err.(*pq.Error); ok {
+			err = targetError(pqe)
+		}
+		return false, fmt.Errorf("failed to upsert %s for query %s: %w", change, removeDuplicateSpaces(query), err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// runConflictSQL runs the SQL of a custom conflict rule, with the new values of
+// the changeset.
+func runConflictSQL(targetDB *sqlx.DB, schema string, change *Changeset, rule *ConflictRule) error {
+	_, _, values, err := prepareQueryArgs(targetTable(schema, change.Table), change.NewValues)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the conflict sql of %s: %w", change, err)
+	}
+	_, err = targetDB.NamedExec(rule.SQL, values)
+	if err != nil {
+		if pqe, ok := err.(*pq.Error); ok {
+			err = targetError(pqe)
+		}
+		return fmt.Errorf("failed to run the conflict sql of %s: %w", change, err)
+	}
+	return nil
+}
+
+// lastWriterCondition returns the condition of a last_writer_wins rule,
+// matching the rows of the target older than the changeset.
+func lastWriterCondition(schema string, change *Changeset, rule *ConflictRule) (string, error) {
+	if rule == nil || rule.Policy != ConflictPolicyLastWriterWins {
+		return "", nil
+	}
+	if _, ok := change.GetNewColumnValue(rule.TimestampColumn); !ok {
+		return "", fmt.Errorf("last_writer_wins: no value of column %s", rule.TimestampColumn)
+	}
+
+	column := quoteNamedIdentifier(change.Table, rule.TimestampColumn)
+	target := columnTypes[targetTable(schema, change.Table)][rule.TimestampColumn]
+	return fmt.Sprintf("(%s IS NULL OR %s < %s)", column, column, castArg(queryParam(rule.TimestampColumn), target)), nil
+}
@@ -0,0 +1,71 @@
+package warppipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConflictsConfig(t *testing.T) {
+	config, err := ParseConflictsConfig([]byte(`
+tables:
+  users:
+    policy: last_writer_wins
+    timestamp_column: updated_at
+  orders:
+    policy: custom
+    sql: UPDATE orders SET total = total + :total WHERE id = :id
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, &ConflictRule{Policy: ConflictPolicyLastWriterWins, TimestampColumn: "updated_at"}, config.Tables["users"])
+	assert.Equal(t, ConflictPolicyCustom, config.Tables["orders"].Policy)
+
+	testCases := []string{
+		`tables: {users: {policy: newest}}`,
+		`tables: {users: {policy: last_writer_wins}}`,
+		`tables: {users: {policy: custom}}`,
+		`tables: {users: }`,
+		`tables: {users: {policy: error, unknown_field: true}}`,
+	}
+	for _, tc := range testCases {
+		_, err = ParseConflictsConfig([]byte(tc))
+		assert.Error(t, err, tc)
+	}
+}
+
+func TestConflictRule(t *testing.T) {
+	a := newTestAxon(&AxonConfig{ConflictPolicy: ConflictPolicySourceWins})
+	assert.Equal(t, &ConflictRule{Policy: ConflictPolicySourceWins}, a.conflictRule("users"))
+
+	a.conflicts = &ConflictsConfig{Tables: map[string]*ConflictRule{
+		"users": {Policy: ConflictPolicyError},
+	}}
+	assert.Equal(t, &ConflictRule{Policy: ConflictPolicyError}, a.conflictRule("users"))
+
+	a.Config.ConflictPolicy = ""
+	assert.Equal(t, &ConflictRule{Policy: ConflictPolicyTargetWins}, a.conflictRule("orders"))
+}
+
+func TestPrepareUpdateQueryLastWriterWins(t *testing.T) {
+	rule := &ConflictRule{Policy: ConflictPolicyLastWriterWins, TimestampColumn: "updated_at"}
+	change := &Changeset{
+		Kind:  ChangesetKindUpdate,
+		Table: "users",
+		NewValues: []*ChangesetColumn{
+			{Column: "id", Value: int64(1)},
+			{Column: "updated_at", Value: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		},
+	}
+
+	query, _, err := prepareUpdateQuery("public", []string{"id"}, change, rule)
+	assert.NoError(t, err)
+	assert.Equal(t, `INSERT INTO "public"."users" ("id", "updated_at") VALUES (:id, :updated_at) `+
+		`ON CONFLICT ("id") DO UPDATE SET "id" = :id, "updated_at" = :updated_at `+
+		`WHERE "users"."id" = :id AND ("users"."updated_at" IS NULL OR "users"."updated_at" < :updated_at)`,
+		removeDuplicateSpaces(query))
+
+	change.NewValues = change.NewValues[:1]
+	_, _, err = prepareUpdateQuery("public", []string{"id"}, change, rule)
+	assert.EqualError(t, err, "last_writer_wins: no value of column updated_at")
+}
@@ -0,0 +1,164 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Errors of the Axon, matched with errors.Is().
+var (
+	// ErrNoPrimaryKey is returned for changesets of tables without a known
+	// primary key in the target.
+	ErrNoPrimaryKey = errors.New("no primary key")
+	// ErrUnsupportedType is returned for values that cannot be written to the
+	// target.
+	ErrUnsupportedType = errors.New("unsupported type")
+	// ErrTargetConstraint is returned for changesets violating a constraint of
+	// the target, other than the duplicate inserts that are skipped.
+	ErrTargetConstraint = errors.New("target constraint violation")
+)
+
+// ApplyError is an error of the Axon writing a changeset to the target.
+type ApplyError struct {
+	// Changeset the Axon failed to write.
+	Changeset *Changeset
+	// Err is the cause of the failure.
+	Err error
+}
+
+// Error implements error.
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("changeset %d: %v", e.Changeset.ID, e.Err)
+}
+
+// Unwrap returns the cause of the failure.
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// ApplyPolicy is the handling of changesets that the Axon failed to write to
+// the target.
+type ApplyPolicy string
+
+// ApplyPolicy constants
+const (
+	// Log the error and skip the changeset. This is the default.
+	ApplyPolicySkip ApplyPolicy = "skip"
+	// Retry the changeset with a backoff, and halt if it still fails.
+	ApplyPolicyRetry ApplyPolicy = "retry"
+	// Stop the Axon without acknowledging the changeset.
+	ApplyPolicyHalt ApplyPolicy = "halt"
+	// Send the changeset to the dead-letter sink, and skip it. The Axon halts
+	// if the changeset cannot be sent.
+	ApplyPolicyDeadLetter ApplyPolicy = "dead_letter"
+)
+
+// ParseApplyPolicy parses an apply policy from a string.
+func ParseApplyPolicy(policy string) (ApplyPolicy, error) {
+	switch ApplyPolicy(policy) {
+	case ApplyPolicySkip, ApplyPolicyRetry, ApplyPolicyHalt, ApplyPolicyDeadLetter:
+		return ApplyPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("'%s' is not a valid apply policy. Must be one of `skip`, `retry`, `halt` or `dead_letter`", policy)
+	}
+}
+
+// targetError marks the constraint violations of the target database with
+// ErrTargetConstraint.
+func targetError(pqe *pq.Error) error {
+	if pqe.Code.Class() != "23" {
+		return pqe
+	}
+	return fmt.Errorf("%w: %s", ErrTargetConstraint, pqe.Message)
+}
+
+// applyPolicy returns the policy configured for an error.
+func (a *Axon) applyPolicy(err error) ApplyPolicy {
+	var policy ApplyPolicy
+	switch {
+	case errors.Is(err, ErrNoPrimaryKey):
+		policy = a.Config.OnNoPrimaryKey
+	case errors.Is(err, ErrUnsupportedType):
+		policy = a.Config.OnUnsupportedType
+	case errors.Is(err, ErrTargetConstraint):
+		policy = a.Config.OnTargetConstraint
+	}
+	if policy == "" {
+		policy = a.Config.OnError
+	}
+	if policy == "" {
+		policy = ApplyPolicySkip
+	}
+	return policy
+}
+
+// checkApplyPolicies validates the configured apply policies.
+func (a *Axon) checkApplyPolicies() error {
+	policies := map[string]ApplyPolicy{
+		"on_error":             a.Config.OnError,
+		"on_no_primary_key":    a.Config.OnNoPrimaryKey,
+		"on_unsupported_type":  a.Config.OnUnsupportedType,
+		"on_target_constraint": a.Config.OnTargetConstraint,
+	}
+	for name, policy := range policies {
+		if policy == "" {
+			continue
+		}
+		_, err := ParseApplyPolicy(string(policy))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if policy == ApplyPolicyDeadLetter && a.DeadLetter == nil {
+			return fmt.Errorf("invalid %s: dead_letter requires a dead-letter sink", name)
+		}
+	}
+	return nil
+}
+
+// handleApplyError applies the configured policy to a changeset that failed to
+// be written to the target, retrying it with apply. It returns an error if the
+// Axon must halt.
+func (a *Axon) handleApplyError(ctx context.Context, change *Changeset, err error, apply func() error) error {
+	logger := a.Logger.WithError(err).WithField("changeset_id", change.ID).WithField("table", change.Table)
+
+	policy := a.applyPolicy(err)
+	if policy == ApplyPolicyRetry {
+		retry := &stageOptions{retries: a.Config.Retries, retryBackoff: a.Config.RetryBackoff}
+		attempted := false
+		cancelled, retryErr := retry.withRetries(ctx, func() error {
+			if !attempted {
+				// the changeset was already applied once
+				attempted = true
+				return err
+			}
+			logger.Warn("retrying changeset")
+			return apply()
+		})
+		if cancelled {
+			return &ApplyError{Changeset: change, Err: ctx.Err()}
+		}
+		if retryErr == nil {
+			return nil
+		}
+		err = retryErr
+		policy = ApplyPolicyHalt
+	}
+
+	switch policy {
+	case ApplyPolicyHalt:
+		return &ApplyError{Changeset: change, Err: err}
+	case ApplyPolicyDeadLetter:
+		sendErr := a.DeadLetter.Send(ctx, &StageError{Stage: "axon", Changeset: change, Err: err})
+		if sendErr != nil {
+			return &ApplyError{Changeset: change, Err: fmt.Errorf("failed to send to the dead-letter sink: %v: %w", sendErr, err)}
+		}
+		logger.Warn("changeset sent to the dead-letter sink")
+		return nil
+	default:
+		logger.Error("failed to apply changeset, skipped")
+		return nil
+	}
+}
@@ -0,0 +1,109 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAxon(config *AxonConfig) *Axon {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return &Axon{Config: config, Logger: logger}
+}
+
+func TestTargetError(t *testing.T) {
+	err := targetError(&pq.Error{Code: "23503", Message: "violates foreign key constraint"})
+	assert.True(t, errors.Is(err, ErrTargetConstraint))
+	assert.EqualError(t, err, "target constraint violation: violates foreign key constraint")
+
+	err = targetError(&pq.Error{Code: "42P01", Message: "relation does not exist"})
+	assert.False(t, errors.Is(err, ErrTargetConstraint))
+}
+
+func TestApplyPolicy(t *testing.T) {
+	a := newTestAxon(&AxonConfig{
+		OnError:            ApplyPolicyRetry,
+		OnNoPrimaryKey:     ApplyPolicyHalt,
+		OnTargetConstraint: ApplyPolicyDeadLetter,
+	})
+
+	assert.Equal(t, ApplyPolicyHalt, a.applyPolicy(fmt.Errorf("update: %w", ErrNoPrimaryKey)))
+	assert.Equal(t, ApplyPolicyDeadLetter, a.applyPolicy(fmt.Errorf("insert: %w", ErrTargetConstraint)))
+	assert.Equal(t, ApplyPolicyRetry, a.applyPolicy(fmt.Errorf("insert: %w", ErrUnsupportedType)))
+	assert.Equal(t, ApplyPolicyRetry, a.applyPolicy(errors.New("connection refused")))
+
+	a.Config.OnError = ""
+	assert.Equal(t, ApplyPolicySkip, a.applyPolicy(errors.New("connection refused")))
+
+	// dead-lettering requires a sink
+	assert.Error(t, a.checkApplyPolicies())
+	a.DeadLetter = DeadLetterFunc(func(ctx context.Context, err *StageError) error { return nil })
+	assert.NoError(t, a.checkApplyPolicies())
+	a.Config.OnUnsupportedType = "ignore"
+	assert.Error(t, a.checkApplyPolicies())
+}
+
+func TestHandleApplyError(t *testing.T) {
+	change := &Changeset{ID: 7, Kind: ChangesetKindInsert, Table: "users"}
+	errApply := fmt.Errorf("insert: %w", ErrTargetConstraint)
+
+	testCases := []struct {
+		policy   ApplyPolicy
+		failures int
+		halted   bool
+		attempts int
+		letters  int
+	}{
+		{ApplyPolicySkip, 1, false, 0, 0},
+		{ApplyPolicyHalt, 1, true, 0, 0},
+		{ApplyPolicyDeadLetter, 1, false, 0, 1},
+		// the changeset succeeds on the second retry
+		{ApplyPolicyRetry, 2, false, 2, 0},
+		// the retries are exhausted, so the Axon halts
+		{ApplyPolicyRetry, 10, true, 3, 0},
+	}
+
+	for _, tc := range testCases {
+		a := newTestAxon(&AxonConfig{
+			OnTargetConstraint: tc.policy,
+			Retries:            3,
+			RetryBackoff:       time.Millisecond,
+		})
+		var letters []*StageError
+		a.DeadLetter = DeadLetterFunc(func(ctx context.Context, err *StageError) error {
+			letters = append(letters, err)
+			return nil
+		})
+
+		failures := tc.failures - 1
+		attempts := 0
+		err := a.handleApplyError(context.Background(), change, errApply, func() error {
+			attempts++
+			if failures > 0 {
+				failures--
+				return errApply
+			}
+			return nil
+		})
+
+		if tc.halted {
+			var applyErr *ApplyError
+			if assert.True(t, errors.As(err, &applyErr), tc.policy) {
+				assert.Equal(t, change, applyErr.Changeset)
+				assert.True(t, errors.Is(err, ErrTargetConstraint))
+			}
+		} else {
+			assert.NoError(t, err, tc.policy)
+		}
+		assert.Equal(t, tc.attempts, attempts, tc.policy)
+		assert.Len(t, letters, tc.letters, tc.policy)
+	}
+}
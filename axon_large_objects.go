@@ -0,0 +1,116 @@
+package warppipe
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// isLargeObjectType returns true for the column types that reference large
+// objects: oid, and the lo domain of the lo extension.
+func isLargeObjectType(colType string) bool {
+	name, dims := parseTypeName(colType)
+	if dims > 0 {
+		return false
+	}
+	return name == "oid" || name == "lo" || name == "public.lo"
+}
+
+// changedLargeObjects returns the oids referenced by the large object columns
+// of a changeset that were inserted or changed, by the column types of its
+// table in the target schema.
+func changedLargeObjects(logger logrus.FieldLogger, schema string, change *Changeset) []uint32 {
+	if change.Kind == ChangesetKindDelete {
+		return nil
+	}
+
+	var oids []uint32
+	for _, c := range change.NewValues {
+		if c.Unchanged || c.Value == nil {
+			continue
+		}
+		colType := c.Type
+		if target := columnTypes[targetTable(schema, change.Table)][c.Column]; target != nil {
+			colType = target.Type
+		}
+		if !isLargeObjectType(colType) {
+			continue
+		}
+
+		if change.Kind == ChangesetKindUpdate {
+			if old, ok := change.GetPreviousColumnValue(c.Column); ok && valuesEqual(old, c.Value) {
+				continue
+			}
+		}
+
+		oid, err := strconv.ParseUint(valueText(c.Value), 10, 32)
+		if err != nil {
+			logger.Warnf("skipping large object of column %s, invalid oid %v", c.Column, c.Value)
+			continue
+		}
+		oids = append(oids, uint32(oid))
+	}
+	return oids
+}
+
+// replicateLargeObjects copies the large objects referenced by the changed
+// large object columns of a changeset from the source to the target, under the
+// same oids. The contents of a large object are read into memory.
+func replicateLargeObjects(logger logrus.FieldLogger, sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset) error {
+	for _, oid := range changedLargeObjects(logger, schema, change) {
+		err := copyLargeObject(logger, sourceDB, targetDB, oid)
+		if err != nil {
+			return fmt.Errorf("failed to copy large object %d of %s: %w", oid, change, err)
+		}
+	}
+	return nil
+}
+
+func copyLargeObject(logger logrus.FieldLogger, sourceDB *sqlx.DB, targetDB *sqlx.DB, oid uint32) error {
+	var data []byte
+	err := sourceDB.Get(&data, `
+		SELECT lo_get(oid)
+		FROM pg_largeobject_metadata
+		WHERE oid = $1`,
+		oid,
+	)
+	if err == sql.ErrNoRows {
+		// the oid does not reference a large object
+		logger.Infof("large object %d not found in source, skipped", oid)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("copyLargeObject: error reading source: %w", err)
+	}
+
+	tx, err := targetDB.Beginx()
+	if err != nil {
+		return fmt.Errorf("copyLargeObject: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		SELECT lo_unlink(oid)
+		FROM pg_largeobject_metadata
+		WHERE oid = $1`,
+		oid,
+	)
+	if err != nil {
+		return fmt.Errorf("copyLargeObject: error unlinking target: %w", err)
+	}
+
+	_, err = tx.Exec(`SELECT lo_from_bytea($1, $2)`, oid, data)
+	if err != nil {
+		return fmt.Errorf("copyLargeObject: error writing target: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("copyLargeObject: %w", err)
+	}
+	logger.Infof("large object copied: %d (%d bytes)", oid, len(data))
+	return nil
+}
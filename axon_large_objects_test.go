@@ -0,0 +1,78 @@
+package warppipe
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangedLargeObjects(t *testing.T) {
+	columnTypes["public.documents"] = map[string]*targetColumn{
+		"blob":      {Type: "oid"},
+		"thumbnail": {Type: "public.lo"},
+		"owner":     {Type: "oid[]"},
+	}
+	defer delete(columnTypes, "public.documents")
+
+	testCases := []struct {
+		change   *Changeset
+		expected []uint32
+	}{
+		{
+			&Changeset{
+				Kind:  ChangesetKindInsert,
+				Table: "documents",
+				NewValues: []*ChangesetColumn{
+					{Column: "id", Type: "integer", Value: int64(1)},
+					{Column: "blob", Value: int64(16401)},
+					{Column: "thumbnail", Value: nil},
+					{Column: "owner", Value: []interface{}{int64(10)}},
+				},
+			},
+			[]uint32{16401},
+		},
+		{
+			&Changeset{
+				Kind:  ChangesetKindUpdate,
+				Table: "documents",
+				NewValues: []*ChangesetColumn{
+					{Column: "blob", Value: int64(16401)},
+					{Column: "thumbnail", Value: json.Number("16402")},
+				},
+				OldValues: []*ChangesetColumn{
+					{Column: "blob", Value: int64(16401)},
+					{Column: "thumbnail", Value: json.Number("16400")},
+				},
+			},
+			[]uint32{16402},
+		},
+		{
+			// untracked tables use the type of the changeset column
+			&Changeset{
+				Kind:  ChangesetKindUpdate,
+				Table: "attachments",
+				NewValues: []*ChangesetColumn{
+					{Column: "data", Type: "oid", Value: int64(16403)},
+					{Column: "size", Type: "bigint", Value: int64(16404)},
+				},
+			},
+			[]uint32{16403},
+		},
+		{
+			&Changeset{
+				Kind:  ChangesetKindDelete,
+				Table: "documents",
+				OldValues: []*ChangesetColumn{
+					{Column: "blob", Value: int64(16401)},
+				},
+			},
+			nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, changedLargeObjects(logrus.New(), "public", tc.change), tc.change.String())
+	}
+}
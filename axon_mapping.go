@@ -0,0 +1,272 @@
+package warppipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+// MappingConfig is the configuration of the names of the target schemas,
+// tables and columns that the Axon writes the source tables to.
+type MappingConfig struct {
+	// Schemas maps source schemas to target schemas. The tables of unmapped
+	// schemas are written to AxonConfig.TargetDBSchema.
+	Schemas map[string]string `yaml:"schemas" json:"schemas"`
+	// Tables maps source tables, either <schema>.<table> or <table>, to their
+	// target table.
+	Tables map[string]*TableMapping `yaml:"tables" json:"tables"`
+}
+
+// TableMapping is the target of a source table.
+type TableMapping struct {
+	// Schema of the target table. Defaults to the target of the source schema.
+	Schema string `yaml:"schema" json:"schema"`
+	// Name of the target table. Defaults to the source name.
+	Table string `yaml:"table" json:"table"`
+	// Rename maps source columns to target columns.
+	Rename map[string]string `yaml:"rename" json:"rename"`
+	// Drop lists the source columns that are not written to the target.
+	Drop []string `yaml:"drop" json:"drop"`
+	// Defaults are the values of target columns, written by the inserts and
+	// updates that have no value for them.
+	Defaults map[string]interface{} `yaml:"defaults" json:"defaults"`
+}
+
+// LoadMappingConfig reads a mapping configuration from a YAML or JSON file.
+func LoadMappingConfig(path string) (*MappingConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping config: %w", err)
+	}
+
+	return ParseMappingConfig(data)
+}
+
+// ParseMappingConfig parses a mapping configuration in YAML or JSON, and
+// validates its table mappings.
+func ParseMappingConfig(data []byte) (*MappingConfig, error) {
+	var config MappingConfig
+	err := yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mapping config: %w", err)
+	}
+
+	for source, target := range config.Schemas {
+		if target == "" {
+			return nil, fmt.Errorf("schema %s has no target schema", source)
+		}
+	}
+
+	for table, mapping := range config.Tables {
+		if mapping == nil {
+			return nil, fmt.Errorf("table %s has no mapping", table)
+		}
+		if len(strings.Split(table, ".")) > 2 {
+			return nil, fmt.Errorf("invalid table %s, must be either <schema>.<table> or <table>", table)
+		}
+		for column, value := range mapping.Defaults {
+			switch value.(type) {
+			case nil, string, bool, int, int64, float64:
+			default:
+				return nil, fmt.Errorf("default of `%s` for table %s must be a string, number, boolean or null", column, table)
+			}
+		}
+	}
+
+	return &config, nil
+}
+
+// tableMapping returns the mapping of a source table, if any.
+func (c *MappingConfig) tableMapping(schema, table string) *TableMapping {
+	if c == nil {
+		return nil
+	}
+	if mapping, ok := c.Tables[schema+"."+table]; ok {
+		return mapping
+	}
+	return c.Tables[table]
+}
+
+// targetSchemas returns the target schemas of the mapping, and the default
+// target schema.
+func (c *MappingConfig) targetSchemas(defaultSchema string) []string {
+	schemas := []string{defaultSchema}
+	seen := map[string]bool{defaultSchema: true}
+	add := func(schema string) {
+		if schema != "" && !seen[schema] {
+			seen[schema] = true
+			schemas = append(schemas, schema)
+		}
+	}
+
+	if c != nil {
+		for _, schema := range c.Schemas {
+			add(schema)
+		}
+		for _, mapping := range c.Tables {
+			add(mapping.Schema)
+		}
+	}
+	return schemas
+}
+
+// mapChange returns a copy of a changeset with the target schema, table and
+// columns of its source table. The changeset itself is not modified.
+func (c *MappingConfig) mapChange(change *Changeset, defaultSchema string) *Changeset {
+	mapped := *change
+	mapped.Schema = defaultSchema
+	if c != nil {
+		if schema, ok := c.Schemas[change.Schema]; ok {
+			mapped.Schema = schema
+		}
+	}
+
+	mapping := c.tableMapping(change.Schema, change.Table)
+	if mapping == nil {
+		return &mapped
+	}
+	if mapping.Schema != "" {
+		mapped.Schema = mapping.Schema
+	}
+	if mapping.Table != "" {
+		mapped.Table = mapping.Table
+	}
+
+	drop := stringSet(mapping.Drop)
+	mapped.NewValues = mapping.mapColumns(change.NewValues, drop)
+	mapped.OldValues = mapping.mapColumns(change.OldValues, drop)
+	if mapped.NewValues != nil {
+		for column, value := range mapping.Defaults {
+			if !hasColumn(mapped.NewValues, column) {
+				mapped.NewValues = append(mapped.NewValues, &ChangesetColumn{Column: column, Value: value})
+			}
+		}
+	}
+	return &mapped
+}
+
+// mapColumns returns copies of the columns, renamed and without the dropped
+// columns.
+func (m *TableMapping) mapColumns(values []*ChangesetColumn, drop map[string]bool) []*ChangesetColumn {
+	if values == nil {
+		return nil
+	}
+
+	mapped := make([]*ChangesetColumn, 0, len(values))
+	for _, v := range values {
+		if drop[v.Column] {
+			continue
+		}
+		column := *v
+		if name, ok := m.Rename[v.Column]; ok {
+			column.Column = name
+		}
+		mapped = append(mapped, &column)
+	}
+	return mapped
+}
+
+func hasColumn(values []*ChangesetColumn, column string) bool {
+	for _, v := range values {
+		if v.Column == column {
+			return true
+		}
+	}
+	return false
+}
+
+// mappedTable is a source table and its target table, with the columns that
+// are written to the target, in the same order.
+type mappedTable struct {
+	SourceSchema  string
+	SourceTable   string
+	SourceColumns []string
+	TargetSchema  string
+	TargetTable   string
+	TargetColumns []string
+}
+
+// mapTable returns the target table of a source table and of its columns,
+// leaving out the dropped columns. The defaults of the target columns, which
+// have no source column, are not included.
+func (c *MappingConfig) mapTable(schema, table string, columns []string, defaultSchema string) *mappedTable {
+	// the columns are mapped as the old values of a delete, which get no
+	// defaults, each value being the name of its source column
+	values := make([]*ChangesetColumn, len(columns))
+	for i, column := range columns {
+		values[i] = &ChangesetColumn{Column: column, Value: column}
+	}
+	mapped := c.mapChange(&Changeset{
+		Kind:      ChangesetKindDelete,
+		Schema:    schema,
+		Table:     table,
+		OldValues: values,
+	}, defaultSchema)
+
+	t := &mappedTable{
+		SourceSchema: schema,
+		SourceTable:  table,
+		TargetSchema: mapped.Schema,
+		TargetTable:  mapped.Table,
+	}
+	for _, v := range mapped.OldValues {
+		t.SourceColumns = append(t.SourceColumns, v.Value.(string))
+		t.TargetColumns = append(t.TargetColumns, v.Column)
+	}
+	return t
+}
+
+// checksumSQL returns the queries of the checksums of the source and target
+// tables, over their mapped columns, in the order of the given source key
+// columns. Tables are ordered by their values if a key column is dropped, or
+// if there is no key.
+func (t *mappedTable) checksumSQL(keyColumns []string) (string, string) {
+	targetColumns := make(map[string]string, len(t.SourceColumns))
+	for i, column := range t.SourceColumns {
+		targetColumns[column] = t.TargetColumns[i]
+	}
+
+	var sourceKey, targetKey []string
+	for _, column := range keyColumns {
+		target, ok := targetColumns[column]
+		if !ok {
+			sourceKey, targetKey = nil, nil
+			break
+		}
+		sourceKey = append(sourceKey, column)
+		targetKey = append(targetKey, target)
+	}
+
+	return checksumSQL(t.SourceSchema, t.SourceTable, t.SourceColumns, sourceKey),
+		checksumSQL(t.TargetSchema, t.TargetTable, t.TargetColumns, targetKey)
+}
+
+func checksumSQL(schema, table string, columns, keyColumns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = db.QuoteIdentifier(column)
+	}
+	row := fmt.Sprintf(`CAST(ROW(%s) AS TEXT)`, strings.Join(quoted, ", "))
+
+	// rows without a key are ordered by their values, so identical tables
+	// have the same order
+	orderBy := row
+	if len(keyColumns) > 0 {
+		quotedKey := make([]string, len(keyColumns))
+		for i, column := range keyColumns {
+			quotedKey[i] = db.QuoteIdentifier(column)
+		}
+		orderBy = strings.Join(quotedKey, ", ")
+	}
+
+	return fmt.Sprintf(
+		`SELECT pg_md5_hashagg(md5(%s) ORDER BY %s) FROM %s`,
+		row,
+		orderBy,
+		db.QuoteIdentifier(schema, table),
+	)
+}
@@ -0,0 +1,154 @@
+package warppipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMappingConfig(t *testing.T) {
+	config, err := ParseMappingConfig([]byte(`
+schemas:
+  store_eu: reporting
+  store_us: reporting
+tables:
+  store_eu.orders:
+    table: eu_orders
+    rename: {total: total_cents}
+    drop: [internal_notes]
+    defaults: {region: eu}
+  users:
+    schema: accounts
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "reporting", config.Schemas["store_eu"])
+	assert.Equal(t, &TableMapping{
+		Table:    "eu_orders",
+		Rename:   map[string]string{"total": "total_cents"},
+		Drop:     []string{"internal_notes"},
+		Defaults: map[string]interface{}{"region": "eu"},
+	}, config.Tables["store_eu.orders"])
+	assert.Equal(t, []string{"public", "reporting", "accounts"}, config.targetSchemas("public"))
+
+	testCases := []string{
+		`schemas: {store_eu: ""}`,
+		`tables: {users: }`,
+		`tables: {a.b.users: {table: users}}`,
+		`tables: {users: {defaults: {tags: [a, b]}}}`,
+		`tables: {users: {unknown_field: true}}`,
+	}
+	for _, tc := range testCases {
+		_, err = ParseMappingConfig([]byte(tc))
+		assert.Error(t, err, tc)
+	}
+}
+
+func TestMapChange(t *testing.T) {
+	config := &MappingConfig{
+		Schemas: map[string]string{"store_eu": "reporting"},
+		Tables: map[string]*TableMapping{
+			"store_eu.orders": {
+				Table:    "eu_orders",
+				Rename:   map[string]string{"total": "total_cents"},
+				Drop:     []string{"internal_notes"},
+				Defaults: map[string]interface{}{"region": "eu"},
+			},
+			"users": {Schema: "accounts"},
+		},
+	}
+
+	change := &Changeset{
+		Kind:   ChangesetKindUpdate,
+		Schema: "store_eu",
+		Table:  "orders",
+		NewValues: []*ChangesetColumn{
+			{Column: "id", Value: 1},
+			{Column: "total", Value: 100},
+			{Column: "internal_notes", Value: "fragile"},
+		},
+		OldValues: []*ChangesetColumn{
+			{Column: "id", Value: 1},
+			{Column: "total", Value: 90},
+		},
+	}
+	mapped := config.mapChange(change, "public")
+	assert.Equal(t, "reporting", mapped.Schema)
+	assert.Equal(t, "eu_orders", mapped.Table)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: 1},
+		{Column: "total_cents", Value: 100},
+		{Column: "region", Value: "eu"},
+	}, mapped.NewValues)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: 1},
+		{Column: "total_cents", Value: 90},
+	}, mapped.OldValues)
+
+	// the source changeset is unchanged
+	assert.Equal(t, "orders", change.Table)
+	assert.Equal(t, "total", change.NewValues[1].Column)
+	assert.Len(t, change.NewValues, 3)
+
+	// deletes get no defaults
+	mapped = config.mapChange(&Changeset{
+		Kind:      ChangesetKindDelete,
+		Schema:    "store_eu",
+		Table:     "orders",
+		OldValues: []*ChangesetColumn{{Column: "id", Value: 1}},
+	}, "public")
+	assert.Nil(t, mapped.NewValues)
+
+	mapped = config.mapChange(&Changeset{Schema: "store_us", Table: "users"}, "public")
+	assert.Equal(t, "accounts", mapped.Schema)
+	assert.Equal(t, "users", mapped.Table)
+
+	mapped = config.mapChange(&Changeset{Schema: "store_us", Table: "orders"}, "public")
+	assert.Equal(t, "public", mapped.Schema)
+	assert.Equal(t, "orders", mapped.Table)
+
+	var empty *MappingConfig
+	mapped = empty.mapChange(&Changeset{Schema: "store_eu", Table: "orders"}, "public")
+	assert.Equal(t, "public", mapped.Schema)
+	assert.Equal(t, []string{"public"}, empty.targetSchemas("public"))
+}
+
+func TestMapTableChecksumSQL(t *testing.T) {
+	config := &MappingConfig{
+		Schemas: map[string]string{"store_eu": "reporting"},
+		Tables: map[string]*TableMapping{
+			"store_eu.orders": {
+				Table:    "eu_orders",
+				Rename:   map[string]string{"id": "order_id", "total": "total_cents"},
+				Drop:     []string{"internal_notes"},
+				Defaults: map[string]interface{}{"region": "eu"},
+			},
+		},
+	}
+
+	table := config.mapTable("store_eu", "orders", []string{"id", "total", "internal_notes"}, "public")
+	assert.Equal(t, &mappedTable{
+		SourceSchema:  "store_eu",
+		SourceTable:   "orders",
+		SourceColumns: []string{"id", "total"},
+		TargetSchema:  "reporting",
+		TargetTable:   "eu_orders",
+		TargetColumns: []string{"order_id", "total_cents"},
+	}, table)
+
+	sourceSQL, targetSQL := table.checksumSQL([]string{"id"})
+	assert.Equal(t, `SELECT pg_md5_hashagg(md5(CAST(ROW("id", "total") AS TEXT)) ORDER BY "id") FROM "store_eu"."orders"`, sourceSQL)
+	assert.Equal(t, `SELECT pg_md5_hashagg(md5(CAST(ROW("order_id", "total_cents") AS TEXT)) ORDER BY "order_id") FROM "reporting"."eu_orders"`, targetSQL)
+
+	// a dropped key column orders the rows by their values
+	sourceSQL, targetSQL = table.checksumSQL([]string{"id", "internal_notes"})
+	assert.Equal(t, `SELECT pg_md5_hashagg(md5(CAST(ROW("id", "total") AS TEXT)) ORDER BY CAST(ROW("id", "total") AS TEXT)) FROM "store_eu"."orders"`, sourceSQL)
+	assert.Equal(t, `SELECT pg_md5_hashagg(md5(CAST(ROW("order_id", "total_cents") AS TEXT)) ORDER BY CAST(ROW("order_id", "total_cents") AS TEXT)) FROM "reporting"."eu_orders"`, targetSQL)
+
+	// unmapped tables are written to the default schema
+	var empty *MappingConfig
+	table = empty.mapTable("store_eu", "orders", []string{"id"}, "public")
+	assert.Equal(t, "public", table.TargetSchema)
+	assert.Equal(t, "orders", table.TargetTable)
+	assert.Equal(t, []string{"id"}, table.TargetColumns)
+}
@@ -2,24 +2,34 @@ package warppipe
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/perangel/warp-pipe/db"
+	"github.com/sirupsen/logrus"
 )
 
+// The metadata of the target tables is keyed by targetTable(schema, table).
+
 // maps primary key columns by table
 var primaryKeys = make(map[string][]string)
 
+// maps the columns of a unique index of non-null columns by table, for tables
+// without a primary key
+var uniqueKeys = make(map[string][]string)
+
+// maps the types of the target columns by table and column
+var columnTypes = make(map[string]map[string]*targetColumn)
+
 // maps serial key columns by table
 var sequenceColumns = make(map[string]string)
 
 // lists sequences not associated with any table column
 var orphanSequences []string
 
-func checkTargetVersion(conn *sqlx.DB) error {
+func checkTargetVersion(logger logrus.FieldLogger, conn *sqlx.DB) error {
 	var serverVersion string
 	err := conn.Get(&serverVersion, "SHOW server_version;")
 	if err != nil {
@@ -45,88 +55,226 @@ func checkTargetVersion(conn *sqlx.DB) error {
 		// handle the conflict as our cue to update.
 		return fmt.Errorf("Target DB Unsupported Version: %s", serverVersion)
 	}
-	log.Printf("Target DB Version: %s", serverVersion)
+	logger.Infof("Target DB Version: %s", serverVersion)
 	return nil
 }
 
-func printSourceStats(conn *sqlx.DB) error {
+func printSourceStats(logger logrus.FieldLogger, conn *sqlx.DB) error {
 	var changesetCount int
 	err := conn.Get(&changesetCount, "SELECT count(id) FROM warp_pipe.changesets")
 	if err != nil {
 		return err
 	}
-	log.Printf("Changesets Found in Source: %d", changesetCount)
+	logger.Infof("Changesets Found in Source: %d", changesetCount)
 	return nil
 }
 
+// targetTable returns the key of a target table in the metadata maps.
+func targetTable(schema, table string) string {
+	return schema + "." + table
+}
+
 func loadPrimaryKeys(conn *sqlx.DB) error {
 	var rows []struct {
-		TableName  string         `db:"table_name"`
-		PrimaryKey pq.StringArray `db:"primary_key"`
+		TableSchema string         `db:"table_schema"`
+		TableName   string         `db:"table_name"`
+		PrimaryKey  pq.StringArray `db:"primary_key"`
 	}
 	err := conn.Select(&rows, `
 		SELECT
+			t.table_schema,
 			t.table_name,
-			string_to_array(string_agg(c.column_name, ','), ',') AS primary_key
+			string_to_array(string_agg(c.column_name, ',' ORDER BY c.ordinal_position), ',') AS primary_key
 		FROM information_schema.key_column_usage AS c
 			LEFT JOIN information_schema.table_constraints AS t
 				ON c.constraint_name = t.constraint_name
+				AND c.constraint_schema = t.constraint_schema
 				AND t.constraint_type = 'PRIMARY KEY'
 		WHERE t.table_name != ''
-		GROUP BY t.table_name`,
+		GROUP BY t.table_schema, t.table_name`,
 	)
 	if err != nil {
 		return err
 	}
 
 	for _, r := range rows {
-		primaryKeys[r.TableName] = r.PrimaryKey
+		primaryKeys[targetTable(r.TableSchema, r.TableName)] = r.PrimaryKey
 	}
 
 	return nil
 }
 
-func getPrimaryKeyForChange(change *Changeset) ([]string, error) {
-	col, ok := primaryKeys[change.Table]
+// loadUniqueKeys loads the columns of a unique index of non-null columns of the
+// target tables without a primary key, which identify their rows instead.
+func loadUniqueKeys(conn *sqlx.DB, schemas []string) error {
+	var rows []struct {
+		TableSchema string         `db:"table_schema"`
+		TableName   string         `db:"table_name"`
+		UniqueKey   pq.StringArray `db:"unique_key"`
+	}
+	err := conn.Select(&rows, `
+	SELECT DISTINCT ON (n.nspname, c.relname)
+		n.nspname AS table_schema,
+		c.relname AS table_name,
+		array_agg(a.attname::text ORDER BY k.position) AS unique_key
+	FROM pg_index x
+		JOIN pg_class c ON c.oid = x.indrelid
+		JOIN pg_class i ON i.oid = x.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN LATERAL unnest(x.indkey::int2[]) WITH ORDINALITY AS k(attnum, position) ON true
+		JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum
+	WHERE
+		n.nspname = ANY($1)
+	AND
+		x.indisunique
+	AND
+		x.indimmediate
+	AND
+		x.indpred IS NULL
+	AND
+		x.indexprs IS NULL
+	AND
+		NOT EXISTS (SELECT 1 FROM pg_index p WHERE p.indrelid = x.indrelid AND p.indisprimary)
+	GROUP BY n.nspname, c.relname, i.relname
+	HAVING bool_and(a.attnotnull)
+	ORDER BY n.nspname, c.relname, i.relname`,
+		pq.Array(schemas),
+	)
+	if err != nil {
+		return fmt.Errorf("loadUniqueKeys: %w", err)
+	}
+
+	for _, r := range rows {
+		uniqueKeys[targetTable(r.TableSchema, r.TableName)] = r.UniqueKey
+	}
+	return nil
+}
+
+// getPrimaryKeyForChange returns the columns identifying the rows of the
+// target table of a changeset: its primary key, or else the columns of a
+// unique index.
+func getPrimaryKeyForChange(schema string, change *Changeset) ([]string, error) {
+	col, ok := primaryKeys[targetTable(schema, change.Table)]
+	if !ok {
+		col, ok = uniqueKeys[targetTable(schema, change.Table)]
+	}
 	if !ok {
-		return nil, fmt.Errorf("no primary key in mapping for table `%s`", change.Table)
+		return nil, fmt.Errorf("%w in mapping for table `%s`", ErrNoPrimaryKey, change.Table)
 	}
 	return col, nil
 }
 
+// targetColumn is the type of a column of a target table.
+type targetColumn struct {
+	// Type is the name of the type, as written by format_type(), such as
+	// character varying(255) or public.address[].
+	Type string
+	// Composite is true if the type, or the element type of an array type, is
+	// a composite type.
+	Composite bool
+}
+
+// loadColumnTypes loads the types of the columns of the target tables, for
+// casting the values written to them.
+func loadColumnTypes(conn *sqlx.DB, schemas []string) error {
+	var rows []struct {
+		TableSchema string `db:"table_schema"`
+		TableName   string `db:"table_name"`
+		ColumnName  string `db:"column_name"`
+		ColumnType  string `db:"column_type"`
+		Composite   bool   `db:"composite"`
+	}
+	err := conn.Select(&rows, `
+	SELECT
+		n.nspname AS table_schema,
+		c.relname AS table_name,
+		a.attname AS column_name,
+		format_type(a.atttypid, a.atttypmod) AS column_type,
+		COALESCE(e.typtype, t.typtype) = 'c' AS composite
+	FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_type e ON e.oid = t.typelem AND t.typcategory = 'A'
+	WHERE
+		n.nspname = ANY($1)
+	AND
+		c.relkind IN ('r', 'p')
+	AND
+		a.attnum > 0
+	AND
+		NOT a.attisdropped`,
+		pq.Array(schemas),
+	)
+	if err != nil {
+		return fmt.Errorf("loadColumnTypes: %w", err)
+	}
+
+	for _, r := range rows {
+		table := targetTable(r.TableSchema, r.TableName)
+		if columnTypes[table] == nil {
+			columnTypes[table] = make(map[string]*targetColumn)
+		}
+		columnTypes[table][r.ColumnName] = &targetColumn{
+			Type:      r.ColumnType,
+			Composite: r.Composite,
+		}
+	}
+	return nil
+}
+
 // loadColumnSequences loads sequences used explictly in a table column which
 // need to be updated after INSERTs.
-func loadColumnSequences(conn *sqlx.DB) error {
+func loadColumnSequences(logger logrus.FieldLogger, conn *sqlx.DB, schemas []string) error {
 	var rows []struct {
+		TableSchema   string `db:"table_schema"`
 		TableName     string `db:"table_name"`
 		ColumnName    string `db:"column_name"`
 		ColumnDefault string `db:"column_default"`
 	}
 	err := conn.Select(&rows, `
 	SELECT
+		table_schema,
 		table_name,
 		column_name,
 		column_default
 	FROM information_schema.columns
 	WHERE
-		table_schema = 'public'
+		table_schema = ANY($1)
 	AND
 		column_default LIKE 'nextval(%'`,
+		pq.Array(schemas),
 	)
 	if err != nil {
 		return fmt.Errorf("loadColumnSequences: %w", err)
 	}
 
 	for _, r := range rows {
-		colDefault := strings.Split(r.ColumnDefault, "'")
-		sequenceName := colDefault[1]
+		sequenceName, ok := parseSequenceDefault(r.ColumnDefault)
+		if !ok {
+			continue
+		}
 
-		sequenceColumns[r.TableName+"/"+r.ColumnName] = sequenceName
+		sequenceColumns[targetTable(r.TableSchema, r.TableName)+"/"+r.ColumnName] = sequenceName
 	}
-	log.Printf("sequence columns found: %v", sequenceColumns)
+	logger.Infof("sequence columns found: %v", sequenceColumns)
 	return nil
 }
 
+// parseSequenceDefault returns the sequence of a nextval('<sequence>'::regclass)
+// column default, as quoted by Postgres.
+func parseSequenceDefault(columnDefault string) (string, bool) {
+	if !strings.HasPrefix(columnDefault, "nextval('") {
+		return "", false
+	}
+	sequenceName := strings.TrimPrefix(columnDefault, "nextval('")
+	end := strings.LastIndex(sequenceName, "'::regclass)")
+	if end < 0 {
+		return "", false
+	}
+	return strings.ReplaceAll(sequenceName[:end], "''", "'"), true
+}
+
 func getSequenceColumns(table, column string) (string, bool) {
 	if sequenceName, ok := sequenceColumns[table+"/"+column]; ok {
 		return sequenceName, true
@@ -134,7 +282,7 @@ func getSequenceColumns(table, column string) (string, bool) {
 	return "", false
 }
 
-func updateColumnSequence(conn *sqlx.DB, table string, columns []*ChangesetColumn) error {
+func updateColumnSequence(logger logrus.FieldLogger, conn *sqlx.DB, table string, columns []*ChangesetColumn) error {
 	// Why no transaction? From the manual: Because sequences are
 	// non-transactional, changes made by setval are not undone if the transaction
 	// rolls back.
@@ -157,7 +305,7 @@ func updateColumnSequence(conn *sqlx.DB, table string, columns []*ChangesetColum
 		if err != nil {
 			return fmt.Errorf("updateSerialColumns: %w", err)
 		}
-		log.Printf("sequence set %s: %s", sequenceName, setVal)
+		logger.Infof("sequence set %s: %s", sequenceName, setVal)
 	}
 	return nil
 }
@@ -166,7 +314,7 @@ func updateColumnSequence(conn *sqlx.DB, table string, columns []*ChangesetColum
 // with a table column so they can be automatically updated each INSERT. There
 // is no way to watch sequence value updates, so all must be updated each
 // insert.
-func loadOrphanSequences(conn *sqlx.DB) error {
+func loadOrphanSequences(logger logrus.FieldLogger, conn *sqlx.DB) error {
 	var rows []struct {
 		SequenceName string `db:"sequence_name"`
 	}
@@ -190,15 +338,15 @@ func loadOrphanSequences(conn *sqlx.DB) error {
 			orphanSequences = append(orphanSequences, r.SequenceName)
 		}
 	}
-	log.Printf("orphaned sequences found: %v", orphanSequences)
+	logger.Infof("orphaned sequences found: %v", orphanSequences)
 	return nil
 }
 
-func updateOrphanSequences(sourceDB *sqlx.DB, targetDB *sqlx.DB, table string, columns []*ChangesetColumn) error {
+func updateOrphanSequences(logger logrus.FieldLogger, sourceDB *sqlx.DB, targetDB *sqlx.DB, table string, columns []*ChangesetColumn) error {
 	for _, sequenceName := range orphanSequences {
 		var lastVal int64 // PG bigint is 8 bytes
 
-		err := sourceDB.Get(&lastVal, "SELECT last_value FROM "+sequenceName)
+		err := sourceDB.Get(&lastVal, "SELECT last_value FROM "+db.QuoteIdentifier("public", sequenceName))
 		if err != nil {
 			return fmt.Errorf("updateOrphanSequences: error getting last_value for %s: %w", sequenceName, err)
 		}
@@ -211,11 +359,11 @@ func updateOrphanSequences(sourceDB *sqlx.DB, targetDB *sqlx.DB, table string, c
 				$2,
 				true
 			)
-		`, sequenceName, lastVal)
+		`, db.QuoteIdentifier(sequenceName), lastVal)
 		if err != nil {
 			return fmt.Errorf("updateOrphanSequences: error setting value for %s: %w", sequenceName, err)
 		}
-		log.Printf("orphan sequence set %s: %v", sequenceName, setVal)
+		logger.Infof("orphan sequence set %s: %v", sequenceName, setVal)
 	}
 	return nil
 }
@@ -1,194 +1,479 @@
 package warppipe
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"log"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/perangel/warp-pipe/db"
+	"github.com/sirupsen/logrus"
 )
 
 var regexSpace = regexp.MustCompile(`\s+`)
 
+// The queries of the Axon are sqlx named queries, in which a colon starts a
+// named parameter, unless it is doubled.
+
+// quoteNamedIdentifier quotes an identifier for a named query.
+func quoteNamedIdentifier(names ...string) string {
+	return escapeNamed(db.QuoteIdentifier(names...))
+}
+
+// quoteNamedIdentifiers quotes a list of identifiers for a named query.
+func quoteNamedIdentifiers(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteNamedIdentifier(name)
+	}
+	return quoted
+}
+
+// escapeNamed escapes the colons of SQL interpolated into a named query.
+func escapeNamed(sql string) string {
+	return strings.ReplaceAll(sql, ":", "::")
+}
+
+// queryParam returns the name of the named parameter of a column. sqlx only
+// reads parameter names of letters, digits and underscores, so other column
+// names are bound as __hex_ and their hex encoding.
+func queryParam(column string) string {
+	for i := 0; i < len(column); i++ {
+		c := column[i]
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return "__hex_" + hex.EncodeToString([]byte(column))
+		}
+	}
+	if column == "" {
+		return "__hex_"
+	}
+	return column
+}
+
 func removeDuplicateSpaces(in string) string {
 	return strings.TrimSpace(regexSpace.ReplaceAllString(in, " "))
 }
 
-func prepareQueryArgs(changesetCols []*ChangesetColumn) ([]string, []string, map[string]interface{}, error) {
+// prepareQueryArgs returns the columns of the changeset values, the
+// expressions binding their values, cast to the types of the columns of the
+// target table when known, and the values to bind by parameter name. The
+// table is keyed by targetTable().
+func prepareQueryArgs(table string, changesetCols []*ChangesetColumn) ([]string, []string, map[string]interface{}, error) {
 	var cols []string
 	var colArgs []string
 	values := make(map[string]interface{}, len(cols))
 	for _, c := range changesetCols {
-		t := reflect.TypeOf(c.Value)
-		if t != nil && t.Kind() == reflect.Map {
-			// Found a hashmap, this is a JSON/B field. This type is not supported
-			// since re-marshaling breaks md5 checksum validation. Instead pass the
-			// original raw json as a string.
-			return nil, nil, nil, fmt.Errorf("expected raw json string")
-		}
-		if t != nil && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Interface {
-			// Set empty slices to pq.Array(nil) to avoid package sql error on an
-			// empty character varying[]: "unsupported type []interface {}, a slice of
-			// interface"
-			if reflect.ValueOf(c.Value).Len() == 0 {
-				c.Value = pq.Array(nil)
-			} else {
-				c.Value = pq.Array(c.Value)
-			}
+		if c.Unchanged {
+			// unchanged TOASTed columns have no value, and keep their value in
+			// the target.
+			continue
+		}
+		param := queryParam(c.Column)
+		colArg, value, err := prepareQueryArg(param, c.Value, columnTypes[table][c.Column])
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("column %s: %w", c.Column, err)
 		}
 		cols = append(cols, c.Column)
-		colArgs = append(colArgs, fmt.Sprintf(":%s", c.Column))
-		values[c.Column] = c.Value
+		colArgs = append(colArgs, colArg)
+		values[param] = value
 	}
 
 	return cols, colArgs, values, nil
 }
 
-func preparePrimaryKeyWhereClause(table string, primaryKey []string) string {
+// prepareQueryArg returns the expression binding the value of a column to a
+// named parameter, and the value to bind. Values are bound as text cast to the type of the target
+// column, so that arrays, ranges, enums and domains are written with their
+// exact type, and composite values parsed from JSON are converted with
+// json_populate_record(). Without a target type, values are bound as is.
+func prepareQueryArg(param string, value interface{}, target *targetColumn) (string, interface{}, error) {
+	if target == nil {
+		value, err := prepareUntypedQueryArg(value)
+		return ":" + param, value, err
+	}
+
+	colArg := castArg(param, target)
+	if target.Composite && isJSONValue(value) {
+		data, err := jsonText(value)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, dims := parseTypeName(target.Type); dims > 0 {
+			colArg = fmt.Sprintf("ARRAY(SELECT json_populate_recordset(CAST(NULL AS %s), CAST(:%s AS json)))", escapeNamed(strings.TrimSuffix(target.Type, "[]")), param)
+		} else {
+			colArg = fmt.Sprintf("json_populate_record(CAST(NULL AS %s), CAST(:%s AS json))", escapeNamed(target.Type), param)
+		}
+		return colArg, data, nil
+	}
+
+	switch v := value.(type) {
+	case json.RawMessage:
+		return colArg, string(v), nil
+	case []interface{}:
+		return colArg, arrayLiteral(v), nil
+	case map[string]interface{}:
+		return "", nil, fmt.Errorf("%w: %T value, expected raw json", ErrUnsupportedType, value)
+	}
+	return colArg, value, nil
+}
+
+// prepareUntypedQueryArg converts a changeset value to a query argument, for
+// a column of unknown type.
+func prepareUntypedQueryArg(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.RawMessage:
+		// JSON/B values are written as their original text, since re-marshaling
+		// breaks md5 checksum validation.
+		return string(v), nil
+	case []interface{}:
+		// Set empty slices to pq.Array(nil) to avoid package sql error on an
+		// empty character varying[]: "unsupported type []interface {}, a slice of
+		// interface"
+		if len(v) == 0 {
+			return pq.Array(nil), nil
+		}
+		elems := make([]interface{}, len(v))
+		for i, elem := range v {
+			switch e := elem.(type) {
+			case json.RawMessage:
+				elems[i] = string(e)
+			case []byte:
+				// pq.Array writes bytes as is, so bytea elements are written as
+				// their hex text
+				elems[i] = literalText(e)
+			default:
+				elems[i] = elem
+			}
+		}
+		return pq.Array(elems), nil
+	}
+
+	t := reflect.TypeOf(value)
+	if t != nil && t.Kind() == reflect.Map {
+		// A parsed JSON/B value. This type is not supported since re-marshaling
+		// breaks md5 checksum validation, the value must be a json.RawMessage.
+		return nil, fmt.Errorf("%w: %T value, expected raw json", ErrUnsupportedType, value)
+	}
+	return value, nil
+}
+
+// castArg returns a named parameter, cast to the type of the target column if
+// known. Target types are read with format_type(), which quotes them.
+func castArg(param string, target *targetColumn) string {
+	if target == nil {
+		return ":" + param
+	}
+	return fmt.Sprintf("CAST(:%s AS %s)", param, escapeNamed(target.Type))
+}
+
+// isJSONValue returns true for values parsed from JSON objects, such as the
+// composite values of audit changesets, and arrays of them.
+func isJSONValue(value interface{}) bool {
+	switch v := value.(type) {
+	case json.RawMessage, map[string]interface{}:
+		return true
+	case []interface{}:
+		for _, elem := range v {
+			if isJSONValue(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonText(value interface{}) (string, error) {
+	if raw, ok := value.(json.RawMessage); ok {
+		return string(raw), nil
+	}
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// arrayLiteral formats an array, possibly multidimensional, as a Postgres
+// array literal.
+func arrayLiteral(elems []interface{}) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, elem := range elems {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		switch e := elem.(type) {
+		case nil:
+			b.WriteString("NULL")
+		case []interface{}:
+			b.WriteString(arrayLiteral(e))
+		default:
+			b.WriteByte('"')
+			b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(literalText(e)))
+			b.WriteByte('"')
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// literalText formats a changeset value as the text of a Postgres literal.
+func literalText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.RawMessage:
+		return string(v)
+	case []byte:
+		return `\x` + hex.EncodeToString(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case bool:
+		if v {
+			return "t"
+		}
+		return "f"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case map[string]interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return fmt.Sprint(value)
+}
+
+func preparePrimaryKeyWhereClause(schema, table string, primaryKey []string) string {
 	clauses := make([]string, len(primaryKey))
 	for i, c := range primaryKey {
-		clauses[i] = fmt.Sprintf(`"%s".%s = :%s`, table, c, c)
+		clauses[i] = fmt.Sprintf(`%s = %s`, quoteNamedIdentifier(table, c), castArg(queryParam(c), columnTypes[targetTable(schema, table)][c]))
 	}
 
 	return strings.Join(clauses, " AND ")
 }
 
-func prepareInsertQuery(schema string, change *Changeset) (string, map[string]interface{}) {
-	cols, colArgs, values, err := prepareQueryArgs(change.NewValues)
+// oldValuePrefix prefixes the named parameters of old values, to tell them from
+// the new values.
+const oldValuePrefix = "__old_"
+
+// prepareRowMatchClause returns the condition matching a single row of a table
+// without a key by all its old values, and adds the old values to the values
+// to bind.
+func prepareRowMatchClause(schema, table string, oldValues []*ChangesetColumn, values map[string]interface{}) (string, error) {
+	var clauses []string
+	for _, c := range oldValues {
+		if c.Unchanged {
+			continue
+		}
+		param := queryParam(oldValuePrefix + c.Column)
+		colArg, value, err := prepareQueryArg(param, c.Value, columnTypes[targetTable(schema, table)][c.Column])
+		if err != nil {
+			return "", fmt.Errorf("column %s: %w", c.Column, err)
+		}
+		values[param] = value
+		// values are compared as text, since some types, such as json, have no
+		// equality operator
+		clauses = append(clauses, fmt.Sprintf(`CAST(%s AS text) IS NOT DISTINCT FROM CAST(%s AS text)`, quoteNamedIdentifier(table, c.Column), colArg))
+	}
+	if len(clauses) == 0 {
+		return "", fmt.Errorf("%w for table `%s`, and no old values to match", ErrNoPrimaryKey, table)
+	}
+
+	return fmt.Sprintf(
+		`(tableoid, ctid) = (SELECT tableoid, ctid FROM %s WHERE %s LIMIT 1)`,
+		quoteNamedIdentifier(schema, table),
+		strings.Join(clauses, " AND "),
+	), nil
+}
+
+func prepareInsertQuery(schema string, change *Changeset) (string, map[string]interface{}, error) {
+	cols, colArgs, values, err := prepareQueryArgs(targetTable(schema, change.Table), change.NewValues)
 	if err != nil {
-		// TODO: Is failure the best option here? Probably no way to safely save anything.
-		log.Fatalf("prepareQueryArgs: error in changeset %s: %s", change, err)
+		return "", nil, err
 	}
 
 	sql := fmt.Sprintf(
-		`INSERT INTO "%s"."%s" (%s) VALUES (%s)`,
-		schema,
-		change.Table,
-		strings.Join(cols, ","),
+		`INSERT INTO %s (%s) VALUES (%s)`,
+		quoteNamedIdentifier(schema, change.Table),
+		strings.Join(quoteNamedIdentifiers(cols), ","),
 		strings.Join(colArgs, ","),
 	)
 
-	return sql, values
+	return sql, values, nil
 }
 
-func prepareUpdateQuery(schema string, primaryKey []string, change *Changeset) (string, map[string]interface{}) {
-	cols, colArgs, values, err := prepareQueryArgs(change.NewValues)
+// prepareUpdateQuery returns the query writing the new values of a changeset
+// by primary key, or updating the row matching its old values for tables
+// without a key. With a last_writer_wins conflict rule, only the rows older
+// than the changeset are written.
+func prepareUpdateQuery(schema string, primaryKey []string, change *Changeset, rule *ConflictRule) (string, map[string]interface{}, error) {
+	cols, colArgs, values, err := prepareQueryArgs(targetTable(schema, change.Table), change.NewValues)
 	if err != nil {
-		log.Fatalf("prepareQueryArgs: error in changeset %s: %s", change, err)
+		return "", nil, err
 	}
 	setClauses := make([]string, len(cols))
 	for i, c := range cols {
-		setClauses[i] = fmt.Sprintf("%s = :%s", c, c)
+		setClauses[i] = fmt.Sprintf("%s = %s", quoteNamedIdentifier(c), colArgs[i])
 	}
 
-	primaryKeyWhereClauses := make([]string, len(primaryKey))
-	for i, c := range primaryKey {
-		primaryKeyWhereClauses[i] = fmt.Sprintf(`"%s".%s = :%s`, change.Table, c, c)
+	var whereClause string
+	if len(primaryKey) > 0 {
+		whereClause = preparePrimaryKeyWhereClause(schema, change.Table, primaryKey)
+	} else {
+		whereClause, err = prepareRowMatchClause(schema, change.Table, change.OldValues, values)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	condition, err := lastWriterCondition(schema, change, rule)
+	if err != nil {
+		return "", nil, err
+	}
+	if condition != "" {
+		whereClause += " AND " + condition
+	}
+
+	if hasUnchangedColumns(change.NewValues) || len(primaryKey) == 0 {
+		// The row is incomplete and cannot be inserted, or has no key to
+		// upsert on, so only update the columns that are present.
+		sql := fmt.Sprintf(
+			`UPDATE %s SET %s WHERE %s`,
+			quoteNamedIdentifier(schema, change.Table),
+			strings.Join(setClauses, ", "),
+			whereClause,
+		)
+		return sql, values, nil
 	}
 
 	sql := fmt.Sprintf(`
-		INSERT INTO "%s"."%s" (%s) VALUES (%s)
+		INSERT INTO %s (%s) VALUES (%s)
 			ON CONFLICT (%s)
 			DO UPDATE SET %s WHERE %s`,
-		schema,
-		change.Table,
-		strings.Join(cols, ", "),
+		quoteNamedIdentifier(schema, change.Table),
+		strings.Join(quoteNamedIdentifiers(cols), ", "),
 		strings.Join(colArgs, ", "),
-		strings.Join(primaryKey, ", "),
+		strings.Join(quoteNamedIdentifiers(primaryKey), ", "),
 		strings.Join(setClauses, ", "),
-		preparePrimaryKeyWhereClause(change.Table, primaryKey),
+		whereClause,
 	)
 
-	return sql, values
+	return sql, values, nil
 }
 
-func prepareDeleteQuery(schema string, primaryKey []string, change *Changeset) (string, map[string]interface{}) {
-	_, _, values, err := prepareQueryArgs(change.OldValues)
+func prepareDeleteQuery(schema string, primaryKey []string, change *Changeset) (string, map[string]interface{}, error) {
+	if len(primaryKey) == 0 {
+		// tables without a key delete a single row matching the old values
+		values := make(map[string]interface{}, len(change.OldValues))
+		whereClause, err := prepareRowMatchClause(schema, change.Table, change.OldValues, values)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf(`DELETE FROM %s WHERE %s`, quoteNamedIdentifier(schema, change.Table), whereClause), values, nil
+	}
+
+	_, _, values, err := prepareQueryArgs(targetTable(schema, change.Table), change.OldValues)
 	if err != nil {
-		log.Fatalf("prepareQueryArgs: error in changeset %s: %s", change, err)
+		return "", nil, err
 	}
 
 	sql := fmt.Sprintf(
-		`DELETE FROM "%s"."%s" WHERE %s`,
-		schema,
-		change.Table,
-		preparePrimaryKeyWhereClause(change.Table, primaryKey),
+		`DELETE FROM %s WHERE %s`,
+		quoteNamedIdentifier(schema, change.Table),
+		preparePrimaryKeyWhereClause(schema, change.Table, primaryKey),
 	)
 
-	return sql, values
+	return sql, values, nil
 }
 
-func insertRow(sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset) error {
-	query, args := prepareInsertQuery(schema, change)
-	_, err := targetDB.NamedExec(query, args)
+func insertRow(logger logrus.FieldLogger, sourceDB *sqlx.DB, targetDB *sqlx.DB, schema string, change *Changeset, rule *ConflictRule) error {
+	query, args, err := prepareInsertQuery(schema, change)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the insert of %s: %w", change, err)
+	}
+	_, err = targetDB.NamedExec(query, args)
 	if err != nil {
 		// PG error codes: https://www.postgresql.org/docs/9.2/errcodes-appendix.html
 		pqe, ok := err.(*pq.Error)
 		if !ok {
-			return fmt.Errorf("failed to insert %s for query %s args %s: %+v", change, removeDuplicateSpaces(query), args, err)
+			return fmt.Errorf("failed to insert %s for query %s args %s: %w", change, removeDuplicateSpaces(query), args, err)
 		}
 		if pqe.Code.Name() == "unique_violation" {
-			// Ignore duplicates
-			// TODO: Should they be updated instead?
-			log.Printf("duplicate row insert skipped %s:", change)
 			// Always update, even on duplicate row.
-			err = updateColumnSequence(targetDB, change.Table, change.NewValues)
+			err = updateColumnSequence(logger, targetDB, targetTable(schema, change.Table), change.NewValues)
 			if err != nil {
 				return err
 			}
 
-			return nil
+			return resolveConflict(logger, targetDB, schema, change, rule, pqe)
 		}
-		return fmt.Errorf("PG error %s:%s failed to insert %s for query %s args %s: %+v", pqe.Code, pqe.Code.Name(), change, removeDuplicateSpaces(query), args, err)
+		return fmt.Errorf("PG error %s:%s failed to insert %s for query %s args %s: %w", pqe.Code, pqe.Code.Name(), change, removeDuplicateSpaces(query), args, targetError(pqe))
 	}
 
-	err = updateColumnSequence(targetDB, change.Table, change.NewValues)
+	err = updateColumnSequence(logger, targetDB, targetTable(schema, change.Table), change.NewValues)
 	if err != nil {
 		return err
 	}
 
-	err = updateOrphanSequences(sourceDB, targetDB, change.Table, change.NewValues)
+	err = updateOrphanSequences(logger, sourceDB, targetDB, change.Table, change.NewValues)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("row inserted: %s", change)
+	logger.Infof("row inserted: %s", change)
 	return nil
 }
 
-func updateRow(targetDB *sqlx.DB, schema string, change *Changeset, primaryKey []string) error {
-	query, args := prepareUpdateQuery(schema, primaryKey, change)
-	_, err := targetDB.NamedExec(query, args)
+func updateRow(logger logrus.FieldLogger, targetDB *sqlx.DB, schema string, change *Changeset, primaryKey []string, rule *ConflictRule) error {
+	query, args, err := prepareUpdateQuery(schema, primaryKey, change, rule)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the update of %s: %w", change, err)
+	}
+	result, err := targetDB.NamedExec(query, args)
 	if err != nil {
 		pqe, ok := err.(*pq.Error)
 		if !ok {
-			return fmt.Errorf("failed to update %s for query %s args %s: %+v", change, removeDuplicateSpaces(query), args, err)
+			return fmt.Errorf("failed to update %s for query %s args %s: %w", change, removeDuplicateSpaces(query), args, err)
 		}
 		if pqe.Code.Name() == "unique_violation" {
-			// Ignore duplicates
-			log.Print("update duplicate row skipped")
-			return nil
+			return resolveConflict(logger, targetDB, schema, change, rule, pqe)
 		}
 
-		return fmt.Errorf("PG error %s:%s failed to update %s for query %s args %s: %+v", pqe.Code, pqe.Code.Name(), change, removeDuplicateSpaces(query), args, err)
+		return fmt.Errorf("PG error %s:%s failed to update %s for query %s args %s: %w", pqe.Code, pqe.Code.Name(), change, removeDuplicateSpaces(query), args, targetError(pqe))
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		if rule != nil && rule.Policy == ConflictPolicyLastWriterWins {
+			// the row of the target is newer than the changeset
+			return recordConflict(logger, targetDB, schema, change, rule, conflictResolutionTarget, nil)
+		}
+		if hasUnchangedColumns(change.NewValues) {
+			logger.Infof("update skipped, row with unchanged TOAST columns not found: %s", change)
+			return nil
+		}
+		if len(primaryKey) == 0 {
+			logger.Infof("update skipped, row matching the old values not found: %s", change)
+			return nil
+		}
 	}
-	log.Printf("row updated: %s", change)
+	logger.Infof("row updated: %s", change)
 	return nil
 }
 
-func deleteRow(targetDB *sqlx.DB, schema string, change *Changeset, primaryKey []string) error {
-	query, values := prepareDeleteQuery(schema, primaryKey, change)
-	_, err := targetDB.NamedExec(query, values)
+func deleteRow(logger logrus.FieldLogger, targetDB *sqlx.DB, schema string, change *Changeset, primaryKey []string) error {
+	query, values, err := prepareDeleteQuery(schema, primaryKey, change)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the delete of %s: %w", change, err)
+	}
+	_, err = targetDB.NamedExec(query, values)
 	if err != nil {
 		pqe, ok := err.(*pq.Error)
 		if !ok {
-			return fmt.Errorf("failed to delete %s for query %s: %+v", change, removeDuplicateSpaces(query), err)
+			return fmt.Errorf("failed to delete %s for query %s: %w", change, removeDuplicateSpaces(query), err)
 		}
-		return fmt.Errorf("PG error %s:%s delete to update %s for query %s: %+v", pqe.Code, pqe.Code.Name(), change, removeDuplicateSpaces(query), err)
+		return fmt.Errorf("PG error %s:%s failed to delete %s for query %s: %w", pqe.Code, pqe.Code.Name(), change, removeDuplicateSpaces(query), targetError(pqe))
 	}
-	log.Printf("row deleted: %s", change)
+	logger.Infof("row deleted: %s", change)
 	return nil
 }
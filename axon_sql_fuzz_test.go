@@ -0,0 +1,39 @@
+// +build go1.18
+
+package warppipe
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/perangel/warp-pipe/db"
+)
+
+func FuzzPrepareInsertQuery(f *testing.F) {
+	f.Add("Orders", "id")
+	f.Add("order", `a"b`)
+	f.Add("x:y", "::")
+	f.Add("naïve", ":= 1; --")
+
+	f.Fuzz(func(t *testing.T, table, column string) {
+		query, values, err := prepareInsertQuery("public", &Changeset{
+			Table:     table,
+			NewValues: []*ChangesetColumn{{Column: column, Value: "value"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bound, args, err := sqlx.BindNamed(sqlx.DOLLAR, query, values)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		expected := "INSERT INTO " + db.QuoteIdentifier("public", table) + " (" + db.QuoteIdentifier(column) + ") VALUES ($1)"
+		if bound != expected {
+			t.Fatalf("bound %q, expected %q", bound, expected)
+		}
+		if len(args) != 1 || args[0] != "value" {
+			t.Fatalf("bound args %v", args)
+		}
+	})
+}
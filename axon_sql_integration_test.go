@@ -0,0 +1,328 @@
+// +build integration
+
+package warppipe
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// typeMatrixColumns covers every category of built-in types, and arrays,
+// composites, ranges, enums and domains.
+var typeMatrixColumns = []struct {
+	name    string
+	colType string
+	literal string
+}{
+	{"c_smallint", "smallint", "-32768"},
+	{"c_integer", "integer", "2147483647"},
+	{"c_bigint", "bigint", "9007199254740993"},
+	{"c_numeric", "numeric(38,10)", "12345678901234567890.0123456789"},
+	{"c_numeric_nan", "numeric", "'NaN'"},
+	{"c_real", "real", "3.14159"},
+	{"c_double", "double precision", "'-Infinity'"},
+	{"c_money", "money", "1234.56"},
+	{"c_text", "text", `'multi "line" \ text'`},
+	{"c_varchar", "varchar(10)", "'short'"},
+	{"c_char", "char(3)", "'ab'"},
+	{"c_bytea", "bytea", `'\x00ff10'`},
+	{"c_timestamp", "timestamp", "'2020-01-02 03:04:05.123456'"},
+	{"c_timestamptz", "timestamptz", "'2020-01-02 03:04:05.123456+05:30'"},
+	{"c_timestamptz_inf", "timestamptz", "'infinity'"},
+	{"c_date", "date", "'2020-02-29'"},
+	{"c_time", "time", "'23:59:59.999'"},
+	{"c_timetz", "timetz", "'23:59:59+02'"},
+	{"c_interval", "interval", "'1 year 2 mons 3 days 04:05:06'"},
+	{"c_boolean", "boolean", "true"},
+	{"c_point", "point", "'(1.5,2)'"},
+	{"c_box", "box", "'((0,0),(1,1))'"},
+	{"c_inet", "inet", "'192.168.0.1/24'"},
+	{"c_cidr", "cidr", "'10.0.0.0/8'"},
+	{"c_macaddr", "macaddr", "'08:00:2b:01:02:03'"},
+	{"c_bit", "bit(4)", "B'1010'"},
+	{"c_varbit", "varbit", "B'101'"},
+	{"c_tsvector", "tsvector", "'a fat cat'"},
+	{"c_uuid", "uuid", "'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'"},
+	{"c_xml", "xml", "'<a>b</a>'"},
+	{"c_json", "json", `'{"b": 1,  "a": [1, 2]}'`},
+	{"c_jsonb", "jsonb", `'[{"a": 1}, 2]'`},
+	{"c_int_matrix", "integer[][]", "'{{1,2},{3,NULL}}'"},
+	{"c_text_array", "text[]", `ARRAY['a b', 'c"d', NULL]`},
+	{"c_timestamptz_array", "timestamptz[]", "ARRAY['2020-01-02 03:04:05+00'::timestamptz]"},
+	{"c_uuid_array", "uuid[]", "ARRAY['a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'::uuid]"},
+	{"c_jsonb_array", "jsonb[]", `ARRAY['{"a": 1}'::jsonb]`},
+	{"c_address", "type_matrix_address", "ROW('main st', 1)"},
+	{"c_addresses", "type_matrix_address[]", "ARRAY[ROW('main st', 1)::type_matrix_address]"},
+	{"c_int4range", "int4range", "'[1,10)'"},
+	{"c_tstzrange", "tstzrange", "'[2020-01-01 00:00:00+00,)'"},
+	{"c_daterange", "daterange", "'empty'"},
+	{"c_mood", "type_matrix_mood", "'happy'"},
+	{"c_moods", "type_matrix_mood[]", "'{happy,sad}'"},
+	{"c_email", "type_matrix_email", "'bob@example.com'"},
+}
+
+func getIntegrationTestDB(t *testing.T) *sqlx.DB {
+	getEnv := func(key, fallback string) string {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return fallback
+	}
+	port, err := strconv.Atoi(getEnv("DB_PORT", "6432"))
+	require.NoError(t, err)
+
+	conn, err := sqlx.Open("postgres", getDBConnString(
+		getEnv("DB_HOST", "127.0.0.1"),
+		port,
+		getEnv("DB_NAME", "test"),
+		getEnv("DB_USER", "test"),
+		getEnv("DB_PASS", "test"),
+	))
+	require.NoError(t, err)
+	return conn
+}
+
+// TestAxonTypeMatrix reads rows of every type category as an audit changeset,
+// writes them with the Axon queries, and checks that the written rows are
+// identical.
+func TestAxonTypeMatrix(t *testing.T) {
+	conn := getIntegrationTestDB(t)
+	defer conn.Close()
+
+	columns := "id integer PRIMARY KEY"
+	values := "1"
+	for _, c := range typeMatrixColumns {
+		columns += ", " + c.name + " " + c.colType
+		values += ", " + c.literal
+	}
+
+	conn.MustExec(`
+		DROP TABLE IF EXISTS type_matrix_src, type_matrix_dst;
+		DROP TYPE IF EXISTS type_matrix_address, type_matrix_mood;
+		DROP DOMAIN IF EXISTS type_matrix_email;
+		CREATE TYPE type_matrix_address AS (street text, number integer);
+		CREATE TYPE type_matrix_mood AS ENUM ('happy', 'sad');
+		CREATE DOMAIN type_matrix_email AS text CHECK (VALUE LIKE '%@%');`)
+	defer conn.Exec(`
+		DROP TABLE IF EXISTS type_matrix_src, type_matrix_dst;
+		DROP TYPE IF EXISTS type_matrix_address, type_matrix_mood;
+		DROP DOMAIN IF EXISTS type_matrix_email;`)
+
+	conn.MustExec("CREATE TABLE type_matrix_src (" + columns + ")")
+	conn.MustExec("CREATE TABLE type_matrix_dst (" + columns + ")")
+	// one row with every value, and one with only nulls
+	conn.MustExec("INSERT INTO type_matrix_src VALUES (" + values + "), (2)")
+
+	require.NoError(t, loadColumnTypes(conn, []string{"public"}))
+
+	var rows []struct {
+		Values []byte `db:"row_values"`
+		Types  []byte `db:"column_types"`
+	}
+	err := conn.Select(&rows, `
+		SELECT row_to_json(t) AS row_values, (
+			SELECT json_object_agg(attname, format_type(atttypid, atttypmod))
+			FROM pg_attribute
+			WHERE attrelid = 'type_matrix_src'::regclass AND attnum > 0 AND NOT attisdropped
+		) AS column_types
+		FROM type_matrix_src t ORDER BY id`)
+	require.NoError(t, err)
+
+	for _, row := range rows {
+		var types map[string]string
+		require.NoError(t, json.Unmarshal(row.Types, &types))
+
+		cols, err := parseEventValues(row.Values, types)
+		require.NoError(t, err)
+		require.NoError(t, decodeColumns(cols))
+
+		query, args, err := prepareInsertQuery("public", &Changeset{
+			Kind:      ChangesetKindInsert,
+			Table:     "type_matrix_dst",
+			NewValues: cols,
+		})
+		require.NoError(t, err)
+		_, err = conn.NamedExec(query, args)
+		require.NoError(t, err, removeDuplicateSpaces(query))
+	}
+
+	for _, c := range typeMatrixColumns {
+		var src, dst []string
+		require.NoError(t, conn.Select(&src, "SELECT COALESCE("+c.name+"::text, 'NULL') FROM type_matrix_src ORDER BY id"))
+		require.NoError(t, conn.Select(&dst, "SELECT COALESCE("+c.name+"::text, 'NULL') FROM type_matrix_dst ORDER BY id"))
+		assert.Equal(t, src, dst, c.colType)
+	}
+}
+
+func TestAxonLargeObjects(t *testing.T) {
+	conn := getIntegrationTestDB(t)
+	defer conn.Close()
+
+	var oid uint32
+	require.NoError(t, conn.Get(&oid, `SELECT lo_from_bytea(0, '\x00ff10')`))
+	defer conn.Exec(`SELECT lo_unlink($1)`, oid)
+
+	change := &Changeset{
+		Kind:  ChangesetKindInsert,
+		Table: "documents",
+		NewValues: []*ChangesetColumn{
+			{Column: "blob", Type: "oid", Value: int64(oid)},
+			{Column: "missing", Type: "oid", Value: int64(1)},
+		},
+	}
+	// the source and target are the same database, so the large object is
+	// replaced with its own contents
+	require.NoError(t, replicateLargeObjects(logrus.New(), conn, conn, "public", change))
+
+	var data []byte
+	require.NoError(t, conn.Get(&data, `SELECT lo_get($1)`, oid))
+	assert.Equal(t, []byte{0x00, 0xff, 0x10}, data)
+}
+
+func TestAxonConflicts(t *testing.T) {
+	conn := getIntegrationTestDB(t)
+	defer conn.Close()
+
+	conn.MustExec(`
+		DROP TABLE IF EXISTS conflict_users;
+		CREATE TABLE conflict_users (id integer PRIMARY KEY, name text, updated_at timestamptz);
+		INSERT INTO conflict_users VALUES (1, 'target', '2020-01-02 00:00:00+00');`)
+	defer conn.Exec(`DROP TABLE IF EXISTS conflict_users`)
+	require.NoError(t, createConflictsTable(conn))
+	conn.MustExec(`DELETE FROM warp_pipe.conflicts WHERE table_name = 'conflict_users'`)
+
+	primaryKeys["public.conflict_users"] = []string{"id"}
+	defer delete(primaryKeys, "public.conflict_users")
+
+	insert := func(name string, updatedAt time.Time) *Changeset {
+		return &Changeset{
+			Kind:  ChangesetKindInsert,
+			Table: "conflict_users",
+			NewValues: []*ChangesetColumn{
+				{Column: "id", Value: int64(1)},
+				{Column: "name", Value: name},
+				{Column: "updated_at", Value: updatedAt},
+			},
+		}
+	}
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		change     *Changeset
+		rule       *ConflictRule
+		name       string
+		resolution string
+	}{
+		{insert("source", newer), &ConflictRule{Policy: ConflictPolicyTargetWins}, "target", "target"},
+		{insert("older", older), &ConflictRule{Policy: ConflictPolicyLastWriterWins, TimestampColumn: "updated_at"}, "target", "target"},
+		{insert("newer", newer), &ConflictRule{Policy: ConflictPolicyLastWriterWins, TimestampColumn: "updated_at"}, "newer", "source"},
+		{insert("source", older), &ConflictRule{Policy: ConflictPolicySourceWins}, "source", "source"},
+		{insert("custom", older), &ConflictRule{Policy: ConflictPolicyCustom, SQL: `UPDATE conflict_users SET name = name || '+' || :name WHERE id = :id`}, "source+custom", "custom"},
+		{insert("error", older), &ConflictRule{Policy: ConflictPolicyError}, "source+custom", "error"},
+	}
+
+	logger := logrus.New()
+	for _, tc := range testCases {
+		err := insertRow(logger, conn, conn, "public", tc.change, tc.rule)
+		if tc.rule.Policy == ConflictPolicyError {
+			assert.True(t, errors.Is(err, ErrTargetConstraint))
+		} else {
+			assert.NoError(t, err, tc.rule.Policy)
+		}
+
+		var name string
+		require.NoError(t, conn.Get(&name, `SELECT name FROM conflict_users WHERE id = 1`))
+		assert.Equal(t, tc.name, name, tc.rule.Policy)
+
+		var resolution string
+		require.NoError(t, conn.Get(&resolution, `
+			SELECT resolution FROM warp_pipe.conflicts
+			WHERE table_name = 'conflict_users' ORDER BY id DESC LIMIT 1`))
+		assert.Equal(t, tc.resolution, resolution, tc.rule.Policy)
+	}
+
+	// updates of rows newer than the changeset are conflicts
+	update := insert("stale", older)
+	update.Kind = ChangesetKindUpdate
+	rule := &ConflictRule{Policy: ConflictPolicyLastWriterWins, TimestampColumn: "updated_at"}
+	conn.MustExec(`UPDATE conflict_users SET updated_at = $1`, newer)
+	require.NoError(t, updateRow(logger, conn, "public", update, []string{"id"}, rule))
+
+	var count int
+	require.NoError(t, conn.Get(&count, `SELECT count(*) FROM warp_pipe.conflicts WHERE table_name = 'conflict_users'`))
+	assert.Equal(t, len(testCases)+1, count)
+}
+
+func TestAxonTablesWithoutKey(t *testing.T) {
+	conn := getIntegrationTestDB(t)
+	defer conn.Close()
+
+	conn.MustExec(`
+		DROP TABLE IF EXISTS keyless_logs, keyless_events;
+		CREATE TABLE keyless_logs (message text, data json);
+		CREATE TABLE keyless_events (source text NOT NULL, seq integer NOT NULL, name text, UNIQUE (source, seq));
+		INSERT INTO keyless_logs VALUES ('a', '{"x": 1}'), ('a', '{"x": 1}'), ('b', NULL);`)
+	defer conn.Exec(`DROP TABLE IF EXISTS keyless_logs, keyless_events`)
+
+	require.NoError(t, loadUniqueKeys(conn, []string{"public"}))
+	require.NoError(t, loadColumnTypes(conn, []string{"public"}))
+	assert.Equal(t, []string{"source", "seq"}, uniqueKeys["public.keyless_events"])
+	_, ok := uniqueKeys["public.keyless_logs"]
+	assert.False(t, ok)
+
+	logger := logrus.New()
+	oldValues := []*ChangesetColumn{
+		{Column: "message", Value: "a"},
+		{Column: "data", Value: json.RawMessage(`{"x": 1}`)},
+	}
+
+	// only one of the duplicate rows is updated, then deleted
+	err := updateRow(logger, conn, "public", &Changeset{
+		Kind:      ChangesetKindUpdate,
+		Table:     "keyless_logs",
+		NewValues: []*ChangesetColumn{{Column: "message", Value: "c"}, {Column: "data", Value: nil}},
+		OldValues: oldValues,
+	}, nil, nil)
+	require.NoError(t, err)
+
+	err = deleteRow(logger, conn, "public", &Changeset{
+		Kind:      ChangesetKindDelete,
+		Table:     "keyless_logs",
+		OldValues: oldValues,
+	}, nil)
+	require.NoError(t, err)
+
+	var messages []string
+	require.NoError(t, conn.Select(&messages, `SELECT message FROM keyless_logs ORDER BY message`))
+	assert.Equal(t, []string{"b", "c"}, messages)
+
+	// tables with a unique index upsert on it
+	change := &Changeset{
+		Kind:  ChangesetKindUpdate,
+		Table: "keyless_events",
+		NewValues: []*ChangesetColumn{
+			{Column: "source", Value: "api"},
+			{Column: "seq", Value: int64(1)},
+			{Column: "name", Value: "created"},
+		},
+	}
+	pk, err := getPrimaryKeyForChange("public", change)
+	require.NoError(t, err)
+	require.NoError(t, updateRow(logger, conn, "public", change, pk, nil))
+	require.NoError(t, updateRow(logger, conn, "public", change, pk, nil))
+
+	var count int
+	require.NoError(t, conn.Get(&count, `SELECT count(*) FROM keyless_events`))
+	assert.Equal(t, 1, count)
+}
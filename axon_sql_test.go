@@ -0,0 +1,321 @@
+package warppipe
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareUpdateQuery(t *testing.T) {
+	change := &Changeset{
+		Kind:  ChangesetKindUpdate,
+		Table: "users",
+		NewValues: []*ChangesetColumn{
+			{Column: "id", Value: 1, Type: "integer"},
+			{Column: "email", Value: "a@example.com", Type: "text"},
+		},
+	}
+
+	query, values, err := prepareUpdateQuery("public", []string{"id"}, change, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, removeDuplicateSpaces(query), `INSERT INTO "public"."users" ("id", "email") VALUES (:id, :email) ON CONFLICT ("id")`)
+	assert.Equal(t, map[string]interface{}{"id": 1, "email": "a@example.com"}, values)
+
+	// unchanged TOAST columns are left out, and the incomplete row is only updated
+	change.NewValues = append(change.NewValues, &ChangesetColumn{Column: "bio", Type: "text", Unchanged: true})
+	query, values, err = prepareUpdateQuery("public", []string{"id"}, change, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `UPDATE "public"."users" SET "id" = :id, "email" = :email WHERE "users"."id" = :id`, query)
+	assert.Equal(t, map[string]interface{}{"id": 1, "email": "a@example.com"}, values)
+}
+
+func TestPrepareQueryArgsExactValues(t *testing.T) {
+	values := []byte(`{
+		"id": 9007199254740993,
+		"amount": 12345678901234567890.0123456789,
+		"amount_nan": "NaN",
+		"price": "$1,234.56",
+		"ratio": 0.1,
+		"ratio_nan": "NaN",
+		"ratio_inf": "-Infinity",
+		"untyped": 9007199254740993
+	}`)
+	types := map[string]string{
+		"id":         "bigint",
+		"amount":     "numeric(38,10)",
+		"amount_nan": "numeric",
+		"price":      "money",
+		"ratio":      "double precision",
+		"ratio_nan":  "double precision",
+		"ratio_inf":  "real",
+	}
+
+	cols, err := parseEventValues(values, types)
+	assert.NoError(t, err)
+	assert.NoError(t, decodeColumns(cols))
+
+	_, _, args, err := prepareQueryArgs("public.test", cols)
+	assert.NoError(t, err)
+
+	// the values bound on the target keep their exact text
+	binds := make(map[string]driver.Value, len(args))
+	for column, arg := range args {
+		binds[column], err = driver.DefaultParameterConverter.ConvertValue(arg)
+		assert.NoError(t, err, column)
+	}
+	assert.Equal(t, map[string]driver.Value{
+		"id":         int64(9007199254740993),
+		"amount":     "12345678901234567890.0123456789",
+		"amount_nan": "NaN",
+		"price":      "$1,234.56",
+		"ratio":      float64(0.1),
+		"ratio_nan":  "NaN",
+		"ratio_inf":  "-Infinity",
+		"untyped":    "9007199254740993",
+	}, binds)
+}
+
+func TestPrepareQueryArgsJSON(t *testing.T) {
+	values := []byte(`{
+		"doc": {"b": 1,  "a": [1, 2]},
+		"list": [{"a": 1}, 2],
+		"tags": [{"z": 1}, null],
+		"empty": null,
+		"legacy": {"b": 1,  "a": 2}
+	}`)
+	types := map[string]string{
+		"doc":   "json",
+		"list":  "jsonb",
+		"tags":  "jsonb[]",
+		"empty": "jsonb",
+	}
+
+	cols, err := parseEventValues(values, types)
+	assert.NoError(t, err)
+	assert.NoError(t, decodeColumns(cols))
+
+	_, _, args, err := prepareQueryArgs("public.test", cols)
+	assert.NoError(t, err)
+
+	// JSON values are written with their original text
+	assert.Equal(t, `{"b": 1,  "a": [1, 2]}`, args["doc"])
+	assert.Equal(t, `[{"a": 1}, 2]`, args["list"])
+	assert.Nil(t, args["empty"])
+	assert.Equal(t, `{"b": 1,  "a": 2}`, args["legacy"])
+	tags, err := args["tags"].(driver.Valuer).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"{\"z\": 1}",NULL}`, tags)
+
+	// JSON values from wal2json are strings of their JSON text
+	lrCols := []*ChangesetColumn{{Column: "doc", Type: "jsonb", Value: `[1, {"a": "b"}]`}}
+	assert.NoError(t, decodeColumns(lrCols))
+	assert.Equal(t, json.RawMessage(`[1, {"a": "b"}]`), lrCols[0].Value)
+
+	// parsed JSON values fail without stopping the process
+	_, _, err = prepareInsertQuery("public", &Changeset{
+		Table:     "documents",
+		NewValues: []*ChangesetColumn{{Column: "doc", Value: map[string]interface{}{"a": 1}}},
+	})
+	assert.EqualError(t, err, "column doc: unsupported type: map[string]interface {} value, expected raw json")
+	assert.True(t, errors.Is(err, ErrUnsupportedType))
+}
+
+func TestPrepareQueryArgsCasts(t *testing.T) {
+	columnTypes["public.items"] = map[string]*targetColumn{
+		"id":        {Type: "uuid"},
+		"matrix":    {Type: "text[]"},
+		"seen":      {Type: "timestamp with time zone[]"},
+		"period":    {Type: "tstzrange"},
+		"mood":      {Type: "public.mood"},
+		"email":     {Type: "public.email_address"},
+		"doc":       {Type: "jsonb"},
+		"address":   {Type: "public.address", Composite: true},
+		"addresses": {Type: "public.address[]", Composite: true},
+		"home":      {Type: "public.address", Composite: true},
+	}
+	defer delete(columnTypes, "public.items")
+
+	id, err := ParseUUID("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")
+	assert.NoError(t, err)
+	period, err := ParseRange(`["2020-01-01 00:00:00+00",)`)
+	assert.NoError(t, err)
+
+	cols := []*ChangesetColumn{
+		{Column: "id", Value: id},
+		{Column: "matrix", Value: []interface{}{[]interface{}{"a", `b"c`}, []interface{}{"d", nil}}},
+		{Column: "seen", Value: []interface{}{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}},
+		{Column: "period", Value: period},
+		{Column: "mood", Value: "happy"},
+		{Column: "email", Value: "bob@example.com"},
+		{Column: "doc", Value: json.RawMessage(`{"a": 1}`)},
+		{Column: "address", Value: json.RawMessage(`{"street": "main", "number": 1}`)},
+		{Column: "addresses", Value: []interface{}{map[string]interface{}{"street": "main"}}},
+		{Column: "home", Value: "(main,1)"},
+		{Column: "untyped", Value: []interface{}{"x"}},
+	}
+
+	_, colArgs, values, err := prepareQueryArgs("public.items", cols)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"CAST(:id AS uuid)",
+		"CAST(:matrix AS text[])",
+		"CAST(:seen AS timestamp with time zone[])",
+		"CAST(:period AS tstzrange)",
+		"CAST(:mood AS public.mood)",
+		"CAST(:email AS public.email_address)",
+		"CAST(:doc AS jsonb)",
+		"json_populate_record(CAST(NULL AS public.address), CAST(:address AS json))",
+		"ARRAY(SELECT json_populate_recordset(CAST(NULL AS public.address), CAST(:addresses AS json)))",
+		"CAST(:home AS public.address)",
+		":untyped",
+	}, colArgs)
+
+	assert.Equal(t, id, values["id"])
+	assert.Equal(t, `{{"a","b\"c"},{"d",NULL}}`, values["matrix"])
+	assert.Equal(t, `{"2020-01-02T03:04:05Z"}`, values["seen"])
+	assert.Equal(t, period, values["period"])
+	assert.Equal(t, `{"a": 1}`, values["doc"])
+	assert.Equal(t, `{"street": "main", "number": 1}`, values["address"])
+	assert.Equal(t, `[{"street":"main"}]`, values["addresses"])
+	assert.Equal(t, "(main,1)", values["home"])
+
+	query, _, err := prepareUpdateQuery("public", []string{"id"}, &Changeset{
+		Table:     "items",
+		NewValues: []*ChangesetColumn{{Column: "id", Value: id}, {Column: "mood", Value: "sad"}},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `INSERT INTO "public"."items" ("id", "mood") VALUES (CAST(:id AS uuid), CAST(:mood AS public.mood)) `+
+		`ON CONFLICT ("id") DO UPDATE SET "id" = CAST(:id AS uuid), "mood" = CAST(:mood AS public.mood) WHERE "items"."id" = CAST(:id AS uuid)`,
+		removeDuplicateSpaces(query))
+}
+
+func TestPrepareQueryArgsBytea(t *testing.T) {
+	columnTypes["public.files"] = map[string]*targetColumn{
+		"data":   {Type: "bytea"},
+		"chunks": {Type: "bytea[]"},
+	}
+	defer delete(columnTypes, "public.files")
+
+	cols := []*ChangesetColumn{
+		{Column: "data", Value: []byte{0x00, 0xff}},
+		{Column: "chunks", Value: []interface{}{[]byte{0x00}, nil}},
+		{Column: "untyped", Value: []interface{}{[]byte{0x01}}},
+	}
+
+	_, colArgs, values, err := prepareQueryArgs("public.files", cols)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CAST(:data AS bytea)", "CAST(:chunks AS bytea[])", ":untyped"}, colArgs)
+
+	// bytea values are bound as bytes, and written as binary by the driver
+	assert.Equal(t, []byte{0x00, 0xff}, values["data"])
+	assert.Equal(t, `{"\\x00",NULL}`, values["chunks"])
+
+	untyped, err := values["untyped"].(driver.Valuer).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"\\x01"}`, untyped)
+}
+
+func TestPrepareQueriesWithoutKey(t *testing.T) {
+	columnTypes["public.logs"] = map[string]*targetColumn{
+		"message": {Type: "text"},
+		"data":    {Type: "json"},
+	}
+	defer delete(columnTypes, "public.logs")
+
+	change := &Changeset{
+		Kind:      ChangesetKindUpdate,
+		Table:     "logs",
+		NewValues: []*ChangesetColumn{{Column: "message", Value: "new"}, {Column: "data", Value: json.RawMessage(`{}`)}},
+		OldValues: []*ChangesetColumn{{Column: "message", Value: "old"}, {Column: "data", Value: nil}},
+	}
+	match := `(tableoid, ctid) = (SELECT tableoid, ctid FROM "public"."logs" WHERE ` +
+		`CAST("logs"."message" AS text) IS NOT DISTINCT FROM CAST(CAST(:__old_message AS text) AS text) AND ` +
+		`CAST("logs"."data" AS text) IS NOT DISTINCT FROM CAST(CAST(:__old_data AS json) AS text) LIMIT 1)`
+
+	query, values, err := prepareUpdateQuery("public", nil, change, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `UPDATE "public"."logs" SET "message" = CAST(:message AS text), "data" = CAST(:data AS json) WHERE `+match, removeDuplicateSpaces(query))
+	assert.Equal(t, map[string]interface{}{"message": "new", "data": "{}", "__old_message": "old", "__old_data": nil}, values)
+
+	change.Kind = ChangesetKindDelete
+	query, values, err = prepareDeleteQuery("public", nil, change)
+	assert.NoError(t, err)
+	assert.Equal(t, `DELETE FROM "public"."logs" WHERE `+match, removeDuplicateSpaces(query))
+	assert.Equal(t, map[string]interface{}{"__old_message": "old", "__old_data": nil}, values)
+
+	change.OldValues = nil
+	_, _, err = prepareDeleteQuery("public", nil, change)
+	assert.True(t, errors.Is(err, ErrNoPrimaryKey))
+}
+
+func TestGetPrimaryKeyForChange(t *testing.T) {
+	primaryKeys["public.users"] = []string{"id"}
+	uniqueKeys["public.events"] = []string{"source", "seq"}
+	defer delete(primaryKeys, "public.users")
+	defer delete(uniqueKeys, "public.events")
+
+	pk, err := getPrimaryKeyForChange("public", &Changeset{Table: "users"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id"}, pk)
+
+	pk, err = getPrimaryKeyForChange("public", &Changeset{Table: "events"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"source", "seq"}, pk)
+
+	_, err = getPrimaryKeyForChange("public", &Changeset{Table: "logs"})
+	assert.True(t, errors.Is(err, ErrNoPrimaryKey))
+}
+
+func TestPrepareQueriesQuoting(t *testing.T) {
+	columnTypes["Sales.Order Items"] = map[string]*targetColumn{
+		"order": {Type: "integer"},
+	}
+	defer delete(columnTypes, "Sales.Order Items")
+
+	change := &Changeset{
+		Kind:  ChangesetKindUpdate,
+		Table: "Order Items",
+		NewValues: []*ChangesetColumn{
+			{Column: "order", Value: 1},
+			{Column: "UserID", Value: 2},
+			{Column: `a"b`, Value: "quote"},
+			{Column: "x:y", Value: "colon"},
+		},
+	}
+
+	query, values, err := prepareUpdateQuery("Sales", []string{"order"}, change, nil)
+	assert.NoError(t, err)
+
+	bound, args, err := sqlx.BindNamed(sqlx.DOLLAR, query, values)
+	assert.NoError(t, err)
+	assert.Equal(t, `INSERT INTO "Sales"."Order Items" ("order", "UserID", "a""b", "x:y") `+
+		`VALUES (CAST($1 AS integer), $2, $3, $4) ON CONFLICT ("order") `+
+		`DO UPDATE SET "order" = CAST($5 AS integer), "UserID" = $6, "a""b" = $7, "x:y" = $8 `+
+		`WHERE "Order Items"."order" = CAST($9 AS integer)`,
+		removeDuplicateSpaces(bound))
+	assert.Equal(t, []interface{}{1, 2, "quote", "colon", 1, 2, "quote", "colon", 1}, args)
+}
+
+func TestParseSequenceDefault(t *testing.T) {
+	testCases := []struct {
+		columnDefault string
+		expected      string
+		ok            bool
+	}{
+		{"nextval('users_id_seq'::regclass)", "users_id_seq", true},
+		{`nextval('"Sales"."Orders_id_seq"'::regclass)`, `"Sales"."Orders_id_seq"`, true},
+		{`nextval('"it''s_seq"'::regclass)`, `"it's_seq"`, true},
+		{"now()", "", false},
+	}
+
+	for _, tc := range testCases {
+		sequenceName, ok := parseSequenceDefault(tc.columnDefault)
+		assert.Equal(t, tc.ok, ok, tc.columnDefault)
+		assert.Equal(t, tc.expected, sequenceName, tc.columnDefault)
+	}
+}
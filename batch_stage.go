@@ -0,0 +1,185 @@
+package warppipe
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultBatchSize   = 100
+	defaultBatchLinger = 100 * time.Millisecond
+)
+
+// BatchStageFunc is a function for processing changesets in batches in a
+// pipeline Stage, such as enriching them with a single lookup per batch. It
+// accepts the changesets of a batch, in their input order, and returns the
+// changesets to emit, which may be more or fewer than those of the batch (none
+// to drop them all), or an error if the stage failed on the batch.
+// Errors are handled according to the stage's ErrorPolicy, and are reported as
+// a *StageError carrying the batch.
+type BatchStageFunc func([]*Changeset) ([]*Changeset, error)
+
+// batchStageContextFunc is a BatchStageFunc which is also passed the context
+// of the pipeline, for the built-in stages that query the database.
+type batchStageContextFunc func(context.Context, []*Changeset) ([]*Changeset, error)
+
+// StageBatchSize is an option for setting the maximum number of changesets in
+// the batches of a batch stage. Defaults to 100.
+func StageBatchSize(n int) StageOption {
+	return func(o *stageOptions) {
+		o.batchSize = n
+	}
+}
+
+// StageBatchLinger is an option for setting how long a batch stage waits for a
+// batch to fill up after its first changeset, before processing it anyway.
+// Defaults to 100ms.
+func StageBatchLinger(d time.Duration) StageOption {
+	return func(o *stageOptions) {
+		o.batchLinger = d
+	}
+}
+
+// AddBatchStage adds a new Stage processing changesets in batches to the
+// pipeline. Batch stages can be mixed with the stages added with AddStage().
+// Batches are processed one at a time, so StageWorkers() does not apply. When
+// the batch fails with the dead_letter ErrorPolicy, each of its changesets is
+// sent to the DeadLetterSink.
+func (p *Pipeline) AddBatchStage(name string, fn BatchStageFunc, opts ...StageOption) {
+	p.stages = append(p.stages, &Stage{
+		Name: name,
+		Fn:   makeBatchStageFunc(name, fn, opts...),
+	})
+}
+
+// makeBatchStageFunc wraps a BatchStageFunc and returns a stageFn, collecting
+// changesets into batches and applying the stage's error policy.
+func makeBatchStageFunc(name string, fn BatchStageFunc, opts ...StageOption) stageFn {
+	return makeBatchStageContextFunc(name, func(_ context.Context, batch []*Changeset) ([]*Changeset, error) {
+		return fn(batch)
+	}, opts...)
+}
+
+// makeBatchStageContextFunc wraps a batchStageContextFunc and returns a
+// stageFn, like makeBatchStageFunc.
+func makeBatchStageContextFunc(name string, fn batchStageContextFunc, opts ...StageOption) stageFn {
+	options := stageOptions{
+		batchSize:   defaultBatchSize,
+		batchLinger: defaultBatchLinger,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.batchSize < 1 {
+		options.batchSize = 1
+	}
+
+	s := &batchStageRunner{name: name, fn: fn, options: options}
+	return s.run
+}
+
+// batchStageRunner runs the BatchStageFunc of a stage.
+type batchStageRunner struct {
+	name    string
+	fn      batchStageContextFunc
+	options stageOptions
+}
+
+// run collects changesets into batches, and processes a batch once it is full,
+// once it lingered for the configured time, or once the input is closed.
+func (s *batchStageRunner) run(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
+	outCh := make(chan *Changeset)
+	go func() {
+		defer close(outCh)
+
+		linger := time.NewTimer(s.options.batchLinger)
+		linger.Stop()
+		defer linger.Stop()
+
+		var batch []*Changeset
+		flush := func() bool {
+			if !linger.Stop() {
+				// drain a linger that fired while the batch filled up
+				select {
+				case <-linger.C:
+				default:
+				}
+			}
+			results, halt, errs := s.process(ctx, batch)
+			batch = nil
+
+			for _, err := range errs {
+				if !emit(ctx, nil, err, outCh, errCh) {
+					return false
+				}
+			}
+			for _, c := range results {
+				if !emit(ctx, c, nil, outCh, errCh) {
+					return false
+				}
+			}
+			return !halt
+		}
+
+		for {
+			select {
+			case change, ok := <-inCh:
+				if !ok {
+					if len(batch) > 0 {
+						flush()
+					}
+					return
+				}
+
+				batch = append(batch, change)
+				if len(batch) >= s.options.batchSize {
+					if !flush() {
+						return
+					}
+				} else if len(batch) == 1 {
+					linger.Reset(s.options.batchLinger)
+				}
+			case <-linger.C:
+				if !flush() {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return outCh
+}
+
+// process runs the BatchStageFunc on a batch and applies the stage's error
+// policy. It returns the changesets to emit, whether the stage must halt, and
+// the errors to report.
+func (s *batchStageRunner) process(ctx context.Context, batch []*Changeset) ([]*Changeset, bool, []error) {
+	var results []*Changeset
+	cancelled, err := s.options.withRetries(ctx, func() error {
+		var err error
+		results, err = s.fn(ctx, batch)
+		return err
+	})
+	if cancelled {
+		return nil, true, nil
+	}
+	if err == nil {
+		return results, false, nil
+	}
+
+	if s.options.errorPolicy != ErrorPolicyDeadLetter || s.options.deadLetter == nil {
+		halt, err := s.options.handleError(ctx, &StageError{Stage: s.name, Batch: batch, Err: err})
+		return nil, halt, []error{err}
+	}
+
+	var errs []error
+	for _, change := range batch {
+		_, sendErr := s.options.handleError(ctx, &StageError{Stage: s.name, Changeset: change, Err: err})
+		if sendErr != nil {
+			errs = append(errs, sendErr)
+		}
+	}
+	return nil, false, errs
+}
@@ -0,0 +1,120 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordBatches returns a BatchStageFunc emitting its batches unchanged, and
+// the sizes of the batches it received.
+func recordBatches() (BatchStageFunc, func() []int) {
+	var mu sync.Mutex
+	var sizes []int
+	fn := func(batch []*Changeset) ([]*Changeset, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, len(batch))
+		return batch, nil
+	}
+	return fn, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return sizes
+	}
+}
+
+func TestBatchStageSize(t *testing.T) {
+	fn, sizes := recordBatches()
+	p := NewPipeline()
+	p.AddBatchStage("batch", fn, StageBatchSize(4), StageBatchLinger(time.Hour))
+
+	changes := newTestChangesets(10)
+	results, errs := runPipeline(t, p, changes)
+	assert.Equal(t, changes, results)
+	assert.Empty(t, errs)
+	// the last batch is flushed when the input is closed
+	assert.Equal(t, []int{4, 4, 2}, sizes())
+}
+
+func TestBatchStageLinger(t *testing.T) {
+	fn, sizes := recordBatches()
+	p := NewPipeline()
+	p.AddBatchStage("batch", fn, StageBatchSize(100), StageBatchLinger(5*time.Millisecond))
+
+	sourceCh := make(chan *Changeset)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outCh, _ := p.Start(ctx, sourceCh)
+
+	go func() {
+		sourceCh <- &Changeset{ID: 1}
+		sourceCh <- &Changeset{ID: 2}
+	}()
+
+	for _, id := range []int64{1, 2} {
+		select {
+		case change := <-outCh:
+			assert.Equal(t, id, change.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the batch to linger")
+		}
+	}
+	assert.Equal(t, []int{2}, sizes())
+}
+
+func TestBatchStageMixedWithStages(t *testing.T) {
+	p := NewPipeline()
+	p.AddStage("drop_odd", func(change *Changeset) (*Changeset, error) {
+		if change.ID%2 == 1 {
+			return nil, nil
+		}
+		return change, nil
+	})
+	p.AddBatchStage("duplicate", func(batch []*Changeset) ([]*Changeset, error) {
+		var results []*Changeset
+		for _, change := range batch {
+			results = append(results, change, change)
+		}
+		return results, nil
+	}, StageBatchSize(2))
+	p.AddStage("slow", sleepStage(3), StageWorkers(4))
+
+	changes := newTestChangesets(6)
+	results, errs := runPipeline(t, p, changes)
+	assert.Empty(t, errs)
+	assert.Equal(t, []*Changeset{changes[0], changes[0], changes[2], changes[2], changes[4], changes[4]}, results)
+}
+
+func TestBatchStageErrors(t *testing.T) {
+	failing := func(batch []*Changeset) ([]*Changeset, error) {
+		return nil, errTestStage
+	}
+
+	changes := newTestChangesets(3)
+	p := NewPipeline()
+	p.AddBatchStage("lookup", failing, StageBatchSize(3))
+	results, errs := runPipeline(t, p, changes)
+	assert.Empty(t, results)
+	if assert.Len(t, errs, 1) {
+		var stageErr *StageError
+		assert.True(t, errors.As(errs[0], &stageErr))
+		assert.Equal(t, changes, stageErr.Batch)
+		assert.EqualError(t, errs[0], "stage lookup: batch of 3 changesets: stage failed")
+	}
+
+	var deadLetters []*Changeset
+	sink := DeadLetterFunc(func(_ context.Context, err *StageError) error {
+		deadLetters = append(deadLetters, err.Changeset)
+		return nil
+	})
+	p = NewPipeline()
+	p.AddBatchStage("lookup", failing, StageBatchSize(3), StageDeadLetter(sink))
+	_, errs = runPipeline(t, p, changes)
+	assert.Empty(t, errs)
+	assert.Equal(t, changes, deadLetters)
+}
@@ -45,7 +45,7 @@ type Changeset struct {
 
 func (c *Changeset) getColumnValue(values []*ChangesetColumn, column string) (interface{}, bool) {
 	for _, v := range values {
-		if v.Column == column {
+		if v.Column == column && !v.Unchanged {
 			return v.Value, true
 		}
 	}
@@ -62,7 +62,8 @@ func (c *Changeset) String() string {
 }
 
 // GetNewColumnValue returns the current value for a column and a bool denoting
-// whether a new value is present in the changeset.
+// whether a new value is present in the changeset. Unchanged columns have no
+// value.
 func (c *Changeset) GetNewColumnValue(column string) (interface{}, bool) {
 	return c.getColumnValue(c.NewValues, column)
 }
@@ -78,4 +79,21 @@ type ChangesetColumn struct {
 	Column string      `json:"column"`
 	Value  interface{} `json:"value"`
 	Type   string      `json:"type"`
+	// Enriched is true if the column was read from the database by an Enricher
+	// rather than being part of the original changeset.
+	Enriched bool `json:"enriched,omitempty"`
+	// Unchanged is true if the column was left out of the changeset because its
+	// value did not change, such as an unchanged TOASTed value in logical
+	// replication. The column has no Value, and must not be written.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+// hasUnchangedColumns returns true if any of the columns is Unchanged.
+func hasUnchangedColumns(values []*ChangesetColumn) bool {
+	for _, v := range values {
+		if v.Unchanged {
+			return true
+		}
+	}
+	return false
 }
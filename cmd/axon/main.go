@@ -18,4 +18,7 @@ func main() {
 
 	axon := warppipe.Axon{Config: cfg, Logger: logger}
 	axon.Run()
+	if err := axon.Err(); err != nil {
+		logger.WithError(err).Fatal("axon halted")
+	}
 }
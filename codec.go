@@ -0,0 +1,684 @@
+package warppipe
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Codec decodes the values of a Postgres type, as read from the JSON of a
+// changeset, into Go values. Decode is never called with a nil value.
+type Codec interface {
+	Decode(value interface{}) (interface{}, error)
+}
+
+// CodecFunc is a function implementing Codec.
+type CodecFunc func(value interface{}) (interface{}, error)
+
+// Decode implements Codec.
+func (f CodecFunc) Decode(value interface{}) (interface{}, error) {
+	return f(value)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"smallint":                    CodecFunc(decodeInt),
+		"integer":                     CodecFunc(decodeInt),
+		"bigint":                      CodecFunc(decodeInt),
+		"oid":                         CodecFunc(decodeInt),
+		"real":                        CodecFunc(decodeFloat),
+		"double precision":            CodecFunc(decodeFloat),
+		"numeric":                     CodecFunc(decodeNumeric),
+		"boolean":                     CodecFunc(decodeBool),
+		"timestamp with time zone":    CodecFunc(decodeTimestamp),
+		"timestamp without time zone": CodecFunc(decodeTimestamp),
+		"date":                        CodecFunc(decodeTimestamp),
+		"uuid":                        CodecFunc(decodeUUID),
+		"bytea":                       CodecFunc(decodeBytea),
+		"json":                        CodecFunc(decodeJSON),
+		"jsonb":                       CodecFunc(decodeJSON),
+		"int4range":                   CodecFunc(decodeRange),
+		"int8range":                   CodecFunc(decodeRange),
+		"numrange":                    CodecFunc(decodeRange),
+		"tsrange":                     CodecFunc(decodeRange),
+		"tstzrange":                   CodecFunc(decodeRange),
+		"daterange":                   CodecFunc(decodeRange),
+	}
+
+	// typeAliases maps the internal names of Postgres types to the names used
+	// by format_type(), which key the codecs.
+	typeAliases = map[string]string{
+		"int2":        "smallint",
+		"int4":        "integer",
+		"int":         "integer",
+		"int8":        "bigint",
+		"float4":      "real",
+		"float8":      "double precision",
+		"decimal":     "numeric",
+		"bool":        "boolean",
+		"timestamptz": "timestamp with time zone",
+		"timestamp":   "timestamp without time zone",
+	}
+
+	regexTypeModifier = regexp.MustCompile(`\([^)]*\)`)
+)
+
+// RegisterCodec registers the Codec decoding the values of a Postgres type,
+// such as an enum or a domain, replacing any existing codec for the type.
+// Arrays of the type are decoded with the same codec.
+func RegisterCodec(pgType string, codec Codec) {
+	name, _ := parseTypeName(pgType)
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = codec
+}
+
+// DecodeValue decodes a value of a Postgres type, such as the type of a
+// ChangesetColumn, with the registered codecs:
+//
+// smallint, integer, bigint and oid values decode to int64, real and double
+// precision values to float64, numeric values to Decimal, boolean values to
+// bool, timestamp and date values to time.Time, uuid values to UUID, bytea
+// values to []byte, json and jsonb values to json.RawMessage, and range values
+// to Range. Arrays decode to []interface{} of their decoded elements, nested
+// for multidimensional arrays.
+//
+// Values of other types, such as text or enums, are returned as is, as are the
+// special values NaN and ±infinity of floats and timestamps.
+func DecodeValue(pgType string, value interface{}) (interface{}, error) {
+	if value == nil || pgType == "" {
+		return value, nil
+	}
+
+	name, dims := parseTypeName(pgType)
+
+	codecsMu.RLock()
+	codec, ok := codecs[name]
+	codecsMu.RUnlock()
+
+	if dims > 0 {
+		return decodeArray(codec, value)
+	}
+	if !ok {
+		return value, nil
+	}
+	return codec.Decode(value)
+}
+
+// decodeColumns decodes the values of the columns with their types. Columns
+// that fail to decode keep their value, and the first error is returned.
+func decodeColumns(values []*ChangesetColumn) error {
+	var firstErr error
+	for _, v := range values {
+		decoded, err := DecodeValue(v.Type, v.Value)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to decode column %s of type %s: %w", v.Column, v.Type, err)
+			}
+			continue
+		}
+		v.Value = decoded
+	}
+	return firstErr
+}
+
+// unmarshalJSON unmarshals JSON like json.Unmarshal, but decodes numbers into
+// interface{} values as json.Number, keeping their exact text, so that numerics
+// and bigints are not rounded to a float64.
+func unmarshalJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(v)
+	if err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
+
+// parseTypeName returns the name of a Postgres type without its modifiers,
+// such as the length of a varchar, and its number of array dimensions.
+func parseTypeName(pgType string) (string, int) {
+	name := strings.ToLower(regexTypeModifier.ReplaceAllString(pgType, ""))
+	name = strings.Join(strings.Fields(name), " ")
+
+	dims := 0
+	for strings.HasSuffix(name, "[]") {
+		name = strings.TrimSpace(strings.TrimSuffix(name, "[]"))
+		dims++
+	}
+
+	if alias, ok := typeAliases[name]; ok {
+		name = alias
+	}
+	return name, dims
+}
+
+// isSpecialValue returns true for the special values of floats and
+// timestamps, which have no Go equivalent and are kept as strings.
+func isSpecialValue(s string) bool {
+	switch strings.ToLower(s) {
+	case "nan", "infinity", "-infinity", "+infinity":
+		return true
+	}
+	return false
+}
+
+func decodeInt(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return nil, fmt.Errorf("invalid integer %v", v)
+		}
+		return int64(v), nil
+	case json.Number:
+		return strconv.ParseInt(v.String(), 10, 64)
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case int64:
+		return v, nil
+	}
+	return nil, fmt.Errorf("invalid integer %v", v)
+}
+
+func decodeFloat(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		if isSpecialValue(v) {
+			return v, nil
+		}
+		return strconv.ParseFloat(v, 64)
+	}
+	return nil, fmt.Errorf("invalid float %v", v)
+}
+
+func decodeNumeric(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case float64:
+		return Decimal(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case json.Number:
+		return ParseDecimal(v.String())
+	case string:
+		return ParseDecimal(v)
+	}
+	return nil, fmt.Errorf("invalid numeric %v", v)
+}
+
+func decodeBool(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch v {
+		case "t", "true":
+			return true, nil
+		case "f", "false":
+			return false, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid boolean %v", v)
+}
+
+// timestampLayouts are the formats of timestamps and dates, as written by
+// row_to_json() and by wal2json.
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+func decodeTimestamp(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid timestamp %v", v)
+	}
+	if isSpecialValue(s) {
+		return s, nil
+	}
+
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid timestamp %s", s)
+}
+
+func decodeUUID(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid uuid %v", v)
+	}
+	return ParseUUID(s)
+}
+
+func decodeBytea(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid bytea %v", v)
+	}
+	return parseBytea(s)
+}
+
+// decodeJSON decodes a json or jsonb value, written as its JSON text by
+// wal2json, into a json.RawMessage holding that exact text. Values that were
+// already parsed are marshaled again.
+func decodeJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.RawMessage:
+		return v, nil
+	case string:
+		if !json.Valid([]byte(v)) {
+			return nil, fmt.Errorf("invalid json %s", v)
+		}
+		return json.RawMessage(v), nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+func decodeRange(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid range %v", v)
+	}
+	return ParseRange(s)
+}
+
+// decodeArray decodes an array, either a JSON array or a Postgres array
+// literal, decoding its elements with the codec of the element type.
+func decodeArray(codec Codec, v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		var err error
+		v, err = parseArray(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	elems, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid array %v", v)
+	}
+
+	decoded := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		var err error
+		switch {
+		case elem == nil:
+		case isArray(elem):
+			decoded[i], err = decodeArray(codec, elem)
+		case codec != nil:
+			decoded[i], err = codec.Decode(elem)
+		default:
+			decoded[i] = elem
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+func isArray(v interface{}) bool {
+	_, ok := v.([]interface{})
+	return ok
+}
+
+// parseArray parses a Postgres array literal, such as {1,2,NULL} or
+// {{"a b",c},{d,e}}, into nested []interface{} of strings and nils.
+func parseArray(s string) ([]interface{}, error) {
+	// skip the dimension decoration of arrays with custom bounds, such as
+	// [0:1]={1,2}
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid array %s", s)
+		}
+		s = s[i+1:]
+	}
+
+	p := &arrayParser{src: s}
+	arr, err := p.parseArray()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.src) {
+		return nil, fmt.Errorf("invalid array %s", s)
+	}
+	return arr, nil
+}
+
+type arrayParser struct {
+	src string
+	pos int
+}
+
+func (p *arrayParser) parseArray() ([]interface{}, error) {
+	if p.pos >= len(p.src) || p.src[p.pos] != '{' {
+		return nil, fmt.Errorf("invalid array %s", p.src)
+	}
+	p.pos++
+
+	elems := []interface{}{}
+	if p.pos < len(p.src) && p.src[p.pos] == '}' {
+		p.pos++
+		return elems, nil
+	}
+
+	for {
+		elem, err := p.parseElement()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("invalid array %s", p.src)
+		}
+		switch p.src[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return elems, nil
+		default:
+			return nil, fmt.Errorf("invalid array %s", p.src)
+		}
+	}
+}
+
+func (p *arrayParser) parseElement() (interface{}, error) {
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("invalid array %s", p.src)
+	}
+
+	switch p.src[p.pos] {
+	case '{':
+		return p.parseArray()
+	case '"':
+		p.pos++
+		var b strings.Builder
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			p.pos++
+			switch c {
+			case '\\':
+				if p.pos < len(p.src) {
+					b.WriteByte(p.src[p.pos])
+					p.pos++
+				}
+			case '"':
+				return b.String(), nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return nil, fmt.Errorf("invalid array %s", p.src)
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && p.src[p.pos] != ',' && p.src[p.pos] != '}' {
+		p.pos++
+	}
+	elem := strings.TrimSpace(p.src[start:p.pos])
+	if strings.EqualFold(elem, "NULL") {
+		return nil, nil
+	}
+	return elem, nil
+}
+
+// parseBytea parses a bytea in the hex format, such as \x0102, or in the
+// legacy escape format.
+func parseBytea(s string) ([]byte, error) {
+	if strings.HasPrefix(s, `\x`) {
+		return hex.DecodeString(s[2:])
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\\' {
+			b = append(b, '\\')
+			i++
+			continue
+		}
+		if i+4 > len(s) {
+			return nil, fmt.Errorf("invalid bytea %s", s)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytea %s", s)
+		}
+		b = append(b, byte(n))
+		i += 3
+	}
+	return b, nil
+}
+
+// Decimal is an exact numeric value, holding the text of a Postgres numeric,
+// including NaN and ±Infinity.
+type Decimal string
+
+var regexDecimal = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+// ParseDecimal parses the text of a numeric value into a Decimal.
+func ParseDecimal(s string) (Decimal, error) {
+	if !regexDecimal.MatchString(s) && !isSpecialValue(s) {
+		return "", fmt.Errorf("invalid numeric %s", s)
+	}
+	return Decimal(s), nil
+}
+
+// String implements Stringer.
+func (d Decimal) String() string {
+	return string(d)
+}
+
+// Float64 returns the closest float64 to the decimal.
+func (d Decimal) Float64() (float64, error) {
+	return strconv.ParseFloat(string(d), 64)
+}
+
+// Value implements driver.Valuer, writing the exact text of the decimal.
+func (d Decimal) Value() (driver.Value, error) {
+	return string(d), nil
+}
+
+// MarshalJSON implements json.Marshaler. Decimals are written as JSON numbers,
+// and NaN and ±Infinity as strings.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if isSpecialValue(string(d)) {
+		return json.Marshal(string(d))
+	}
+	return []byte(d), nil
+}
+
+// UUID is a Postgres uuid.
+type UUID [16]byte
+
+// ParseUUID parses the text of a uuid, with or without hyphens or braces.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	h := strings.NewReplacer("-", "", "{", "", "}", "").Replace(s)
+	if len(h) != 32 {
+		return u, fmt.Errorf("invalid uuid %s", s)
+	}
+	_, err := hex.Decode(u[:], []byte(h))
+	if err != nil {
+		return u, fmt.Errorf("invalid uuid %s", s)
+	}
+	return u, nil
+}
+
+// String implements Stringer, formatting the uuid in its canonical form.
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Value implements driver.Valuer.
+func (u UUID) Value() (driver.Value, error) {
+	return u.String(), nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (u UUID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.String())
+}
+
+// Range is a Postgres range, such as an int4range or a tstzrange. The bounds
+// hold the text of their values.
+type Range struct {
+	Lower          string
+	Upper          string
+	LowerInclusive bool
+	UpperInclusive bool
+	// LowerInfinite and UpperInfinite are true for unbounded ranges.
+	LowerInfinite bool
+	UpperInfinite bool
+	// Empty is true for the empty range.
+	Empty bool
+}
+
+// ParseRange parses the text of a range, such as [1,10) or empty.
+func ParseRange(s string) (Range, error) {
+	var r Range
+	if strings.EqualFold(strings.TrimSpace(s), "empty") {
+		r.Empty = true
+		return r, nil
+	}
+
+	if len(s) < 3 || (s[0] != '[' && s[0] != '(') || (s[len(s)-1] != ']' && s[len(s)-1] != ')') {
+		return r, fmt.Errorf("invalid range %s", s)
+	}
+	r.LowerInclusive = s[0] == '['
+	r.UpperInclusive = s[len(s)-1] == ']'
+
+	bounds, err := splitRangeBounds(s[1 : len(s)-1])
+	if err != nil {
+		return r, fmt.Errorf("invalid range %s", s)
+	}
+	r.Lower, r.LowerInfinite = bounds[0].text, bounds[0].infinite
+	r.Upper, r.UpperInfinite = bounds[1].text, bounds[1].infinite
+	return r, nil
+}
+
+type rangeBound struct {
+	text     string
+	infinite bool
+}
+
+// splitRangeBounds splits the bounds of a range, unquoting them. Empty,
+// unquoted bounds are infinite.
+func splitRangeBounds(s string) ([2]rangeBound, error) {
+	var bounds [2]rangeBound
+	n := 0
+	var b strings.Builder
+	quoted, inQuotes := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case c == '"':
+			if inQuotes && i+1 < len(s) && s[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+			} else {
+				inQuotes = !inQuotes
+				quoted = true
+			}
+		case c == ',' && !inQuotes:
+			if n > 0 {
+				return bounds, errors.New("too many bounds")
+			}
+			bounds[n] = rangeBound{text: b.String(), infinite: !quoted && b.Len() == 0}
+			b.Reset()
+			quoted = false
+			n++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if n != 1 || inQuotes {
+		return bounds, errors.New("expected two bounds")
+	}
+	bounds[1] = rangeBound{text: b.String(), infinite: !quoted && b.Len() == 0}
+	return bounds, nil
+}
+
+// String implements Stringer, formatting the range as a Postgres literal.
+func (r Range) String() string {
+	if r.Empty {
+		return "empty"
+	}
+
+	var b strings.Builder
+	if r.LowerInclusive {
+		b.WriteByte('[')
+	} else {
+		b.WriteByte('(')
+	}
+	if !r.LowerInfinite {
+		b.WriteString(quoteRangeBound(r.Lower))
+	}
+	b.WriteByte(',')
+	if !r.UpperInfinite {
+		b.WriteString(quoteRangeBound(r.Upper))
+	}
+	if r.UpperInclusive {
+		b.WriteByte(']')
+	} else {
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// quoteRangeBound quotes a bound if it is empty or contains special characters,
+// as Postgres does.
+func quoteRangeBound(s string) string {
+	if s != "" && !strings.ContainsAny(s, ",()[]\" \t\n\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Value implements driver.Valuer.
+func (r Range) Value() (driver.Value, error) {
+	return r.String(), nil
+}
+
+// MarshalJSON implements json.Marshaler, writing the range as a string.
+func (r Range) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
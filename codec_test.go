@@ -0,0 +1,123 @@
+package warppipe
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeValue(t *testing.T) {
+	testCases := []struct {
+		pgType   string
+		value    interface{}
+		expected interface{}
+	}{
+		{"integer", float64(42), int64(42)},
+		{"bigint", json.Number("9007199254740993"), int64(9007199254740993)},
+		{"int8", "-7", int64(-7)},
+		{"double precision", float64(1.5), float64(1.5)},
+		{"real", "NaN", "NaN"},
+		{"numeric(38,10)", json.Number("12345678901234567890.0123456789"), Decimal("12345678901234567890.0123456789")},
+		{"numeric", float64(0.1), Decimal("0.1")},
+		{"boolean", true, true},
+		{"bool", "f", false},
+		{"timestamp with time zone", "2020-01-02 03:04:05.123456+00", time.Date(2020, 1, 2, 3, 4, 5, 123456000, time.UTC)},
+		{"timestamp(3) with time zone", "2020-01-02T03:04:05+00:00", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"timestamp without time zone", "2020-01-02T03:04:05", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"timestamptz", "infinity", "infinity"},
+		{"date", "2020-01-02", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"uuid", "A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11", UUID{0xa0, 0xee, 0xbc, 0x99, 0x9c, 0x0b, 0x4e, 0xf8, 0xbb, 0x6d, 0x6b, 0xb9, 0xbd, 0x38, 0x0a, 0x11}},
+		{"bytea", `\x00ff`, []byte{0x00, 0xff}},
+		{"bytea", `a\\b\001`, []byte{'a', '\\', 'b', 0x01}},
+		{"int4range", "[1,10)", Range{Lower: "1", Upper: "10", LowerInclusive: true}},
+		{"tstzrange", `["2020-01-01 00:00:00+00",)`, Range{Lower: "2020-01-01 00:00:00+00", LowerInclusive: true, UpperInfinite: true}},
+		{"daterange", "empty", Range{Empty: true}},
+		{"integer[]", "{1,2,NULL}", []interface{}{int64(1), int64(2), nil}},
+		{"integer[]", []interface{}{float64(1), float64(2)}, []interface{}{int64(1), int64(2)}},
+		{"int4[][]", "{{1,2},{3,4}}", []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(3), int64(4)}}},
+		{"character varying(10)[]", `{"a b","c\"d",e}`, []interface{}{"a b", `c"d`, "e"}},
+		{"text[]", "[0:1]={a,b}", []interface{}{"a", "b"}},
+		{"text[]", "{}", []interface{}{}},
+		{"mood", "happy", "happy"},
+		{"mood[]", "{happy,sad}", []interface{}{"happy", "sad"}},
+		{"jsonb", `{"a": 1}`, json.RawMessage(`{"a": 1}`)},
+		{"json[]", `{"{\"a\": 1}",NULL}`, []interface{}{json.RawMessage(`{"a": 1}`), nil}},
+		{"text", nil, nil},
+		{"", float64(1), float64(1)},
+	}
+
+	for _, tc := range testCases {
+		value, err := DecodeValue(tc.pgType, tc.value)
+		if !assert.NoError(t, err, tc.pgType) {
+			continue
+		}
+		if expected, ok := tc.expected.(time.Time); ok {
+			assert.True(t, expected.Equal(value.(time.Time)), tc.pgType)
+		} else {
+			assert.Equal(t, tc.expected, value, tc.pgType)
+		}
+	}
+}
+
+func TestDecodeValueErrors(t *testing.T) {
+	testCases := []struct {
+		pgType string
+		value  interface{}
+	}{
+		{"integer", float64(1.5)},
+		{"numeric", "1.2.3"},
+		{"timestamp with time zone", "yesterday"},
+		{"uuid", "not-a-uuid"},
+		{"bytea", `\xzz`},
+		{"int4range", "1,10"},
+		{"integer[]", "{1,2"},
+		{"jsonb", "{not json"},
+	}
+
+	for _, tc := range testCases {
+		_, err := DecodeValue(tc.pgType, tc.value)
+		assert.Error(t, err, tc.pgType)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec("public.mood", CodecFunc(func(v interface{}) (interface{}, error) {
+		return len(v.(string)), nil
+	}))
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, "public.mood")
+		codecsMu.Unlock()
+	}()
+
+	value, err := DecodeValue("public.mood[]", "{happy,sad}")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{5, 3}, value)
+}
+
+func TestDecodeColumns(t *testing.T) {
+	cols := []*ChangesetColumn{
+		{Column: "id", Type: "integer", Value: float64(1)},
+		{Column: "created_at", Type: "timestamptz", Value: "not a timestamp"},
+	}
+	err := decodeColumns(cols)
+	assert.EqualError(t, err, "failed to decode column created_at of type timestamptz: invalid timestamp not a timestamp")
+	assert.Equal(t, int64(1), cols[0].Value)
+	assert.Equal(t, "not a timestamp", cols[1].Value)
+}
+
+func TestTypedValuesJSON(t *testing.T) {
+	u, err := ParseUUID("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")
+	assert.NoError(t, err)
+
+	data, err := json.Marshal([]interface{}{
+		Decimal("1.10"),
+		Decimal("NaN"),
+		u,
+		Range{Lower: "a b", Upper: "c", LowerInclusive: true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `[1.10,"NaN","a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11","[\"a b\",c)"]`, string(data))
+}
@@ -3,6 +3,7 @@ package warppipe
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sirupsen/logrus"
@@ -30,7 +31,8 @@ type Config struct {
 	// Note: This setting takes precedent over the whitelisted tables.
 	IgnoreTables []string `envconfig:"IGNORE_TABLES"`
 
-	// Replication mode may be either `lr` (logical replication) or `audit`.
+	// Replication mode may be one of `lr` (logical replication), `audit`, or
+	// `poll` (audit without LISTEN/NOTIFY).
 	ReplicationMode string `envconfig:"REPLICATION_MODE" default:"lr"`
 
 	// Specifies the replication slot name to be used. (LR mode only)
@@ -45,6 +47,69 @@ type Config struct {
 	// Start replication from the specified changeset timestamp. (Audit mode only)
 	StartFromTimestamp int64 `envconfig:"START_FROM_TIMESTAMP"`
 
+	// Number of changesets read per query when catching up. (Audit mode only)
+	BacklogPageSize int `envconfig:"BACKLOG_PAGE_SIZE"`
+
+	// Read the backlog of changesets through a server-side cursor. (Audit mode only)
+	BacklogCursor bool `envconfig:"BACKLOG_CURSOR"`
+
+	// Interval between re-reads of the changesets table for changesets committed
+	// out of order. Disabled when zero. (Audit mode only)
+	RepollInterval time.Duration `envconfig:"REPOLL_INTERVAL" default:"5s"`
+
+	// Minimum interval between polls, used while changesets keep arriving. (Poll mode only)
+	PollMinInterval time.Duration `envconfig:"POLL_MIN_INTERVAL" default:"100ms"`
+
+	// Maximum interval between polls, backed off to while idle. (Poll mode only)
+	PollMaxInterval time.Duration `envconfig:"POLL_MAX_INTERVAL" default:"5s"`
+
+	// Prune changesets older than the specified number of days. (Audit mode only)
+	RetentionDays int `envconfig:"RETENTION_DAYS"`
+
+	// Prune changesets acknowledged by all registered consumers. (Audit mode only)
+	PruneAcknowledged bool `envconfig:"PRUNE_ACKNOWLEDGED"`
+
+	// Interval between background prunes. Disabled when zero, in which case
+	// only the upcoming partitions of a partitioned table are created, hourly.
+	// (Audit mode only)
+	PruneInterval time.Duration `envconfig:"PRUNE_INTERVAL"`
+
+	// Maximum number of changesets deleted per statement when pruning.
+	PruneBatchSize int `envconfig:"PRUNE_BATCH_SIZE" default:"1000"`
+
+	// If set, warppipe will only emit changes for which the filter expression
+	// evaluates to true.
+	Filter string `envconfig:"FILTER"`
+
+	// Path to a YAML or JSON file of built-in pipeline stages.
+	PipelineConfig string `envconfig:"PIPELINE_CONFIG"`
+
+	// If set, changesets that the filter or the pipeline stages fail to
+	// process are appended to this file as lines of JSON.
+	DeadLetterFile string `envconfig:"DEAD_LETTER_FILE"`
+
+	// If set, changesets of these tables are enriched with the columns missing
+	// from their new values, read from the source database by primary key.
+	EnrichTables []string `envconfig:"ENRICH_TABLES"`
+
+	// Related rows added to the changesets, as <table>.<column>=[<schema>.]<related table>.
+	EnrichRelated []string `envconfig:"ENRICH_RELATED"`
+
+	// Number of rows cached for enrichment.
+	EnrichCacheSize int `envconfig:"ENRICH_CACHE_SIZE" default:"10000"`
+
+	// Host of a replica of the source database used for enrichment, instead of
+	// the source database.
+	EnrichDBHost string `envconfig:"ENRICH_DB_HOST"`
+
+	// Maximum time to wait on shutdown for the changesets in flight to be
+	// emitted before closing the connections.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+
+	// Secret key of the HMAC-SHA256 replacing the values of hashed columns.
+	// (setup-db only)
+	HashSecret string `envconfig:"HASH_SECRET"`
+
 	// Sets the log level
 	LogLevel string `envconfig:"LOG_LEVEL" default:"info"`
 }
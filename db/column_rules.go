@@ -0,0 +1,167 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+// ColumnRuleAction is the treatment applied to a column's values before a
+// changeset is written to the `warp_pipe.changesets` table.
+type ColumnRuleAction string
+
+// ColumnRuleAction constants
+const (
+	// Leave the column out of the changeset.
+	ColumnExclude ColumnRuleAction = "exclude"
+	// Replace the value with its HMAC-SHA256, keyed by a secret, so that
+	// changes remain detectable but values cannot be recovered by hashing
+	// guesses.
+	ColumnHash ColumnRuleAction = "hash"
+	// Replace the value with a fixed placeholder.
+	ColumnRedact ColumnRuleAction = "redact"
+)
+
+// ColumnRule is a rule applied by the `warp_pipe.on_modify()` trigger to a
+// column of a table.
+type ColumnRule struct {
+	Schema string
+	Table  string
+	Column string
+	Action ColumnRuleAction
+}
+
+// ParseColumnRule parses a column rule from a column in the form
+// `[schema.]table.column`. The schema defaults to `public`.
+func ParseColumnRule(action ColumnRuleAction, column string) (ColumnRule, error) {
+	rule := ColumnRule{Schema: "public", Action: action}
+
+	parts := strings.Split(column, ".")
+	switch len(parts) {
+	case 2:
+		rule.Table, rule.Column = parts[0], parts[1]
+	case 3:
+		rule.Schema, rule.Table, rule.Column = parts[0], parts[1], parts[2]
+	default:
+		return rule, fmt.Errorf("'%s' is not a valid column. Must be in the form `[schema.]table.column`", column)
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			return rule, fmt.Errorf("'%s' is not a valid column. Must be in the form `[schema.]table.column`", column)
+		}
+	}
+
+	return rule, nil
+}
+
+func createColumnRulesTable(tx *pgx.Tx, rules []ColumnRule, hashSecret string) error {
+	_, err := tx.Exec(createTableWarpPipeColumnRulesSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(revokeAllOnWarpPipeColumnRulesSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createTableWarpPipeColumnRulesSecretSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(revokeAllOnWarpPipeColumnRulesSecretSQL)
+	if err != nil {
+		return err
+	}
+
+	if hashSecret != "" {
+		_, err = tx.Exec(upsertWarpPipeColumnRulesSecretSQL, hashSecret)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The secret may have been stored by an earlier Prepare.
+	var hasSecret bool
+	err = tx.QueryRow(selectColumnRulesSecretExistsSQL).Scan(&hasSecret)
+	if err != nil {
+		return err
+	}
+
+	// Without a secret, hash rules are rejected, and the HMAC expression is
+	// never evaluated.
+	hashAvailable, hmacSQL := "FALSE", "NULL::TEXT"
+	if hasSecret {
+		_, err = tx.Exec(createExtensionPgcryptoSQL)
+		if err != nil {
+			return fmt.Errorf("failed to create the pgcrypto extension: %w", err)
+		}
+
+		var pgcryptoSchema string
+		err = tx.QueryRow(selectPgcryptoSchemaSQL).Scan(&pgcryptoSchema)
+		if err != nil {
+			return fmt.Errorf("failed to get the schema of the pgcrypto extension: %w", err)
+		}
+		hashAvailable, hmacSQL = "TRUE", columnHashSQL(pgcryptoSchema)
+	} else {
+		for _, rule := range rules {
+			if rule.Action == ColumnHash {
+				return errColumnHashSecret
+			}
+		}
+	}
+
+	_, err = tx.Exec(createCheckColumnRuleTriggerFuncSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createCheckColumnRuleTriggerSQL)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		_, err = tx.Exec(insertWarpPipeColumnRuleSQL, rule.Schema, rule.Table, rule.Column, string(rule.Action))
+		if err != nil {
+			return fmt.Errorf("failed to add %s rule for column %s.%s.%s: %w", rule.Action, rule.Schema, rule.Table, rule.Column, err)
+		}
+	}
+
+	_, err = tx.Exec(createCompileColumnRulesFuncSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(compileColumnRulesSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createOnColumnRulesModifyTriggerFuncSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createColumnRulesModifyTriggerSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(createApplyColumnRulesFuncSQL, hashAvailable, hmacSQL))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// columnHashSQL returns the expression hashing a column value `v.value` with
+// the HMAC-SHA256 of pgcrypto, installed in the given schema, keyed by
+// `secret`.
+func columnHashSQL(pgcryptoSchema string) string {
+	return fmt.Sprintf(`encode(%s(v.value::TEXT, secret, 'sha256'), 'hex')`, QuoteIdentifier(pgcryptoSchema, "hmac"))
+}
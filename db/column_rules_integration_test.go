@@ -0,0 +1,175 @@
+// +build integration
+
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestColumnRules writes rows to a table with column rules in a transaction
+// which is rolled back, and checks the values and types of their changesets.
+func TestColumnRules(t *testing.T) {
+	conn := getIntegrationTestConn(t)
+	defer conn.Close()
+
+	tx, err := conn.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DROP SCHEMA IF EXISTS warp_pipe CASCADE;
+		DROP TABLE IF EXISTS column_rules_test;
+		CREATE TABLE column_rules_test (
+			id integer PRIMARY KEY,
+			password text,
+			email text,
+			notes text,
+			age integer
+		)`)
+	require.NoError(t, err)
+
+	require.NoError(t, createSchema(tx))
+	require.NoError(t, createChangesetsTable(tx, nil))
+	require.NoError(t, createColumnRulesTable(tx, []ColumnRule{
+		{Schema: "public", Table: "column_rules_test", Column: "password", Action: ColumnHash},
+		{Schema: "public", Table: "column_rules_test", Column: "email", Action: ColumnRedact},
+		{Schema: "public", Table: "column_rules_test", Column: "notes", Action: ColumnExclude},
+	}, "s3cret"))
+	require.NoError(t, createTriggerFunc(tx, false))
+	require.NoError(t, registerTrigger(tx, "public", "column_rules_test"))
+
+	lastChangeset := func() (map[string]interface{}, map[string]string) {
+		var newValues, columnTypes []byte
+		err := tx.QueryRow(`
+			SELECT new_values::TEXT, column_types::TEXT FROM warp_pipe.changesets
+			ORDER BY id DESC LIMIT 1`,
+		).Scan(&newValues, &columnTypes)
+		require.NoError(t, err)
+
+		var values map[string]interface{}
+		var types map[string]string
+		require.NoError(t, json.Unmarshal(newValues, &values))
+		require.NoError(t, json.Unmarshal(columnTypes, &types))
+		return values, types
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO column_rules_test VALUES (1, 'hunter2', 'bob@example.com', 'fragile', 42)`)
+	require.NoError(t, err)
+
+	// the HMAC is keyed by the secret, over the JSON text of the value
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(`"hunter2"`))
+	values, types := lastChangeset()
+	assert.Equal(t, map[string]interface{}{
+		"id":       float64(1),
+		"password": hex.EncodeToString(mac.Sum(nil)),
+		"email":    "[REDACTED]",
+		"age":      float64(42),
+	}, values)
+	assert.Equal(t, "integer", types["age"])
+	assert.Equal(t, "text", types["password"])
+	assert.NotContains(t, types, "notes")
+
+	// changes to the rules apply to the following rows
+	_, err = tx.Exec(`
+		DELETE FROM warp_pipe.column_rules WHERE column_name = 'email';
+		UPDATE warp_pipe.column_rules SET action = 'redact' WHERE column_name = 'notes'`)
+	require.NoError(t, err)
+
+	_, err = tx.Exec(`
+		INSERT INTO column_rules_test VALUES (2, NULL, 'alice@example.com', 'fragile', 7)`)
+	require.NoError(t, err)
+
+	values, types = lastChangeset()
+	assert.Equal(t, map[string]interface{}{
+		"id":       float64(2),
+		"password": nil,
+		"email":    "alice@example.com",
+		"notes":    "[REDACTED]",
+		"age":      float64(7),
+	}, values)
+	assert.Equal(t, "text", types["email"])
+	assert.Equal(t, "text", types["notes"])
+}
+
+// TestColumnRulesSecret checks that the stored secret outlives a Prepare
+// without one, and that hashing without a secret fails instead of losing
+// changesets.
+func TestColumnRulesSecret(t *testing.T) {
+	conn := getIntegrationTestConn(t)
+	defer conn.Close()
+
+	tx, err := conn.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DROP SCHEMA IF EXISTS warp_pipe CASCADE;
+		DROP TABLE IF EXISTS column_rules_test;
+		CREATE TABLE column_rules_test (
+			id integer PRIMARY KEY,
+			password text
+		)`)
+	require.NoError(t, err)
+
+	require.NoError(t, createSchema(tx))
+	require.NoError(t, createChangesetsTable(tx, nil))
+	require.NoError(t, createTriggerFunc(tx, false))
+	require.NoError(t, registerTrigger(tx, "public", "column_rules_test"))
+
+	hashRules := []ColumnRule{
+		{Schema: "public", Table: "column_rules_test", Column: "password", Action: ColumnHash},
+	}
+
+	// hash rules are rejected until a secret is stored
+	_, err = tx.Exec(`SAVEPOINT no_secret`)
+	require.NoError(t, err)
+	assert.Equal(t, errColumnHashSecret, createColumnRulesTable(tx, hashRules, ""))
+	_, err = tx.Exec(`ROLLBACK TO SAVEPOINT no_secret`)
+	require.NoError(t, err)
+
+	require.NoError(t, createColumnRulesTable(tx, hashRules, "s3cret"))
+
+	// preparing again without a secret keeps the stored one
+	require.NoError(t, createColumnRulesTable(tx, nil, ""))
+
+	_, err = tx.Exec(`INSERT INTO column_rules_test VALUES (1, 'hunter2')`)
+	require.NoError(t, err)
+
+	var password string
+	err = tx.QueryRow(`
+		SELECT new_values->>'password' FROM warp_pipe.changesets ORDER BY id DESC LIMIT 1`,
+	).Scan(&password)
+	require.NoError(t, err)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(`"hunter2"`))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), password)
+
+	// without the secret, writes to hashed tables and new hash rules fail
+	_, err = tx.Exec(`
+		SAVEPOINT deleted_secret;
+		DELETE FROM warp_pipe.column_rules_secret`)
+	require.NoError(t, err)
+
+	_, err = tx.Exec(`INSERT INTO column_rules_test VALUES (2, 'hunter3')`)
+	assert.Error(t, err)
+	_, err = tx.Exec(`ROLLBACK TO SAVEPOINT deleted_secret`)
+	require.NoError(t, err)
+
+	_, err = tx.Exec(`DELETE FROM warp_pipe.column_rules_secret`)
+	require.NoError(t, err)
+
+	_, err = tx.Exec(`
+		INSERT INTO warp_pipe.column_rules (schema_name, table_name, column_name, action)
+		VALUES ('public', 'column_rules_test', 'id', 'hash')`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseColumnRule(t *testing.T) {
+	rule, err := ParseColumnRule(ColumnHash, "users.password")
+	assert.NoError(t, err)
+	assert.Equal(t, ColumnRule{Schema: "public", Table: "users", Column: "password", Action: ColumnHash}, rule)
+
+	rule, err = ParseColumnRule(ColumnExclude, "auth.tokens.secret")
+	assert.NoError(t, err)
+	assert.Equal(t, ColumnRule{Schema: "auth", Table: "tokens", Column: "secret", Action: ColumnExclude}, rule)
+
+	for _, column := range []string{"password", "a.b.c.d", "users.", ".users.password"} {
+		_, err = ParseColumnRule(ColumnRedact, column)
+		assert.Error(t, err, column)
+	}
+}
+
+func TestColumnHashSQL(t *testing.T) {
+	assert.Equal(t, `encode("public"."hmac"(v.value::TEXT, secret, 'sha256'), 'hex')`, columnHashSQL("public"))
+
+	sql := fmt.Sprintf(createApplyColumnRulesFuncSQL, "TRUE", columnHashSQL("ext"))
+	assert.Contains(t, sql, "hash_available BOOLEAN := TRUE;")
+	assert.Contains(t, sql, `THEN to_json(encode("ext"."hmac"(v.value::TEXT, secret, 'sha256'), 'hex'))`)
+	assert.NotContains(t, sql, "%!")
+}
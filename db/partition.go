@@ -0,0 +1,292 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+const (
+	partitionNamePrefix = "changesets_p"
+	partitionNameLayout = "20060102"
+)
+
+// PartitionInterval is the time range covered by a single partition of the
+// `warp_pipe.changesets` table.
+type PartitionInterval string
+
+// PartitionInterval constants
+const (
+	PartitionDaily  PartitionInterval = "daily"
+	PartitionWeekly PartitionInterval = "weekly"
+)
+
+// ParsePartitionInterval parses a partition interval from a string.
+func ParsePartitionInterval(interval string) (PartitionInterval, error) {
+	switch strings.ToLower(interval) {
+	case string(PartitionDaily):
+		return PartitionDaily, nil
+	case string(PartitionWeekly):
+		return PartitionWeekly, nil
+	default:
+		return "", fmt.Errorf("'%s' is not a valid partition interval. Must be either `daily` or `weekly`", interval)
+	}
+}
+
+// start returns the start of the partition containing t. Partitions are
+// aligned to UTC days, and weekly partitions start on Monday.
+func (i PartitionInterval) start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if i == PartitionWeekly {
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// next returns the start of the partition following the one starting at t.
+func (i PartitionInterval) next(t time.Time) time.Time {
+	if i == PartitionWeekly {
+		return t.AddDate(0, 0, 7)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// Partitioning represents the partitioning settings of the `warp_pipe.changesets` table.
+type Partitioning struct {
+	// The time range covered by a single partition.
+	Interval PartitionInterval
+	// The number of future partitions kept ahead of the current one.
+	Premake int
+}
+
+func partitionName(start time.Time) string {
+	return partitionNamePrefix + start.Format(partitionNameLayout)
+}
+
+func parsePartitionName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, partitionNamePrefix) {
+		return time.Time{}, false
+	}
+
+	start, err := time.ParseInLocation(partitionNameLayout, strings.TrimPrefix(name, partitionNamePrefix), time.UTC)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+func createPartitionedChangesetsTable(tx *pgx.Tx, partitioning *Partitioning) error {
+	_, err := tx.Exec(createPartitionedTableWarpPipeChangesetsSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createDefaultPartitionWarpPipeChangesetsSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createTableWarpPipePartitioningSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(upsertWarpPipePartitioningSQL, string(partitioning.Interval), partitioning.Premake)
+	if err != nil {
+		return err
+	}
+
+	_, err = createPartitions(tx, partitioning, time.Now())
+	return err
+}
+
+// GetPartitioning returns the partitioning settings of the `warp_pipe.changesets`
+// table, or nil if the table is not partitioned.
+func GetPartitioning(conn *pgx.Conn) (*Partitioning, error) {
+	var exists bool
+	err := conn.QueryRow(`SELECT to_regclass('warp_pipe.changesets_partitioning') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	var interval string
+	var partitioning Partitioning
+	err = conn.QueryRow(`
+		SELECT partition_interval, premake FROM warp_pipe.changesets_partitioning LIMIT 1`,
+	).Scan(&interval, &partitioning.Premake)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	partitioning.Interval, err = ParsePartitionInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &partitioning, nil
+}
+
+type queryExecer interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+	Query(sql string, args ...interface{}) (*pgx.Rows, error)
+	QueryRow(sql string, args ...interface{}) *pgx.Row
+}
+
+// CreatePartitions creates the partition covering now and the configured
+// number of future partitions, skipping any that already exist. It returns the
+// names of the partitions that were created.
+func CreatePartitions(conn *pgx.Conn, partitioning *Partitioning, now time.Time) ([]string, error) {
+	return createPartitions(conn, partitioning, now)
+}
+
+func createPartitions(conn queryExecer, partitioning *Partitioning, now time.Time) ([]string, error) {
+	var created []string
+
+	start := partitioning.Interval.start(now)
+	for i := 0; i <= partitioning.Premake; i++ {
+		end := partitioning.Interval.next(start)
+		name := partitionName(start)
+
+		var exists bool
+		err := conn.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, QuoteIdentifier("warp_pipe", name)).Scan(&exists)
+		if err != nil {
+			return created, fmt.Errorf("failed to check for partition %s: %w", name, err)
+		}
+
+		if !exists {
+			// Rows written while the partition was missing are in the default
+			// partition, which must not overlap the range of a new partition.
+			var hasDefaultRows bool
+			err = conn.QueryRow(selectDefaultPartitionRowsExistSQL, start, end).Scan(&hasDefaultRows)
+			if err != nil {
+				return created, fmt.Errorf("failed to check the default partition for partition %s: %w", name, err)
+			}
+
+			_, err = conn.Exec(createPartitionSQL(name, start, end, hasDefaultRows))
+			if err != nil {
+				return created, fmt.Errorf("failed to create partition %s: %w", name, err)
+			}
+			created = append(created, name)
+		}
+
+		start = end
+	}
+
+	return created, nil
+}
+
+// createPartitionSQL returns the statements creating the partition of
+// `warp_pipe.changesets` for a range. With moveDefaultRows, the partition is
+// created detached, the rows of the range are moved to it from the default
+// partition, and it is then attached. The statements are sent together, so
+// they run in a single transaction.
+func createPartitionSQL(name string, start, end time.Time, moveDefaultRows bool) string {
+	table := QuoteIdentifier("warp_pipe", name)
+	from := QuoteLiteral(start.Format(time.RFC3339))
+	to := QuoteLiteral(end.Format(time.RFC3339))
+
+	if !moveDefaultRows {
+		return fmt.Sprintf(`
+			CREATE TABLE %s
+				PARTITION OF warp_pipe.changesets
+				FOR VALUES FROM (%s) TO (%s)`,
+			table, from, to,
+		)
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE %s (LIKE warp_pipe.changesets INCLUDING DEFAULTS INCLUDING CONSTRAINTS);
+		WITH moved AS (
+			DELETE FROM warp_pipe.changesets_default WHERE ts >= %s AND ts < %s
+			RETURNING *
+		)
+		INSERT INTO %s SELECT * FROM moved;
+		ALTER TABLE warp_pipe.changesets ATTACH PARTITION %s FOR VALUES FROM (%s) TO (%s)`,
+		table,
+		from, to,
+		table,
+		table, from, to,
+	)
+}
+
+// DeleteDefaultPartitionBefore deletes the changesets older than the cutoff
+// from the default partition of the `warp_pipe.changesets` table, which holds
+// the changesets written while their partition was missing. It returns the
+// number of changesets deleted.
+func DeleteDefaultPartitionBefore(conn *pgx.Conn, cutoff time.Time) (int64, error) {
+	return deleteDefaultPartitionBefore(conn, cutoff)
+}
+
+func deleteDefaultPartitionBefore(conn queryExecer, cutoff time.Time) (int64, error) {
+	tag, err := conn.Exec(deleteDefaultPartitionRowsBeforeSQL, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune the default partition: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DropPartitionsBefore drops all partitions of the `warp_pipe.changesets` table
+// whose range ends at or before the cutoff. It returns the names of the
+// partitions that were dropped.
+func DropPartitionsBefore(conn *pgx.Conn, partitioning *Partitioning, cutoff time.Time) ([]string, error) {
+	return dropPartitionsBefore(conn, partitioning, cutoff)
+}
+
+func dropPartitionsBefore(conn queryExecer, partitioning *Partitioning, cutoff time.Time) ([]string, error) {
+	rows, err := conn.Query(`
+		SELECT c.relname
+		FROM pg_catalog.pg_inherits i
+		JOIN pg_catalog.pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'warp_pipe.changesets'::regclass`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		start, ok := parsePartitionName(name)
+		if !ok {
+			continue
+		}
+
+		if !partitioning.Interval.next(start).After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	sort.Strings(expired)
+
+	var dropped []string
+	for _, name := range expired {
+		_, err = conn.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s`, QuoteIdentifier("warp_pipe", name)))
+		if err != nil {
+			return dropped, fmt.Errorf("failed to drop partition %s: %w", name, err)
+		}
+		dropped = append(dropped, name)
+	}
+
+	return dropped, nil
+}
@@ -0,0 +1,94 @@
+// +build integration
+
+package db
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getIntegrationTestConn(t *testing.T) *pgx.Conn {
+	getEnv := func(key, fallback string) string {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return fallback
+	}
+	port, err := strconv.Atoi(getEnv("DB_PORT", "6432"))
+	require.NoError(t, err)
+
+	conn, err := pgx.Connect(pgx.ConnConfig{
+		Host:     getEnv("DB_HOST", "127.0.0.1"),
+		Port:     uint16(port),
+		Database: getEnv("DB_NAME", "test"),
+		User:     getEnv("DB_USER", "test"),
+		Password: getEnv("DB_PASS", "test"),
+	})
+	require.NoError(t, err)
+	return conn
+}
+
+// TestPartitionsDefaultRows prepares a partitioned changesets table in a
+// transaction which is rolled back, and checks that the rows written to the
+// default partition are moved to new partitions, or pruned once expired.
+func TestPartitionsDefaultRows(t *testing.T) {
+	conn := getIntegrationTestConn(t)
+	defer conn.Close()
+
+	tx, err := conn.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DROP SCHEMA IF EXISTS warp_pipe CASCADE`)
+	require.NoError(t, err)
+	require.NoError(t, createSchema(tx))
+
+	partitioning := &Partitioning{Interval: PartitionDaily, Premake: 1}
+	require.NoError(t, createPartitionedChangesetsTable(tx, partitioning))
+
+	// preparing again keeps a single row of settings
+	partitioning.Premake = 3
+	require.NoError(t, createPartitionedChangesetsTable(tx, partitioning))
+	var settings int
+	require.NoError(t, tx.QueryRow(`SELECT COUNT(*) FROM warp_pipe.changesets_partitioning`).Scan(&settings))
+	assert.Equal(t, 1, settings)
+
+	now := time.Now()
+	future := PartitionDaily.start(now).AddDate(0, 0, 10)
+	past := PartitionDaily.start(now).AddDate(0, 0, -10)
+	for _, ts := range []time.Time{past, future.Add(time.Hour)} {
+		_, err = tx.Exec(`
+			INSERT INTO warp_pipe.changesets (ts, action, schema_name, table_name, relid)
+			VALUES ($1, 'INSERT', 'public', 'users', 0)`, ts)
+		require.NoError(t, err)
+	}
+
+	countDefault := func() int {
+		var n int
+		require.NoError(t, tx.QueryRow(`SELECT COUNT(*) FROM warp_pipe.changesets_default`).Scan(&n))
+		return n
+	}
+	require.Equal(t, 2, countDefault())
+
+	// the partition of the future row can be created, and holds the row
+	created, err := createPartitions(tx, &Partitioning{Interval: PartitionDaily, Premake: 10}, now)
+	require.NoError(t, err)
+	assert.Contains(t, created, partitionName(future))
+	assert.Equal(t, 1, countDefault())
+
+	var n int
+	require.NoError(t, tx.QueryRow(`SELECT COUNT(*) FROM `+QuoteIdentifier("warp_pipe", partitionName(future))).Scan(&n))
+	assert.Equal(t, 1, n)
+
+	// the expired row is pruned from the default partition
+	deleted, err := deleteDefaultPartitionBefore(tx, now.AddDate(0, 0, -1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Equal(t, 0, countDefault())
+}
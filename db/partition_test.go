@@ -0,0 +1,69 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionIntervalStart(t *testing.T) {
+	// Wednesday
+	ts := time.Date(2020, 4, 15, 13, 45, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2020, 4, 15, 0, 0, 0, 0, time.UTC), PartitionDaily.start(ts))
+	assert.Equal(t, time.Date(2020, 4, 16, 0, 0, 0, 0, time.UTC), PartitionDaily.next(PartitionDaily.start(ts)))
+	assert.Equal(t, time.Date(2020, 4, 13, 0, 0, 0, 0, time.UTC), PartitionWeekly.start(ts))
+	assert.Equal(t, time.Date(2020, 4, 20, 0, 0, 0, 0, time.UTC), PartitionWeekly.next(PartitionWeekly.start(ts)))
+
+	// Sunday belongs to the week starting on the previous Monday
+	sunday := time.Date(2020, 4, 19, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2020, 4, 13, 0, 0, 0, 0, time.UTC), PartitionWeekly.start(sunday))
+}
+
+func TestPartitionName(t *testing.T) {
+	start := time.Date(2020, 4, 13, 0, 0, 0, 0, time.UTC)
+	name := partitionName(start)
+	assert.Equal(t, "changesets_p20200413", name)
+
+	parsed, ok := parsePartitionName(name)
+	assert.True(t, ok)
+	assert.Equal(t, start, parsed)
+
+	_, ok = parsePartitionName("changesets_default")
+	assert.False(t, ok)
+}
+
+func TestParsePartitionInterval(t *testing.T) {
+	interval, err := ParsePartitionInterval("Daily")
+	assert.NoError(t, err)
+	assert.Equal(t, PartitionDaily, interval)
+
+	interval, err = ParsePartitionInterval("weekly")
+	assert.NoError(t, err)
+	assert.Equal(t, PartitionWeekly, interval)
+
+	_, err = ParsePartitionInterval("monthly")
+	assert.Error(t, err)
+}
+
+func TestCreatePartitionSQL(t *testing.T) {
+	start := time.Date(2020, 4, 13, 0, 0, 0, 0, time.UTC)
+	end := PartitionDaily.next(start)
+
+	sql := createPartitionSQL(partitionName(start), start, end, false)
+	assert.Contains(t, sql, `CREATE TABLE "warp_pipe"."changesets_p20200413"`)
+	assert.Contains(t, sql, `PARTITION OF warp_pipe.changesets`)
+	assert.Contains(t, sql, `FOR VALUES FROM ('2020-04-13T00:00:00Z') TO ('2020-04-14T00:00:00Z')`)
+	assert.NotContains(t, sql, "changesets_default")
+
+	// the rows of the range are moved out of the default partition before the
+	// new partition is attached
+	sql = createPartitionSQL(partitionName(start), start, end, true)
+	create := strings.Index(sql, `CREATE TABLE "warp_pipe"."changesets_p20200413" (LIKE warp_pipe.changesets`)
+	move := strings.Index(sql, `DELETE FROM warp_pipe.changesets_default WHERE ts >= '2020-04-13T00:00:00Z' AND ts < '2020-04-14T00:00:00Z'`)
+	insert := strings.Index(sql, `INSERT INTO "warp_pipe"."changesets_p20200413" SELECT * FROM moved`)
+	attach := strings.Index(sql, `ATTACH PARTITION "warp_pipe"."changesets_p20200413" FOR VALUES FROM ('2020-04-13T00:00:00Z') TO ('2020-04-14T00:00:00Z')`)
+	assert.True(t, create >= 0 && create < move && move < insert && insert < attach, sql)
+}
@@ -0,0 +1,32 @@
+package db
+
+import "strings"
+
+// QuoteIdentifier quotes an identifier for interpolation into SQL, qualified by
+// the names before it: QuoteIdentifier("public", "users") returns
+// "public"."users". Double quotes are escaped by doubling them, and NUL bytes,
+// which Postgres identifiers cannot contain, are removed. Values should be
+// bound as query parameters instead, wherever Postgres allows it.
+func QuoteIdentifier(names ...string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		name = strings.ReplaceAll(name, "\x00", "")
+		quoted[i] = `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, ".")
+}
+
+// QuoteLiteral quotes a string literal for interpolation into SQL, for the
+// statements that cannot take query parameters, such as DDL. Single quotes are
+// escaped by doubling them. Strings with backslashes are written as escape
+// strings (E'...') with their backslashes doubled, so that they are read the
+// same whatever the standard_conforming_strings setting. NUL bytes, which
+// Postgres text cannot contain, are removed.
+func QuoteLiteral(literal string) string {
+	literal = strings.ReplaceAll(literal, "\x00", "")
+	literal = strings.ReplaceAll(literal, `'`, `''`)
+	if strings.Contains(literal, `\`) {
+		return `E'` + strings.ReplaceAll(literal, `\`, `\\`) + `'`
+	}
+	return `'` + literal + `'`
+}
@@ -0,0 +1,42 @@
+// +build go1.18
+
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzQuoteIdentifier(f *testing.F) {
+	f.Add("public", "users")
+	f.Add("Public", `a"b`)
+	f.Add("", `"; DROP TABLE users; --`)
+	f.Add("a.b", "c\x00d")
+
+	f.Fuzz(func(t *testing.T, schema, table string) {
+		names, err := unquoteIdentifier(QuoteIdentifier(schema, table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 2 || names[0] != strings.ReplaceAll(schema, "\x00", "") || names[1] != strings.ReplaceAll(table, "\x00", "") {
+			t.Fatalf("QuoteIdentifier(%q, %q) reads as %q", schema, table, names)
+		}
+	})
+}
+
+func FuzzQuoteLiteral(f *testing.F) {
+	f.Add("users")
+	f.Add(`it's`)
+	f.Add(`\'; DROP TABLE users; --`)
+	f.Add("a\x00b")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		literal, err := unquoteLiteral(QuoteLiteral(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if literal != strings.ReplaceAll(value, "\x00", "") {
+			t.Fatalf("QuoteLiteral(%q) reads as %q", value, literal)
+		}
+	})
+}
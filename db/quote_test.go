@@ -0,0 +1,134 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	testCases := []struct {
+		names    []string
+		expected string
+	}{
+		{[]string{"users"}, `"users"`},
+		{[]string{"public", "users"}, `"public"."users"`},
+		{[]string{"Public", "UserEvents"}, `"Public"."UserEvents"`},
+		{[]string{"order"}, `"order"`},
+		{[]string{`a"b`}, `"a""b"`},
+		{[]string{`"; DROP TABLE users; --`}, `"""; DROP TABLE users; --"`},
+		{[]string{"a.b"}, `"a.b"`},
+		{[]string{"a\x00b"}, `"ab"`},
+		{[]string{""}, `""`},
+	}
+
+	for _, tc := range testCases {
+		quoted := QuoteIdentifier(tc.names...)
+		assert.Equal(t, tc.expected, quoted)
+
+		names, err := unquoteIdentifier(quoted)
+		assert.NoError(t, err)
+		assert.Equal(t, len(tc.names), len(names))
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	testCases := []struct {
+		literal  string
+		expected string
+	}{
+		{"users", `'users'`},
+		{"it's", `'it''s'`},
+		{`'; DROP TABLE users; --`, `'''; DROP TABLE users; --'`},
+		{`C:\temp`, `E'C:\\temp'`},
+		{`\'`, `E'\\'''`},
+		{"a\x00b", `'ab'`},
+		{"", `''`},
+	}
+
+	for _, tc := range testCases {
+		quoted := QuoteLiteral(tc.literal)
+		assert.Equal(t, tc.expected, quoted)
+
+		literal, err := unquoteLiteral(quoted)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.ReplaceAll(tc.literal, "\x00", ""), literal)
+	}
+}
+
+// unquoteIdentifier reads a qualified identifier as Postgres does, and fails if
+// any input remains.
+func unquoteIdentifier(sql string) ([]string, error) {
+	var names []string
+	for i := 0; ; i++ {
+		if i >= len(sql) || sql[i] != '"' {
+			return nil, fmt.Errorf("expected '\"' at %d in %s", i, sql)
+		}
+
+		var name strings.Builder
+		for i++; ; i++ {
+			if i >= len(sql) {
+				return nil, fmt.Errorf("unterminated identifier in %s", sql)
+			}
+			if sql[i] == '"' {
+				if i+1 < len(sql) && sql[i+1] == '"' {
+					name.WriteByte('"')
+					i++
+					continue
+				}
+				break
+			}
+			name.WriteByte(sql[i])
+		}
+		names = append(names, name.String())
+
+		i++
+		if i == len(sql) {
+			return names, nil
+		}
+		if sql[i] != '.' {
+			return nil, fmt.Errorf("unexpected %q at %d in %s", sql[i], i, sql)
+		}
+	}
+}
+
+// unquoteLiteral reads a string literal as Postgres does, and fails if any
+// input remains.
+func unquoteLiteral(sql string) (string, error) {
+	escape := strings.HasPrefix(sql, "E'")
+	i := 1
+	if escape {
+		i = 2
+	} else if !strings.HasPrefix(sql, "'") {
+		return "", fmt.Errorf("expected \"'\" in %s", sql)
+	}
+
+	var literal strings.Builder
+	for ; ; i++ {
+		if i >= len(sql) {
+			return "", fmt.Errorf("unterminated literal in %s", sql)
+		}
+		switch {
+		case sql[i] == '\'' && i+1 < len(sql) && sql[i+1] == '\'':
+			literal.WriteByte('\'')
+			i++
+		case sql[i] == '\'':
+			if i+1 != len(sql) {
+				return "", fmt.Errorf("unexpected %q at %d in %s", sql[i+1], i+1, sql)
+			}
+			return literal.String(), nil
+		case escape && sql[i] == '\\':
+			if i+1 >= len(sql) || sql[i+1] != '\\' {
+				return "", fmt.Errorf("unexpected escape at %d in %s", i, sql)
+			}
+			literal.WriteByte('\\')
+			i++
+		case sql[i] == 0:
+			return "", fmt.Errorf("unexpected NUL at %d in %s", i, sql)
+		default:
+			literal.WriteByte(sql[i])
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+// ReplicaIdentity is the replica identity of a table, which sets the columns
+// of the old values of updates and deletes written to the WAL, as read by
+// logical replication.
+type ReplicaIdentity string
+
+// ReplicaIdentity constants
+const (
+	// The columns of the primary key, if any. This is the Postgres default.
+	ReplicaIdentityDefault ReplicaIdentity = "default"
+	// All the columns of the table.
+	ReplicaIdentityFull ReplicaIdentity = "full"
+	// The columns of the primary key, or of a unique index on non-null columns
+	// for tables without a primary key. Tables with neither use all columns.
+	ReplicaIdentityIndex ReplicaIdentity = "index"
+)
+
+// ParseReplicaIdentity parses a replica identity from a string.
+func ParseReplicaIdentity(identity string) (ReplicaIdentity, error) {
+	switch ReplicaIdentity(strings.ToLower(identity)) {
+	case ReplicaIdentityDefault:
+		return ReplicaIdentityDefault, nil
+	case ReplicaIdentityFull:
+		return ReplicaIdentityFull, nil
+	case ReplicaIdentityIndex:
+		return ReplicaIdentityIndex, nil
+	default:
+		return "", fmt.Errorf("'%s' is not a valid replica identity. Must be one of `default`, `full` or `index`", identity)
+	}
+}
+
+// SetReplicaIdentity is an option for setting the replica identity of the
+// registered tables, for logical replication.
+func SetReplicaIdentity(identity ReplicaIdentity) PrepareOption {
+	return func(o *prepareOptions) {
+		o.replicaIdentity = identity
+	}
+}
+
+// replicaIdentitySQL returns the statement setting the replica identity of a
+// table.
+func replicaIdentitySQL(table *Table, identity ReplicaIdentity) string {
+	name := QuoteIdentifier(table.Schema, table.Name)
+
+	switch identity {
+	case ReplicaIdentityFull:
+		return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL", name)
+	case ReplicaIdentityIndex:
+		if len(table.PKeyFields) > 0 {
+			return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY DEFAULT", name)
+		}
+		if table.UniqueIndexName != "" {
+			return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY USING INDEX %s", name, QuoteIdentifier(table.UniqueIndexName))
+		}
+		return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL", name)
+	default:
+		return fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY DEFAULT", name)
+	}
+}
+
+func setReplicaIdentity(tx *pgx.Tx, table *Table, identity ReplicaIdentity) error {
+	_, err := tx.Exec(replicaIdentitySQL(table, identity))
+	return err
+}
+
+// getUniqueIndex sets the unique index of a table without a primary key that
+// can identify its rows: the first unique, immediate index of non-null
+// columns, without expressions or predicate.
+func getUniqueIndex(conn *pgx.Conn, table *Table) error {
+	rows, err := conn.Query(`
+		SELECT
+			i.relname AS index_name,
+			array_agg(a.attname::text ORDER BY k.position) AS index_columns
+		FROM pg_index x
+			JOIN pg_class i ON i.oid = x.indexrelid
+			JOIN LATERAL unnest(x.indkey::int2[]) WITH ORDINALITY AS k(attnum, position) ON true
+			JOIN pg_attribute a ON a.attrelid = x.indrelid AND a.attnum = k.attnum
+		WHERE x.indrelid = $1::regclass
+			AND x.indisunique
+			AND NOT x.indisprimary
+			AND x.indimmediate
+			AND x.indpred IS NULL
+			AND x.indexprs IS NULL
+		GROUP BY i.relname
+		HAVING bool_and(a.attnotnull)
+		ORDER BY i.relname
+		LIMIT 1`,
+		QuoteIdentifier(table.Schema, table.Name),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = rows.Scan(&table.UniqueIndexName, &table.UniqueIndexFields)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
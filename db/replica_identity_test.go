@@ -0,0 +1,38 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReplicaIdentity(t *testing.T) {
+	identity, err := ParseReplicaIdentity("FULL")
+	assert.NoError(t, err)
+	assert.Equal(t, ReplicaIdentityFull, identity)
+
+	_, err = ParseReplicaIdentity("nothing")
+	assert.Error(t, err)
+}
+
+func TestReplicaIdentitySQL(t *testing.T) {
+	withPK := &Table{Schema: "public", Name: "users", PKeyFields: map[int]string{1: "id"}}
+	withIndex := &Table{Schema: "public", Name: "events", UniqueIndexName: "events_uuid_key", UniqueIndexFields: []string{"uuid"}}
+	keyless := &Table{Schema: "public", Name: "logs"}
+
+	testCases := []struct {
+		table    *Table
+		identity ReplicaIdentity
+		expected string
+	}{
+		{withPK, ReplicaIdentityFull, `ALTER TABLE "public"."users" REPLICA IDENTITY FULL`},
+		{withPK, ReplicaIdentityIndex, `ALTER TABLE "public"."users" REPLICA IDENTITY DEFAULT`},
+		{withIndex, ReplicaIdentityIndex, `ALTER TABLE "public"."events" REPLICA IDENTITY USING INDEX "events_uuid_key"`},
+		{keyless, ReplicaIdentityIndex, `ALTER TABLE "public"."logs" REPLICA IDENTITY FULL`},
+		{keyless, ReplicaIdentityDefault, `ALTER TABLE "public"."logs" REPLICA IDENTITY DEFAULT`},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, replicaIdentitySQL(tc.table, tc.identity))
+	}
+}
@@ -14,6 +14,10 @@ type Table struct {
 	Schema     string
 	PKeyName   string
 	PKeyFields map[int]string
+	// UniqueIndexName and UniqueIndexFields are the name and columns of a
+	// unique index of non-null columns, for tables without a primary key.
+	UniqueIndexName   string
+	UniqueIndexFields []string
 }
 
 var (
@@ -21,13 +25,66 @@ var (
 	errDuplicateSchema     = errors.New("`warp_pipe` schema already exists")
 	errCreateTable         = errors.New("error creating `warp_pipe.changesets` table")
 	errDuplicateTable      = errors.New("`warp_pipe.changesets` table already exists")
+	errCreateConsumers     = errors.New("error creating `warp_pipe.consumers` table")
+	errCreateColumnRules   = errors.New("error creating `warp_pipe.column_rules` table")
+	errColumnHashSecret    = errors.New("hashed columns require a secret")
 	errCreateTriggerFunc   = errors.New("error creating `on_modify` trigger function")
 	errRegisterTrigger     = errors.New("error registering `on_modify` trigger on table")
+	errReplicaIdentity     = errors.New("error setting the replica identity of table")
 	errTransactionBegin    = errors.New("error starting new transaction")
 	errTransactionCommit   = errors.New("error committing transaction")
 	errTransactionRollback = errors.New("error rolling back transaction")
 )
 
+// PrepareOption is a Prepare option function.
+type PrepareOption func(*prepareOptions)
+
+type prepareOptions struct {
+	partitioning       *Partitioning
+	fullNotifyPayloads bool
+	columnRules        []ColumnRule
+	columnHashSecret   string
+	replicaIdentity    ReplicaIdentity
+}
+
+// PartitionBy is an option for creating the `warp_pipe.changesets` table as a
+// table partitioned by changeset timestamp, keeping premake future partitions
+// ahead of the current one. Requires Postgres >= 11.
+func PartitionBy(interval PartitionInterval, premake int) PrepareOption {
+	return func(o *prepareOptions) {
+		o.partitioning = &Partitioning{Interval: interval, Premake: premake}
+	}
+}
+
+// FullNotifyPayloads is an option for sending the full changeset in the payload
+// of each notification, so that listeners don't need to read it back from the
+// `warp_pipe.changesets` table. Changesets that don't fit in a notification
+// are sent as an ID only.
+func FullNotifyPayloads() PrepareOption {
+	return func(o *prepareOptions) {
+		o.fullNotifyPayloads = true
+	}
+}
+
+// ColumnRules is an option for adding rules that exclude, hash or redact the
+// values of columns before changesets are written. Rules can later be changed
+// in the `warp_pipe.column_rules` table.
+func ColumnRules(rules ...ColumnRule) PrepareOption {
+	return func(o *prepareOptions) {
+		o.columnRules = append(o.columnRules, rules...)
+	}
+}
+
+// ColumnHashSecret is an option for setting the secret key of the HMAC-SHA256
+// that replaces the values of hashed columns. It is stored in the
+// `warp_pipe.column_rules_secret` table, and requires the pgcrypto extension,
+// which is created if missing. Hash rules cannot be added without it.
+func ColumnHashSecret(secret string) PrepareOption {
+	return func(o *prepareOptions) {
+		o.columnHashSecret = secret
+	}
+}
+
 // Teardown removes the `warp_pipe` schema and all associated tables and functions.
 func Teardown(conn *pgx.Conn) error {
 	_, err := conn.Exec("DROP SCHEMA warp_pipe CASCADE")
@@ -41,10 +98,18 @@ func Teardown(conn *pgx.Conn) error {
 // Prepare prepares the database for capturing changesets.
 // This will setup:
 //     - new `warp_pipe` schema
-//     - new `changesets` table in the `warp_pipe` schema
+//     - new `changesets` table in the `warp_pipe` schema, optionally partitioned by timestamp
+//     - new `consumers` table in the `warp_pipe` schema, for tracking acknowledged changesets
+//     - new `column_rules` table in the `warp_pipe` schema, for excluding, hashing or redacting columns
 //     - new TRIGGER function to be fired AFTER an INSERT, UPDATE, or DELETE on a table
 //     - registers the trigger with all configured tables in the source schema
-func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []string) error {
+//     - optionally sets the replica identity of the configured tables
+func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []string, opts ...PrepareOption) error {
+	var options prepareOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	tx, err := conn.Begin()
 	if err != nil {
 		return errTransactionBegin
@@ -63,7 +128,7 @@ func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []st
 		return errCreateSchema
 	}
 
-	err = createChangesetsTable(tx)
+	err = createChangesetsTable(tx, options.partitioning)
 	if err != nil {
 		// https://www.postgresql.org/docs/10/errcodes-appendix.html
 		pgErr, ok := err.(pgx.PgError)
@@ -73,7 +138,21 @@ func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []st
 		return errCreateTable
 	}
 
-	err = createTriggerFunc(tx)
+	err = createConsumersTable(tx)
+	if err != nil {
+		return errCreateConsumers
+	}
+
+	err = createColumnRulesTable(tx, options.columnRules, options.columnHashSecret)
+	if err != nil {
+		if errors.Is(err, errColumnHashSecret) {
+			return errColumnHashSecret
+		}
+		log.WithError(err).Error(errCreateColumnRules.Error())
+		return errCreateColumnRules
+	}
+
+	err = createTriggerFunc(tx, options.fullNotifyPayloads)
 	if err != nil {
 		return errCreateTriggerFunc
 	}
@@ -85,7 +164,7 @@ func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []st
 
 	for _, table := range registerTables {
 		if len(table.PKeyFields) == 0 {
-			return fmt.Errorf(`table "%s"."%s" has no primary key.`, table.Schema, table.Name)
+			log.Warnf(`table "%s"."%s" has no primary key, its rows are matched by unique index or by all their values`, table.Schema, table.Name)
 		}
 		err = registerTrigger(tx, table.Schema, table.Name)
 		if err != nil {
@@ -95,6 +174,14 @@ func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []st
 			}
 			return errRegisterTrigger
 		}
+
+		if options.replicaIdentity != "" {
+			err = setReplicaIdentity(tx, &table, options.replicaIdentity)
+			if err != nil {
+				log.WithError(err).Error(errReplicaIdentity.Error())
+				return errReplicaIdentity
+			}
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -124,8 +211,23 @@ func createSchema(tx *pgx.Tx) error {
 	return nil
 }
 
-func createChangesetsTable(tx *pgx.Tx) error {
-	_, err := tx.Exec(createTableWarpPipeChangesetsSQL)
+func createChangesetsTable(tx *pgx.Tx, partitioning *Partitioning) error {
+	var err error
+	if partitioning != nil {
+		err = createPartitionedChangesetsTable(tx, partitioning)
+	} else {
+		_, err = tx.Exec(createTableWarpPipeChangesetsSQL)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(addColumnTypesToWarpPipeChangesetsSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(addTxIDToWarpPipeChangesetsSQL)
 	if err != nil {
 		return err
 	}
@@ -135,11 +237,21 @@ func createChangesetsTable(tx *pgx.Tx) error {
 		return err
 	}
 
+	_, err = tx.Exec(dropIndexChangesetsTimestampSQL)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec(createIndexChangesetsTimestampSQL)
 	if err != nil {
 		return err
 	}
 
+	_, err = tx.Exec(createIndexChangesetsTxIDSQL)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec(createIndexChangesetsActionSQL)
 	if err != nil {
 		return err
@@ -153,8 +265,37 @@ func createChangesetsTable(tx *pgx.Tx) error {
 	return nil
 }
 
-func createTriggerFunc(tx *pgx.Tx) error {
-	_, err := tx.Exec(createOnModifyTriggerFuncSQL)
+func createConsumersTable(tx *pgx.Tx) error {
+	_, err := tx.Exec(createTableWarpPipeConsumersSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(revokeAllOnWarpPipeConsumersSQL)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func createTriggerFunc(tx *pgx.Tx, fullNotifyPayloads bool) error {
+	notifyFuncSQL := createNotifyChangesetIDFuncSQL
+	if fullNotifyPayloads {
+		notifyFuncSQL = createNotifyChangesetFullFuncSQL
+	}
+
+	_, err := tx.Exec(dropLegacyNotifyChangesetFuncSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(notifyFuncSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(createOnModifyTriggerFuncSQL)
 
 	return err
 }
@@ -256,33 +397,44 @@ func getTableDetails(conn *pgx.Conn, name string) (*Table, error) {
 		table.PKeyName = constraintName
 		table.PKeyFields[position] = column
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(table.PKeyFields) == 0 {
+		err = getUniqueIndex(conn, &table)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &table, nil
 }
 
 func registerTrigger(tx *pgx.Tx, schema string, table string) error {
 	// trigger name is <schema>__<table>_changesets
 	triggerName := fmt.Sprintf("%s__%s_changesets", schema, table)
+
+	var exists bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(
+			SELECT * FROM information_schema.triggers
+			WHERE trigger_name = $1
+			AND event_object_schema = $2
+			AND event_object_table = $3
+		)`, triggerName, schema, table).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
 	sql := fmt.Sprintf(`
-		DO  
-		$$  
-		BEGIN  
-			IF NOT EXISTS(
-				SELECT * FROM(
-					SELECT trigger_name AS name, concat_ws('.', event_object_schema, event_object_table) AS table 
-					FROM information_schema.triggers
-				) AS triggers
-				WHERE triggers.name = '%s'
-				AND triggers.table = '%s.%s'  
-			)  
-			THEN
-				CREATE TRIGGER "%s"
-				AFTER INSERT OR UPDATE OR DELETE
-				ON "%s"."%s"
-				FOR EACH ROW EXECUTE PROCEDURE warp_pipe.on_modify();
-			END IF ;
-		END;  
-		$$`, triggerName, schema, table, triggerName, schema, table)
-	_, err := tx.Exec(sql)
+		CREATE TRIGGER %s
+		AFTER INSERT OR UPDATE OR DELETE
+		ON %s
+		FOR EACH ROW EXECUTE PROCEDURE warp_pipe.on_modify()`,
+		QuoteIdentifier(triggerName),
+		QuoteIdentifier(schema, table),
+	)
+	_, err = tx.Exec(sql)
 
 	return err
 }
@@ -20,14 +20,86 @@ const (
 			table_name TEXT NOT NULL,
 			relid OID NOT NULL,
 			new_values JSON,
-			old_values JSON
+			old_values JSON,
+			txid BIGINT DEFAULT txid_current() NOT NULL,
+			column_types JSON
 		)`
 
+	// Create the warp_pipe.changesets table as a table partitioned by range on
+	// ts. The primary key of a partitioned table must include the partition key.
+	createPartitionedTableWarpPipeChangesetsSQL = `
+		CREATE TABLE IF NOT EXISTS warp_pipe.changesets (
+			id BIGSERIAL NOT NULL,
+			ts TIMESTAMPTZ DEFAULT NOW() NOT NULL,
+			action TEXT NOT NULL CHECK (action IN ('INSERT', 'UPDATE', 'DELETE')),
+			schema_name TEXT NOT NULL,
+			table_name TEXT NOT NULL,
+			relid OID NOT NULL,
+			new_values JSON,
+			old_values JSON,
+			txid BIGINT DEFAULT txid_current() NOT NULL,
+			column_types JSON,
+			PRIMARY KEY (id, ts)
+		) PARTITION BY RANGE (ts)`
+
+	// Create the default partition of warp_pipe.changesets, catching any rows
+	// outside of the range of the created partitions
+	createDefaultPartitionWarpPipeChangesetsSQL = `
+		CREATE TABLE IF NOT EXISTS warp_pipe.changesets_default
+			PARTITION OF warp_pipe.changesets DEFAULT`
+
+	// Create the warp_pipe.changesets_partitioning table, which stores the
+	// partitioning settings of warp_pipe.changesets
+	createTableWarpPipePartitioningSQL = `
+		CREATE TABLE IF NOT EXISTS warp_pipe.changesets_partitioning (
+			partition_interval TEXT NOT NULL CHECK (partition_interval IN ('daily', 'weekly')),
+			premake INTEGER NOT NULL
+		)`
+
+	// Store the partitioning settings of warp_pipe.changesets, in a single row
+	upsertWarpPipePartitioningSQL = `
+		WITH updated AS (
+			UPDATE warp_pipe.changesets_partitioning
+			SET partition_interval = CAST($1 AS TEXT), premake = CAST($2 AS INTEGER)
+			RETURNING *
+		)
+		INSERT INTO warp_pipe.changesets_partitioning (partition_interval, premake)
+		SELECT CAST($1 AS TEXT), CAST($2 AS INTEGER) WHERE NOT EXISTS (SELECT * FROM updated)`
+
+	// Check the default partition of warp_pipe.changesets for rows in a range
+	selectDefaultPartitionRowsExistSQL = `
+		SELECT EXISTS(
+			SELECT * FROM warp_pipe.changesets_default WHERE ts >= $1 AND ts < $2
+		)`
+
+	// Delete the expired rows of the default partition of warp_pipe.changesets
+	deleteDefaultPartitionRowsBeforeSQL = `
+		DELETE FROM warp_pipe.changesets_default WHERE ts < $1`
+
+	// Add the column_types column to a warp_pipe.changesets table created
+	// before column types were recorded
+	addColumnTypesToWarpPipeChangesetsSQL = `
+		ALTER TABLE warp_pipe.changesets ADD COLUMN IF NOT EXISTS column_types JSON`
+
+	// Add the txid column to a warp_pipe.changesets table created before
+	// transaction IDs were recorded. The default only applies to new rows, so
+	// the existing rows are not rewritten.
+	addTxIDToWarpPipeChangesetsSQL = `
+		ALTER TABLE warp_pipe.changesets
+			ADD COLUMN IF NOT EXISTS txid BIGINT,
+			ALTER COLUMN txid SET DEFAULT txid_current()`
+
 	// Revoke all privileges from public on warp_pipe.changesets
 	revokeAllOnWarpPipeChangesetsSQL = `REVOKE ALL ON warp_pipe.changesets FROM public`
 
-	// Create an index for warp_pipe.changesets(ts)
-	createIndexChangesetsTimestampSQL = `CREATE INDEX IF NOT EXISTS changesets_ts_idx ON warp_pipe.changesets (ts)`
+	// Drop the former index for warp_pipe.changesets(ts), superseded by changesets_ts_id_idx
+	dropIndexChangesetsTimestampSQL = `DROP INDEX IF EXISTS warp_pipe.changesets_ts_idx`
+
+	// Create an index for warp_pipe.changesets(ts, id), used for keyset pagination by timestamp
+	createIndexChangesetsTimestampSQL = `CREATE INDEX IF NOT EXISTS changesets_ts_id_idx ON warp_pipe.changesets (ts, id)`
+
+	// Create an index for warp_pipe.changesets(txid), used for finding changesets by committing transaction
+	createIndexChangesetsTxIDSQL = `CREATE INDEX IF NOT EXISTS changesets_txid_idx ON warp_pipe.changesets (txid)`
 
 	// Create an index for warp_pipe.changesets(action)
 	createIndexChangesetsActionSQL = `CREATE INDEX IF NOT EXISTS changesets_action_idx ON warp_pipe.changesets (action)`
@@ -38,82 +110,348 @@ const (
 	// Create an index for warp_pipe.changesets(table_name)
 	createIndexChangesetsTableNameSQL = `CREATE INDEX IF NOT EXISTS changesets_table_name_idx ON warp_pipe.changesets (table_name)`
 
+	// Create the warp_pipe.consumers table, which tracks the last changeset
+	// acknowledged by each registered consumer
+	createTableWarpPipeConsumersSQL = `
+		CREATE TABLE IF NOT EXISTS warp_pipe.consumers (
+			name TEXT PRIMARY KEY,
+			last_acked_id BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMPTZ DEFAULT NOW() NOT NULL
+		)`
+
+	// Revoke all privileges from public on warp_pipe.consumers
+	revokeAllOnWarpPipeConsumersSQL = `REVOKE ALL ON warp_pipe.consumers FROM public`
+
+	// Create the warp_pipe.column_rules table, which lists the columns that are
+	// excluded, hashed or redacted before a changeset is written
+	createTableWarpPipeColumnRulesSQL = `
+		CREATE TABLE IF NOT EXISTS warp_pipe.column_rules (
+			schema_name TEXT NOT NULL,
+			table_name TEXT NOT NULL,
+			column_name TEXT NOT NULL,
+			action TEXT NOT NULL CHECK (action IN ('exclude', 'hash', 'redact')),
+			PRIMARY KEY (schema_name, table_name, column_name)
+		)`
+
+	// Revoke all privileges from public on warp_pipe.column_rules
+	revokeAllOnWarpPipeColumnRulesSQL = `REVOKE ALL ON warp_pipe.column_rules FROM public`
+
+	// Add a rule to warp_pipe.column_rules
+	insertWarpPipeColumnRuleSQL = `
+		INSERT INTO warp_pipe.column_rules (schema_name, table_name, column_name, action) VALUES ($1, $2, $3, $4)`
+
+	// Create the warp_pipe.column_rules_secret table, which holds the secret key
+	// of the HMAC of hashed columns
+	createTableWarpPipeColumnRulesSecretSQL = `
+		CREATE TABLE IF NOT EXISTS warp_pipe.column_rules_secret (
+			secret TEXT NOT NULL
+		)`
+
+	// Revoke all privileges from public on warp_pipe.column_rules_secret
+	revokeAllOnWarpPipeColumnRulesSecretSQL = `REVOKE ALL ON warp_pipe.column_rules_secret FROM public`
+
+	// Store the secret key of the HMAC of hashed columns, in a single row
+	upsertWarpPipeColumnRulesSecretSQL = `
+		WITH updated AS (
+			UPDATE warp_pipe.column_rules_secret SET secret = CAST($1 AS TEXT)
+			RETURNING *
+		)
+		INSERT INTO warp_pipe.column_rules_secret (secret)
+		SELECT CAST($1 AS TEXT) WHERE NOT EXISTS (SELECT * FROM updated)`
+
+	// Check for a stored secret key of the HMAC of hashed columns
+	selectColumnRulesSecretExistsSQL = `SELECT EXISTS(SELECT * FROM warp_pipe.column_rules_secret)`
+
+	// Create the pgcrypto extension, which provides hmac()
+	createExtensionPgcryptoSQL = `CREATE EXTENSION IF NOT EXISTS pgcrypto`
+
+	// Select the schema of the pgcrypto extension
+	selectPgcryptoSchemaSQL = `
+		SELECT n.nspname FROM pg_extension e
+		JOIN pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname = 'pgcrypto'`
+
+	// Create warp_pipe.compile_column_rules() function, which (re)creates the
+	// warp_pipe.column_rules() function returning the rules of
+	// warp_pipe.column_rules as a constant, in the form
+	// {schema: {table: {column: action}}}. The trigger then reads the rules
+	// without querying warp_pipe.column_rules for every row.
+	createCompileColumnRulesFuncSQL = `
+		CREATE OR REPLACE FUNCTION warp_pipe.compile_column_rules()
+			RETURNS VOID AS $$
+				DECLARE
+					rules JSONB;
+				BEGIN
+					SELECT COALESCE(jsonb_object_agg(s.schema_name, s.tables), '{}'::JSONB) INTO rules
+					FROM (
+						SELECT t.schema_name, jsonb_object_agg(t.table_name, t.columns) AS tables
+						FROM (
+							SELECT r.schema_name, r.table_name, jsonb_object_agg(r.column_name, r.action) AS columns
+							FROM warp_pipe.column_rules r
+							GROUP BY r.schema_name, r.table_name
+						) t
+						GROUP BY t.schema_name
+					) s;
+
+					EXECUTE format(
+						'CREATE OR REPLACE FUNCTION warp_pipe.column_rules() RETURNS JSONB AS %L LANGUAGE sql IMMUTABLE',
+						format('SELECT %L::JSONB', rules)
+					);
+				END;
+			$$ LANGUAGE plpgsql`
+
+	// Create warp_pipe.on_column_rules_modify() trigger function, which
+	// recompiles the rules when warp_pipe.column_rules is changed
+	createOnColumnRulesModifyTriggerFuncSQL = `
+		CREATE OR REPLACE FUNCTION warp_pipe.on_column_rules_modify()
+			RETURNS TRIGGER AS $$
+				BEGIN
+					PERFORM warp_pipe.compile_column_rules();
+					RETURN NULL;
+				END;
+			$$ LANGUAGE plpgsql`
+
+	// Create warp_pipe.check_column_rule() trigger function, which rejects hash
+	// rules while there is no secret to key their HMAC
+	createCheckColumnRuleTriggerFuncSQL = `
+		CREATE OR REPLACE FUNCTION warp_pipe.check_column_rule()
+			RETURNS TRIGGER AS $$
+				BEGIN
+					IF NEW.action = 'hash' AND NOT EXISTS (SELECT * FROM warp_pipe.column_rules_secret) THEN
+						RAISE EXCEPTION 'hash rule for column %.%.% requires a secret in warp_pipe.column_rules_secret',
+							NEW.schema_name, NEW.table_name, NEW.column_name
+							USING ERRCODE = 'WP001';
+					END IF;
+					RETURN NEW;
+				END;
+			$$ LANGUAGE plpgsql`
+
+	// Register warp_pipe.check_column_rule() on warp_pipe.column_rules
+	createCheckColumnRuleTriggerSQL = `
+		DROP TRIGGER IF EXISTS column_rules_check ON warp_pipe.column_rules;
+		CREATE TRIGGER column_rules_check
+		BEFORE INSERT OR UPDATE
+		ON warp_pipe.column_rules
+		FOR EACH ROW EXECUTE PROCEDURE warp_pipe.check_column_rule()`
+
+	// Register warp_pipe.on_column_rules_modify() on warp_pipe.column_rules
+	createColumnRulesModifyTriggerSQL = `
+		DROP TRIGGER IF EXISTS column_rules_modify ON warp_pipe.column_rules;
+		CREATE TRIGGER column_rules_modify
+		AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE
+		ON warp_pipe.column_rules
+		FOR EACH STATEMENT EXECUTE PROCEDURE warp_pipe.on_column_rules_modify()`
+
+	// Compile the rules of warp_pipe.column_rules
+	compileColumnRulesSQL = `SELECT warp_pipe.compile_column_rules()`
+
+	// Create warp_pipe.apply_column_rules() function, which applies the rules of
+	// a table, as {column: action}, to the values of a row. Hashed values are
+	// replaced by the hex encoded HMAC-SHA256 of their JSON text, keyed by the
+	// secret of warp_pipe.column_rules_secret. Whether the HMAC is available,
+	// and its expression, are formatted in, as the schema of pgcrypto is only
+	// known once it is installed. Hashing without a secret raises the WP001
+	// error, which warp_pipe.on_modify() lets through, failing the write
+	// rather than recording the changeset without the column or not at all.
+	createApplyColumnRulesFuncSQL = `
+		CREATE OR REPLACE FUNCTION warp_pipe.apply_column_rules(
+			rules JSONB,
+			row_values JSON
+		)
+			RETURNS JSON AS $$
+				DECLARE
+					result JSON;
+					secret TEXT;
+					hash_available BOOLEAN := %s;
+				BEGIN
+					IF row_values IS NULL OR rules = '{}'::JSONB THEN
+						RETURN row_values;
+					END IF;
+
+					IF EXISTS (SELECT * FROM jsonb_each_text(rules) r WHERE r.value = 'hash') THEN
+						SELECT s.secret INTO secret FROM warp_pipe.column_rules_secret s;
+						IF secret IS NULL OR NOT hash_available THEN
+							RAISE EXCEPTION 'warp_pipe.apply_column_rules() cannot hash columns without a secret, set by setup-db --hash-secret'
+								USING ERRCODE = 'WP001';
+						END IF;
+					END IF;
+
+					SELECT json_object_agg(
+						v.key,
+						CASE
+							WHEN json_typeof(v.value) = 'null' THEN v.value
+							WHEN rules ->> v.key = 'hash' THEN to_json(%s)
+							WHEN rules ->> v.key = 'redact' THEN to_json('[REDACTED]'::TEXT)
+							ELSE v.value
+						END
+						ORDER BY v.ordinality
+					) INTO result
+					FROM json_each(row_values) WITH ORDINALITY AS v(key, value, ordinality)
+					WHERE (rules ->> v.key) IS DISTINCT FROM 'exclude';
+
+					RETURN COALESCE(result, '{}'::JSON);
+				END;
+			$$ LANGUAGE plpgsql STABLE`
+
+	// Drop the warp_pipe.notify_changeset() function created before column
+	// types were recorded, which took no column types
+	dropLegacyNotifyChangesetFuncSQL = `
+		DROP FUNCTION IF EXISTS warp_pipe.notify_changeset(BIGINT, TIMESTAMPTZ, TEXT, TEXT, TEXT, OID, JSON, JSON)`
+
+	// Create warp_pipe.notify_changeset() function, which notifies listeners of
+	// a new changeset with a payload of <id>_<timestamp>
+	createNotifyChangesetIDFuncSQL = `
+		CREATE OR REPLACE FUNCTION warp_pipe.notify_changeset(
+			id BIGINT,
+			ts TIMESTAMPTZ,
+			action TEXT,
+			schema_name TEXT,
+			table_name TEXT,
+			relid OID,
+			new_values JSON,
+			old_values JSON,
+			column_types JSON
+		)
+			RETURNS VOID AS $$
+				BEGIN
+					PERFORM pg_notify('warp_pipe_new_changeset', id::TEXT || '_' || ts::TEXT);
+				END;
+			$$ LANGUAGE plpgsql`
+
+	// Create warp_pipe.notify_changeset() function, which notifies listeners of
+	// a new changeset with the full changeset as a JSON payload. Changesets that
+	// exceed the 8000 byte payload limit of pg_notify() fall back to a payload
+	// of <id>_<timestamp>.
+	createNotifyChangesetFullFuncSQL = `
+		CREATE OR REPLACE FUNCTION warp_pipe.notify_changeset(
+			id BIGINT,
+			ts TIMESTAMPTZ,
+			action TEXT,
+			schema_name TEXT,
+			table_name TEXT,
+			relid OID,
+			new_values JSON,
+			old_values JSON,
+			column_types JSON
+		)
+			RETURNS VOID AS $$
+				DECLARE
+					payload TEXT;
+				BEGIN
+					payload := json_build_object(
+						'id', id,
+						'ts', ts,
+						'action', action,
+						'schema_name', schema_name,
+						'table_name', table_name,
+						'relid', relid,
+						'new_values', new_values,
+						'old_values', old_values,
+						'txid', txid_current(),
+						'column_types', column_types
+					)::TEXT;
+
+					IF octet_length(payload) >= 8000 THEN
+						payload := id::TEXT || '_' || ts::TEXT;
+					END IF;
+
+					PERFORM pg_notify('warp_pipe_new_changeset', payload);
+				END;
+			$$ LANGUAGE plpgsql`
+
 	// Create warp_pipe.on_modify() trigger function
 	createOnModifyTriggerFuncSQL = `
 		CREATE OR REPLACE FUNCTION warp_pipe.on_modify()
 			RETURNS TRIGGER AS $$
+				DECLARE
+					changeset_id BIGINT;
+					changeset_new_values JSON;
+					changeset_old_values JSON;
+					changeset_column_types JSON;
+					changeset_column_rules JSONB;
 				BEGIN
 					IF TG_WHEN <> 'AFTER' THEN
 						RAISE EXCEPTION 'warp_pipe.on_modify() may only run as an AFTER trigger';
 					END IF;
 
 					IF (TG_OP = 'UPDATE') THEN
-						INSERT INTO warp_pipe.changesets(
-							id,
-							ts,
-							action,
-							schema_name,
-							table_name,
-							relid,
-							new_values,
-							old_values
-						) VALUES (
-							nextval('warp_pipe.changesets_id_seq'),
-							current_timestamp,
-							TG_OP::TEXT,
-							TG_TABLE_SCHEMA::TEXT,
-							TG_TABLE_NAME::TEXT,
-							TG_RELID,
-							row_to_json(NEW, true),
-							row_to_json(OLD, true)
-						);
-						PERFORM pg_notify('warp_pipe_new_changeset', currval('warp_pipe.changesets_id_seq')::TEXT || '_' || current_timestamp::TEXT);
-						RETURN NEW;
+						changeset_new_values := row_to_json(NEW, true);
+						changeset_old_values := row_to_json(OLD, true);
 					ELSIF (TG_OP = 'DELETE') THEN
-						INSERT INTO warp_pipe.changesets(
-							id,
-							ts,
-							action,
-							schema_name,
-							table_name,
-							relid,
-							old_values
-						) VALUES (
-							nextval('warp_pipe.changesets_id_seq'),
-							current_timestamp,
-							TG_OP::TEXT,
-							TG_TABLE_SCHEMA::TEXT,
-							TG_TABLE_NAME::TEXT,
-							TG_RELID,
-							row_to_json(OLD, true)
-						);
-						PERFORM pg_notify('warp_pipe_new_changeset', currval('warp_pipe.changesets_id_seq')::TEXT || '_' || current_timestamp::TEXT);
-						RETURN OLD;
+						changeset_old_values := row_to_json(OLD, true);
 					ELSIF (TG_OP = 'INSERT') THEN
-						INSERT INTO warp_pipe.changesets(
-							id,
-							ts,
-							action,
-							schema_name,
-							table_name,
-							relid,
-							new_values
-						) VALUES (
-							nextval('warp_pipe.changesets_id_seq'),
-							current_timestamp,
-							TG_OP::TEXT, TG_TABLE_SCHEMA::TEXT,
-							TG_TABLE_NAME::TEXT,
-							TG_RELID,
-							row_to_json(NEW, true)
-						);
-						PERFORM pg_notify('warp_pipe_new_changeset', currval('warp_pipe.changesets_id_seq')::TEXT || '_' || current_timestamp::TEXT);
-						RETURN NEW;
+						changeset_new_values := row_to_json(NEW, true);
 					ELSE
 						RAISE WARNING '[WARP_PIPE.ON_MODIFY()] - Other action occurred: %, at %',TG_OP,NOW();
 						RETURN NULL;
 					END IF;
 
+					changeset_column_rules := COALESCE(
+						warp_pipe.column_rules() #> ARRAY[TG_TABLE_SCHEMA::TEXT, TG_TABLE_NAME::TEXT],
+						'{}'::JSONB
+					);
+					changeset_new_values := warp_pipe.apply_column_rules(changeset_column_rules, changeset_new_values);
+					changeset_old_values := warp_pipe.apply_column_rules(changeset_column_rules, changeset_old_values);
+
+					-- Record the types of the columns, hashed and redacted columns
+					-- being text
+					SELECT json_object_agg(
+						a.attname,
+						CASE
+							WHEN changeset_column_rules ->> a.attname IS NULL THEN format_type(a.atttypid, a.atttypmod)
+							ELSE 'text'
+						END
+						ORDER BY a.attnum
+					) INTO changeset_column_types
+					FROM pg_attribute a
+					WHERE a.attrelid = TG_RELID
+						AND a.attnum > 0
+						AND NOT a.attisdropped
+						AND (changeset_column_rules ->> a.attname) IS DISTINCT FROM 'exclude';
+
+					INSERT INTO warp_pipe.changesets(
+						id,
+						ts,
+						action,
+						schema_name,
+						table_name,
+						relid,
+						new_values,
+						old_values,
+						column_types
+					) VALUES (
+						nextval('warp_pipe.changesets_id_seq'),
+						current_timestamp,
+						TG_OP::TEXT,
+						TG_TABLE_SCHEMA::TEXT,
+						TG_TABLE_NAME::TEXT,
+						TG_RELID,
+						changeset_new_values,
+						changeset_old_values,
+						changeset_column_types
+					) RETURNING id INTO changeset_id;
+
+					PERFORM warp_pipe.notify_changeset(
+						changeset_id,
+						current_timestamp,
+						TG_OP::TEXT,
+						TG_TABLE_SCHEMA::TEXT,
+						TG_TABLE_NAME::TEXT,
+						TG_RELID,
+						changeset_new_values,
+						changeset_old_values,
+						changeset_column_types
+					);
+
+					IF (TG_OP = 'DELETE') THEN
+						RETURN OLD;
+					END IF;
+					RETURN NEW;
+
 				EXCEPTION
+					-- Column rules that cannot be applied fail the write
+					WHEN SQLSTATE 'WP001' THEN
+						RAISE;
 					WHEN data_exception THEN
 						RAISE WARNING '[WARP_PIPE.ON_MODIFY()] - UDF ERROR [DATA EXCEPTION] - SQLSTATE: %, SQLERRM: %',SQLSTATE,SQLERRM;
 						RETURN NULL;
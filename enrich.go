@@ -0,0 +1,615 @@
+package warppipe
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/perangel/warp-pipe/db"
+)
+
+const defaultEnrichCacheSize = 10000
+
+// RowLookup reads rows of the source database by primary key, for enriching
+// changesets.
+type RowLookup interface {
+	// PrimaryKey returns the primary key columns of a table, or none if the
+	// table has no primary key.
+	PrimaryKey(ctx context.Context, schema, table string) ([]string, error)
+	// FetchRows returns the rows of a table with the given primary key values,
+	// listed in the order of PrimaryKey(). Keys without a row are skipped.
+	FetchRows(ctx context.Context, schema, table string, keys [][]interface{}) ([][]*ChangesetColumn, error)
+}
+
+// RelatedRows is the lookup of a row related to the changesets of a table,
+// such as the customer of an order, by its primary key.
+type RelatedRows struct {
+	// Table of the changesets, in the formats of WhitelistTables().
+	Table string
+	// Column of the changesets holding the primary key of the related row.
+	Column string
+	// Schema of the related table.
+	RelatedSchema string
+	// Related table, which must have a single-column primary key.
+	RelatedTable string
+	// Prefix of the columns of the related row added to the changesets.
+	// Defaults to `<related table>.`.
+	Prefix string
+}
+
+// ParseRelatedRows parses a RelatedRows from
+// `<table>.<column>=[<schema>.]<related table>`, where the table is in the
+// formats of WhitelistTables(). The related schema defaults to `public`.
+func ParseRelatedRows(s string) (RelatedRows, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return RelatedRows{}, fmt.Errorf("'%s' is not a valid related rows lookup. Must be <table>.<column>=[<schema>.]<related table>", s)
+	}
+
+	i := strings.LastIndex(parts[0], ".")
+	if i <= 0 || i == len(parts[0])-1 || parts[1] == "" {
+		return RelatedRows{}, fmt.Errorf("'%s' is not a valid related rows lookup. Must be <table>.<column>=[<schema>.]<related table>", s)
+	}
+
+	related := RelatedRows{
+		Table:         parts[0][:i],
+		Column:        parts[0][i+1:],
+		RelatedSchema: "public",
+		RelatedTable:  parts[1],
+	}
+	if j := strings.Index(parts[1], "."); j >= 0 {
+		related.RelatedSchema = parts[1][:j]
+		related.RelatedTable = parts[1][j+1:]
+	}
+
+	return related, nil
+}
+
+// EnrichOption is an Enricher option function.
+type EnrichOption func(*Enricher)
+
+// EnrichTables is an option for setting the tables whose changesets are
+// enriched with their missing columns, in the formats of WhitelistTables().
+// Defaults to all tables. An empty list only enables the EnrichRelated() rows.
+func EnrichTables(tables []string) EnrichOption {
+	return func(e *Enricher) {
+		e.tables = tables
+	}
+}
+
+// EnrichRelated is an option for adding the columns of related rows to the
+// changesets.
+func EnrichRelated(related ...RelatedRows) EnrichOption {
+	return func(e *Enricher) {
+		e.related = append(e.related, related...)
+	}
+}
+
+// EnrichCacheSize is an option for setting the number of rows kept in the
+// cache of the Enricher. Defaults to 10000.
+func EnrichCacheSize(n int) EnrichOption {
+	return func(e *Enricher) {
+		e.cacheSize = n
+	}
+}
+
+// Enricher enriches changesets with data read from the source database, or a
+// replica of it. Columns missing from the new values of updates, or flagged as
+// Unchanged, such as the unchanged TOASTed columns of logical replication, are
+// read from the row with the same primary key, and the columns of related rows are added to the
+// changesets. Every column added by the Enricher is marked as Enriched, since
+// it is not part of the original changeset.
+//
+// Rows are cached, and the cache is kept up to date with the changesets of the
+// enriched tables, so deletes also get the missing columns of their previous
+// values when their row is cached. Rows read from the database reflect their
+// state at the time of the lookup, which may be more recent than the changeset.
+type Enricher struct {
+	lookup      RowLookup
+	tables      []string
+	related     []RelatedRows
+	cacheSize   int
+	cache       *lruCache
+	primaryKeys map[string][]string
+}
+
+// NewEnricher returns a new Enricher.
+func NewEnricher(lookup RowLookup, opts ...EnrichOption) *Enricher {
+	e := &Enricher{
+		lookup:      lookup,
+		cacheSize:   defaultEnrichCacheSize,
+		primaryKeys: make(map[string][]string),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	for i, related := range e.related {
+		if related.Prefix == "" {
+			e.related[i].Prefix = related.RelatedTable + "."
+		}
+	}
+	e.cache = newLRUCache(e.cacheSize)
+
+	return e
+}
+
+// Enrich is a BatchStageFunc enriching a batch of changesets, with a single
+// lookup per table for the rows missing from the cache.
+func (e *Enricher) Enrich(batch []*Changeset) ([]*Changeset, error) {
+	return e.EnrichContext(context.Background(), batch)
+}
+
+// EnrichContext is like Enrich, with the lookups cancelled with ctx. The
+// WarpPipe passes the context of its pipeline, so that lookups don't hold up
+// a shutdown.
+func (e *Enricher) EnrichContext(ctx context.Context, batch []*Changeset) ([]*Changeset, error) {
+	keys := make([]string, len(batch))
+	fetches := newRowFetches()
+	// rows cached by the earlier changesets of the batch
+	batched := make(map[string]bool)
+	for i, change := range batch {
+		if e.tables != nil && !matchTables(e.tables, change.Schema, change.Table) {
+			continue
+		}
+
+		pk, err := e.primaryKey(ctx, change.Schema, change.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		values := change.NewValues
+		if change.Kind == ChangesetKindDelete {
+			values = change.OldValues
+		}
+		keyValues, ok := columnValues(values, pk)
+		if !ok {
+			continue
+		}
+
+		keys[i] = rowKey(change.Schema, change.Table, keyValues)
+		switch change.Kind {
+		case ChangesetKindInsert:
+			batched[keys[i]] = true
+		case ChangesetKindUpdate:
+			if _, ok := e.cache.get(keys[i]); !ok && !batched[keys[i]] {
+				fetches.add(change.Schema, change.Table, keys[i], keyValues)
+			}
+			batched[keys[i]] = true
+		}
+	}
+
+	fetched, err := e.fetch(ctx, fetches)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, change := range batch {
+		key := keys[i]
+		if key == "" {
+			continue
+		}
+
+		switch change.Kind {
+		case ChangesetKindInsert:
+			e.cache.add(key, cloneColumns(change.NewValues))
+		case ChangesetKindUpdate:
+			// the cache holds the row as of the previous changeset of the batch
+			row, ok := e.cache.get(key)
+			if !ok {
+				row = fetched[key]
+			}
+			change.NewValues = mergeColumns(change.NewValues, row)
+			e.cache.add(key, cloneColumns(change.NewValues))
+		case ChangesetKindDelete:
+			row, _ := e.cache.get(key)
+			change.OldValues = mergeColumns(change.OldValues, row)
+			e.cache.remove(key)
+		}
+	}
+
+	for _, related := range e.related {
+		err := e.addRelatedRows(ctx, related, batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return batch, nil
+}
+
+// addRelatedRows adds the columns of the related rows to the changesets.
+func (e *Enricher) addRelatedRows(ctx context.Context, related RelatedRows, batch []*Changeset) error {
+	pk, err := e.primaryKey(ctx, related.RelatedSchema, related.RelatedTable)
+	if err != nil {
+		return err
+	}
+	if len(pk) != 1 {
+		return fmt.Errorf("related table %s.%s must have a single-column primary key", related.RelatedSchema, related.RelatedTable)
+	}
+
+	keys := make([]string, len(batch))
+	fetches := newRowFetches()
+	for i, change := range batch {
+		if !matchTables([]string{related.Table}, change.Schema, change.Table) {
+			continue
+		}
+
+		values := change.NewValues
+		if change.Kind == ChangesetKindDelete {
+			values = change.OldValues
+		}
+		v, ok := change.getColumnValue(values, related.Column)
+		if !ok || v == nil {
+			continue
+		}
+
+		keyValues := []interface{}{v}
+		keys[i] = rowKey(related.RelatedSchema, related.RelatedTable, keyValues)
+		if _, ok := e.cache.get(keys[i]); !ok {
+			fetches.add(related.RelatedSchema, related.RelatedTable, keys[i], keyValues)
+		}
+	}
+
+	fetched, err := e.fetch(ctx, fetches)
+	if err != nil {
+		return err
+	}
+
+	for i, change := range batch {
+		if keys[i] == "" {
+			continue
+		}
+
+		row, ok := fetched[keys[i]]
+		if !ok {
+			row, ok = e.cache.get(keys[i])
+		}
+		if !ok {
+			continue
+		}
+
+		prefixed := make([]*ChangesetColumn, len(row))
+		for j, col := range row {
+			prefixed[j] = &ChangesetColumn{Column: related.Prefix + col.Column, Value: col.Value, Type: col.Type}
+		}
+
+		if change.Kind == ChangesetKindDelete {
+			change.OldValues = mergeColumns(change.OldValues, prefixed)
+		} else {
+			change.NewValues = mergeColumns(change.NewValues, prefixed)
+		}
+	}
+
+	return nil
+}
+
+// primaryKey returns the primary key columns of a table, caching them.
+func (e *Enricher) primaryKey(ctx context.Context, schema, table string) ([]string, error) {
+	name := schema + "." + table
+	pk, ok := e.primaryKeys[name]
+	if ok {
+		return pk, nil
+	}
+
+	pk, err := e.lookup.PrimaryKey(ctx, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the primary key of %s: %w", name, err)
+	}
+
+	e.primaryKeys[name] = pk
+	return pk, nil
+}
+
+// fetch reads the rows of the fetches, with one lookup per table, and returns
+// them by row key. The rows are also cached.
+func (e *Enricher) fetch(ctx context.Context, fetches *rowFetches) (map[string][]*ChangesetColumn, error) {
+	rows := make(map[string][]*ChangesetColumn)
+	for _, f := range fetches.tables {
+		pk, err := e.primaryKey(ctx, f.schema, f.table)
+		if err != nil {
+			return nil, err
+		}
+
+		fetched, err := e.lookup.FetchRows(ctx, f.schema, f.table, f.keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch rows of %s.%s: %w", f.schema, f.table, err)
+		}
+
+		for _, row := range fetched {
+			keyValues, ok := columnValues(row, pk)
+			if !ok {
+				continue
+			}
+
+			key := rowKey(f.schema, f.table, keyValues)
+			rows[key] = row
+			e.cache.add(key, row)
+		}
+	}
+
+	return rows, nil
+}
+
+// rowFetches are the rows to read from each table, without duplicates.
+type rowFetches struct {
+	tables []*rowFetch
+	byName map[string]*rowFetch
+	seen   map[string]bool
+}
+
+type rowFetch struct {
+	schema string
+	table  string
+	keys   [][]interface{}
+}
+
+func newRowFetches() *rowFetches {
+	return &rowFetches{
+		byName: make(map[string]*rowFetch),
+		seen:   make(map[string]bool),
+	}
+}
+
+func (f *rowFetches) add(schema, table, key string, keyValues []interface{}) {
+	if f.seen[key] {
+		return
+	}
+	f.seen[key] = true
+
+	name := schema + "." + table
+	fetch, ok := f.byName[name]
+	if !ok {
+		fetch = &rowFetch{schema: schema, table: table}
+		f.byName[name] = fetch
+		f.tables = append(f.tables, fetch)
+	}
+	fetch.keys = append(fetch.keys, keyValues)
+}
+
+// rowKey returns the cache key of the row of a table with the given primary
+// key values.
+func rowKey(schema, table string, keyValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(schema)
+	b.WriteByte('.')
+	b.WriteString(table)
+	for _, v := range keyValues {
+		fmt.Fprintf(&b, "|%v", v)
+	}
+	return b.String()
+}
+
+// columnValues returns the values of the columns, and false if any of them is
+// missing or null, or if there are no columns.
+func columnValues(values []*ChangesetColumn, columns []string) ([]interface{}, bool) {
+	if len(columns) == 0 {
+		return nil, false
+	}
+
+	keyValues := make([]interface{}, len(columns))
+	for i, column := range columns {
+		var found bool
+		for _, v := range values {
+			if v.Column == column && !v.Unchanged {
+				keyValues[i], found = v.Value, v.Value != nil
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	return keyValues, true
+}
+
+// mergeColumns adds the columns of row missing from values, or Unchanged in
+// values, marked as enriched.
+func mergeColumns(values, row []*ChangesetColumn) []*ChangesetColumn {
+	present := make(map[string]*ChangesetColumn, len(values))
+	for _, v := range values {
+		present[v.Column] = v
+	}
+
+	for _, col := range row {
+		if v, ok := present[col.Column]; ok {
+			if v.Unchanged {
+				v.Value = col.Value
+				v.Unchanged = false
+				v.Enriched = true
+			}
+			continue
+		}
+		values = append(values, &ChangesetColumn{
+			Column:   col.Column,
+			Value:    col.Value,
+			Type:     col.Type,
+			Enriched: true,
+		})
+	}
+
+	return values
+}
+
+// cloneColumns returns a copy of the columns to cache, so that later stages
+// modifying the changeset do not modify the cache.
+func cloneColumns(values []*ChangesetColumn) []*ChangesetColumn {
+	var cloned []*ChangesetColumn
+	for _, v := range values {
+		if !v.Unchanged {
+			cloned = append(cloned, &ChangesetColumn{Column: v.Column, Value: v.Value, Type: v.Type})
+		}
+	}
+	return cloned
+}
+
+// primaryKeySQL reads the primary key columns of a table, and their types.
+const primaryKeySQL = `
+SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+FROM pg_index i
+	JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE i.indrelid = $1::regclass AND i.indisprimary
+ORDER BY array_position(i.indkey::int2[], a.attnum)`
+
+// sqlRowLookup is a RowLookup reading rows with SQL queries.
+type sqlRowLookup struct {
+	conn *pgx.Conn
+	keys map[string][]keyColumn
+}
+
+type keyColumn struct {
+	name    string
+	colType string
+}
+
+// NewSQLRowLookup returns a RowLookup reading rows from a database connection,
+// to the source database or a replica of it.
+func NewSQLRowLookup(conn *pgx.Conn) RowLookup {
+	return &sqlRowLookup{
+		conn: conn,
+		keys: make(map[string][]keyColumn),
+	}
+}
+
+func (l *sqlRowLookup) keyColumns(ctx context.Context, schema, table string) ([]keyColumn, error) {
+	name := db.QuoteIdentifier(schema, table)
+	if keys, ok := l.keys[name]; ok {
+		return keys, nil
+	}
+
+	rows, err := l.conn.QueryEx(ctx, primaryKeySQL, nil, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []keyColumn
+	for rows.Next() {
+		var key keyColumn
+		err := rows.Scan(&key.name, &key.colType)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	l.keys[name] = keys
+	return keys, nil
+}
+
+// PrimaryKey implements RowLookup.
+func (l *sqlRowLookup) PrimaryKey(ctx context.Context, schema, table string) ([]string, error) {
+	keys, err := l.keyColumns(ctx, schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(keys))
+	for i, key := range keys {
+		columns[i] = key.name
+	}
+	return columns, nil
+}
+
+// FetchRows implements RowLookup. Key values are sent as text and cast to the
+// types of the primary key columns, so the lookup can use the primary key index.
+func (l *sqlRowLookup) FetchRows(ctx context.Context, schema, table string, keys [][]interface{}) ([][]*ChangesetColumn, error) {
+	keyColumns, err := l.keyColumns(ctx, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || len(keyColumns) == 0 {
+		return nil, nil
+	}
+
+	columns := make([]string, len(keyColumns))
+	for i, key := range keyColumns {
+		columns[i] = db.QuoteIdentifier(key.name)
+	}
+
+	var args []interface{}
+	tuples := make([]string, len(keys))
+	for i, keyValues := range keys {
+		params := make([]string, len(keyColumns))
+		for j, key := range keyColumns {
+			args = append(args, keyText(keyValues[j]))
+			params[j] = fmt.Sprintf("$%d::text::%s", len(args), key.colType)
+		}
+		tuples[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+
+	// the column types are read once per query, to decode the values
+	args = append(args, db.QuoteIdentifier(schema, table))
+	sql := fmt.Sprintf(`SELECT row_to_json(t), (
+			SELECT json_object_agg(attname, format_type(atttypid, atttypmod))
+			FROM pg_attribute
+			WHERE attrelid = $%d::regclass AND attnum > 0 AND NOT attisdropped
+		) FROM %s AS t WHERE (%s) IN (%s)`,
+		len(args),
+		db.QuoteIdentifier(schema, table),
+		strings.Join(columns, ", "),
+		strings.Join(tuples, ", "),
+	)
+
+	rows, err := l.conn.QueryEx(ctx, sql, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result [][]*ChangesetColumn
+	for rows.Next() {
+		var data, typesData []byte
+		err := rows.Scan(&data, &typesData)
+		if err != nil {
+			return nil, err
+		}
+
+		var types map[string]string
+		err = json.Unmarshal(typesData, &types)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal column types: %w", err)
+		}
+
+		row, err := parseEventValues(data, types)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal row: %w", err)
+		}
+
+		err = decodeColumns(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode row: %w", err)
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// keyText formats a primary key value as text, to be cast to its column type.
+func keyText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return `\x` + hex.EncodeToString(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
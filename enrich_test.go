@@ -0,0 +1,224 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRowLookup is a RowLookup over in-memory rows keyed by their `id` column.
+type fakeRowLookup struct {
+	rows    map[string]map[float64][]*ChangesetColumn
+	fetches [][]interface{}
+}
+
+func (l *fakeRowLookup) PrimaryKey(_ context.Context, schema, table string) ([]string, error) {
+	if _, ok := l.rows[schema+"."+table]; !ok {
+		return nil, nil
+	}
+	return []string{"id"}, nil
+}
+
+func (l *fakeRowLookup) FetchRows(_ context.Context, schema, table string, keys [][]interface{}) ([][]*ChangesetColumn, error) {
+	var rows [][]*ChangesetColumn
+	for _, key := range keys {
+		l.fetches = append(l.fetches, key)
+		if row, ok := l.rows[schema+"."+table][key[0].(float64)]; ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func newTestRowLookup() *fakeRowLookup {
+	return &fakeRowLookup{rows: map[string]map[float64][]*ChangesetColumn{
+		"public.documents": {
+			1: {{Column: "id", Value: float64(1)}, {Column: "body", Value: "large body"}, {Column: "author_id", Value: float64(7)}},
+			2: {{Column: "id", Value: float64(2)}, {Column: "body", Value: "other body"}, {Column: "author_id", Value: float64(7)}},
+		},
+		"public.authors": {
+			7: {{Column: "id", Value: float64(7)}, {Column: "name", Value: "bob"}},
+		},
+	}}
+}
+
+func newDocumentChangeset(kind ChangesetKind, id float64, values ...*ChangesetColumn) *Changeset {
+	change := &Changeset{Kind: kind, Schema: "public", Table: "documents"}
+	values = append([]*ChangesetColumn{{Column: "id", Value: id}}, values...)
+	if kind == ChangesetKindDelete {
+		change.OldValues = values
+	} else {
+		change.NewValues = values
+	}
+	return change
+}
+
+func TestEnricherMissingColumns(t *testing.T) {
+	lookup := newTestRowLookup()
+	e := NewEnricher(lookup, EnrichTables([]string{"documents"}))
+
+	batch := []*Changeset{
+		newDocumentChangeset(ChangesetKindUpdate, 1, &ChangesetColumn{Column: "author_id", Value: float64(8)}),
+		newDocumentChangeset(ChangesetKindUpdate, 2),
+		newDocumentChangeset(ChangesetKindUpdate, 1),
+		newDocumentChangeset(ChangesetKindUpdate, 3),
+	}
+	results, err := e.Enrich(batch)
+	assert.NoError(t, err)
+	assert.Equal(t, batch, results)
+
+	// the rows are fetched in a single lookup
+	assert.Equal(t, [][]interface{}{{float64(1)}, {float64(2)}, {float64(3)}}, lookup.fetches)
+
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(1)},
+		{Column: "author_id", Value: float64(8)},
+		{Column: "body", Value: "large body", Enriched: true},
+	}, results[0].NewValues)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(2)},
+		{Column: "body", Value: "other body", Enriched: true},
+		{Column: "author_id", Value: float64(7), Enriched: true},
+	}, results[1].NewValues)
+	// the second update of the row gets the values of the first one
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(1)},
+		{Column: "author_id", Value: float64(8), Enriched: true},
+		{Column: "body", Value: "large body", Enriched: true},
+	}, results[2].NewValues)
+	// missing rows are left as is
+	assert.Len(t, results[3].NewValues, 1)
+
+	// cached rows are not fetched again, and deletes get their previous values
+	lookup.fetches = nil
+	results, err = e.Enrich([]*Changeset{
+		newDocumentChangeset(ChangesetKindUpdate, 2),
+		newDocumentChangeset(ChangesetKindDelete, 1),
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, lookup.fetches)
+	assert.Len(t, results[0].NewValues, 3)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(1)},
+		{Column: "author_id", Value: float64(8), Enriched: true},
+		{Column: "body", Value: "large body", Enriched: true},
+	}, results[1].OldValues)
+}
+
+func TestEnricherInsertsFillTheCache(t *testing.T) {
+	lookup := newTestRowLookup()
+	e := NewEnricher(lookup)
+
+	insert := newDocumentChangeset(ChangesetKindInsert, 5, &ChangesetColumn{Column: "body", Value: "new body"})
+	update := newDocumentChangeset(ChangesetKindUpdate, 5)
+	_, err := e.Enrich([]*Changeset{insert, update})
+	assert.NoError(t, err)
+	assert.Empty(t, lookup.fetches)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(5)},
+		{Column: "body", Value: "new body", Enriched: true},
+	}, update.NewValues)
+
+	// later stages modifying the changeset do not modify the cache
+	insert.NewValues[1].Value = "[REDACTED]"
+	update = newDocumentChangeset(ChangesetKindUpdate, 5)
+	_, err = e.Enrich([]*Changeset{update})
+	assert.NoError(t, err)
+	assert.Equal(t, "new body", update.NewValues[1].Value)
+}
+
+func TestEnricherUnchangedColumns(t *testing.T) {
+	lookup := newTestRowLookup()
+	e := NewEnricher(lookup)
+
+	update := newDocumentChangeset(ChangesetKindUpdate, 1,
+		&ChangesetColumn{Column: "author_id", Value: float64(8)},
+		&ChangesetColumn{Column: "body", Type: "text", Unchanged: true},
+	)
+	_, err := e.Enrich([]*Changeset{update})
+	assert.NoError(t, err)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(1)},
+		{Column: "author_id", Value: float64(8)},
+		{Column: "body", Value: "large body", Type: "text", Enriched: true},
+	}, update.NewValues)
+}
+
+func TestEnricherRelatedRows(t *testing.T) {
+	lookup := newTestRowLookup()
+	related, err := ParseRelatedRows("public.documents.author_id=authors")
+	assert.NoError(t, err)
+	e := NewEnricher(lookup, EnrichTables([]string{}), EnrichRelated(related))
+
+	insert := newDocumentChangeset(ChangesetKindInsert, 5, &ChangesetColumn{Column: "author_id", Value: float64(7)})
+	_, err = e.Enrich([]*Changeset{insert})
+	assert.NoError(t, err)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(5)},
+		{Column: "author_id", Value: float64(7)},
+		{Column: "authors.id", Value: float64(7), Enriched: true},
+		{Column: "authors.name", Value: "bob", Enriched: true},
+	}, insert.NewValues)
+}
+
+// cancellableRowLookup is a fakeRowLookup failing once its context is done.
+type cancellableRowLookup struct {
+	*fakeRowLookup
+}
+
+func (l *cancellableRowLookup) FetchRows(ctx context.Context, schema, table string, keys [][]interface{}) ([][]*ChangesetColumn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return l.fakeRowLookup.FetchRows(ctx, schema, table, keys)
+}
+
+func TestEnricherContext(t *testing.T) {
+	lookup := &cancellableRowLookup{newTestRowLookup()}
+	e := NewEnricher(lookup)
+
+	update := newDocumentChangeset(ChangesetKindUpdate, 1, &ChangesetColumn{Column: "author_id", Value: float64(8)})
+	_, err := e.EnrichContext(context.Background(), []*Changeset{update})
+	assert.NoError(t, err)
+	assert.Len(t, update.NewValues, 3)
+
+	// the lookups are cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	update = newDocumentChangeset(ChangesetKindUpdate, 2, &ChangesetColumn{Column: "author_id", Value: float64(8)})
+	_, err = e.EnrichContext(ctx, []*Changeset{update})
+	assert.True(t, errors.Is(err, context.Canceled), err)
+	assert.Empty(t, lookup.fetches[1:])
+}
+
+func TestParseRelatedRows(t *testing.T) {
+	related, err := ParseRelatedRows("orders.customer_id=sales.customers")
+	assert.NoError(t, err)
+	assert.Equal(t, RelatedRows{Table: "orders", Column: "customer_id", RelatedSchema: "sales", RelatedTable: "customers"}, related)
+
+	for _, s := range []string{"orders", "orders=customers", "orders.=customers", "orders.customer_id="} {
+		_, err := ParseRelatedRows(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", nil)
+	c.add("b", nil)
+	c.get("a")
+	c.add("c", nil)
+
+	_, ok := c.get("b")
+	assert.False(t, ok)
+	_, ok = c.get("a")
+	assert.True(t, ok)
+	_, ok = c.get("c")
+	assert.True(t, ok)
+
+	c.remove("a")
+	_, ok = c.get("a")
+	assert.False(t, ok)
+}
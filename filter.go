@@ -0,0 +1,84 @@
+package warppipe
+
+import (
+	"fmt"
+
+	"github.com/perangel/warp-pipe/internal/expr"
+)
+
+// Changeset fields available to filter expressions.
+var filterFields = []string{"id", "kind", "schema", "table"}
+
+// Filter is an option for only emitting the changesets for which the
+// expression evaluates to true. Expressions are compiled by NewWarpPipe, and
+// are applied after WhitelistTables() and IgnoreTables().
+//
+// Expressions may refer to the changeset fields `id`, `kind`, `schema` and
+// `table`, and to column values with the functions:
+//     new("column")      the new value of a column, or null (see GetNewColumnValue)
+//     old("column")      the previous value of a column, or null (see GetPreviousColumnValue)
+//     has_new("column")  true if the changeset has a new value for the column
+//     has_old("column")  true if the changeset has a previous value for the column
+//     changed("column")  true if the new and previous values of the column differ
+// They support number, string, bool, null and list literals, the operators
+// ==, !=, <, <=, >, >=, in, !, && and ||, and the string functions
+// startsWith(s, prefix), endsWith(s, suffix), contains(s, substr) and
+// matches(s, "regexp"). For example:
+//     table == "orders" && changed("status")
+//     new("tenant_id") != 42
+func Filter(expression string) Option {
+	return func(w *WarpPipe) {
+		w.filters = append(w.filters, expression)
+	}
+}
+
+func compileFilter(expression string) (*expr.Program, error) {
+	program, err := expr.Compile(expression, filterFields...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression: %w", err)
+	}
+	return program, nil
+}
+
+// newFilterStageFunc returns a StageFunc that drops the changesets for which
+// the program evaluates to false.
+func newFilterStageFunc(program *expr.Program) StageFunc {
+	return func(change *Changeset) (*Changeset, error) {
+		ok, err := program.Eval(changesetRow{change})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil
+		}
+		return change, nil
+	}
+}
+
+// changesetRow exposes a Changeset to filter expressions.
+type changesetRow struct {
+	*Changeset
+}
+
+func (r changesetRow) Field(name string) interface{} {
+	switch name {
+	case "id":
+		return r.ID
+	case "kind":
+		return string(r.Kind)
+	case "schema":
+		return r.Schema
+	case "table":
+		return r.Table
+	default:
+		return nil
+	}
+}
+
+func (r changesetRow) NewValue(column string) (interface{}, bool) {
+	return r.GetNewColumnValue(column)
+}
+
+func (r changesetRow) OldValue(column string) (interface{}, bool) {
+	return r.GetPreviousColumnValue(column)
+}
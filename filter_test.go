@@ -0,0 +1,46 @@
+package warppipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterStageFunc(t *testing.T) {
+	program, err := compileFilter(`table == "orders" && changed("status") && new("tenant_id") != 42`)
+	assert.NoError(t, err)
+	filter := newFilterStageFunc(program)
+
+	newOrder := func(tenantID float64, status string) *Changeset {
+		return &Changeset{
+			ID:    1,
+			Kind:  ChangesetKindUpdate,
+			Table: "orders",
+			NewValues: []*ChangesetColumn{
+				{Column: "tenant_id", Value: tenantID},
+				{Column: "status", Value: status},
+			},
+			OldValues: []*ChangesetColumn{
+				{Column: "tenant_id", Value: tenantID},
+				{Column: "status", Value: "pending"},
+			},
+		}
+	}
+
+	change, err := filter(newOrder(1, "shipped"))
+	assert.NoError(t, err)
+	assert.NotNil(t, change)
+
+	change, err = filter(newOrder(1, "pending"))
+	assert.NoError(t, err)
+	assert.Nil(t, change)
+
+	change, err = filter(newOrder(42, "shipped"))
+	assert.NoError(t, err)
+	assert.Nil(t, change)
+
+	program, err = compileFilter(`new("status") > 1`)
+	assert.NoError(t, err)
+	_, err = newFilterStageFunc(program)(newOrder(1, "shipped"))
+	assert.Error(t, err)
+}
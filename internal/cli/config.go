@@ -1,9 +1,12 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/jackc/pgx"
 	warppipe "github.com/perangel/warp-pipe"
 )
 
@@ -49,6 +52,78 @@ func parseConfig() (*warppipe.Config, error) {
 	config.StartFromID = startFromID
 	config.StartFromTimestamp = startFromTimestamp
 
+	if backlogPageSize != 0 {
+		config.BacklogPageSize = backlogPageSize
+	}
+
+	if backlogCursor {
+		config.BacklogCursor = true
+	}
+
+	if pollMinInterval != 0 {
+		config.PollMinInterval = pollMinInterval
+	}
+
+	if pollMaxInterval != 0 {
+		config.PollMaxInterval = pollMaxInterval
+	}
+
+	if cmdRepollInterval >= 0 {
+		config.RepollInterval = cmdRepollInterval
+	}
+
+	if retentionDays != 0 {
+		config.RetentionDays = retentionDays
+	}
+
+	if pruneAcknowledged {
+		config.PruneAcknowledged = true
+	}
+
+	if pruneInterval != 0 {
+		config.PruneInterval = pruneInterval
+	}
+
+	if pruneBatchSize != 0 {
+		config.PruneBatchSize = pruneBatchSize
+	}
+
+	if filter != "" {
+		config.Filter = filter
+	}
+
+	if pipelineConfig != "" {
+		config.PipelineConfig = pipelineConfig
+	}
+
+	if enrichTables != nil {
+		config.EnrichTables = enrichTables
+	}
+
+	if enrichRelated != nil {
+		config.EnrichRelated = enrichRelated
+	}
+
+	if enrichCacheSize != 0 {
+		config.EnrichCacheSize = enrichCacheSize
+	}
+
+	if enrichDBHost != "" {
+		config.EnrichDBHost = enrichDBHost
+	}
+
+	if shutdownTimeout != 0 {
+		config.ShutdownTimeout = shutdownTimeout
+	}
+
+	if deadLetterFile != "" {
+		config.DeadLetterFile = deadLetterFile
+	}
+
+	if hashSecret != "" {
+		config.HashSecret = hashSecret
+	}
+
 	if logLevel != "" {
 		config.LogLevel = logLevel
 	}
@@ -76,8 +151,90 @@ func initListener(config *warppipe.Config) (warppipe.Listener, error) {
 			opts = append(opts, warppipe.StartFromTimestamp(t))
 		}
 
+		if config.BacklogPageSize > 0 {
+			opts = append(opts, warppipe.BacklogPageSize(config.BacklogPageSize))
+		}
+
+		opts = append(opts, warppipe.RepollInterval(config.RepollInterval))
+
+		if config.BacklogCursor {
+			opts = append(opts, warppipe.BacklogCursor())
+		}
+
 		return warppipe.NewNotifyListener(opts...), nil
+	case replicationModePoll:
+		opts := []warppipe.PollOption{
+			warppipe.PollInterval(config.PollMinInterval, config.PollMaxInterval),
+		}
+
+		if config.StartFromID != -1 {
+			opts = append(opts, warppipe.PollStartFromID(config.StartFromID))
+		} else if config.StartFromTimestamp != -1 {
+			t := time.Unix(config.StartFromTimestamp, 0)
+			opts = append(opts, warppipe.PollStartFromTimestamp(t))
+		}
+
+		if config.BacklogPageSize > 0 {
+			opts = append(opts, warppipe.PollPageSize(config.BacklogPageSize))
+		}
+
+		return warppipe.NewPollingListener(opts...), nil
 	default:
-		return nil, fmt.Errorf("'%s' is not a valid value for `--replication-mode`. Must be either `lr` or `audit`", config.ReplicationMode)
+		return nil, fmt.Errorf("'%s' is not a valid value for `--replication-mode`. Must be one of `lr`, `audit` or `poll`", config.ReplicationMode)
+	}
+}
+
+// Interval between the creations of upcoming partitions, when changesets are
+// not pruned in the background.
+const partitionInterval = time.Hour
+
+// runPruner prunes the changesets table in the background every prune
+// interval. Without one, it only creates the upcoming partitions of a
+// partitioned table, so that they don't run out after the premade ones.
+func runPruner(ctx context.Context, connConfig *pgx.ConnConfig, config *warppipe.Config) error {
+	interval := config.PruneInterval
+	pruneConfig := *config
+	if interval <= 0 {
+		interval = partitionInterval
+		pruneConfig.RetentionDays = 0
+		pruneConfig.PruneAcknowledged = false
 	}
+
+	conn, err := pgx.Connect(*connConfig)
+	if err != nil {
+		return err
+	}
+
+	pruner, err := initPruner(conn, &pruneConfig)
+	if err != nil {
+		conn.Close()
+		if config.PruneInterval <= 0 && errors.Is(err, warppipe.ErrNothingToPrune) {
+			return nil
+		}
+		return err
+	}
+
+	go func() {
+		defer conn.Close()
+		pruner.Run(ctx, interval)
+	}()
+
+	return nil
+}
+
+func initPruner(conn *pgx.Conn, config *warppipe.Config) (*warppipe.Pruner, error) {
+	opts := []warppipe.PrunerOption{
+		warppipe.PruneBatchSize(config.PruneBatchSize),
+		warppipe.ManagePartitions(),
+	}
+
+	if config.RetentionDays > 0 {
+		opts = append(opts, warppipe.RetainFor(time.Duration(config.RetentionDays)*24*time.Hour))
+	}
+
+	if config.PruneAcknowledged {
+		opts = append(opts, warppipe.PruneAcknowledged())
+	}
+
+	return warppipe.NewPruner(conn, opts...)
 }
@@ -15,6 +15,13 @@ var (
 	setupDBIgnoreTables    []string
 	setupDBWhitelistTables []string
 	setupDBReplicaIdentity string
+	setupDBPartitionBy     string
+	setupDBPremake         int
+	setupDBFullNotify      bool
+	setupDBExcludeColumns  []string
+	setupDBHashColumns     []string
+	setupDBRedactColumns   []string
+	hashSecret             string
 )
 
 var setupDBCmd = &cobra.Command{
@@ -50,7 +57,38 @@ For more details see: https://github.com/perangel/warp-pipe/docs/setup_database.
 			return err
 		}
 
-		err = db.Prepare(conn, setupDBSchemas, setupDBWhitelistTables, setupDBIgnoreTables)
+		var opts []db.PrepareOption
+		if setupDBPartitionBy != "" {
+			interval, err := db.ParsePartitionInterval(setupDBPartitionBy)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, db.PartitionBy(interval, setupDBPremake))
+		}
+
+		if setupDBReplicaIdentity != "" {
+			identity, err := db.ParseReplicaIdentity(setupDBReplicaIdentity)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, db.SetReplicaIdentity(identity))
+		}
+
+		if setupDBFullNotify {
+			opts = append(opts, db.FullNotifyPayloads())
+		}
+
+		rules, err := parseColumnRules()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, db.ColumnRules(rules...))
+
+		if config.HashSecret != "" {
+			opts = append(opts, db.ColumnHashSecret(config.HashSecret))
+		}
+
+		err = db.Prepare(conn, setupDBSchemas, setupDBWhitelistTables, setupDBIgnoreTables, opts...)
 		if err != nil {
 			return err
 		}
@@ -93,8 +131,38 @@ var teardownDBCmd = &cobra.Command{
 	},
 }
 
+func parseColumnRules() ([]db.ColumnRule, error) {
+	var rules []db.ColumnRule
+	for _, flag := range []struct {
+		action  db.ColumnRuleAction
+		columns []string
+	}{
+		{db.ColumnExclude, setupDBExcludeColumns},
+		{db.ColumnHash, setupDBHashColumns},
+		{db.ColumnRedact, setupDBRedactColumns},
+	} {
+		for _, column := range flag.columns {
+			rule, err := db.ParseColumnRule(flag.action, column)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
 func init() {
 	setupDBCmd.Flags().StringSliceVarP(&setupDBIgnoreTables, "ignore-tables", "i", nil, "tables to exclude from replication setup")
 	setupDBCmd.Flags().StringSliceVarP(&setupDBWhitelistTables, "whitelist-tables", "w", nil, "tables to include in replication setup")
 	setupDBCmd.Flags().StringSliceVarP(&setupDBSchemas, "schemas", "S", []string{"public"}, "schemas to setup for replication")
+	setupDBCmd.Flags().StringVar(&setupDBPartitionBy, "partition-by", "", "partition the changesets table by timestamp, either `daily` or `weekly` (Postgres >= 11)")
+	setupDBCmd.Flags().IntVar(&setupDBPremake, "premake-partitions", 7, "number of future partitions to create ahead of time")
+	setupDBCmd.Flags().StringVar(&setupDBReplicaIdentity, "replica-identity", "", "set the replica identity of the tables for lr mode, either `full` (all columns), `index` (the primary key or a unique index, otherwise all columns) or `default`")
+	setupDBCmd.Flags().BoolVar(&setupDBFullNotify, "full-notify-payload", false, "send the full changeset in notification payloads when it fits, instead of only its ID")
+	setupDBCmd.Flags().StringSliceVar(&setupDBExcludeColumns, "exclude-columns", nil, "columns (`[schema.]table.column`) to leave out of changesets")
+	setupDBCmd.Flags().StringSliceVar(&setupDBHashColumns, "hash-columns", nil, "columns (`[schema.]table.column`) whose values are replaced by their HMAC-SHA256 in changesets, keyed by --hash-secret")
+	setupDBCmd.Flags().StringVar(&hashSecret, "hash-secret", "", "secret key of the HMAC of hashed columns, also read from HASH_SECRET (requires the pgcrypto extension)")
+	setupDBCmd.Flags().StringSliceVar(&setupDBRedactColumns, "redact-columns", nil, "columns (`[schema.]table.column`) whose values are redacted in changesets")
 }
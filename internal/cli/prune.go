@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/spf13/cobra"
+)
+
+// Flags
+var (
+	retentionDays     int
+	pruneAcknowledged bool
+	pruneInterval     time.Duration
+	pruneBatchSize    int
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Prune the `warp_pipe.changesets` table",
+	Long: `Prune the 'warp_pipe.changesets' table in the source database.
+
+Changesets are removed if they are older than the retention period, or if they
+have been acknowledged by every registered consumer. Rows are deleted in batches
+to avoid holding long locks on the table.
+
+If the changesets table is partitioned, expired partitions are dropped and
+future partitions are created instead.`,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		config, err := parseConfig()
+		if err != nil {
+			return err
+		}
+
+		dbConfig := &pgx.ConnConfig{
+			Host:     config.Database.Host,
+			Port:     uint16(config.Database.Port),
+			User:     config.Database.User,
+			Password: config.Database.Password,
+			Database: config.Database.Database,
+		}
+
+		conn, err := pgx.Connect(*dbConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		pruner, err := initPruner(conn, config)
+		if err != nil {
+			return err
+		}
+
+		result, err := pruner.Prune(context.Background())
+		if result != nil {
+			fmt.Printf("Pruned %d changesets (%d expired, %d acknowledged)\n",
+				result.Total(),
+				result.Expired,
+				result.Acknowledged,
+			)
+			for _, name := range result.DroppedPartitions {
+				fmt.Printf("Dropped partition %s\n", name)
+			}
+			for _, name := range result.CreatedPartitions {
+				fmt.Printf("Created partition %s\n", name)
+			}
+		}
+		return err
+	},
+}
+
+func init() {
+	pruneCmd.Flags().IntVar(&retentionDays, "retention-days", 0, "prune changesets older than the provided number of days")
+	pruneCmd.Flags().BoolVar(&pruneAcknowledged, "prune-acknowledged", false, "prune changesets acknowledged by all registered consumers")
+	pruneCmd.Flags().IntVar(&pruneBatchSize, "prune-batch-size", 0, "maximum number of changesets deleted per statement")
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/jackc/pgx"
 	warppipe "github.com/perangel/warp-pipe"
@@ -28,12 +29,26 @@ var (
 	startFromID        int64
 	startFromTimestamp int64
 	startFromLSN       int64
+	backlogPageSize    int
+	backlogCursor      bool
+	cmdRepollInterval  time.Duration
+	pollMinInterval    time.Duration
+	pollMaxInterval    time.Duration
+	filter             string
+	pipelineConfig     string
+	deadLetterFile     string
+	shutdownTimeout    time.Duration
+	enrichTables       []string
+	enrichRelated      []string
+	enrichCacheSize    int
+	enrichDBHost       string
 	logLevel           string
 )
 
 const (
 	replicationModeLR    = "lr"
 	replicationModeAudit = "audit"
+	replicationModePoll  = "poll"
 )
 
 func init() {
@@ -46,14 +61,32 @@ func init() {
 	WarpPipeCmd.Flags().Int64Var(&startFromLSN, "start-from-lsn", -1, "stream all changes starting from the provided LSN")
 	WarpPipeCmd.Flags().Int64Var(&startFromID, "start-from-id", -1, "stream all changes starting from the provided changeset ID")
 	WarpPipeCmd.Flags().Int64Var(&startFromTimestamp, "start-from-ts", -1, "stream all changes starting from the provided timestamp")
+	WarpPipeCmd.Flags().IntVar(&backlogPageSize, "backlog-page-size", 0, "number of changesets read per query when catching up (audit mode only)")
+	WarpPipeCmd.Flags().BoolVar(&backlogCursor, "backlog-cursor", false, "read the changeset backlog through a server-side cursor (audit mode only)")
+	WarpPipeCmd.Flags().DurationVar(&cmdRepollInterval, "repoll-interval", -1, "interval between re-reads of changesets committed out of order, 0 to disable (audit mode only)")
+	WarpPipeCmd.Flags().DurationVar(&pollMinInterval, "poll-min-interval", 0, "minimum interval between polls while changesets keep arriving (poll mode only)")
+	WarpPipeCmd.Flags().DurationVar(&pollMaxInterval, "poll-max-interval", 0, "maximum interval between polls while idle (poll mode only)")
 	WarpPipeCmd.Flags().StringVarP(&replicationMode, "replication-mode", "M", replicationModeLR, "replication mode")
 	WarpPipeCmd.Flags().StringSliceVarP(&ignoreTables, "ignore-tables", "i", nil, "tables to ignore during replication")
 	WarpPipeCmd.Flags().StringSliceVarP(&whitelistTables, "whitelist-tables", "w", nil, "tables to include during replication")
+	WarpPipeCmd.Flags().StringVar(&filter, "filter", "", "only emit changes for which the expression evaluates to true, e.g. 'table == \"orders\" && changed(\"status\")'")
+	WarpPipeCmd.Flags().StringVar(&pipelineConfig, "pipeline-config", "", "path to a YAML or JSON file of built-in pipeline stages")
+	WarpPipeCmd.Flags().StringVar(&deadLetterFile, "dead-letter-file", "", "append changesets that the filter or pipeline stages fail to process to this file")
+	WarpPipeCmd.Flags().StringSliceVar(&enrichTables, "enrich-tables", nil, "tables whose changes are enriched with the columns missing from their new values")
+	WarpPipeCmd.Flags().StringSliceVar(&enrichRelated, "enrich-related", nil, "related rows added to the changes, as <table>.<column>=[<schema>.]<related table>")
+	WarpPipeCmd.Flags().IntVar(&enrichCacheSize, "enrich-cache-size", 0, "number of rows cached for enrichment (default 10000)")
+	WarpPipeCmd.Flags().StringVar(&enrichDBHost, "enrich-db-host", "", "host of a replica of the source database used for enrichment")
+	WarpPipeCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "maximum time to wait on shutdown for the changes in flight to be emitted (default 30s)")
+	WarpPipeCmd.Flags().DurationVar(&pruneInterval, "prune-interval", 0, "interval between background prunes of the changesets table (audit mode only)")
+	WarpPipeCmd.Flags().IntVar(&retentionDays, "retention-days", 0, "prune changesets older than the provided number of days")
+	WarpPipeCmd.Flags().BoolVar(&pruneAcknowledged, "prune-acknowledged", false, "prune changesets acknowledged by all registered consumers")
+	WarpPipeCmd.Flags().IntVar(&pruneBatchSize, "prune-batch-size", 0, "maximum number of changesets deleted per statement")
 	WarpPipeCmd.Flags().SortFlags = false
 
 	WarpPipeCmd.AddCommand(
 		setupDBCmd,
 		teardownDBCmd,
+		pruneCmd,
 	)
 }
 
@@ -81,13 +114,49 @@ var WarpPipeCmd = &cobra.Command{
 			Database: config.Database.Database,
 		}
 
-		wp, err := warppipe.NewWarpPipe(
-			connConfig,
-			listener,
+		opts := []warppipe.Option{
 			warppipe.IgnoreTables(config.IgnoreTables),
 			warppipe.WhitelistTables(config.WhitelistTables),
 			warppipe.LogLevel(config.LogLevel),
-		)
+		}
+
+		if config.Filter != "" {
+			opts = append(opts, warppipe.Filter(config.Filter))
+		}
+
+		if config.PipelineConfig != "" {
+			pipelineConfig, err := warppipe.LoadPipelineConfig(config.PipelineConfig)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, warppipe.Stages(pipelineConfig.Stages))
+		}
+
+		if config.EnrichTables != nil || config.EnrichRelated != nil {
+			enrichOpts, err := parseEnrichOptions(config)
+			if err != nil {
+				return err
+			}
+
+			var enrichConnConfig *pgx.ConnConfig
+			if config.EnrichDBHost != "" {
+				replicaConfig := *connConfig
+				replicaConfig.Host = config.EnrichDBHost
+				enrichConnConfig = &replicaConfig
+			}
+			opts = append(opts, warppipe.Enrich(enrichConnConfig, enrichOpts...))
+		}
+
+		if config.DeadLetterFile != "" {
+			f, err := os.OpenFile(config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to open the dead-letter file: %w", err)
+			}
+			defer f.Close()
+			opts = append(opts, warppipe.DeadLetter(warppipe.NewJSONDeadLetterSink(f)))
+		}
+
+		wp, err := warppipe.NewWarpPipe(connConfig, listener, opts...)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -97,11 +166,23 @@ var WarpPipeCmd = &cobra.Command{
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
+
+		if config.ReplicationMode != replicationModeLR {
+			if err := runPruner(ctx, connConfig, config); err != nil {
+				log.Fatal(err)
+			}
+		}
+
 		changes, errors := wp.ListenForChanges(ctx)
+		doneCh := make(chan struct{})
 		go func() {
+			defer close(doneCh)
 			for {
 				select {
-				case change := <-changes:
+				case change, ok := <-changes:
+					if !ok {
+						return
+					}
 					b, err := json.Marshal(change)
 					if err != nil {
 						log.Error(err)
@@ -115,13 +196,45 @@ var WarpPipeCmd = &cobra.Command{
 
 		shutdownCh := make(chan os.Signal, 1)
 		signal.Notify(shutdownCh, os.Interrupt, syscall.SIGTERM)
-		for {
-			<-shutdownCh
-			cancel()
-			if err := wp.Close(); err != nil {
-				return err
+		<-shutdownCh
+
+		// drain the changes in flight, until a second signal or the timeout
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancelShutdown()
+		go func() {
+			select {
+			case <-shutdownCh:
+				cancelShutdown()
+			case <-shutdownCtx.Done():
 			}
-			return nil
-		}
+		}()
+
+		err = wp.Shutdown(shutdownCtx)
+		cancel()
+		<-doneCh
+		return err
 	},
 }
+
+func parseEnrichOptions(config *warppipe.Config) ([]warppipe.EnrichOption, error) {
+	// only add related rows unless tables are set
+	tables := config.EnrichTables
+	if tables == nil {
+		tables = []string{}
+	}
+
+	opts := []warppipe.EnrichOption{
+		warppipe.EnrichTables(tables),
+		warppipe.EnrichCacheSize(config.EnrichCacheSize),
+	}
+
+	for _, r := range config.EnrichRelated {
+		related, err := warppipe.ParseRelatedRows(r)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, warppipe.EnrichRelated(related))
+	}
+
+	return opts, nil
+}
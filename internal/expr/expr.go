@@ -0,0 +1,593 @@
+// Package expr implements a small, CEL-like expression language for row-level
+// changeset filters.
+//
+// Expressions combine literals (numbers, strings, true, false, null, lists),
+// fields of the changeset, and the column functions:
+//
+//	new("column")      the new value of a column, or null
+//	old("column")      the previous value of a column, or null
+//	has_new("column")  true if the changeset has a new value for the column
+//	has_old("column")  true if the changeset has a previous value for the column
+//	changed("column")  true if the new and previous values of the column differ
+//
+// with the operators ==, !=, <, <=, >, >=, in, !, && and ||, and the string
+// functions startsWith, endsWith, contains and matches.
+//
+// Numbers compare exactly, by their decimal value, so that integers beyond
+// 2^53 and numerics keep their precision. Only NaN, infinities and numbers
+// with exponents beyond ±9999 compare as float64; NaN is not equal to, nor
+// ordered against, any number.
+package expr
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is an error in an expression, at a byte offset of its source.
+type Error struct {
+	Src string
+	Pos int
+	Msg string
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at offset %d in `%s`", e.Msg, e.Pos, e.Src)
+}
+
+// Row is the changeset an expression is evaluated against.
+type Row interface {
+	// Field returns the value of a changeset field.
+	Field(name string) interface{}
+	// NewValue returns the new value of a column, and whether it is present.
+	NewValue(column string) (interface{}, bool)
+	// OldValue returns the previous value of a column, and whether it is present.
+	OldValue(column string) (interface{}, bool)
+}
+
+// Program is a compiled expression.
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile parses and type-checks a boolean expression. fields are the names of
+// the changeset fields the expression may refer to.
+func Compile(src string, fields ...string) (*Program, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{src: src, tokens: tokens, fields: make(map[string]bool)}
+	for _, f := range fields {
+		p.fields[f] = true
+	}
+
+	if p.peek().kind == tokenEOF {
+		return nil, p.errorf(0, "empty expression")
+	}
+
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t.pos, "unexpected %s", t)
+	}
+
+	if t := root.typ(); t != typeBool && t != typeDyn {
+		return nil, p.errorf(0, "expression must evaluate to a bool, found %s", t)
+	}
+
+	return &Program{src: src, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (p *Program) String() string {
+	return p.src
+}
+
+// Eval evaluates the expression against a row.
+func (p *Program) Eval(row Row) (bool, error) {
+	v, err := p.root.eval(row)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate `%s`: %w", p.src, err)
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("failed to evaluate `%s`: expected a bool, found %s", p.src, typeOf(v))
+	}
+	return b, nil
+}
+
+type valueType int
+
+const (
+	typeDyn valueType = iota
+	typeBool
+	typeNumber
+	typeString
+	typeNull
+	typeList
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeBool:
+		return "bool"
+	case typeNumber:
+		return "number"
+	case typeString:
+		return "string"
+	case typeNull:
+		return "null"
+	case typeList:
+		return "list"
+	default:
+		return "value"
+	}
+}
+
+func typeOf(v interface{}) valueType {
+	switch v.(type) {
+	case nil:
+		return typeNull
+	case bool:
+		return typeBool
+	case *big.Rat, float64:
+		return typeNumber
+	case string:
+		return typeString
+	case []interface{}:
+		return typeList
+	default:
+		return typeDyn
+	}
+}
+
+// normalize converts column values to the types used by expressions, so that
+// numbers compare by their exact value, timestamps compare as RFC 3339
+// strings, raw JSON compares as its text, and other typed values compare as
+// their string representation.
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case *big.Rat:
+		return n
+	case int:
+		return new(big.Rat).SetInt64(int64(n))
+	case int32:
+		return new(big.Rat).SetInt64(int64(n))
+	case int64:
+		return new(big.Rat).SetInt64(n)
+	case uint32:
+		return new(big.Rat).SetUint64(uint64(n))
+	case uint64:
+		return new(big.Rat).SetUint64(n)
+	case float32:
+		// the shortest decimal of the float, so that 0.1 equals 0.1
+		num, _ := parseNumber(strconv.FormatFloat(float64(n), 'g', -1, 32))
+		return num
+	case float64:
+		num, _ := parseNumber(strconv.FormatFloat(n, 'g', -1, 64))
+		return num
+	case interface {
+		Float64() (float64, error)
+		String() string
+	}:
+		// json.Number and exact decimals
+		if num, ok := parseNumber(n.String()); ok {
+			return num
+		}
+		return math.NaN()
+	case json.RawMessage:
+		return string(n)
+	case []byte:
+		// bytea values, as their hex text
+		return `\x` + hex.EncodeToString(n)
+	case time.Time:
+		return n.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return n.String()
+	case []interface{}:
+		list := make([]interface{}, len(n))
+		for i, item := range n {
+			list[i] = normalize(item)
+		}
+		return list
+	}
+	return v
+}
+
+// Exponents up to which numbers are parsed exactly. Larger ones would take as
+// many digits of memory.
+const maxExactExponent = 9999
+
+// parseNumber parses the text of a number, exactly unless it is NaN, infinite
+// or has a large exponent, in which case it is parsed as a float64.
+func parseNumber(s string) (interface{}, bool) {
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, err := strconv.Atoi(s[i+1:])
+		if err != nil || exp > maxExactExponent || exp < -maxExactExponent {
+			f, err := strconv.ParseFloat(s, 64)
+			return f, err == nil || errors.Is(err, strconv.ErrRange)
+		}
+	}
+
+	if r, ok := new(big.Rat).SetString(s); ok {
+		return r, true
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// compareNumbers compares two numbers, returning false if either is not a
+// number, or if they are unordered, as NaN is.
+func compareNumbers(a, b interface{}) (int, bool) {
+	ra, aIsRat := a.(*big.Rat)
+	rb, bIsRat := b.(*big.Rat)
+	if aIsRat && bIsRat {
+		return ra.Cmp(rb), true
+	}
+
+	fa, ok := numberFloat64(a)
+	if !ok {
+		return 0, false
+	}
+	fb, ok := numberFloat64(b)
+	if !ok {
+		return 0, false
+	}
+
+	switch {
+	case fa < fb:
+		return -1, true
+	case fa > fb:
+		return 1, true
+	case fa == fb:
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// numberFloat64 returns the closest float64 to a number.
+func numberFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case *big.Rat:
+		f, _ := n.Float64()
+		return f, true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+type node interface {
+	eval(row Row) (interface{}, error)
+	// typ is the static type of the node, or typeDyn if only known at runtime.
+	typ() valueType
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(Row) (interface{}, error) { return n.value, nil }
+func (n *literalNode) typ() valueType                { return typeOf(n.value) }
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(row Row) (interface{}, error) {
+	list := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+func (n *listNode) typ() valueType { return typeList }
+
+type fieldNode struct {
+	name string
+}
+
+func (n *fieldNode) eval(row Row) (interface{}, error) { return normalize(row.Field(n.name)), nil }
+func (n *fieldNode) typ() valueType                    { return typeDyn }
+
+type columnNode struct {
+	fn     string
+	column string
+}
+
+func (n *columnNode) eval(row Row) (interface{}, error) {
+	switch n.fn {
+	case "new":
+		v, _ := row.NewValue(n.column)
+		return normalize(v), nil
+	case "old":
+		v, _ := row.OldValue(n.column)
+		return normalize(v), nil
+	case "has_new":
+		_, ok := row.NewValue(n.column)
+		return ok, nil
+	case "has_old":
+		_, ok := row.OldValue(n.column)
+		return ok, nil
+	default: // changed
+		newValue, hasNew := row.NewValue(n.column)
+		oldValue, hasOld := row.OldValue(n.column)
+		return hasNew != hasOld || !equal(normalize(newValue), normalize(oldValue)), nil
+	}
+}
+
+func (n *columnNode) typ() valueType {
+	if n.fn == "new" || n.fn == "old" {
+		return typeDyn
+	}
+	return typeBool
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(row Row) (interface{}, error) {
+	b, err := evalBool(n.operand, row)
+	if err != nil {
+		return nil, err
+	}
+	return !b, nil
+}
+
+func (n *notNode) typ() valueType { return typeBool }
+
+type logicalNode struct {
+	or          bool
+	left, right node
+}
+
+func (n *logicalNode) eval(row Row) (interface{}, error) {
+	left, err := evalBool(n.left, row)
+	if err != nil {
+		return nil, err
+	}
+
+	if left == n.or {
+		return left, nil
+	}
+
+	return evalBool(n.right, row)
+}
+
+func (n *logicalNode) typ() valueType { return typeBool }
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(row Row) (interface{}, error) {
+	left, err := n.left.eval(row)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := n.right.eval(row)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	}
+
+	// Ordering a missing value is false, rather than an error.
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	var c int
+	switch l := left.(type) {
+	case *big.Rat, float64:
+		if typeOf(right) != typeNumber {
+			return nil, fmt.Errorf("cannot compare %s %s %s", typeOf(left), n.op, typeOf(right))
+		}
+		var ordered bool
+		c, ordered = compareNumbers(left, right)
+		if !ordered {
+			return false, nil
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %s %s %s", typeOf(left), n.op, typeOf(right))
+		}
+		c = strings.Compare(l, r)
+	default:
+		return nil, fmt.Errorf("operator %s is not defined on %s", n.op, typeOf(left))
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func (n *compareNode) typ() valueType { return typeBool }
+
+type inNode struct {
+	left, right node
+}
+
+func (n *inNode) eval(row Row) (interface{}, error) {
+	left, err := n.left.eval(row)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := n.right.eval(row)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := right.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("right operand of `in` must be a list, found %s", typeOf(right))
+	}
+
+	for _, item := range list {
+		if equal(left, normalize(item)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (n *inNode) typ() valueType { return typeBool }
+
+type matchesNode struct {
+	operand node
+	re      *regexp.Regexp
+}
+
+func (n *matchesNode) eval(row Row) (interface{}, error) {
+	v, err := n.operand.eval(row)
+	if err != nil || v == nil {
+		return false, err
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("argument 1 of `matches` must be a string, found %s", typeOf(v))
+	}
+	return n.re.MatchString(s), nil
+}
+
+func (n *matchesNode) typ() valueType { return typeBool }
+
+type function struct {
+	params []valueType
+	result valueType
+	call   func(args []interface{}) (interface{}, error)
+}
+
+var functions = map[string]function{
+	"new":        {params: []valueType{typeString}, result: typeDyn},
+	"old":        {params: []valueType{typeString}, result: typeDyn},
+	"has_new":    {params: []valueType{typeString}, result: typeBool},
+	"has_old":    {params: []valueType{typeString}, result: typeBool},
+	"changed":    {params: []valueType{typeString}, result: typeBool},
+	"matches":    {params: []valueType{typeString, typeString}, result: typeBool},
+	"startsWith": {params: []valueType{typeString, typeString}, result: typeBool, call: stringFunc(strings.HasPrefix)},
+	"endsWith":   {params: []valueType{typeString, typeString}, result: typeBool, call: stringFunc(strings.HasSuffix)},
+	"contains":   {params: []valueType{typeString, typeString}, result: typeBool, call: stringFunc(strings.Contains)},
+}
+
+// stringFunc wraps a string predicate. A missing value matches nothing.
+func stringFunc(fn func(s, substr string) bool) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil || args[1] == nil {
+			return false, nil
+		}
+
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("argument 1 must be a string, found %s", typeOf(args[0]))
+		}
+		substr, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("argument 2 must be a string, found %s", typeOf(args[1]))
+		}
+		return fn(s, substr), nil
+	}
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(row Row) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	v, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return v, nil
+}
+
+func (n *callNode) typ() valueType { return n.fn.result }
+
+func evalBool(n node, row Row) (bool, error) {
+	v, err := n.eval(row)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("logical operand must be a bool, found %s", typeOf(v))
+	}
+	return b, nil
+}
+
+func equal(a, b interface{}) bool {
+	if typeOf(a) == typeNumber && typeOf(b) == typeNumber {
+		c, ordered := compareNumbers(a, b)
+		return ordered && c == 0
+	}
+
+	if la, ok := a.([]interface{}); ok {
+		lb, ok := b.([]interface{})
+		if !ok || len(la) != len(lb) {
+			return false
+		}
+		for i := range la {
+			if !equal(la[i], lb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
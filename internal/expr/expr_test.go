@@ -0,0 +1,186 @@
+package expr
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRow struct {
+	fields    map[string]interface{}
+	newValues map[string]interface{}
+	oldValues map[string]interface{}
+}
+
+func (r *testRow) Field(name string) interface{} {
+	return r.fields[name]
+}
+
+func (r *testRow) NewValue(column string) (interface{}, bool) {
+	v, ok := r.newValues[column]
+	return v, ok
+}
+
+func (r *testRow) OldValue(column string) (interface{}, bool) {
+	v, ok := r.oldValues[column]
+	return v, ok
+}
+
+var fields = []string{"id", "kind", "table"}
+
+func TestEval(t *testing.T) {
+	row := &testRow{
+		fields: map[string]interface{}{"id": int64(7), "kind": "update", "table": "orders"},
+		newValues: map[string]interface{}{
+			"status":     "shipped",
+			"tenant_id":  float64(42),
+			"total":      float64(99.5),
+			"email":      "bob@example.com",
+			"note":       nil,
+			"amount":     json.Number("12.50"),
+			"tags":       []interface{}{int64(1), int64(2)},
+			"shipped_at": time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			"signature":  []byte{0xde, 0xad},
+		},
+		oldValues: map[string]interface{}{
+			"status":    "pending",
+			"tenant_id": float64(42),
+		},
+	}
+
+	testCases := []struct {
+		expr   string
+		result bool
+	}{
+		{`table == "orders" && changed("status")`, true},
+		{`table == 'orders' && changed("tenant_id")`, false},
+		{`new("tenant_id") != 42`, false},
+		{`new("tenant_id") == 42 || id > 100`, true},
+		{`!(kind == "insert")`, true},
+		{`kind in ["insert", "update"]`, true},
+		{`new("tenant_id") in [1, 2, 3]`, false},
+		{`new("total") >= 99.5 && new("total") < 1e3`, true},
+		{`new("missing") > 0`, false},
+		{`new("missing") == null && !has_new("missing") && has_new("note")`, true},
+		{`has_old("status") && old("status") == "pending"`, true},
+		{`startsWith(new("email"), "bob") && endsWith(new("email"), ".com")`, true},
+		{`contains(new("email"), "@example") && matches(new("email"), "^[a-z]+@")`, true},
+		{`matches(new("missing"), ".*")`, false},
+		{`id == 7`, true},
+		{`new("amount") > 12 && 2 in new("tags")`, true},
+		{`new("shipped_at") > "2020-01-01" && startsWith(new("shipped_at"), "2020-01-02T03:04:05")`, true},
+		{`new("signature") == "\\xdead"`, true},
+		// && and || short-circuit, so the type error is not evaluated
+		{`false && new("status") > 1`, false},
+	}
+
+	for _, tc := range testCases {
+		p, err := Compile(tc.expr, fields...)
+		if !assert.NoError(t, err, tc.expr) {
+			continue
+		}
+
+		result, err := p.Eval(row)
+		assert.NoError(t, err, tc.expr)
+		assert.Equal(t, tc.result, result, tc.expr)
+	}
+}
+
+func TestEvalNumbers(t *testing.T) {
+	row := &testRow{
+		newValues: map[string]interface{}{
+			"id":      int64(9007199254740993),
+			"big_id":  json.Number("9007199254740993"),
+			"total":   json.Number("12345678901234567890.0123456789"),
+			"ratio":   float64(0.1),
+			"invalid": json.Number("1.2.3"),
+			"nan":     json.Number("NaN"),
+			"huge":    json.Number("1e400"),
+		},
+	}
+
+	testCases := []struct {
+		expr   string
+		result bool
+	}{
+		// integers beyond 2^53 are not rounded to their neighbours
+		{`new("id") == 9007199254740993`, true},
+		{`new("id") == 9007199254740992`, false},
+		{`new("id") > 9007199254740992`, true},
+		{`new("big_id") == new("id") && new("big_id") in [9007199254740993]`, true},
+		{`new("total") > 12345678901234567890.0123456788`, true},
+		{`new("total") == 12345678901234567890.0123456789`, true},
+		{`new("ratio") == 0.1 && new("ratio") == 1e-1`, true},
+		// values that are not numbers compare as NaN, unordered and unequal
+		{`new("invalid") > 0 || new("invalid") <= 0 || new("invalid") == 0`, false},
+		{`new("nan") >= 0 || new("nan") < 0 || new("nan") == new("nan")`, false},
+		// numbers beyond the exact exponents compare as float64
+		{`new("huge") > 1e308`, true},
+	}
+
+	for _, tc := range testCases {
+		p, err := Compile(tc.expr, fields...)
+		if !assert.NoError(t, err, tc.expr) {
+			continue
+		}
+
+		result, err := p.Eval(row)
+		assert.NoError(t, err, tc.expr)
+		assert.Equal(t, tc.result, result, tc.expr)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	row := &testRow{
+		newValues: map[string]interface{}{"status": "shipped", "count": float64(1)},
+	}
+
+	for _, src := range []string{
+		`new("status") > 1`,
+		`new("count") && true`,
+		`new("status")`,
+		`startsWith(new("count"), "1")`,
+	} {
+		p, err := Compile(src, fields...)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+
+		_, err = p.Eval(row)
+		assert.Error(t, err, src)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	testCases := []struct {
+		expr string
+		err  string
+	}{
+		{``, "empty expression at offset 0"},
+		{`table ==`, "unexpected end of expression at offset 8"},
+		{`table == "orders`, "unterminated string at offset 9"},
+		{`tabel == "orders"`, "unknown field `tabel` at offset 0"},
+		{`table = "orders"`, "unexpected character '=' at offset 6"},
+		{`(table == "orders"`, "expected \")\", found end of expression at offset 18"},
+		{`table == "orders" kind`, "unexpected \"kind\" at offset 18"},
+		{`lower(table) == "orders"`, "unknown function `lower` at offset 0"},
+		{`new("a", "b") == 1`, "function `new` takes 1 arguments, found 2 at offset 0"},
+		{`new(table) == 1`, "argument of `new` must be a column name literal at offset 0"},
+		{`matches(table, "(")`, "invalid pattern: error parsing regexp: missing closing ): `(` at offset 0"},
+		{`1 == "1"`, "cannot compare number == string at offset 2"},
+		{`true < false`, "operator < is not defined on bool at offset 5"},
+		{`1 && true`, "logical operand must be a bool, found number at offset 2"},
+		{`kind in "insert"`, "right operand of `in` must be a list, found string at offset 5"},
+		{`new("a")  == 1 || 1`, "logical operand must be a bool, found number at offset 15"},
+		{`"orders"`, "expression must evaluate to a bool, found string at offset 0"},
+	}
+
+	for _, tc := range testCases {
+		_, err := Compile(tc.expr, fields...)
+		if assert.Error(t, err, tc.expr) {
+			assert.Equal(t, tc.err+" in `"+tc.expr+"`", err.Error())
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// Operators, longest first so that `<=` is not read as `<`.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[start:i], pos: start})
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || strings.ContainsRune(".eE", rune(src[i])) ||
+				((src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			s, n, err := unquote(src[i:])
+			if err != nil {
+				return nil, &Error{Src: src, Pos: start, Msg: err.Error()}
+			}
+			i += n
+			tokens = append(tokens, token{kind: tokenString, text: s, pos: start})
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &Error{Src: src, Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// unquote reads a quoted string from the start of s, returning its value and
+// the number of bytes read.
+func unquote(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '\'':
+				b.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("invalid escape sequence \\%c", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+	fields map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOp && t.text == op
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &Error{Src: p.src, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(op string) error {
+	t := p.next()
+	if t.kind != tokenOp || t.text != op {
+		return p.errorf(t.pos, "expected %q, found %s", op, t)
+	}
+	return nil
+}
+
+// parseExpr parses `or`, the lowest precedence level.
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("||") {
+		t := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkBool(t.pos, left, right); err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("&&") {
+		t := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkBool(t.pos, left, right); err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") {
+		t := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkBool(t.pos, operand); err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokenOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+
+		lt, rt := left.typ(), right.typ()
+		if lt != typeDyn && rt != typeDyn && lt != typeNull && rt != typeNull && lt != rt {
+			return nil, p.errorf(t.pos, "cannot compare %s %s %s", lt, t.text, rt)
+		}
+		if t.text != "==" && t.text != "!=" {
+			for _, vt := range []valueType{lt, rt} {
+				if vt == typeBool || vt == typeList {
+					return nil, p.errorf(t.pos, "operator %s is not defined on %s", t.text, vt)
+				}
+			}
+		}
+		return &compareNode{op: t.text, left: left, right: right}, nil
+	case t.kind == tokenIdent && t.text == "in":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if rt := right.typ(); rt != typeList && rt != typeDyn {
+			return nil, p.errorf(t.pos, "right operand of `in` must be a list, found %s", rt)
+		}
+		return &inNode{left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		num, ok := parseNumber(t.text)
+		if !ok {
+			return nil, p.errorf(t.pos, "invalid number %s", t.text)
+		}
+		return &literalNode{value: num}, nil
+	case tokenString:
+		return &literalNode{value: t.text}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+
+		if p.isOp("(") {
+			return p.parseCall(t)
+		}
+
+		if !p.fields[t.text] {
+			return nil, p.errorf(t.pos, "unknown field `%s`", t.text)
+		}
+		return &fieldNode{name: t.text}, nil
+	case tokenOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			list := &listNode{}
+			for !p.isOp("]") {
+				n, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, n)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			return list, p.expect("]")
+		}
+	}
+
+	return nil, p.errorf(t.pos, "unexpected %s", t)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	p.next() // (
+
+	var args []node
+	for !p.isOp(")") {
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, n)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, p.errorf(name.pos, "unknown function `%s`", name.text)
+	}
+
+	if len(args) != len(fn.params) {
+		return nil, p.errorf(name.pos, "function `%s` takes %d arguments, found %d", name.text, len(fn.params), len(args))
+	}
+
+	for i, param := range fn.params {
+		if at := args[i].typ(); at != typeDyn && at != param {
+			return nil, p.errorf(name.pos, "argument %d of `%s` must be a %s, found %s", i+1, name.text, param, at)
+		}
+	}
+
+	switch name.text {
+	case "new", "old", "has_new", "has_old", "changed":
+		column, ok := args[0].(*literalNode)
+		if !ok {
+			return nil, p.errorf(name.pos, "argument of `%s` must be a column name literal", name.text)
+		}
+		return &columnNode{fn: name.text, column: column.value.(string)}, nil
+	case "matches":
+		pattern, ok := args[1].(*literalNode)
+		if !ok {
+			return nil, p.errorf(name.pos, "pattern of `matches` must be a string literal")
+		}
+		re, err := regexp.Compile(pattern.value.(string))
+		if err != nil {
+			return nil, p.errorf(name.pos, "invalid pattern: %v", err)
+		}
+		return &matchesNode{operand: args[0], re: re}, nil
+	}
+
+	return &callNode{name: name.text, fn: fn, args: args}, nil
+}
+
+func (p *parser) checkBool(pos int, operands ...node) error {
+	for _, n := range operands {
+		if t := n.typ(); t != typeBool && t != typeDyn {
+			return p.errorf(pos, "logical operand must be a bool, found %s", t)
+		}
+	}
+	return nil
+}
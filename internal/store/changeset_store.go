@@ -15,6 +15,18 @@ var (
 
 const (
 	paginationDefaultLimit = 500
+	deleteDefaultBatchSize = 1000
+
+	changesetsCursorName = "warp_pipe_changesets_cursor"
+	changesetsColumns    = `
+			id,
+			ts,
+			action,
+			schema_name,
+			table_name,
+			relid,
+			new_values,
+			old_values`
 )
 
 // Event represents an entry in the events store.
@@ -27,25 +39,83 @@ type Event struct {
 	OID        int64
 	NewValues  []byte
 	OldValues  []byte
+	// JSON object of the Postgres types of the columns, or nil if the store
+	// predates column type tracking.
+	ColumnTypes []byte
+	// ID of the transaction that wrote the event, or 0 if the store predates
+	// transaction tracking.
+	TxID int64
 }
 
 // EventStore is the interface for providing access to events storage.
 type EventStore interface {
 	GetByID(ctx context.Context, eventID int64) (*Event, error)
+	GetByIDs(ctx context.Context, eventIDs []int64) ([]*Event, error)
 	GetSinceID(ctx context.Context, eventID int64, eventCh chan *Event, doneCh chan bool, errCh chan error)
 	GetSinceTimestamp(ctx context.Context, since time.Time, eventCh chan *Event, doneCh chan bool, errCh chan error)
-	DeleteBeforeID(ctx context.Context, eventID int64) error
-	DeleteBeforeTimestamp(ctx context.Context, since time.Time) error
+	DeleteBeforeID(ctx context.Context, eventID int64) (int64, error)
+	DeleteBeforeTimestamp(ctx context.Context, since time.Time) (int64, error)
+	AckConsumer(ctx context.Context, consumer string, eventID int64) error
+	GetAcknowledgedID(ctx context.Context) (int64, error)
+	GetLatestID(ctx context.Context) (int64, error)
+	HasTxID(ctx context.Context) (bool, error)
+	GetSnapshot(ctx context.Context) (*Snapshot, error)
+	GetCommittedBetween(ctx context.Context, since, until *Snapshot) ([]*Event, error)
+}
+
+// Option is a ChangesetStore option function.
+type Option func(*ChangesetStore)
+
+// DeleteBatchSize is an option for setting the maximum number of rows removed
+// by a single DELETE statement when pruning.
+func DeleteBatchSize(size int) Option {
+	return func(s *ChangesetStore) {
+		s.deleteBatchSize = size
+	}
+}
+
+// PageSize is an option for setting the number of events read per query when
+// streaming events.
+func PageSize(size int) Option {
+	return func(s *ChangesetStore) {
+		s.pageSize = size
+	}
+}
+
+// UseCursor is an option for streaming events through a server-side cursor,
+// instead of issuing one query per page.
+func UseCursor() Option {
+	return func(s *ChangesetStore) {
+		s.useCursor = true
+	}
 }
 
 // ChangesetStore is an EventStore for changesets.
 type ChangesetStore struct {
-	conn *pgx.Conn
+	conn            *pgx.Conn
+	pageSize        int
+	useCursor       bool
+	deleteBatchSize int
+	hasColumns      map[string]bool
 }
 
 // NewChangesetStore initializes a new ChangesetStore.
-func NewChangesetStore(conn *pgx.Conn) *ChangesetStore {
-	return &ChangesetStore{conn: conn}
+func NewChangesetStore(conn *pgx.Conn, opts ...Option) *ChangesetStore {
+	s := &ChangesetStore{conn: conn, hasColumns: make(map[string]bool)}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.pageSize <= 0 {
+		s.pageSize = paginationDefaultLimit
+	}
+
+	if s.deleteBatchSize <= 0 {
+		s.deleteBatchSize = deleteDefaultBatchSize
+	}
+
+	return s
 }
 
 func (s *ChangesetStore) scanRow(rows *pgx.Rows) (*Event, error) {
@@ -59,13 +129,55 @@ func (s *ChangesetStore) scanRow(rows *pgx.Rows) (*Event, error) {
 		&evt.OID,
 		&evt.NewValues,
 		&evt.OldValues,
+		&evt.TxID,
+		&evt.ColumnTypes,
 	)
 
 	return &evt, err
 }
 
-func (s *ChangesetStore) get(id int64) (*Event, error) {
-	events, err := s.query("SELECT * FROM warp_pipe.changesets WHERE id = $1", id)
+// columns returns the select list for events. Changesets tables created before
+// transaction tracking was introduced report a zero TxID, and those created
+// before column type tracking report NULL column types.
+func (s *ChangesetStore) columns(ctx context.Context) (string, error) {
+	hasTxID, err := s.HasTxID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	hasColumnTypes, err := s.hasColumn(ctx, "column_types")
+	if err != nil {
+		return "", err
+	}
+
+	cols := changesetsColumns
+	if hasTxID {
+		// rows written before the txid column was added have no txid
+		cols += `,
+			COALESCE(txid, 0) AS txid`
+	} else {
+		cols += `,
+			0::BIGINT AS txid`
+	}
+
+	if hasColumnTypes {
+		cols += `,
+			column_types`
+	} else {
+		cols += `,
+			NULL::JSON AS column_types`
+	}
+
+	return cols, nil
+}
+
+func (s *ChangesetStore) get(ctx context.Context, id int64) (*Event, error) {
+	cols, err := s.columns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := s.query(ctx, "SELECT"+cols+" FROM warp_pipe.changesets WHERE id = $1", id)
 	if err != nil {
 		return nil, err
 	}
@@ -77,11 +189,16 @@ func (s *ChangesetStore) get(id int64) (*Event, error) {
 	return events[0], nil
 }
 
-func (s *ChangesetStore) query(sql string, args ...interface{}) ([]*Event, error) {
-	rows, err := s.conn.Query(sql, args...)
+func (s *ChangesetStore) query(ctx context.Context, sql string, args ...interface{}) ([]*Event, error) {
+	rows, err := s.conn.QueryEx(ctx, sql, nil, args...)
 	if err != nil {
 		return nil, err
 	}
+
+	return s.scanRows(rows)
+}
+
+func (s *ChangesetStore) scanRows(rows *pgx.Rows) ([]*Event, error) {
 	defer rows.Close()
 
 	var events []*Event
@@ -94,114 +211,353 @@ func (s *ChangesetStore) query(sql string, args ...interface{}) ([]*Event, error
 		events = append(events, evt)
 	}
 
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
 	return events, nil
 }
 
-func (s *ChangesetStore) exec(sql string, args ...interface{}) error {
-	return nil
+func (s *ChangesetStore) exec(ctx context.Context, sql string, args ...interface{}) (int64, error) {
+	ct, err := s.conn.ExecEx(ctx, sql, nil, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return ct.RowsAffected(), nil
 }
 
-// GetByID gets an event by ID.
-func (s *ChangesetStore) GetByID(ctx context.Context, eventID int64) (*Event, error) {
-	return s.get(eventID)
+// sendEvents sends events on eventCh, returning false if the context was
+// cancelled before all events were sent.
+func (s *ChangesetStore) sendEvents(ctx context.Context, events []*Event, eventCh chan *Event) bool {
+	for _, event := range events {
+		select {
+		case eventCh <- event:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
 }
 
-// GetSinceID returns all events after a given ID.
-func (s *ChangesetStore) GetSinceID(ctx context.Context, eventID int64, eventCh chan *Event, doneCh chan bool, errCh chan error) {
-	sql := `
-		SELECT
-			id,
-			ts,
-			action,
-			schema_name,
-			table_name,	
-			relid,
-			new_values,
-			old_values
-		FROM warp_pipe.changesets
-			WHERE id >= $1
-			ORDER BY id 
-			LIMIT %d
-			OFFSET %d`
+func (s *ChangesetStore) sendDone(ctx context.Context, doneCh chan bool) {
+	select {
+	case doneCh <- true:
+	case <-ctx.Done():
+	}
+}
 
-	offset := 0
+func (s *ChangesetStore) sendError(ctx context.Context, err error, errCh chan error) {
+	select {
+	case errCh <- err:
+	case <-ctx.Done():
+	}
+}
+
+// paginate streams events page by page using keyset pagination. firstPage
+// returns the query and arguments for the first page, nextPage those for the
+// page following the last event read.
+func (s *ChangesetStore) paginate(
+	ctx context.Context,
+	firstPage func() (string, []interface{}),
+	nextPage func(last *Event) (string, []interface{}),
+	eventCh chan *Event,
+	doneCh chan bool,
+	errCh chan error,
+) {
+	sql, args := firstPage()
 	for {
-		evts, err := s.query(fmt.Sprintf(sql, paginationDefaultLimit, offset), eventID)
+		evts, err := s.query(ctx, fmt.Sprintf("%s LIMIT %d", sql, s.pageSize), args...)
 		if err != nil {
-			errCh <- err
+			s.sendError(ctx, err, errCh)
 			return
 		}
 
-		for _, event := range evts {
-			eventCh <- event
+		if !s.sendEvents(ctx, evts, eventCh) {
+			return
 		}
 
-		if len(evts) < paginationDefaultLimit {
-			doneCh <- true
+		if len(evts) < s.pageSize {
+			s.sendDone(ctx, doneCh)
 			return
 		}
 
-		offset += len(evts)
+		sql, args = nextPage(evts[len(evts)-1])
 	}
 }
 
-// GetSinceTimestamp returns all events after a given timestamp.
-func (s *ChangesetStore) GetSinceTimestamp(ctx context.Context, since time.Time, eventCh chan *Event, doneCh chan bool, errCh chan error) {
-	sql := `
-		SELECT
-			id,
-			ts,
-			action,
-			schema_name,
-			table_name,	
-			relid,
-			new_values,
-			old_values
-		FROM warp_pipe.changesets
-			WHERE ts >= $1
-			ORDER BY ts
-			LIMIT %d
-			OFFSET %d`
+// stream streams all events returned by the query through a server-side
+// cursor, fetching one page at a time. The arguments are bound when the cursor
+// is declared.
+func (s *ChangesetStore) stream(ctx context.Context, sql string, args []interface{}, eventCh chan *Event, doneCh chan bool, errCh chan error) {
+	tx, err := s.conn.BeginEx(ctx, &pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		s.sendError(ctx, err, errCh)
+		return
+	}
+	defer tx.Rollback()
 
-	offset := 0
+	_, err = tx.ExecEx(ctx, fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", changesetsCursorName, sql), nil, args...)
+	if err != nil {
+		s.sendError(ctx, err, errCh)
+		return
+	}
+
+	fetchSQL := fmt.Sprintf("FETCH FORWARD %d FROM %s", s.pageSize, changesetsCursorName)
 	for {
-		evts, err := s.query(fmt.Sprintf(sql, paginationDefaultLimit, offset), since)
+		rows, err := tx.QueryEx(ctx, fetchSQL, nil)
 		if err != nil {
-			errCh <- err
+			s.sendError(ctx, err, errCh)
 			return
 		}
 
-		for _, event := range evts {
-			eventCh <- event
+		evts, err := s.scanRows(rows)
+		if err != nil {
+			s.sendError(ctx, err, errCh)
+			return
 		}
 
-		if len(evts) < paginationDefaultLimit {
-			doneCh <- true
+		if !s.sendEvents(ctx, evts, eventCh) {
 			return
 		}
 
-		offset += len(evts)
+		if len(evts) < s.pageSize {
+			s.sendDone(ctx, doneCh)
+			return
+		}
 	}
 }
 
-// DeleteBeforeID deletes all events before a given ID.
-func (s *ChangesetStore) DeleteBeforeID(ctx context.Context, eventID int64) error {
-	return s.exec(`
+// deleteInBatches deletes all changesets matching the where clause, at most
+// deleteBatchSize rows at a time, so that no single statement holds its locks
+// for long. It returns the total number of deleted rows.
+func (s *ChangesetStore) deleteInBatches(ctx context.Context, where string, args ...interface{}) (int64, error) {
+	sql := fmt.Sprintf(`
 		DELETE FROM warp_pipe.changesets
-			WHERE id < $1`,
-		eventID,
+			WHERE id IN (
+				SELECT id FROM warp_pipe.changesets
+					WHERE %s
+					ORDER BY id
+					LIMIT %d
+			)`, where, s.deleteBatchSize)
+
+	var deleted int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		n, err := s.exec(ctx, sql, args...)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+
+		if n < int64(s.deleteBatchSize) {
+			return deleted, nil
+		}
+	}
+}
+
+// GetByID gets an event by ID.
+func (s *ChangesetStore) GetByID(ctx context.Context, eventID int64) (*Event, error) {
+	return s.get(ctx, eventID)
+}
+
+// GetByIDs gets the events with the given IDs, in ID order. IDs that don't
+// exist are skipped.
+func (s *ChangesetStore) GetByIDs(ctx context.Context, eventIDs []int64) ([]*Event, error) {
+	cols, err := s.columns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.query(ctx, "SELECT"+cols+" FROM warp_pipe.changesets WHERE id = ANY($1) ORDER BY id", eventIDs)
+}
+
+// GetSinceID returns all events starting from a given ID, in ID order.
+func (s *ChangesetStore) GetSinceID(ctx context.Context, eventID int64, eventCh chan *Event, doneCh chan bool, errCh chan error) {
+	cols, err := s.columns(ctx)
+	if err != nil {
+		s.sendError(ctx, err, errCh)
+		return
+	}
+
+	if s.useCursor {
+		s.stream(ctx, `
+			SELECT`+cols+`
+			FROM warp_pipe.changesets
+				WHERE id >= $1
+				ORDER BY id`,
+			[]interface{}{eventID}, eventCh, doneCh, errCh)
+		return
+	}
+
+	sql := `
+		SELECT` + cols + `
+		FROM warp_pipe.changesets
+			WHERE id > $1
+			ORDER BY id`
+
+	s.paginate(ctx,
+		func() (string, []interface{}) {
+			return sql, []interface{}{eventID - 1}
+		},
+		func(last *Event) (string, []interface{}) {
+			return sql, []interface{}{last.ID}
+		},
+		eventCh, doneCh, errCh,
 	)
 }
 
-// DeleteBeforeTimestamp deletes all events before a given timestamp.
-func (s *ChangesetStore) DeleteBeforeTimestamp(ctx context.Context, ts time.Time) error {
-	return s.exec(`
-		DELETE FROM warp_pipe.changesets
-			WHERE ts < $1`,
-		ts,
+// GetSinceTimestamp returns all events starting from a given timestamp, in
+// timestamp order. Events sharing a timestamp are returned in ID order.
+func (s *ChangesetStore) GetSinceTimestamp(ctx context.Context, since time.Time, eventCh chan *Event, doneCh chan bool, errCh chan error) {
+	cols, err := s.columns(ctx)
+	if err != nil {
+		s.sendError(ctx, err, errCh)
+		return
+	}
+
+	if s.useCursor {
+		s.stream(ctx, `
+			SELECT`+cols+`
+			FROM warp_pipe.changesets
+				WHERE ts >= $1
+				ORDER BY ts, id`,
+			[]interface{}{since}, eventCh, doneCh, errCh)
+		return
+	}
+
+	s.paginate(ctx,
+		func() (string, []interface{}) {
+			return `
+				SELECT` + cols + `
+				FROM warp_pipe.changesets
+					WHERE ts >= $1
+					ORDER BY ts, id`, []interface{}{since}
+		},
+		func(last *Event) (string, []interface{}) {
+			return `
+				SELECT` + cols + `
+				FROM warp_pipe.changesets
+					WHERE (ts, id) > ($1, $2)
+					ORDER BY ts, id`, []interface{}{last.Timestamp, last.ID}
+		},
+		eventCh, doneCh, errCh,
+	)
+}
+
+// DeleteBeforeID deletes all events before a given ID and returns the number
+// of deleted events.
+func (s *ChangesetStore) DeleteBeforeID(ctx context.Context, eventID int64) (int64, error) {
+	return s.deleteInBatches(ctx, "id < $1", eventID)
+}
+
+// DeleteBeforeTimestamp deletes all events before a given timestamp and returns
+// the number of deleted events.
+func (s *ChangesetStore) DeleteBeforeTimestamp(ctx context.Context, ts time.Time) (int64, error) {
+	return s.deleteInBatches(ctx, "ts < $1", ts)
+}
+
+// AckConsumer records that a consumer has processed all events up to and
+// including the given ID. A consumer is registered on its first ack, and its
+// acknowledged ID never moves backwards.
+func (s *ChangesetStore) AckConsumer(ctx context.Context, consumer string, eventID int64) error {
+	_, err := s.exec(ctx, `
+		INSERT INTO warp_pipe.consumers (name, last_acked_id)
+			VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET
+				last_acked_id = GREATEST(warp_pipe.consumers.last_acked_id, EXCLUDED.last_acked_id),
+				updated_at = NOW()`,
+		consumer, eventID,
+	)
+
+	return err
+}
+
+// GetAcknowledgedID returns the highest event ID that has been acknowledged by
+// every registered consumer, or 0 if there are no registered consumers.
+func (s *ChangesetStore) GetAcknowledgedID(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.conn.QueryRowEx(ctx, `SELECT COALESCE(MIN(last_acked_id), 0) FROM warp_pipe.consumers`, nil).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetLatestID returns the ID of the latest event, or 0 if there are no events.
+func (s *ChangesetStore) GetLatestID(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.conn.QueryRowEx(ctx, `SELECT COALESCE(MAX(id), 0) FROM warp_pipe.changesets`, nil).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// HasTxID returns true if the changesets table records the ID of the
+// transaction that wrote each changeset.
+func (s *ChangesetStore) HasTxID(ctx context.Context) (bool, error) {
+	return s.hasColumn(ctx, "txid")
+}
+
+// hasColumn returns true if the changesets table has the column, which may be
+// missing from tables created by older versions.
+func (s *ChangesetStore) hasColumn(ctx context.Context, column string) (bool, error) {
+	if has, ok := s.hasColumns[column]; ok {
+		return has, nil
+	}
+
+	var has bool
+	err := s.conn.QueryRowEx(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.columns
+				WHERE table_schema = 'warp_pipe'
+				AND table_name = 'changesets'
+				AND column_name = $1
+		)`, nil, column,
+	).Scan(&has)
+	if err != nil {
+		return false, err
+	}
+
+	s.hasColumns[column] = has
+	return has, nil
+}
+
+// GetSnapshot returns the current transaction snapshot.
+func (s *ChangesetStore) GetSnapshot(ctx context.Context) (*Snapshot, error) {
+	var snapshot string
+	err := s.conn.QueryRowEx(ctx, `SELECT txid_current_snapshot()::TEXT`, nil).Scan(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSnapshot(snapshot)
+}
+
+// GetCommittedBetween returns, in ID order, all events written by transactions
+// that had not completed at the since snapshot but had completed at the until
+// snapshot. Successive calls with adjacent snapshots return every committed
+// event exactly once, regardless of the order in which transactions committed.
+func (s *ChangesetStore) GetCommittedBetween(ctx context.Context, since, until *Snapshot) ([]*Event, error) {
+	cols, err := s.columns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.query(ctx, `
+		SELECT`+cols+`
+		FROM warp_pipe.changesets
+			WHERE txid >= $1
+			AND txid < $2
+			AND txid_visible_in_snapshot(txid, $3::TEXT::txid_snapshot)
+			AND NOT txid_visible_in_snapshot(txid, $4::TEXT::txid_snapshot)
+			ORDER BY id`,
+		since.Xmin, until.Xmax, until.String(), since.String(),
 	)
 }
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Snapshot is a transaction snapshot, as returned by `txid_current_snapshot()`.
+// It determines which transactions had committed when it was taken.
+type Snapshot struct {
+	// Earliest transaction ID that was still active.
+	Xmin int64
+	// First as-yet-unassigned transaction ID.
+	Xmax int64
+	// Transaction IDs that were active between Xmin and Xmax.
+	Xip []int64
+}
+
+// ParseSnapshot parses a snapshot from its text representation `xmin:xmax:xip_list`.
+func ParseSnapshot(snapshot string) (*Snapshot, error) {
+	parts := strings.Split(snapshot, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid txid snapshot: %s", snapshot)
+	}
+
+	xmin, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid txid snapshot xmin: %w", err)
+	}
+
+	xmax, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid txid snapshot xmax: %w", err)
+	}
+
+	s := &Snapshot{Xmin: xmin, Xmax: xmax}
+	if parts[2] != "" {
+		for _, txid := range strings.Split(parts[2], ",") {
+			xip, err := strconv.ParseInt(txid, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid txid snapshot xip: %w", err)
+			}
+			s.Xip = append(s.Xip, xip)
+		}
+	}
+
+	return s, nil
+}
+
+// Visible returns true if the transaction had already completed when the
+// snapshot was taken, mirroring `txid_visible_in_snapshot()`.
+func (s *Snapshot) Visible(txid int64) bool {
+	if txid < s.Xmin {
+		return true
+	}
+
+	if txid >= s.Xmax {
+		return false
+	}
+
+	for _, xip := range s.Xip {
+		if xip == txid {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String implements Stringer, returning the text representation of the snapshot.
+func (s *Snapshot) String() string {
+	xip := make([]string, len(s.Xip))
+	for i, txid := range s.Xip {
+		xip[i] = strconv.FormatInt(txid, 10)
+	}
+
+	return fmt.Sprintf("%d:%d:%s", s.Xmin, s.Xmax, strings.Join(xip, ","))
+}
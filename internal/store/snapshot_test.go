@@ -0,0 +1,50 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSnapshot(t *testing.T) {
+	s, err := ParseSnapshot("10:20:10,15")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), s.Xmin)
+	assert.Equal(t, int64(20), s.Xmax)
+	assert.Equal(t, []int64{10, 15}, s.Xip)
+	assert.Equal(t, "10:20:10,15", s.String())
+
+	s, err = ParseSnapshot("10:10:")
+	assert.NoError(t, err)
+	assert.Empty(t, s.Xip)
+	assert.Equal(t, "10:10:", s.String())
+
+	_, err = ParseSnapshot("10:20")
+	assert.Error(t, err)
+
+	_, err = ParseSnapshot("a:20:")
+	assert.Error(t, err)
+}
+
+func TestSnapshotVisible(t *testing.T) {
+	s, err := ParseSnapshot("10:20:10,15")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		txid    int64
+		visible bool
+	}{
+		{txid: 9, visible: true},
+		{txid: 10, visible: false},
+		{txid: 12, visible: true},
+		{txid: 13, visible: true},
+		{txid: 15, visible: false},
+		{txid: 19, visible: true},
+		{txid: 20, visible: false},
+		{txid: 21, visible: false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.visible, s.Visible(tc.txid), "txid %d", tc.txid)
+	}
+}
@@ -12,3 +12,10 @@ type Listener interface {
 	ListenForChanges(context.Context) (chan *Changeset, chan error)
 	Close() error
 }
+
+// Checkpointer is implemented by listeners that persist their position in the
+// source, so that a restarted listener resumes after the changesets processed
+// before a shutdown. WarpPipe.Shutdown() calls it once the pipeline is drained.
+type Checkpointer interface {
+	Checkpoint(context.Context) error
+}
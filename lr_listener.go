@@ -2,9 +2,9 @@ package warppipe
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -58,9 +58,13 @@ type LogicalReplicationListener struct {
 	replConn                     *pgx.ReplicationConn
 	replSlotName                 string
 	replLSN                      uint64
+	deliveredLSN                 uint64
+	statusMu                     sync.Mutex
 	replSnapshot                 string
 	wal2jsonArgs                 []string
 	connHeartbeatIntervalSeconds int
+	tableColumns                 map[string][]tableColumn
+	readTableColumns             func(table string) ([]tableColumn, error)
 	changesetsCh                 chan *Changeset
 	errCh                        chan error
 	logger                       *log.Entry
@@ -71,7 +75,9 @@ func NewLogicalReplicationListener(opts ...LROption) *LogicalReplicationListener
 	l := &LogicalReplicationListener{
 		logger:       log.WithFields(log.Fields{"component": "listener"}),
 		wal2jsonArgs: defaultWal2jsonArgs,
+		tableColumns: make(map[string][]tableColumn),
 	}
+	l.readTableColumns = l.queryTableColumns
 
 	for _, opt := range opts {
 		opt(l)
@@ -149,6 +155,9 @@ func (l *LogicalReplicationListener) ListenForChanges(ctx context.Context) (chan
 
 	// loop - listen for messages
 	go func() {
+		// closing the channel lets the pipeline drain once the listener stops
+		defer close(l.changesetsCh)
+
 		for {
 			if !l.replConn.IsAlive() {
 				log.WithField("conn_err", l.replConn.CauseOfDeath()).Error(
@@ -163,11 +172,18 @@ func (l *LogicalReplicationListener) ListenForChanges(ctx context.Context) (chan
 					return
 				}
 				log.WithError(err).Error("encountered an error while waiting for replication message")
-				l.errCh <- err
+				l.sendError(ctx, err)
 			}
 
 			if msg != nil && msg.WalMessage != nil {
-				l.processMessage(msg)
+				if !l.processMessage(ctx, msg) {
+					if ctx.Err() != nil {
+						log.Info("shutting down...")
+					} else {
+						l.logger.Error("stopping the listener")
+					}
+					return
+				}
 			} else {
 				continue
 			}
@@ -175,7 +191,9 @@ func (l *LogicalReplicationListener) ListenForChanges(ctx context.Context) (chan
 			if msg.ServerHeartbeat != nil {
 				l.logger.WithField("heartbeat", msg.ServerHeartbeat).Info("received server heartbeat")
 				if msg.ServerHeartbeat.ReplyRequested == 1 {
-					l.sendStandbyStatus()
+					if err := l.sendStandbyStatus(); err != nil {
+						l.sendError(ctx, err)
+					}
 				}
 			}
 		}
@@ -184,6 +202,19 @@ func (l *LogicalReplicationListener) ListenForChanges(ctx context.Context) (chan
 	return l.changesetsCh, l.errCh
 }
 
+// Checkpoint confirms to the server that the changesets delivered so far have
+// been processed, allowing it to release their WAL. It is called on shutdown,
+// once the pipeline has been drained.
+func (l *LogicalReplicationListener) Checkpoint(ctx context.Context) error {
+	l.statusMu.Lock()
+	if l.deliveredLSN > l.replLSN {
+		l.replLSN = l.deliveredLSN
+	}
+	l.statusMu.Unlock()
+
+	return l.sendStandbyStatus()
+}
+
 // Close closes the database connection.
 func (l *LogicalReplicationListener) Close() error {
 	if err := l.replConn.Close(); err != nil {
@@ -206,18 +237,36 @@ func (l *LogicalReplicationListener) startHeartBeat(ctx context.Context) {
 			return
 		case <-time.Tick(time.Duration(l.connHeartbeatIntervalSeconds) * time.Second):
 			l.logger.Info("sending heartbeat")
-			l.sendStandbyStatus()
+			if err := l.sendStandbyStatus(); err != nil {
+				l.sendError(ctx, err)
+			}
 		}
 	}
 }
 
-func (l *LogicalReplicationListener) processMessage(msg *pgx.ReplicationMessage) {
+// sendError reports an error of the listener, unless it is shutting down.
+func (l *LogicalReplicationListener) sendError(ctx context.Context, err error) {
+	select {
+	case l.errCh <- err:
+	case <-ctx.Done():
+	}
+}
+
+// processMessage delivers the changesets of a wal2json message, and returns
+// false if the listener must stop: when the context was cancelled before they
+// were all delivered, or when the TOASTable columns of an update could not be
+// read. Without them, the update would be applied with its unchanged TOASTed
+// columns missing, so it is not delivered, and the message is replayed once
+// the listener restarts from its last checkpoint. Changesets whose values
+// cannot be decoded are reported and not delivered, like in the audit and
+// poll modes.
+func (l *LogicalReplicationListener) processMessage(ctx context.Context, msg *pgx.ReplicationMessage) bool {
 	walMsgRaw := msg.WalMessage.WalData
 	var w2jmsg db.Wal2JSONMessage
-	err := json.Unmarshal(walMsgRaw, &w2jmsg)
+	err := unmarshalJSON(walMsgRaw, &w2jmsg)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to parse wal2json message")
-		l.errCh <- fmt.Errorf("failed to parse wal2json: %v", err)
+		l.sendError(ctx, fmt.Errorf("failed to parse wal2json: %v", err))
 	}
 
 	for _, change := range w2jmsg.Changes {
@@ -238,6 +287,26 @@ func (l *LogicalReplicationListener) processMessage(msg *pgx.ReplicationMessage)
 		}
 		cs.NewValues = newColValues
 
+		err := decodeColumns(cs.NewValues)
+		if err != nil {
+			l.logger.WithError(err).Error("failed to decode new values")
+			l.sendError(ctx, fmt.Errorf("failed to decode new values of changeset %d: %w", cs.ID, err))
+			continue
+		}
+
+		switch cs.Kind {
+		case ChangesetKindInsert:
+			l.invalidateColumns(change)
+		case ChangesetKindUpdate:
+			unchanged, err := l.unchangedColumns(change)
+			if err != nil {
+				l.logger.WithError(err).Error("failed to read the TOASTable columns")
+				l.sendError(ctx, fmt.Errorf("failed to read the TOASTable columns of %s.%s: %w", change.Schema, change.Table, err))
+				return false
+			}
+			cs.NewValues = append(cs.NewValues, unchanged...)
+		}
+
 		if change.OldKeys != nil {
 			oldColValues := make([]*ChangesetColumn, len(change.OldKeys.KeyValues))
 			for i, name := range change.OldKeys.KeyNames {
@@ -248,10 +317,134 @@ func (l *LogicalReplicationListener) processMessage(msg *pgx.ReplicationMessage)
 				}
 			}
 			cs.OldValues = oldColValues
+
+			err := decodeColumns(cs.OldValues)
+			if err != nil {
+				l.logger.WithError(err).Error("failed to decode old values")
+				l.sendError(ctx, fmt.Errorf("failed to decode old values of changeset %d: %w", cs.ID, err))
+				continue
+			}
 		}
 
-		l.changesetsCh <- cs
+		select {
+		case l.changesetsCh <- cs:
+		case <-ctx.Done():
+			return false
+		}
 	}
+
+	l.statusMu.Lock()
+	l.deliveredLSN = msg.WalMessage.WalStart
+	l.statusMu.Unlock()
+
+	return true
+}
+
+// tableColumn is a column of a table, whose values may be TOASTed, stored out
+// of line, if it has a variable-length type.
+type tableColumn struct {
+	name      string
+	colType   string
+	toastable bool
+}
+
+// tableColumnsSQL reads the columns of a table, and whether they have
+// variable-length types, the only ones that can be TOASTed.
+const tableColumnsSQL = `
+SELECT attname, format_type(atttypid, atttypmod), attlen = -1
+FROM pg_attribute
+WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+ORDER BY attnum`
+
+// invalidateColumns drops the cached columns of the table of a change if the
+// change doesn't match them, after columns were added to or dropped from the
+// table. Inserts carry all the columns of the table, and updates all but the
+// unchanged TOASTable ones.
+func (l *LogicalReplicationListener) invalidateColumns(change *db.Wal2JSONChange) {
+	name := db.QuoteIdentifier(change.Schema, change.Table)
+	columns, ok := l.tableColumns[name]
+	if !ok {
+		return
+	}
+
+	present := make(map[string]bool, len(change.ColumnNames))
+	for _, column := range change.ColumnNames {
+		present[column] = true
+	}
+
+	insert := ParseChangesetKind(change.Kind) == ChangesetKindInsert
+	known := 0
+	for _, col := range columns {
+		if present[col.name] {
+			known++
+		} else if insert || !col.toastable {
+			delete(l.tableColumns, name)
+			return
+		}
+	}
+	if known != len(present) {
+		delete(l.tableColumns, name)
+	}
+}
+
+// queryTableColumns reads the columns of a table from the source database.
+func (l *LogicalReplicationListener) queryTableColumns(table string) ([]tableColumn, error) {
+	rows, err := l.conn.Query(tableColumnsSQL, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []tableColumn
+	for rows.Next() {
+		var col tableColumn
+		err := rows.Scan(&col.name, &col.colType, &col.toastable)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, col)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return columns, nil
+}
+
+// unchangedColumns returns the TOASTable columns of the table that wal2json
+// left out of an update, because their TOASTed value did not change. The
+// columns of each table are read once, and again after they changed.
+func (l *LogicalReplicationListener) unchangedColumns(change *db.Wal2JSONChange) ([]*ChangesetColumn, error) {
+	l.invalidateColumns(change)
+
+	name := db.QuoteIdentifier(change.Schema, change.Table)
+	columns, ok := l.tableColumns[name]
+	if !ok {
+		var err error
+		columns, err = l.readTableColumns(name)
+		if err != nil {
+			return nil, err
+		}
+		l.tableColumns[name] = columns
+	}
+
+	present := make(map[string]bool, len(change.ColumnNames))
+	for _, name := range change.ColumnNames {
+		present[name] = true
+	}
+
+	var unchanged []*ChangesetColumn
+	for _, col := range columns {
+		if col.toastable && !present[col.name] {
+			unchanged = append(unchanged, &ChangesetColumn{
+				Column:    col.name,
+				Type:      col.colType,
+				Unchanged: true,
+			})
+		}
+	}
+
+	return unchanged, nil
 }
 
 func (l *LogicalReplicationListener) clearReplicationSlots() error {
@@ -281,11 +474,14 @@ func (l *LogicalReplicationListener) clearReplicationSlots() error {
 	return nil
 }
 
-func (l *LogicalReplicationListener) sendStandbyStatus() {
+func (l *LogicalReplicationListener) sendStandbyStatus() error {
+	l.statusMu.Lock()
+	defer l.statusMu.Unlock()
+
 	status, err := pgx.NewStandbyStatus(l.replLSN)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to create StandbyStatus")
-		l.errCh <- fmt.Errorf("heartbeat failed")
+		return fmt.Errorf("heartbeat failed: %w", err)
 	}
 
 	status.ReplyRequested = 0
@@ -294,6 +490,8 @@ func (l *LogicalReplicationListener) sendStandbyStatus() {
 	err = l.replConn.SendStandbyStatus(status)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to send StandbyStatus")
-		l.errCh <- fmt.Errorf("heartbeat failed")
+		return fmt.Errorf("heartbeat failed: %w", err)
 	}
+
+	return nil
 }
@@ -0,0 +1,170 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+func TestLogicalReplicationListenerUnchangedToast(t *testing.T) {
+	l := NewLogicalReplicationListener()
+	l.changesetsCh = make(chan *Changeset, 2)
+	l.errCh = make(chan error, 1)
+	l.tableColumns[`"public"."users"`] = []tableColumn{
+		{name: "id", colType: "integer"},
+		{name: "email", colType: "text", toastable: true},
+		{name: "bio", colType: "text", toastable: true},
+	}
+
+	msg := &pgx.ReplicationMessage{WalMessage: &pgx.WalMessage{
+		WalStart: 10,
+		WalData: []byte(`{"change": [
+			{"id": 1, "kind": "update", "schema": "public", "table": "users",
+			 "columnnames": ["id", "email"], "columntypes": ["integer", "text"], "columnvalues": [1, "a@example.com"],
+			 "oldkeys": {"keynames": ["id"], "keytypes": ["integer"], "keyvalues": [1]}},
+			{"id": 2, "kind": "insert", "schema": "public", "table": "users",
+			 "columnnames": ["id", "email", "bio"], "columntypes": ["integer", "text", "text"], "columnvalues": [2, "b@example.com", null]}
+		]}`),
+	}}
+	assert.True(t, l.processMessage(context.Background(), msg))
+
+	update := <-l.changesetsCh
+	if assert.Len(t, update.NewValues, 3) {
+		assert.Equal(t, &ChangesetColumn{Column: "bio", Type: "text", Unchanged: true}, update.NewValues[2])
+	}
+	_, ok := update.GetNewColumnValue("bio")
+	assert.False(t, ok)
+
+	// inserts always carry all of their columns
+	insert := <-l.changesetsCh
+	assert.Len(t, insert.NewValues, 3)
+	assert.Empty(t, l.errCh)
+	assert.Contains(t, l.tableColumns, `"public"."users"`)
+}
+
+func TestLogicalReplicationListenerInvalidateColumns(t *testing.T) {
+	columns := []tableColumn{
+		{name: "id", colType: "integer"},
+		{name: "email", colType: "text", toastable: true},
+	}
+
+	testCases := []struct {
+		name        string
+		kind        string
+		columns     []string
+		invalidated bool
+	}{
+		{"insert of all columns", "insert", []string{"id", "email"}, false},
+		{"update without a TOASTable column", "update", []string{"id"}, false},
+		{"insert of an added column", "insert", []string{"id", "email", "bio"}, true},
+		{"update of an added column", "update", []string{"id", "bio"}, true},
+		{"insert without a dropped column", "insert", []string{"id"}, true},
+		{"update without a dropped column", "update", []string{"email"}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewLogicalReplicationListener()
+			l.tableColumns[`"public"."users"`] = columns
+
+			l.invalidateColumns(&db.Wal2JSONChange{
+				Kind:        tc.kind,
+				Schema:      "public",
+				Table:       "users",
+				ColumnNames: tc.columns,
+			})
+			_, cached := l.tableColumns[`"public"."users"`]
+			assert.Equal(t, !tc.invalidated, cached)
+		})
+	}
+}
+
+func TestLogicalReplicationListenerErrorOnShutdown(t *testing.T) {
+	l := NewLogicalReplicationListener()
+	l.changesetsCh = make(chan *Changeset, 1)
+	l.errCh = make(chan error)
+
+	// the error of an unparsable message is not sent once the listener is
+	// shutting down, and doesn't block it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msg := &pgx.ReplicationMessage{WalMessage: &pgx.WalMessage{WalData: []byte(`{"change": [`)}}
+	assert.True(t, l.processMessage(ctx, msg))
+}
+
+func TestLogicalReplicationListenerExactNumbers(t *testing.T) {
+	l := NewLogicalReplicationListener()
+	l.changesetsCh = make(chan *Changeset, 1)
+	l.errCh = make(chan error, 1)
+
+	msg := &pgx.ReplicationMessage{WalMessage: &pgx.WalMessage{
+		WalData: []byte(`{"change": [
+			{"id": 1, "kind": "insert", "schema": "public", "table": "accounts",
+			 "columnnames": ["id", "balance", "score"],
+			 "columntypes": ["bigint", "numeric(38,10)", "double precision"],
+			 "columnvalues": [9007199254740993, 12345678901234567890.0123456789, "Infinity"]}
+		]}`),
+	}}
+	assert.True(t, l.processMessage(context.Background(), msg))
+
+	change := <-l.changesetsCh
+	id, _ := change.GetNewColumnValue("id")
+	assert.Equal(t, int64(9007199254740993), id)
+	balance, _ := change.GetNewColumnValue("balance")
+	assert.Equal(t, Decimal("12345678901234567890.0123456789"), balance)
+	score, _ := change.GetNewColumnValue("score")
+	assert.Equal(t, "Infinity", score)
+	assert.Empty(t, l.errCh)
+}
+
+func TestLogicalReplicationListenerToastColumnsError(t *testing.T) {
+	l := NewLogicalReplicationListener()
+	l.changesetsCh = make(chan *Changeset, 2)
+	l.errCh = make(chan error, 1)
+	l.readTableColumns = func(string) ([]tableColumn, error) {
+		return nil, errors.New("connection reset")
+	}
+
+	// the update is not delivered without its unchanged TOASTed columns, and
+	// the listener stops before the rest of the message
+	msg := &pgx.ReplicationMessage{WalMessage: &pgx.WalMessage{
+		WalStart: 10,
+		WalData: []byte(`{"change": [
+			{"id": 1, "kind": "update", "schema": "public", "table": "users",
+			 "columnnames": ["id"], "columntypes": ["integer"], "columnvalues": [1]},
+			{"id": 2, "kind": "insert", "schema": "public", "table": "accounts",
+			 "columnnames": ["id"], "columntypes": ["integer"], "columnvalues": [2]}
+		]}`),
+	}}
+	assert.False(t, l.processMessage(context.Background(), msg))
+	assert.Empty(t, l.changesetsCh)
+	assert.Error(t, <-l.errCh)
+	assert.Equal(t, uint64(0), l.deliveredLSN)
+}
+
+func TestLogicalReplicationListenerDecodeError(t *testing.T) {
+	l := NewLogicalReplicationListener()
+	l.changesetsCh = make(chan *Changeset, 2)
+	l.errCh = make(chan error, 1)
+
+	// changesets that cannot be decoded are reported and not delivered
+	msg := &pgx.ReplicationMessage{WalMessage: &pgx.WalMessage{
+		WalData: []byte(`{"change": [
+			{"id": 1, "kind": "insert", "schema": "public", "table": "accounts",
+			 "columnnames": ["id", "created_at"], "columntypes": ["integer", "timestamptz"], "columnvalues": [1, "not a timestamp"]},
+			{"id": 2, "kind": "insert", "schema": "public", "table": "accounts",
+			 "columnnames": ["id"], "columntypes": ["integer"], "columnvalues": [2]}
+		]}`),
+	}}
+	assert.True(t, l.processMessage(context.Background(), msg))
+	assert.Error(t, <-l.errCh)
+
+	change := <-l.changesetsCh
+	assert.Equal(t, int64(2), change.ID)
+	assert.Empty(t, l.changesetsCh)
+}
@@ -14,6 +14,13 @@ import (
 	"github.com/perangel/warp-pipe/internal/store"
 )
 
+const (
+	defaultRepollInterval = 5 * time.Second
+	// Maximum number of queued notifications processed together, whose
+	// changesets are read from the store in a single query.
+	maxNotificationBatchSize = 1000
+)
+
 // NotifyOption is a NotifyListener option function
 type NotifyOption func(*NotifyListener)
 
@@ -31,6 +38,31 @@ func StartFromTimestamp(t time.Time) NotifyOption {
 	}
 }
 
+// BacklogPageSize is an option for setting the number of changesets read per
+// query when catching up from startFromID or startFromTimestamp.
+func BacklogPageSize(size int) NotifyOption {
+	return func(l *NotifyListener) {
+		l.storeOpts = append(l.storeOpts, store.PageSize(size))
+	}
+}
+
+// BacklogCursor is an option for reading the backlog of changesets through a
+// server-side cursor.
+func BacklogCursor() NotifyOption {
+	return func(l *NotifyListener) {
+		l.storeOpts = append(l.storeOpts, store.UseCursor())
+	}
+}
+
+// RepollInterval is an option for setting how often the listener re-reads the
+// changesets table for changesets whose notification was missed, such as those
+// committed out of ID order during catch-up. Disabled when zero.
+func RepollInterval(interval time.Duration) NotifyOption {
+	return func(l *NotifyListener) {
+		l.repollInterval = interval
+	}
+}
+
 // NotifyListener is a listener that uses Postgres' LISTEN/NOTIFY pattern for
 // subscribing for subscribing to changeset enqueued in a changesets table.
 // For more details see `pkg/schema/changesets`.
@@ -38,9 +70,12 @@ type NotifyListener struct {
 	conn                   *pgx.Conn
 	logger                 *log.Entry
 	store                  store.EventStore
+	storeOpts              []store.Option
 	startFromID            *int64
 	startFromTimestamp     *time.Time
 	lastProcessedTimestamp *time.Time
+	repollInterval         time.Duration
+	tracker                *deliveryTracker
 	changesetsCh           chan *Changeset
 	errCh                  chan error
 }
@@ -48,9 +83,11 @@ type NotifyListener struct {
 // NewNotifyListener returns a new NotifyListener.
 func NewNotifyListener(opts ...NotifyOption) *NotifyListener {
 	l := &NotifyListener{
-		logger:       log.WithFields(log.Fields{"component": "listener"}),
-		changesetsCh: make(chan *Changeset),
-		errCh:        make(chan error),
+		logger:         log.WithFields(log.Fields{"component": "listener"}),
+		repollInterval: defaultRepollInterval,
+		tracker:        newDeliveryTracker(),
+		changesetsCh:   make(chan *Changeset),
+		errCh:          make(chan error),
 	}
 
 	for _, opt := range opts {
@@ -73,169 +110,305 @@ func (l *NotifyListener) Dial(connConfig *pgx.ConnConfig) error {
 }
 
 // ListenForChanges returns a channel that emits database changesets.
+//
+// Changesets are delivered exactly once. Any backlog is read first, then
+// changesets are delivered as their notifications arrive. Changesets sent in
+// full in the notification payload are delivered as is, the others are read
+// from the store in batches of queued notifications. When the changesets
+// table tracks transaction IDs, the listener also re-reads the table every
+// RepollInterval for changesets committed since the last read, which catches
+// changesets committed out of ID order while the backlog was being read.
 func (l *NotifyListener) ListenForChanges(ctx context.Context) (chan *Changeset, chan error) {
-	l.logger.Info("Starting notify listener for `warp_pipe_new_changeset`")
-	err := l.conn.Listen("warp_pipe_new_changeset")
-	if err != nil {
-		l.logger.WithError(err).Fatal("failed to listen on notify channel")
-	}
-
-	l.store = store.NewChangesetStore(l.conn)
+	l.store = store.NewChangesetStore(l.conn, l.storeOpts...)
 
 	// loop - listen for notifications
 	go func() {
+		// closing the channel lets the pipeline drain once the listener stops
+		defer close(l.changesetsCh)
+
+		// The snapshot must be taken before listening, so that every changeset
+		// committed after it is either notified or re-read.
+		err := l.tracker.start(ctx, l.store)
+		if err != nil {
+			l.sendError(ctx, fmt.Errorf("failed to start tracking delivered changesets: %w", err))
+			return
+		}
+
+		if l.tracker.snapshot == nil {
+			l.logger.Warn("changesets table does not track transaction IDs, changesets committed out of order may be missed")
+		} else if l.repollInterval <= 0 {
+			// the snapshot is never advanced, so delivered changesets are
+			// only remembered within the dedupe window
+			l.tracker.windowed = true
+		}
+
+		l.logger.Info("Starting notify listener for `warp_pipe_new_changeset`")
+		err = l.conn.Listen("warp_pipe_new_changeset")
+		if err != nil {
+			l.sendError(ctx, fmt.Errorf("failed to listen on notify channel: %w", err))
+			return
+		}
+
 		if l.startFromID != nil {
-			eventCh := make(chan *store.Event)
-			doneCh := make(chan bool)
-			errCh := make(chan error)
-
-			go l.store.GetSinceID(ctx, *l.startFromID, eventCh, doneCh, errCh)
-
-		processIDLoop:
-			for {
-				select {
-				case c := <-eventCh:
-					l.processChangeset(c)
-				case err := <-errCh:
-					log.WithError(err).Fatal("encountered an error while reading changesets")
-					l.errCh <- err
-				case <-doneCh:
-					close(errCh)
-					close(eventCh)
-					break processIDLoop
-				}
-			}
+			err = l.readBacklog(ctx, func(eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+				l.store.GetSinceID(ctx, *l.startFromID, eventCh, doneCh, errCh)
+			})
 		} else if l.startFromTimestamp != nil {
-			eventCh := make(chan *store.Event)
-			doneCh := make(chan bool)
-			errCh := make(chan error)
-
-			go l.store.GetSinceTimestamp(ctx, *l.startFromTimestamp, eventCh, doneCh, errCh)
-
-		processTimestampLoop:
-			for {
-				select {
-				case c := <-eventCh:
-					l.processChangeset(c)
-				case err := <-errCh:
-					log.WithError(err).Fatal("encountered an error while reading changesets")
-					l.errCh <- err
-				case <-doneCh:
-					close(errCh)
-					close(eventCh)
-					break processTimestampLoop
-				}
+			err = l.readBacklog(ctx, func(eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+				l.store.GetSinceTimestamp(ctx, *l.startFromTimestamp, eventCh, doneCh, errCh)
+			})
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
 			}
+			// the backlog cannot be resumed, so the listener stops
+			l.logger.WithError(err).Error("encountered an error while reading changesets")
+			l.sendError(ctx, err)
+			return
 		}
 
+		nextRepoll := time.Now().Add(l.repollInterval)
 		for {
-			msg, err := l.conn.WaitForNotification(ctx)
+			if l.tracker.snapshot != nil && l.repollInterval > 0 && !time.Now().Before(nextRepoll) {
+				err := l.repoll(ctx)
+				if err != nil {
+					if ctx.Err() != nil {
+						l.logger.Info("shutting down...")
+						return
+					}
+					l.logger.WithError(err).Error("encountered an error while re-reading changesets")
+					l.sendError(ctx, err)
+				}
+				nextRepoll = time.Now().Add(l.repollInterval)
+			}
+
+			waitCtx := ctx
+			cancel := func() {}
+			if l.tracker.snapshot != nil && l.repollInterval > 0 {
+				waitCtx, cancel = context.WithDeadline(ctx, nextRepoll)
+			}
+
+			msg, err := l.conn.WaitForNotification(waitCtx)
+			cancel()
 			if err != nil {
 				if ctx.Err() != nil {
-					log.Info("shutting down...")
+					l.logger.Info("shutting down...")
 					return
 				}
-				if err != nil {
-					log.WithError(err).Error("encountered an error while waiting for notifications")
-					l.errCh <- err
+				if waitCtx.Err() == context.DeadlineExceeded {
+					continue
 				}
+				l.logger.WithError(err).Error("encountered an error while waiting for notifications")
+				l.sendError(ctx, err)
+				continue
 			}
 
-			l.processMessage(msg)
+			msgs := append([]*pgx.Notification{msg}, l.queuedNotifications(maxNotificationBatchSize-1)...)
+			l.processMessages(ctx, msgs)
 		}
 	}()
 
 	return l.changesetsCh, l.errCh
 }
 
-func (l *NotifyListener) processMessage(msg *pgx.Notification) {
-	// payload is <event_id>_<timestamp>
-	parts := strings.Split(msg.Payload, "_")
-	eventID, err := strconv.ParseInt(parts[0], 10, 64)
+// repoll delivers all changesets committed since the last snapshot that have
+// not been delivered yet, and advances the snapshot.
+func (l *NotifyListener) repoll(ctx context.Context) error {
+	events, err := l.tracker.poll(ctx, l.store)
 	if err != nil {
-		log.WithError(err).WithField("changeset_id", parts[0]).
-			Error("failed to parse changeset ID from notification payload")
-		l.errCh <- err
+		return err
 	}
 
-	event, err := l.store.GetByID(context.Background(), eventID)
-	if err != nil {
-		log.WithError(err).WithField("changeset_id", parts[0]).Error("failed to get changeset from store")
-		l.errCh <- err
+	for _, event := range events {
+		l.processChangeset(ctx, event)
 	}
 
-	l.processChangeset(event)
+	return nil
 }
 
-func (l *NotifyListener) processChangeset(event *store.Event) {
-	cs := &Changeset{
-		ID:        event.ID,
-		Kind:      ParseChangesetKind(event.Action),
-		Schema:    event.SchemaName,
-		Table:     event.TableName,
-		Timestamp: event.Timestamp,
+// readBacklog delivers all events from a streaming read of the store. Events
+// committed before the listener started are delivered too, so they are only
+// deduplicated against the changesets actually delivered.
+func (l *NotifyListener) readBacklog(ctx context.Context, read func(chan *store.Event, chan bool, chan error)) error {
+	eventCh := make(chan *store.Event)
+	doneCh := make(chan bool)
+	errCh := make(chan error)
+
+	go read(eventCh, doneCh, errCh)
+
+	for {
+		select {
+		case event := <-eventCh:
+			l.deliver(ctx, event)
+		case err := <-errCh:
+			return err
+		case <-doneCh:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendError reports an error of the listener, unless it is shutting down.
+func (l *NotifyListener) sendError(ctx context.Context, err error) {
+	select {
+	case l.errCh <- err:
+	case <-ctx.Done():
 	}
+}
 
-	if event.NewValues != nil {
-		var newValues map[string]interface{}
-		err := json.Unmarshal(event.NewValues, &newValues)
+// deliver emits a changeset unless it has already been delivered.
+func (l *NotifyListener) deliver(ctx context.Context, event *store.Event) {
+	if l.tracker.isDelivered(event) {
+		return
+	}
+
+	l.tracker.markDelivered(event)
+	l.processChangeset(ctx, event)
+}
+
+// queuedNotifications returns up to max notifications that have already been
+// received by the connection, without waiting for new ones.
+func (l *NotifyListener) queuedNotifications(max int) []*pgx.Notification {
+	// WaitForNotification returns received notifications before checking the
+	// context, and fails without reading from the connection otherwise.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var msgs []*pgx.Notification
+	for len(msgs) < max {
+		msg, err := l.conn.WaitForNotification(ctx)
 		if err != nil {
-			l.errCh <- fmt.Errorf("failed to unmarshal new values: %w", err)
+			break
 		}
+		msgs = append(msgs, msg)
+	}
 
-		var newRawValues map[string]json.RawMessage
-		err = json.Unmarshal(event.NewValues, &newRawValues)
+	return msgs
+}
+
+// processMessages delivers the changesets of a batch of notifications, in
+// notification order. Changesets notified by ID only are read from the store
+// in a single query.
+func (l *NotifyListener) processMessages(ctx context.Context, msgs []*pgx.Notification) {
+	events := make([]*store.Event, len(msgs))
+	eventIDs := make([]int64, len(msgs))
+	var fetchIDs []int64
+	for i, msg := range msgs {
+		event, eventID, err := parseNotificationPayload(msg.Payload)
 		if err != nil {
-			l.errCh <- fmt.Errorf("failed to unmarshal raw new values: %w", err)
+			l.logger.WithError(err).WithField("payload", msg.Payload).
+				Error("failed to parse notification payload")
+			l.sendError(ctx, err)
+			continue
 		}
 
-		for k, v := range newValues {
-			// Maps are not supported. They can break checksum validation
-			// when re-marshaling. Pass the original JSON string instead.
-			switch v.(type) {
-			case map[string]interface{}:
-				v = string(newRawValues[k])
-			}
-
-			col := &ChangesetColumn{
-				Column: k,
-				Value:  v,
-			}
-			cs.NewValues = append(cs.NewValues, col)
+		events[i] = event
+		eventIDs[i] = eventID
+		if event == nil && !l.tracker.delivered[eventID] {
+			fetchIDs = append(fetchIDs, eventID)
 		}
 	}
 
-	if event.OldValues != nil {
-		var oldValues map[string]interface{}
-		err := json.Unmarshal(event.OldValues, &oldValues)
+	fetched := make(map[int64]*store.Event, len(fetchIDs))
+	if len(fetchIDs) > 0 {
+		found, err := l.store.GetByIDs(ctx, fetchIDs)
 		if err != nil {
-			l.errCh <- fmt.Errorf("failed to unmarshal old values: %w", err)
+			l.logger.WithError(err).WithField("changeset_count", len(fetchIDs)).
+				Error("failed to get changesets from store")
+			l.sendError(ctx, err)
 		}
 
-		var oldRawValues map[string]json.RawMessage
-		err = json.Unmarshal(event.OldValues, &oldRawValues)
-		if err != nil {
-			l.errCh <- fmt.Errorf("failed to unmarshal raw old values: %w", err)
+		for _, event := range found {
+			fetched[event.ID] = event
 		}
+	}
 
-		for k, v := range oldValues {
-			// Maps are not supported. They can break checksum validation
-			// when re-marshaling. Pass the original JSON string instead.
-			switch v.(type) {
-			case map[string]interface{}:
-				v = string(oldRawValues[k])
-			}
+	for i, event := range events {
+		if event == nil {
+			event = fetched[eventIDs[i]]
+		}
+		if event == nil {
+			continue
+		}
 
-			col := &ChangesetColumn{
-				Column: k,
-				Value:  v,
-			}
-			cs.OldValues = append(cs.OldValues, col)
+		l.deliver(ctx, event)
+	}
+}
+
+// notificationPayload is a changeset sent in full as a notification payload.
+type notificationPayload struct {
+	ID          int64           `json:"id"`
+	Timestamp   time.Time       `json:"ts"`
+	Action      string          `json:"action"`
+	SchemaName  string          `json:"schema_name"`
+	TableName   string          `json:"table_name"`
+	OID         int64           `json:"relid"`
+	NewValues   json.RawMessage `json:"new_values"`
+	OldValues   json.RawMessage `json:"old_values"`
+	TxID        int64           `json:"txid"`
+	ColumnTypes json.RawMessage `json:"column_types"`
+}
+
+// parseNotificationPayload parses a notification payload, which is either the
+// full changeset as a JSON object, or <event_id>_<timestamp>. The returned event
+// is nil if the payload only carries the changeset ID.
+func parseNotificationPayload(payload string) (*store.Event, int64, error) {
+	if strings.HasPrefix(payload, "{") {
+		var p notificationPayload
+		err := json.Unmarshal([]byte(payload), &p)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to unmarshal changeset from notification payload: %w", err)
 		}
+
+		return &store.Event{
+			ID:          p.ID,
+			Timestamp:   p.Timestamp,
+			Action:      p.Action,
+			SchemaName:  p.SchemaName,
+			TableName:   p.TableName,
+			OID:         p.OID,
+			NewValues:   nullableJSON(p.NewValues),
+			OldValues:   nullableJSON(p.OldValues),
+			TxID:        p.TxID,
+			ColumnTypes: nullableJSON(p.ColumnTypes),
+		}, p.ID, nil
+	}
+
+	parts := strings.SplitN(payload, "_", 2)
+	eventID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse changeset ID from notification payload: %w", err)
+	}
+
+	return nil, eventID, nil
+}
+
+// nullableJSON returns nil for a JSON null, matching a NULL column read from the store.
+func nullableJSON(v json.RawMessage) []byte {
+	if len(v) == 0 || string(v) == "null" {
+		return nil
+	}
+	return v
+}
+
+// processChangeset emits the changeset of an event. Changesets that fail to
+// decode are reported on the error channel instead.
+func (l *NotifyListener) processChangeset(ctx context.Context, event *store.Event) {
+	cs, err := newChangesetFromEvent(event)
+	if err != nil {
+		l.logger.WithError(err).WithField("changeset_id", event.ID).Error("failed to decode changeset")
+		l.sendError(ctx, fmt.Errorf("changeset %d: %w", event.ID, err))
+		return
 	}
 
 	l.lastProcessedTimestamp = &event.Timestamp
-	l.changesetsCh <- cs
+	select {
+	case l.changesetsCh <- cs:
+	case <-ctx.Done():
+	}
 }
 
 // Close closes the database connection.
@@ -0,0 +1,274 @@
+package warppipe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/perangel/warp-pipe/internal/store"
+)
+
+type fakeEventStore struct {
+	store.EventStore
+	events   []*store.Event
+	snapshot *store.Snapshot
+	batches  [][]int64
+}
+
+func (s *fakeEventStore) GetByID(ctx context.Context, eventID int64) (*store.Event, error) {
+	for _, e := range s.events {
+		if e.ID == eventID {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *fakeEventStore) GetByIDs(ctx context.Context, eventIDs []int64) ([]*store.Event, error) {
+	s.batches = append(s.batches, eventIDs)
+
+	var events []*store.Event
+	for _, e := range s.events {
+		for _, id := range eventIDs {
+			if e.ID == id {
+				events = append(events, e)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (s *fakeEventStore) GetSinceID(ctx context.Context, eventID int64, eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+	for _, e := range s.events {
+		if e.ID >= eventID {
+			eventCh <- e
+		}
+	}
+	doneCh <- true
+}
+
+func (s *fakeEventStore) GetSnapshot(ctx context.Context) (*store.Snapshot, error) {
+	return s.snapshot, nil
+}
+
+func (s *fakeEventStore) GetCommittedBetween(ctx context.Context, since, until *store.Snapshot) ([]*store.Event, error) {
+	var events []*store.Event
+	for _, e := range s.events {
+		if until.Visible(e.TxID) && !since.Visible(e.TxID) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func mustParseSnapshot(t *testing.T, snapshot string) *store.Snapshot {
+	s, err := store.ParseSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func drainChangesetIDs(ch chan *Changeset) []int64 {
+	var ids []int64
+	for {
+		select {
+		case cs := <-ch:
+			ids = append(ids, cs.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestNotifyListenerExactlyOnce(t *testing.T) {
+	// Transaction 100 writes changeset 1 but commits last. Transactions 101
+	// and 102 write changesets 2 and 3 and commit while the backlog is read.
+	events := []*store.Event{
+		{ID: 1, TxID: 100, Timestamp: time.Now()},
+		{ID: 2, TxID: 101, Timestamp: time.Now()},
+		{ID: 3, TxID: 102, Timestamp: time.Now()},
+	}
+	fake := &fakeEventStore{events: events}
+
+	l := NewNotifyListener()
+	l.store = fake
+	l.changesetsCh = make(chan *Changeset, 10)
+	l.tracker.snapshot = mustParseSnapshot(t, "100:101:100")
+
+	// backlog read sees changesets 2 and 3
+	l.deliver(context.Background(), events[1])
+	l.deliver(context.Background(), events[2])
+	// the queued notification for changeset 2 is a duplicate
+	l.deliver(context.Background(), events[1])
+	assert.Equal(t, []int64{2, 3}, drainChangesetIDs(l.changesetsCh))
+
+	// re-read before transaction 100 commits skips delivered changesets
+	fake.snapshot = mustParseSnapshot(t, "100:103:100")
+	assert.NoError(t, l.repoll(context.Background()))
+	assert.Empty(t, drainChangesetIDs(l.changesetsCh))
+
+	// transaction 100 commits, its notification delivers changeset 1
+	l.deliver(context.Background(), events[0])
+	assert.Equal(t, []int64{1}, drainChangesetIDs(l.changesetsCh))
+
+	// next re-read covers transaction 100, which was already delivered
+	fake.snapshot = mustParseSnapshot(t, "103:103:")
+	assert.NoError(t, l.repoll(context.Background()))
+	assert.Empty(t, drainChangesetIDs(l.changesetsCh))
+	assert.Empty(t, l.tracker.delivered)
+
+	// late notifications for re-read changesets are ignored
+	l.deliver(context.Background(), events[0])
+	assert.Empty(t, drainChangesetIDs(l.changesetsCh))
+}
+
+func TestNotifyListenerBacklogVisibleInSnapshot(t *testing.T) {
+	// changesets 1 and 2 were committed before the listener started, and
+	// changeset 3 while the backlog is read.
+	events := []*store.Event{
+		{ID: 1, TxID: 100, Timestamp: time.Now()},
+		{ID: 2, TxID: 101, Timestamp: time.Now()},
+		{ID: 3, TxID: 102, Timestamp: time.Now()},
+	}
+	fake := &fakeEventStore{events: events}
+
+	l := NewNotifyListener(StartFromID(0))
+	l.store = fake
+	l.changesetsCh = make(chan *Changeset, 10)
+	l.tracker.snapshot = mustParseSnapshot(t, "102:102:")
+
+	err := l.readBacklog(context.Background(), func(eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+		fake.GetSinceID(context.Background(), *l.startFromID, eventCh, doneCh, errCh)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3}, drainChangesetIDs(l.changesetsCh))
+	// only the changeset committed after the snapshot is remembered
+	assert.Equal(t, map[int64]bool{3: true}, l.tracker.delivered)
+
+	// the notification of changeset 3 is a duplicate
+	l.deliver(context.Background(), events[2])
+	assert.Empty(t, drainChangesetIDs(l.changesetsCh))
+
+	// the re-read skips changeset 3, and later notifications are ignored
+	fake.snapshot = mustParseSnapshot(t, "103:103:")
+	assert.NoError(t, l.repoll(context.Background()))
+	assert.Empty(t, drainChangesetIDs(l.changesetsCh))
+	l.deliver(context.Background(), events[1])
+	assert.Empty(t, drainChangesetIDs(l.changesetsCh))
+}
+
+func TestNotifyListenerWithoutRepollTrimsDelivered(t *testing.T) {
+	l := NewNotifyListener(RepollInterval(0))
+	l.changesetsCh = make(chan *Changeset, 1)
+	l.tracker.snapshot = mustParseSnapshot(t, "100:100:")
+	l.tracker.windowed = true
+
+	for id := int64(1); id <= 2*dedupeWindow+1; id++ {
+		l.deliver(context.Background(), &store.Event{ID: id, TxID: 100 + id, Timestamp: time.Now()})
+		<-l.changesetsCh
+	}
+
+	assert.Len(t, l.tracker.delivered, dedupeWindow+1)
+	assert.True(t, l.tracker.delivered[2*dedupeWindow+1])
+	assert.False(t, l.tracker.delivered[dedupeWindow])
+}
+
+func TestNotifyListenerProcessChangesetDecodeError(t *testing.T) {
+	l := NewNotifyListener()
+	l.changesetsCh = make(chan *Changeset, 10)
+	l.errCh = make(chan error, 10)
+
+	l.processChangeset(context.Background(), &store.Event{ID: 1, NewValues: []byte("{")})
+	assert.Empty(t, drainChangesetIDs(l.changesetsCh))
+	assert.Error(t, <-l.errCh)
+
+	// errors are dropped once the listener shuts down
+	l.errCh = make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.processChangeset(ctx, &store.Event{ID: 2, NewValues: []byte("{")})
+}
+
+func TestNotifyListenerRepollMissedChangesets(t *testing.T) {
+	events := []*store.Event{
+		{ID: 5, TxID: 200, Timestamp: time.Now()},
+		{ID: 4, TxID: 201, Timestamp: time.Now()},
+	}
+	fake := &fakeEventStore{events: events}
+
+	l := NewNotifyListener()
+	l.store = fake
+	l.changesetsCh = make(chan *Changeset, 10)
+	l.tracker.snapshot = mustParseSnapshot(t, "200:200:")
+
+	// both transactions commit without their notifications being received
+	fake.snapshot = mustParseSnapshot(t, "202:202:")
+	assert.NoError(t, l.repoll(context.Background()))
+	assert.ElementsMatch(t, []int64{4, 5}, drainChangesetIDs(l.changesetsCh))
+}
+
+func TestParseNotificationPayload(t *testing.T) {
+	event, eventID, err := parseNotificationPayload("42_2020-01-01 00:00:00.000000+00")
+	assert.NoError(t, err)
+	assert.Nil(t, event)
+	assert.Equal(t, int64(42), eventID)
+
+	event, eventID, err = parseNotificationPayload(`{"id" : 43, "ts" : "2020-01-01T00:00:00+00:00", ` +
+		`"action" : "INSERT", "schema_name" : "public", "table_name" : "users", "relid" : 16384, ` +
+		`"new_values" : {"id":1,"name":"a"}, "old_values" : null, "txid" : 600, ` +
+		`"column_types" : {"id":"integer","name":"text"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(43), eventID)
+	assert.True(t, event.Timestamp.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+	event.Timestamp = time.Time{}
+	assert.Equal(t, &store.Event{
+		ID:          43,
+		Action:      "INSERT",
+		SchemaName:  "public",
+		TableName:   "users",
+		OID:         16384,
+		NewValues:   []byte(`{"id":1,"name":"a"}`),
+		TxID:        600,
+		ColumnTypes: []byte(`{"id":"integer","name":"text"}`),
+	}, event)
+
+	cs, err := newChangesetFromEvent(event)
+	assert.NoError(t, err)
+	value, _ := cs.GetNewColumnValue("id")
+	assert.Equal(t, int64(1), value)
+	for _, v := range cs.NewValues {
+		assert.NotEmpty(t, v.Type)
+	}
+
+	_, _, err = parseNotificationPayload("abc_2020-01-01")
+	assert.Error(t, err)
+
+	_, _, err = parseNotificationPayload("{")
+	assert.Error(t, err)
+}
+
+func TestNotifyListenerProcessMessagesBatchesFetches(t *testing.T) {
+	events := []*store.Event{
+		{ID: 1, TxID: 100, Timestamp: time.Now()},
+		{ID: 3, TxID: 102, Timestamp: time.Now()},
+	}
+	fake := &fakeEventStore{events: events}
+
+	l := NewNotifyListener()
+	l.store = fake
+	l.changesetsCh = make(chan *Changeset, 10)
+	l.tracker.snapshot = mustParseSnapshot(t, "100:100:")
+
+	l.processMessages(context.Background(), []*pgx.Notification{
+		{Payload: "1_2020-01-01 00:00:00+00"},
+		{Payload: `{"id": 2, "ts": "2020-01-01T00:00:00+00:00", "action": "INSERT", "txid": 101}`},
+		{Payload: "3_2020-01-01 00:00:00+00"},
+	})
+
+	assert.Equal(t, []int64{1, 2, 3}, drainChangesetIDs(l.changesetsCh))
+	assert.Equal(t, [][]int64{{1, 3}}, fake.batches)
+}
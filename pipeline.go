@@ -2,37 +2,287 @@ package warppipe
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type stageFn func(context.Context, <-chan *Changeset, chan error) chan *Changeset
 
-// makeStageFunc wraps a StageFunc and returns a stageFn.
-func makeStageFunc(sFun StageFunc) stageFn {
-	f := func(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
-		outCh := make(chan *Changeset)
+// makeStageFunc wraps a StageFunc and returns a stageFn, running the StageFunc
+// on the configured number of workers and applying the stage's error policy.
+func makeStageFunc(name string, sFun StageFunc, opts ...StageOption) stageFn {
+	var options stageOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	s := &stageRunner{name: name, fn: sFun, options: options}
+	if options.workers <= 1 {
+		return s.run
+	}
+	if options.key != nil {
+		return s.runKeyed
+	}
+	return s.runOrdered
+}
+
+// stageRunner runs the StageFunc of a stage.
+type stageRunner struct {
+	name    string
+	fn      StageFunc
+	options stageOptions
+}
+
+// run processes changesets one at a time.
+func (s *stageRunner) run(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
+	outCh := make(chan *Changeset)
+	go func() {
+		defer close(outCh)
+		for {
+			select {
+			case change, ok := <-inCh:
+				if !ok {
+					return
+				}
+
+				c, halt, err := s.process(ctx, change)
+				if !emit(ctx, c, err, outCh, errCh) || halt {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return outCh
+}
+
+// stageJob is a changeset processed by a worker of an ordered stage.
+type stageJob struct {
+	change *Changeset
+	result *Changeset
+	err    error
+	halt   bool
+	done   chan struct{}
+}
+
+// runOrdered processes changesets on concurrent workers, and emits them in
+// their input order. The number of changesets in flight is bounded by the
+// number of workers, so a slow changeset holds back the input until it is
+// emitted.
+func (s *stageRunner) runOrdered(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
+	// stopping the stage on halt also stops its workers
+	stageCtx, stop := context.WithCancel(ctx)
+
+	outCh := make(chan *Changeset)
+	jobs := make(chan *stageJob)
+	// Jobs are queued in input order, waiting for their results to be emitted.
+	pending := make(chan *stageJob, s.options.workers)
+
+	for i := 0; i < s.options.workers; i++ {
 		go func() {
-			defer close(outCh)
-			for {
+			for job := range jobs {
+				job.result, job.halt, job.err = s.process(stageCtx, job.change)
+				close(job.done)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for {
+			select {
+			case change, ok := <-inCh:
+				if !ok {
+					return
+				}
+
+				job := &stageJob{change: change, done: make(chan struct{})}
 				select {
-				case change := <-inCh:
-					c, err := sFun(change)
-					if err != nil {
-						errCh <- err
-					}
-
-					if c == nil {
-						continue
-					}
-
-					outCh <- c
-				case <-ctx.Done():
+				case pending <- job:
+				case <-stageCtx.Done():
+					return
+				}
+
+				select {
+				case jobs <- job:
+				case <-stageCtx.Done():
+					return
+				}
+			case <-stageCtx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(outCh)
+		defer stop()
+		for job := range pending {
+			select {
+			case <-job.done:
+			case <-stageCtx.Done():
+				return
+			}
+
+			if !emit(ctx, job.result, job.err, outCh, errCh) || job.halt {
+				return
+			}
+		}
+	}()
+
+	return outCh
+}
+
+// runKeyed processes changesets on concurrent workers, and emits changesets
+// with the same key in their input order. Changesets are assigned to workers by
+// key, so changesets with different keys may be reordered.
+func (s *stageRunner) runKeyed(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
+	// stopping the stage on halt also stops its other workers
+	stageCtx, stop := context.WithCancel(ctx)
+
+	outCh := make(chan *Changeset)
+	lanes := make([]chan *Changeset, s.options.workers)
+
+	var wg sync.WaitGroup
+	for i := range lanes {
+		lanes[i] = make(chan *Changeset)
+		wg.Add(1)
+		go func(lane chan *Changeset) {
+			defer wg.Done()
+			for change := range lane {
+				c, halt, err := s.process(stageCtx, change)
+				if !emit(stageCtx, c, err, outCh, errCh) {
+					return
+				}
+				if halt {
+					stop()
 					return
 				}
 			}
+		}(lanes[i])
+	}
+
+	go func() {
+		defer func() {
+			for _, lane := range lanes {
+				close(lane)
+			}
 		}()
-		return outCh
+
+		for {
+			select {
+			case change, ok := <-inCh:
+				if !ok {
+					return
+				}
+
+				h := fnv.New32a()
+				h.Write([]byte(s.options.key(change)))
+				select {
+				case lanes[h.Sum32()%uint32(s.options.workers)] <- change:
+				case <-stageCtx.Done():
+					return
+				}
+			case <-stageCtx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		stop()
+		close(outCh)
+	}()
+
+	return outCh
+}
+
+// emit sends the result of a StageFunc, returning false if the context was
+// cancelled.
+func emit(ctx context.Context, change *Changeset, err error, outCh chan *Changeset, errCh chan error) bool {
+	if err != nil {
+		select {
+		case errCh <- err:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if change == nil {
+		return true
+	}
+
+	select {
+	case outCh <- change:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// StageOption is a pipeline Stage option function.
+type StageOption func(*stageOptions)
+
+type stageOptions struct {
+	workers      int
+	key          func(*Changeset) string
+	retries      int
+	retryBackoff time.Duration
+	errorPolicy  ErrorPolicy
+	deadLetter   DeadLetterSink
+	batchSize    int
+	batchLinger  time.Duration
+}
+
+// StageWorkers is an option for running a stage's StageFunc on n concurrent
+// workers. Changesets are emitted in their input order, unless
+// StageOrderByKey() is set. The StageFunc must be safe for concurrent use.
+func StageWorkers(n int) StageOption {
+	return func(o *stageOptions) {
+		o.workers = n
+	}
+}
+
+// StageOrderByKey is an option for only preserving the order of changesets with
+// the same key across the workers of a stage, such as those for the same row
+// (see KeyByColumns()). Changesets with different keys may be reordered, so a
+// slow changeset only holds back the changesets sharing its worker.
+func StageOrderByKey(key func(*Changeset) string) StageOption {
+	return func(o *stageOptions) {
+		o.key = key
+	}
+}
+
+// KeyByColumns returns a key function for StageOrderByKey() that keys
+// changesets by table and by the values of the given columns, typically the
+// primary key. Values are read from the previous values of a changeset if
+// present, or from its new values otherwise, so an update that changes the key
+// columns may be reordered with later changesets of the same row.
+func KeyByColumns(columns ...string) func(*Changeset) string {
+	return func(change *Changeset) string {
+		var b strings.Builder
+		b.WriteString(change.Schema)
+		b.WriteByte('.')
+		b.WriteString(change.Table)
+
+		values := change.OldValues
+		if values == nil {
+			values = change.NewValues
+		}
+
+		for _, column := range columns {
+			v, _ := change.getColumnValue(values, column)
+			fmt.Fprintf(&b, "|%v", v)
+		}
+
+		return b.String()
 	}
-	return f
 }
 
 // StageFunc is a function for processing changesets in a pipeline Stage.
@@ -40,6 +290,8 @@ func makeStageFunc(sFun StageFunc) stageFn {
 //     (Changeset, nil): If the stage was successful
 //     (nil, nil): If the changeset should be dropped (useful for filtering)
 //     (nil, error): If there was an error during the stage
+// Errors are handled according to the stage's ErrorPolicy, and are reported as
+// a *StageError.
 type StageFunc func(*Changeset) (*Changeset, error)
 
 // Stage is a pipeline stage.
@@ -65,10 +317,10 @@ func NewPipeline() *Pipeline {
 }
 
 // AddStage adds a new Stage to the pipeline
-func (p *Pipeline) AddStage(name string, fn StageFunc) {
+func (p *Pipeline) AddStage(name string, fn StageFunc, opts ...StageOption) {
 	p.stages = append(p.stages, &Stage{
 		Name: name,
-		Fn:   makeStageFunc(fn),
+		Fn:   makeStageFunc(name, fn, opts...),
 	})
 }
 
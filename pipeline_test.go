@@ -98,3 +98,141 @@ func TestPipeline(t *testing.T) {
 	assert.Equal(t, 1, len(results[0].NewValues))
 	assert.Equal(t, "USERS", results[0].Table)
 }
+
+// runStage feeds the changesets through a single stage pipeline, and returns
+// the emitted changesets once the source is exhausted.
+func runStage(t *testing.T, changes []*Changeset, fn StageFunc, opts ...StageOption) []*Changeset {
+	p := NewPipeline()
+	p.AddStage("test", fn, opts...)
+
+	sourceCh := make(chan *Changeset)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outCh, _ := p.Start(ctx, sourceCh)
+
+	go func() {
+		for _, change := range changes {
+			sourceCh <- change
+		}
+		close(sourceCh)
+	}()
+
+	var results []*Changeset
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case change, ok := <-outCh:
+			if !ok {
+				return results
+			}
+			results = append(results, change)
+		case <-timeout:
+			t.Fatal("timed out waiting for the stage to drain")
+		}
+	}
+}
+
+// sleepStage returns a StageFunc that sleeps longer for lower IDs, so that
+// concurrent workers finish out of order.
+func sleepStage(n int) StageFunc {
+	return func(change *Changeset) (*Changeset, error) {
+		time.Sleep(time.Duration(n-int(change.ID)%n) * time.Millisecond)
+		return change, nil
+	}
+}
+
+func TestStageWorkersPreserveOrder(t *testing.T) {
+	var changes []*Changeset
+	for i := 0; i < 100; i++ {
+		changes = append(changes, &Changeset{ID: int64(i)})
+	}
+
+	results := runStage(t, changes, sleepStage(10), StageWorkers(8))
+	assert.Equal(t, changes, results)
+}
+
+func TestStageWorkersDropChangesets(t *testing.T) {
+	var changes []*Changeset
+	for i := 0; i < 20; i++ {
+		changes = append(changes, &Changeset{ID: int64(i)})
+	}
+
+	results := runStage(t, changes, func(change *Changeset) (*Changeset, error) {
+		if change.ID%2 == 0 {
+			return nil, nil
+		}
+		return change, nil
+	}, StageWorkers(4))
+
+	assert.Len(t, results, 10)
+	for i, change := range results {
+		assert.Equal(t, int64(2*i+1), change.ID)
+	}
+}
+
+func TestStageOrderByKey(t *testing.T) {
+	var changes []*Changeset
+	for i := 0; i < 100; i++ {
+		changes = append(changes, &Changeset{
+			ID:        int64(i),
+			Table:     "users",
+			NewValues: []*ChangesetColumn{{Column: "id", Value: float64(i % 7)}},
+		})
+	}
+
+	results := runStage(t, changes, sleepStage(10), StageWorkers(4), StageOrderByKey(KeyByColumns("id")))
+	assert.Len(t, results, len(changes))
+
+	lastIDs := make(map[interface{}]int64)
+	for _, change := range results {
+		key, _ := change.GetNewColumnValue("id")
+		if last, ok := lastIDs[key]; ok {
+			assert.True(t, change.ID > last, "changeset %d emitted after %d for key %v", change.ID, last, key)
+		}
+		lastIDs[key] = change.ID
+	}
+}
+
+func TestStageWorkersBackpressure(t *testing.T) {
+	p := NewPipeline()
+	p.AddStage("test", func(change *Changeset) (*Changeset, error) {
+		return change, nil
+	}, StageWorkers(2))
+
+	sourceCh := make(chan *Changeset)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx, sourceCh)
+
+	// nothing reads the output, so the stage must stop reading its input
+	read := 0
+	for read < 100 {
+		select {
+		case sourceCh <- &Changeset{ID: int64(read)}:
+			read++
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+
+	assert.True(t, read <= 5, "stage read %d changesets without emitting any", read)
+}
+
+func TestKeyByColumns(t *testing.T) {
+	key := KeyByColumns("tenant_id", "id")
+
+	insert := &Changeset{
+		Schema:    "public",
+		Table:     "users",
+		NewValues: []*ChangesetColumn{{Column: "id", Value: float64(1)}, {Column: "tenant_id", Value: "a"}},
+	}
+	del := &Changeset{
+		Schema:    "public",
+		Table:     "users",
+		OldValues: []*ChangesetColumn{{Column: "tenant_id", Value: "a"}, {Column: "id", Value: float64(1)}},
+	}
+
+	assert.Equal(t, "public.users|a|1", key(insert))
+	assert.Equal(t, key(insert), key(del))
+}
@@ -0,0 +1,286 @@
+package warppipe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/perangel/warp-pipe/internal/store"
+)
+
+const (
+	defaultPollMinInterval = 100 * time.Millisecond
+	defaultPollMaxInterval = 5 * time.Second
+)
+
+// PollOption is a PollingListener option function
+type PollOption func(*PollingListener)
+
+// PollStartFromID is an option for setting the changeset ID to start polling from.
+func PollStartFromID(changesetID int64) PollOption {
+	return func(l *PollingListener) {
+		l.startFromID = &changesetID
+	}
+}
+
+// PollStartFromTimestamp is an option for setting the changeset timestamp to start polling from.
+func PollStartFromTimestamp(t time.Time) PollOption {
+	return func(l *PollingListener) {
+		l.startFromTimestamp = &t
+	}
+}
+
+// PollInterval is an option for setting the bounds of the polling interval.
+// The listener polls every min while changesets keep arriving, and doubles the
+// interval up to max while the changesets table is idle.
+func PollInterval(min, max time.Duration) PollOption {
+	return func(l *PollingListener) {
+		l.minInterval = min
+		l.maxInterval = max
+	}
+}
+
+// PollPageSize is an option for setting the number of changesets read per query.
+func PollPageSize(size int) PollOption {
+	return func(l *PollingListener) {
+		l.storeOpts = append(l.storeOpts, store.PageSize(size))
+	}
+}
+
+// PollingListener is a Listener that polls the changesets table for new
+// changesets, for environments where LISTEN/NOTIFY is unavailable, such as
+// behind PgBouncer in transaction pooling mode.
+// For more details see `pkg/schema/changesets`.
+type PollingListener struct {
+	conn               *pgx.Conn
+	logger             *log.Entry
+	store              store.EventStore
+	storeOpts          []store.Option
+	startFromID        *int64
+	startFromTimestamp *time.Time
+	minInterval        time.Duration
+	maxInterval        time.Duration
+	tracker            *deliveryTracker
+	changesetsCh       chan *Changeset
+	errCh              chan error
+}
+
+// NewPollingListener returns a new PollingListener.
+func NewPollingListener(opts ...PollOption) *PollingListener {
+	l := &PollingListener{
+		logger:       log.WithFields(log.Fields{"component": "listener"}),
+		minInterval:  defaultPollMinInterval,
+		maxInterval:  defaultPollMaxInterval,
+		tracker:      newDeliveryTracker(),
+		changesetsCh: make(chan *Changeset),
+		errCh:        make(chan error),
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if l.maxInterval < l.minInterval {
+		l.maxInterval = l.minInterval
+	}
+
+	return l
+}
+
+// Dial connects to the source database.
+func (l *PollingListener) Dial(connConfig *pgx.ConnConfig) error {
+	conn, err := pgx.Connect(*connConfig)
+	if err != nil {
+		l.logger.WithError(err).Error("Failed to connect to database.")
+		return err
+	}
+
+	l.conn = conn
+	return nil
+}
+
+// ListenForChanges returns a channel that emits database changesets.
+//
+// When the changesets table tracks transaction IDs, each poll reads the
+// changesets committed since the previous poll, so changesets are delivered
+// exactly once even if they commit out of ID order. Otherwise each poll reads
+// the changesets with an ID above the last delivered one.
+func (l *PollingListener) ListenForChanges(ctx context.Context) (chan *Changeset, chan error) {
+	l.store = store.NewChangesetStore(l.conn, l.storeOpts...)
+
+	go func() {
+		// closing the channel lets the pipeline drain once the listener stops
+		defer close(l.changesetsCh)
+
+		err := l.tracker.start(ctx, l.store)
+		if err != nil {
+			l.sendError(ctx, fmt.Errorf("failed to start tracking delivered changesets: %w", err))
+			return
+		}
+
+		if l.tracker.snapshot == nil {
+			l.logger.Warn("changesets table does not track transaction IDs, changesets committed out of order may be missed")
+			if l.startFromID != nil {
+				l.tracker.lastDeliveredID = *l.startFromID - 1
+			} else {
+				l.tracker.lastDeliveredID, err = l.store.GetLatestID(ctx)
+				if err != nil {
+					l.sendError(ctx, fmt.Errorf("failed to get the latest changeset ID: %w", err))
+					return
+				}
+			}
+		}
+
+		l.logger.WithFields(log.Fields{
+			"min_interval": l.minInterval,
+			"max_interval": l.maxInterval,
+		}).Info("Starting polling listener")
+
+		if l.startFromID != nil {
+			_, err = l.readEvents(ctx, func(eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+				l.store.GetSinceID(ctx, *l.startFromID, eventCh, doneCh, errCh)
+			})
+		} else if l.startFromTimestamp != nil {
+			_, err = l.readEvents(ctx, func(eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+				l.store.GetSinceTimestamp(ctx, *l.startFromTimestamp, eventCh, doneCh, errCh)
+			})
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// the backlog cannot be resumed, so the listener stops
+			l.logger.WithError(err).Error("encountered an error while reading changesets")
+			l.sendError(ctx, err)
+			return
+		}
+
+		interval := l.minInterval
+		for {
+			select {
+			case <-ctx.Done():
+				l.logger.Info("shutting down...")
+				return
+			case <-time.After(interval):
+			}
+
+			n, err := l.poll(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					l.logger.Info("shutting down...")
+					return
+				}
+				l.logger.WithError(err).Error("encountered an error while polling for changesets")
+				l.sendError(ctx, err)
+			}
+
+			if n > 0 {
+				interval = l.minInterval
+				continue
+			}
+
+			interval *= 2
+			if interval > l.maxInterval {
+				interval = l.maxInterval
+			}
+		}
+	}()
+
+	return l.changesetsCh, l.errCh
+}
+
+// poll delivers all new changesets and returns the number delivered.
+func (l *PollingListener) poll(ctx context.Context) (int, error) {
+	if l.tracker.snapshot != nil {
+		events, err := l.tracker.poll(ctx, l.store)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, event := range events {
+			l.processChangeset(ctx, event)
+		}
+		return len(events), nil
+	}
+
+	return l.readEvents(ctx, func(eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+		l.store.GetSinceID(ctx, l.tracker.lastDeliveredID+1, eventCh, doneCh, errCh)
+	})
+}
+
+// readEvents delivers all events from a streaming read of the store and
+// returns the number delivered. Events committed before the listener started
+// are delivered too, so they are only deduplicated against the changesets
+// actually delivered.
+func (l *PollingListener) readEvents(ctx context.Context, read func(chan *store.Event, chan bool, chan error)) (int, error) {
+	eventCh := make(chan *store.Event)
+	doneCh := make(chan bool)
+	errCh := make(chan error)
+
+	go read(eventCh, doneCh, errCh)
+
+	n := 0
+	for {
+		select {
+		case event := <-eventCh:
+			if l.deliver(ctx, event) {
+				n++
+			}
+		case err := <-errCh:
+			return n, err
+		case <-doneCh:
+			return n, nil
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+}
+
+// deliver emits a changeset unless it has already been delivered, and returns
+// true if it was emitted.
+func (l *PollingListener) deliver(ctx context.Context, event *store.Event) bool {
+	if l.tracker.isDelivered(event) {
+		return false
+	}
+
+	l.tracker.markDelivered(event)
+	l.processChangeset(ctx, event)
+	return true
+}
+
+// sendError reports an error of the listener, unless it is shutting down.
+func (l *PollingListener) sendError(ctx context.Context, err error) {
+	select {
+	case l.errCh <- err:
+	case <-ctx.Done():
+	}
+}
+
+// processChangeset emits the changeset of an event. Changesets that fail to
+// decode are reported on the error channel instead.
+func (l *PollingListener) processChangeset(ctx context.Context, event *store.Event) {
+	cs, err := newChangesetFromEvent(event)
+	if err != nil {
+		l.logger.WithError(err).WithField("changeset_id", event.ID).Error("failed to decode changeset")
+		l.sendError(ctx, fmt.Errorf("changeset %d: %w", event.ID, err))
+		return
+	}
+
+	select {
+	case l.changesetsCh <- cs:
+	case <-ctx.Done():
+	}
+}
+
+// Close closes the database connection.
+func (l *PollingListener) Close() error {
+	if err := l.conn.Close(); err != nil {
+		l.logger.WithError(err).Error("Error when closing database connection.")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package warppipe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/perangel/warp-pipe/internal/store"
+)
+
+func TestPollingListenerPoll(t *testing.T) {
+	events := []*store.Event{
+		{ID: 1, TxID: 100, Timestamp: time.Now()},
+		{ID: 2, TxID: 101, Timestamp: time.Now()},
+	}
+	fake := &fakeEventStore{events: events}
+
+	l := NewPollingListener()
+	l.store = fake
+	l.changesetsCh = make(chan *Changeset, 10)
+	l.tracker.snapshot = mustParseSnapshot(t, "100:100:")
+
+	// transaction 101 commits before transaction 100
+	fake.snapshot = mustParseSnapshot(t, "100:102:100")
+	n, err := l.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []int64{2}, drainChangesetIDs(l.changesetsCh))
+
+	fake.snapshot = mustParseSnapshot(t, "102:102:")
+	n, err = l.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []int64{1}, drainChangesetIDs(l.changesetsCh))
+
+	n, err = l.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestPollingListenerBacklogVisibleInSnapshot(t *testing.T) {
+	events := []*store.Event{
+		{ID: 1, TxID: 100, Timestamp: time.Now()},
+		{ID: 2, TxID: 101, Timestamp: time.Now()},
+		{ID: 3, TxID: 102, Timestamp: time.Now()},
+	}
+	fake := &fakeEventStore{events: events}
+
+	l := NewPollingListener(PollStartFromID(2))
+	l.store = fake
+	l.changesetsCh = make(chan *Changeset, 10)
+	// changeset 3 commits after the listener started
+	l.tracker.snapshot = mustParseSnapshot(t, "102:102:")
+
+	n, err := l.readEvents(context.Background(), func(eventCh chan *store.Event, doneCh chan bool, errCh chan error) {
+		fake.GetSinceID(context.Background(), *l.startFromID, eventCh, doneCh, errCh)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int64{2, 3}, drainChangesetIDs(l.changesetsCh))
+
+	// the first poll skips the changeset delivered by the backlog
+	fake.snapshot = mustParseSnapshot(t, "103:103:")
+	n, err = l.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestNewPollingListenerInterval(t *testing.T) {
+	l := NewPollingListener(PollInterval(time.Second, time.Millisecond))
+	assert.Equal(t, time.Second, l.minInterval)
+	assert.Equal(t, time.Second, l.maxInterval)
+}
@@ -0,0 +1,219 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/perangel/warp-pipe/db"
+	"github.com/perangel/warp-pipe/internal/store"
+)
+
+// ErrNothingToPrune is returned by NewPruner when the pruner has neither a
+// retention period, nor acknowledged changesets to prune, nor partitions to
+// manage.
+var ErrNothingToPrune = errors.New("pruner requires a retention period, pruning of acknowledged changesets, or a partitioned changesets table")
+
+// PrunerOption is a Pruner option function.
+type PrunerOption func(*Pruner)
+
+// RetainFor is an option for pruning all changesets older than the given age.
+func RetainFor(age time.Duration) PrunerOption {
+	return func(p *Pruner) {
+		p.retention = age
+	}
+}
+
+// PruneAcknowledged is an option for pruning all changesets that have been
+// acknowledged by every registered consumer.
+func PruneAcknowledged() PrunerOption {
+	return func(p *Pruner) {
+		p.pruneAcknowledged = true
+	}
+}
+
+// PruneBatchSize is an option for setting the maximum number of changesets
+// deleted by a single statement.
+func PruneBatchSize(size int) PrunerOption {
+	return func(p *Pruner) {
+		p.batchSize = size
+	}
+}
+
+// ManagePartitions is an option for creating future partitions of the
+// changesets table on every prune, when the table is partitioned. Alone, it
+// requires a partitioned table.
+func ManagePartitions() PrunerOption {
+	return func(p *Pruner) {
+		p.managePartitions = true
+	}
+}
+
+// PruneResult reports the number of changesets removed by a prune.
+type PruneResult struct {
+	// Number of changesets removed for being older than the retention period.
+	Expired int64
+	// Number of changesets removed for having been acknowledged by all consumers.
+	Acknowledged int64
+	// Names of the expired partitions that were dropped.
+	DroppedPartitions []string
+	// Names of the future partitions that were created.
+	CreatedPartitions []string
+}
+
+// Total returns the total number of changesets removed.
+func (r *PruneResult) Total() int64 {
+	return r.Expired + r.Acknowledged
+}
+
+// Pruner removes changesets from the `warp_pipe.changesets` table according
+// to a retention policy.
+type Pruner struct {
+	conn              *pgx.Conn
+	store             store.EventStore
+	retention         time.Duration
+	pruneAcknowledged bool
+	managePartitions  bool
+	batchSize         int
+	logger            *log.Entry
+}
+
+// NewPruner returns a new Pruner for the changesets table reachable through conn.
+func NewPruner(conn *pgx.Conn, opts ...PrunerOption) (*Pruner, error) {
+	p := &Pruner{
+		conn:   conn,
+		logger: log.WithFields(log.Fields{"component": "pruner"}),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.retention <= 0 && !p.pruneAcknowledged {
+		if !p.managePartitions {
+			return nil, ErrNothingToPrune
+		}
+
+		partitioning, err := db.GetPartitioning(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get changesets partitioning: %w", err)
+		}
+		if partitioning == nil {
+			return nil, ErrNothingToPrune
+		}
+	}
+
+	p.store = store.NewChangesetStore(conn, store.DeleteBatchSize(p.batchSize))
+
+	return p, nil
+}
+
+// Prune removes all changesets matched by the retention policy. When the
+// changesets table is partitioned, expired changesets are removed by dropping
+// whole partitions, so the retention period is rounded to partition boundaries,
+// and from the default partition, which holds the changesets written while
+// their partition was missing.
+func (p *Pruner) Prune(ctx context.Context) (*PruneResult, error) {
+	var result PruneResult
+
+	partitioning, err := db.GetPartitioning(p.conn)
+	if err != nil {
+		return &result, fmt.Errorf("failed to get changesets partitioning: %w", err)
+	}
+
+	if partitioning != nil && p.managePartitions {
+		result.CreatedPartitions, err = db.CreatePartitions(p.conn, partitioning, time.Now())
+		if err != nil {
+			return &result, err
+		}
+	}
+
+	if p.retention > 0 {
+		cutoff := time.Now().Add(-p.retention)
+		if partitioning != nil {
+			result.DroppedPartitions, err = db.DropPartitionsBefore(p.conn, partitioning, cutoff)
+			if err != nil {
+				return &result, err
+			}
+
+			result.Expired, err = db.DeleteDefaultPartitionBefore(p.conn, cutoff)
+			if err != nil {
+				return &result, err
+			}
+		} else {
+			n, err := p.store.DeleteBeforeTimestamp(ctx, cutoff)
+			result.Expired = n
+			if err != nil {
+				return &result, fmt.Errorf("failed to prune expired changesets: %w", err)
+			}
+		}
+	}
+
+	if p.pruneAcknowledged {
+		ackedID, err := p.store.GetAcknowledgedID(ctx)
+		if err != nil {
+			return &result, fmt.Errorf("failed to get acknowledged changeset ID: %w", err)
+		}
+
+		if ackedID > 0 {
+			n, err := p.store.DeleteBeforeID(ctx, ackedID+1)
+			result.Acknowledged = n
+			if err != nil {
+				return &result, fmt.Errorf("failed to prune acknowledged changesets: %w", err)
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+// Run prunes changesets once, then every interval until the context is
+// cancelled.
+func (p *Pruner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.pruneAndLog(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneAndLog prunes changesets and logs the result.
+func (p *Pruner) pruneAndLog(ctx context.Context) {
+	result, err := p.Prune(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		p.logger.WithError(err).Error("failed to prune changesets")
+	}
+
+	if result == nil {
+		return
+	}
+
+	if result.Total() > 0 {
+		p.logger.WithFields(log.Fields{
+			"expired":      result.Expired,
+			"acknowledged": result.Acknowledged,
+		}).Infof("pruned %d changesets", result.Total())
+	}
+
+	if len(result.DroppedPartitions) > 0 {
+		p.logger.WithField("partitions", result.DroppedPartitions).Info("dropped expired partitions")
+	}
+
+	if len(result.CreatedPartitions) > 0 {
+		p.logger.WithField("partitions", result.CreatedPartitions).Info("created future partitions")
+	}
+}
@@ -0,0 +1,200 @@
+// +build integration
+
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+func getIntegrationTestConn(t *testing.T) *pgx.Conn {
+	getEnv := func(key, fallback string) string {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return fallback
+	}
+	port, err := strconv.Atoi(getEnv("DB_PORT", "6432"))
+	require.NoError(t, err)
+
+	conn, err := pgx.Connect(pgx.ConnConfig{
+		Host:     getEnv("DB_HOST", "127.0.0.1"),
+		Port:     uint16(port),
+		Database: getEnv("DB_NAME", "test"),
+		User:     getEnv("DB_USER", "test"),
+		Password: getEnv("DB_PASS", "test"),
+	})
+	require.NoError(t, err)
+	return conn
+}
+
+// preparePrunerTest creates an empty `warp_pipe` schema, with a changeset for
+// each of the given timestamps, numbered from 1.
+func preparePrunerTest(t *testing.T, conn *pgx.Conn, timestamps ...time.Time) {
+	_ = db.Teardown(conn)
+	require.NoError(t, db.Prepare(conn, []string{"pruner_test"}, nil, nil))
+
+	for i, ts := range timestamps {
+		_, err := conn.Exec(`
+			INSERT INTO warp_pipe.changesets (id, ts, action, schema_name, table_name, relid)
+			VALUES ($1, $2, 'INSERT', 'public', 'users', 0)`, int64(i+1), ts)
+		require.NoError(t, err)
+	}
+}
+
+func remainingChangesetIDs(t *testing.T, conn *pgx.Conn) []int64 {
+	rows, err := conn.Query(`SELECT id FROM warp_pipe.changesets ORDER BY id`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		require.NoError(t, rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	require.NoError(t, rows.Err())
+	return ids
+}
+
+func TestPrunerDeletesInBatches(t *testing.T) {
+	conn := getIntegrationTestConn(t)
+	defer conn.Close()
+	defer db.Teardown(conn)
+
+	expired := time.Now().Add(-48 * time.Hour)
+	recent := time.Now()
+
+	testCases := []struct {
+		name       string
+		timestamps []time.Time
+		expired    int64
+		remaining  []int64
+	}{
+		{
+			name:       "more expired changesets than a batch",
+			timestamps: []time.Time{expired, expired, expired, expired, expired, recent, recent},
+			expired:    5,
+			remaining:  []int64{6, 7},
+		},
+		{
+			name:       "a multiple of the batch size",
+			timestamps: []time.Time{expired, expired, expired, expired, recent},
+			expired:    4,
+			remaining:  []int64{5},
+		},
+		{
+			name:       "no expired changesets",
+			timestamps: []time.Time{recent, recent},
+			expired:    0,
+			remaining:  []int64{1, 2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			preparePrunerTest(t, conn, tc.timestamps...)
+
+			p, err := NewPruner(conn, RetainFor(24*time.Hour), PruneBatchSize(2))
+			require.NoError(t, err)
+
+			result, err := p.Prune(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tc.expired, result.Expired)
+			assert.Equal(t, tc.remaining, remainingChangesetIDs(t, conn))
+		})
+	}
+}
+
+func TestPrunerAcknowledgedCutoff(t *testing.T) {
+	conn := getIntegrationTestConn(t)
+	defer conn.Close()
+	defer db.Teardown(conn)
+
+	now := time.Now()
+
+	testCases := []struct {
+		name         string
+		acks         map[string]int64
+		acknowledged int64
+		remaining    []int64
+	}{
+		{
+			name:         "no registered consumers",
+			acknowledged: 0,
+			remaining:    []int64{1, 2, 3, 4, 5},
+		},
+		{
+			name:         "the changesets acknowledged by every consumer",
+			acks:         map[string]int64{"fast": 4, "slow": 2},
+			acknowledged: 2,
+			remaining:    []int64{3, 4, 5},
+		},
+		{
+			name:         "all changesets acknowledged",
+			acks:         map[string]int64{"fast": 5, "slow": 5},
+			acknowledged: 5,
+			remaining:    []int64{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			preparePrunerTest(t, conn, now, now, now, now, now)
+			for consumer, id := range tc.acks {
+				_, err := conn.Exec(`
+					INSERT INTO warp_pipe.consumers (name, last_acked_id) VALUES ($1, $2)`, consumer, id)
+				require.NoError(t, err)
+			}
+
+			p, err := NewPruner(conn, PruneAcknowledged(), PruneBatchSize(2))
+			require.NoError(t, err)
+
+			result, err := p.Prune(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, tc.acknowledged, result.Acknowledged)
+			assert.Equal(t, tc.remaining, remainingChangesetIDs(t, conn))
+		})
+	}
+}
+
+func TestPrunerManagesPartitionsAlone(t *testing.T) {
+	conn := getIntegrationTestConn(t)
+	defer conn.Close()
+	defer db.Teardown(conn)
+
+	// an unpartitioned table leaves nothing to do
+	preparePrunerTest(t, conn)
+	_, err := NewPruner(conn, ManagePartitions())
+	assert.True(t, errors.Is(err, ErrNothingToPrune), err)
+
+	_ = db.Teardown(conn)
+	require.NoError(t, db.Prepare(conn, []string{"pruner_test"}, nil, nil, db.PartitionBy(db.PartitionDaily, 1)))
+	p, err := NewPruner(conn, ManagePartitions())
+	require.NoError(t, err)
+
+	// the missing future partition is created again
+	var latest string
+	err = conn.QueryRow(`
+		SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'warp_pipe.changesets'::regclass AND c.relname <> 'changesets_default'
+		ORDER BY c.relname DESC LIMIT 1`).Scan(&latest)
+	require.NoError(t, err)
+	_, err = conn.Exec(`DROP TABLE warp_pipe.` + latest)
+	require.NoError(t, err)
+
+	result, err := p.Prune(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{latest}, result.CreatedPartitions)
+	assert.Equal(t, int64(0), result.Total())
+}
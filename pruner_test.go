@@ -0,0 +1,34 @@
+package warppipe
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPruner(t *testing.T) {
+	t.Run("requires a retention policy", func(t *testing.T) {
+		_, err := NewPruner(nil)
+		assert.True(t, errors.Is(err, ErrNothingToPrune), err)
+	})
+
+	t.Run("with a retention period", func(t *testing.T) {
+		p, err := NewPruner(nil, RetainFor(24*time.Hour), PruneBatchSize(10))
+		assert.NoError(t, err)
+		assert.Equal(t, 24*time.Hour, p.retention)
+		assert.Equal(t, 10, p.batchSize)
+	})
+
+	t.Run("with acknowledged pruning", func(t *testing.T) {
+		p, err := NewPruner(nil, PruneAcknowledged())
+		assert.NoError(t, err)
+		assert.True(t, p.pruneAcknowledged)
+	})
+}
+
+func TestPruneResultTotal(t *testing.T) {
+	r := &PruneResult{Expired: 3, Acknowledged: 4}
+	assert.Equal(t, int64(7), r.Total())
+}
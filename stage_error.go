@@ -0,0 +1,213 @@
+package warppipe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const maxRetryBackoff = time.Minute
+
+// StageError is an error returned by the StageFunc of a pipeline stage.
+type StageError struct {
+	// Name of the stage.
+	Stage string
+	// Changeset the stage failed to process.
+	Changeset *Changeset
+	// Batch the stage failed to process, for batch stages. See AddBatchStage().
+	Batch []*Changeset
+	// Err is the error returned by the StageFunc.
+	Err error
+	// Halted is true if the stage stopped processing changesets because of
+	// the error.
+	Halted bool
+}
+
+// Error implements error.
+func (e *StageError) Error() string {
+	if e.Batch != nil {
+		return fmt.Sprintf("stage %s: batch of %d changesets: %v", e.Stage, len(e.Batch), e.Err)
+	}
+	if e.Changeset == nil {
+		return fmt.Sprintf("stage %s: %v", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("stage %s: changeset %d: %v", e.Stage, e.Changeset.ID, e.Err)
+}
+
+// Unwrap returns the error returned by the StageFunc.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorPolicy is the handling of changesets that a stage failed to process.
+type ErrorPolicy string
+
+// ErrorPolicy constants
+const (
+	// Report the error and drop the changeset. This is the default.
+	ErrorPolicyDrop ErrorPolicy = "drop"
+	// Report the error and stop the stage, closing the pipeline's output.
+	ErrorPolicyHalt ErrorPolicy = "halt"
+	// Send the changeset to the stage's DeadLetterSink. Errors are only
+	// reported if the changeset cannot be sent, or if the stage has no sink.
+	ErrorPolicyDeadLetter ErrorPolicy = "dead_letter"
+)
+
+// ParseErrorPolicy parses an error policy from a string.
+func ParseErrorPolicy(policy string) (ErrorPolicy, error) {
+	switch ErrorPolicy(policy) {
+	case ErrorPolicyDrop, ErrorPolicyHalt, ErrorPolicyDeadLetter:
+		return ErrorPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("'%s' is not a valid error policy. Must be one of `drop`, `halt` or `dead_letter`", policy)
+	}
+}
+
+// DeadLetterSink receives the changesets that a stage failed to process.
+type DeadLetterSink interface {
+	Send(ctx context.Context, err *StageError) error
+}
+
+// DeadLetterFunc is a function implementing DeadLetterSink.
+type DeadLetterFunc func(ctx context.Context, err *StageError) error
+
+// Send implements DeadLetterSink.
+func (f DeadLetterFunc) Send(ctx context.Context, err *StageError) error {
+	return f(ctx, err)
+}
+
+// deadLetter is a dead-lettered changeset, as written by a JSONDeadLetterSink.
+type deadLetter struct {
+	Stage     string     `json:"stage"`
+	Error     string     `json:"error"`
+	Timestamp time.Time  `json:"timestamp"`
+	Changeset *Changeset `json:"changeset"`
+}
+
+// JSONDeadLetterSink is a DeadLetterSink writing each changeset, along with
+// its stage and error, as a line of JSON.
+type JSONDeadLetterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONDeadLetterSink returns a new JSONDeadLetterSink writing to w.
+func NewJSONDeadLetterSink(w io.Writer) *JSONDeadLetterSink {
+	return &JSONDeadLetterSink{w: w}
+}
+
+// Send implements DeadLetterSink.
+func (s *JSONDeadLetterSink) Send(ctx context.Context, err *StageError) error {
+	b, mErr := json.Marshal(&deadLetter{
+		Stage:     err.Stage,
+		Error:     err.Err.Error(),
+		Timestamp: time.Now(),
+		Changeset: err.Changeset,
+	})
+	if mErr != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", mErr)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, wErr := s.w.Write(append(b, '\n'))
+	return wErr
+}
+
+// StageRetry is an option for retrying a failed StageFunc up to attempts times,
+// waiting backoff before the first retry and doubling the wait after each one,
+// before applying the stage's ErrorPolicy. The StageFunc must be safe to retry
+// on the changeset it failed to process.
+func StageRetry(attempts int, backoff time.Duration) StageOption {
+	return func(o *stageOptions) {
+		o.retries = attempts
+		o.retryBackoff = backoff
+	}
+}
+
+// StageOnError is an option for setting the ErrorPolicy of a stage.
+func StageOnError(policy ErrorPolicy) StageOption {
+	return func(o *stageOptions) {
+		o.errorPolicy = policy
+	}
+}
+
+// StageDeadLetter is an option for sending the changesets that a stage fails to
+// process to a DeadLetterSink.
+func StageDeadLetter(sink DeadLetterSink) StageOption {
+	return func(o *stageOptions) {
+		o.errorPolicy = ErrorPolicyDeadLetter
+		o.deadLetter = sink
+	}
+}
+
+// process runs the StageFunc on a changeset and applies the stage's error
+// policy. It returns the changeset to emit, if any, whether the stage must
+// halt, and the error to report, if any.
+func (s *stageRunner) process(ctx context.Context, change *Changeset) (*Changeset, bool, error) {
+	var c *Changeset
+	cancelled, err := s.options.withRetries(ctx, func() error {
+		var err error
+		c, err = s.fn(change)
+		return err
+	})
+	if cancelled {
+		return nil, true, nil
+	}
+	if err == nil {
+		return c, false, nil
+	}
+
+	halt, err := s.options.handleError(ctx, &StageError{Stage: s.name, Changeset: change, Err: err})
+	return nil, halt, err
+}
+
+// withRetries calls fn, and retries it while it fails, up to the configured
+// number of retries. It returns true if the context was cancelled while
+// waiting for a retry, and the last error of fn otherwise.
+func (o *stageOptions) withRetries(ctx context.Context, fn func() error) (bool, error) {
+	err := fn()
+
+	backoff := o.retryBackoff
+	for attempt := 0; err != nil && attempt < o.retries; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return true, nil
+		}
+
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+
+		err = fn()
+	}
+
+	return false, err
+}
+
+// handleError applies the error policy of a stage to a StageError. It returns
+// whether the stage must halt, and the error to report, if any.
+func (o *stageOptions) handleError(ctx context.Context, stageErr *StageError) (bool, error) {
+	switch o.errorPolicy {
+	case ErrorPolicyHalt:
+		stageErr.Halted = true
+		return true, stageErr
+	case ErrorPolicyDeadLetter:
+		if o.deadLetter == nil {
+			return false, stageErr
+		}
+
+		sendErr := o.deadLetter.Send(ctx, stageErr)
+		if sendErr != nil {
+			return false, fmt.Errorf("failed to send to the dead-letter sink: %v: %w", sendErr, stageErr)
+		}
+		return false, nil
+	default:
+		return false, stageErr
+	}
+}
@@ -0,0 +1,172 @@
+package warppipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errTestStage = errors.New("stage failed")
+
+// runStageWithErrors runs a single stage over the changesets, and returns the
+// changesets and errors it emitted.
+func runStageWithErrors(t *testing.T, changes []*Changeset, fn StageFunc, opts ...StageOption) ([]*Changeset, []error) {
+	p := NewPipeline()
+	p.AddStage("test", fn, opts...)
+	return runPipeline(t, p, changes)
+}
+
+// runPipeline runs a pipeline over the changesets, and returns the changesets
+// and errors it emitted.
+func runPipeline(t *testing.T, p *Pipeline, changes []*Changeset) ([]*Changeset, []error) {
+	sourceCh := make(chan *Changeset)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outCh, errCh := p.Start(ctx, sourceCh)
+
+	go func() {
+		for _, change := range changes {
+			select {
+			case sourceCh <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(sourceCh)
+	}()
+
+	var results []*Changeset
+	var errs []error
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case change, ok := <-outCh:
+			if !ok {
+				return results, errs
+			}
+			results = append(results, change)
+		case err := <-errCh:
+			errs = append(errs, err)
+		case <-timeout:
+			t.Fatal("timed out waiting for the stage to drain")
+		}
+	}
+}
+
+func newTestChangesets(n int) []*Changeset {
+	var changes []*Changeset
+	for i := 0; i < n; i++ {
+		changes = append(changes, &Changeset{ID: int64(i)})
+	}
+	return changes
+}
+
+// failOdd fails on changesets with an odd ID.
+func failOdd(change *Changeset) (*Changeset, error) {
+	if change.ID%2 == 1 {
+		return nil, errTestStage
+	}
+	return change, nil
+}
+
+func TestStageErrorPolicyDrop(t *testing.T) {
+	changes := newTestChangesets(4)
+	results, errs := runStageWithErrors(t, changes, failOdd)
+
+	assert.Equal(t, []*Changeset{changes[0], changes[2]}, results)
+	if assert.Len(t, errs, 2) {
+		var stageErr *StageError
+		assert.True(t, errors.As(errs[0], &stageErr))
+		assert.Equal(t, "test", stageErr.Stage)
+		assert.Equal(t, changes[1], stageErr.Changeset)
+		assert.False(t, stageErr.Halted)
+		assert.True(t, errors.Is(errs[0], errTestStage))
+		assert.EqualError(t, errs[0], "stage test: changeset 1: stage failed")
+	}
+}
+
+func TestStageErrorPolicyHalt(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		changes := newTestChangesets(4)
+		results, errs := runStageWithErrors(t, changes, failOdd, StageOnError(ErrorPolicyHalt), StageWorkers(workers))
+
+		assert.Equal(t, []*Changeset{changes[0]}, results)
+		if assert.Len(t, errs, 1) {
+			assert.True(t, errs[0].(*StageError).Halted)
+		}
+	}
+}
+
+func TestStageRetry(t *testing.T) {
+	attempts := 0
+	flaky := func(change *Changeset) (*Changeset, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errTestStage
+		}
+		return change, nil
+	}
+
+	changes := newTestChangesets(1)
+	results, errs := runStageWithErrors(t, changes, flaky, StageRetry(2, time.Millisecond))
+	assert.Equal(t, changes, results)
+	assert.Empty(t, errs)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	results, errs = runStageWithErrors(t, changes, flaky, StageRetry(1, time.Millisecond))
+	assert.Empty(t, results)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestStageDeadLetter(t *testing.T) {
+	var deadLetters []*StageError
+	sink := DeadLetterFunc(func(_ context.Context, err *StageError) error {
+		deadLetters = append(deadLetters, err)
+		return nil
+	})
+
+	changes := newTestChangesets(4)
+	results, errs := runStageWithErrors(t, changes, failOdd, StageDeadLetter(sink))
+	assert.Equal(t, []*Changeset{changes[0], changes[2]}, results)
+	assert.Empty(t, errs)
+	if assert.Len(t, deadLetters, 2) {
+		assert.Equal(t, changes[1], deadLetters[0].Changeset)
+		assert.Equal(t, changes[3], deadLetters[1].Changeset)
+	}
+
+	failingSink := DeadLetterFunc(func(context.Context, *StageError) error {
+		return errors.New("sink unavailable")
+	})
+	_, errs = runStageWithErrors(t, changes, failOdd, StageDeadLetter(failingSink))
+	if assert.Len(t, errs, 2) {
+		assert.True(t, errors.Is(errs[0], errTestStage))
+		assert.EqualError(t, errs[0], "failed to send to the dead-letter sink: sink unavailable: stage test: changeset 1: stage failed")
+	}
+}
+
+func TestJSONDeadLetterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONDeadLetterSink(&buf)
+
+	change := &Changeset{ID: 7, Kind: ChangesetKindInsert, Schema: "public", Table: "users"}
+	err := sink.Send(context.Background(), &StageError{Stage: "hash_columns", Changeset: change, Err: errTestStage})
+	assert.NoError(t, err)
+
+	var line struct {
+		Stage     string     `json:"stage"`
+		Error     string     `json:"error"`
+		Changeset *Changeset `json:"changeset"`
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "hash_columns", line.Stage)
+	assert.Equal(t, "stage failed", line.Error)
+	assert.Equal(t, int64(7), line.Changeset.ID)
+	assert.Equal(t, "users", line.Changeset.Table)
+}
@@ -0,0 +1,491 @@
+package warppipe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/perangel/warp-pipe/internal/expr"
+)
+
+// Built-in stage types
+const (
+	// Keeps only the changesets matching the stage, or drops them if Drop is set.
+	StageTypeFilter = "filter"
+	// Removes Columns from the changeset values.
+	StageTypeDropColumns = "drop_columns"
+	// Renames columns according to the Rename mapping of old to new names.
+	StageTypeRenameColumns = "rename_columns"
+	// Replaces the values of Columns by their HMAC-SHA256, keyed by Secret.
+	StageTypeHashColumns = "hash_columns"
+	// Replaces the values of Columns by Replacement.
+	StageTypeRedactColumns = "redact_columns"
+	// Sets the static Values on the new values of the changeset.
+	StageTypeAddFields = "add_fields"
+	// Renames schemas according to the Rename mapping of old to new names.
+	StageTypeRenameSchema = "rename_schema"
+	// Renames tables according to the Rename mapping of old to new names. Old
+	// names are either <schema>.<table> or <table>.
+	StageTypeRenameTable = "rename_table"
+)
+
+// Column predicate operators
+const (
+	PredicateEquals    = "eq"
+	PredicateNotEquals = "ne"
+	PredicateExists    = "exists"
+	PredicateMissing   = "missing"
+)
+
+const defaultRedactReplacement = "[REDACTED]"
+
+// PipelineConfig is the declarative configuration of a pipeline made of
+// built-in stages.
+type PipelineConfig struct {
+	Stages []StageConfig `yaml:"stages" json:"stages"`
+}
+
+// StageConfig is the configuration of a built-in pipeline stage. Kinds, Tables,
+// Where and Expr select the changesets the stage applies to; any other changeset
+// passes through the stage unchanged, or is dropped by a filter stage.
+type StageConfig struct {
+	// Name of the stage. Defaults to the stage type.
+	Name string `yaml:"name" json:"name"`
+	// Type of the stage, one of the StageType constants.
+	Type string `yaml:"type" json:"type"`
+
+	// Changeset kinds the stage applies to. Defaults to all kinds.
+	Kinds []string `yaml:"kinds" json:"kinds"`
+	// Tables the stage applies to, in the formats accepted by WhitelistTables().
+	// Defaults to all tables.
+	Tables []string `yaml:"tables" json:"tables"`
+	// Predicates that the row values must all match for the stage to apply.
+	Where []ColumnPredicate `yaml:"where" json:"where"`
+	// Filter expression that must evaluate to true for the stage to apply. See
+	// Filter() for the expression language.
+	Expr string `yaml:"expr" json:"expr"`
+
+	// Drop the matching changesets instead of keeping them. (filter)
+	Drop bool `yaml:"drop" json:"drop"`
+	// Columns the stage applies to. (drop_columns, hash_columns, redact_columns)
+	Columns []string `yaml:"columns" json:"columns"`
+	// Mapping of old to new names. (rename_columns, rename_schema, rename_table)
+	Rename map[string]string `yaml:"rename" json:"rename"`
+	// Static values to set, by column. (add_fields)
+	Values map[string]interface{} `yaml:"values" json:"values"`
+	// Value replacing redacted values. Defaults to "[REDACTED]". (redact_columns)
+	Replacement string `yaml:"replacement" json:"replacement"`
+	// Secret key of the HMAC of hashed values, so that they cannot be
+	// recovered by hashing guesses. (hash_columns)
+	Secret string `yaml:"secret" json:"secret"`
+
+	// Number of times a failed changeset is retried. See StageRetry().
+	Retries int `yaml:"retries" json:"retries"`
+	// Wait before the first retry, doubled after each one.
+	RetryBackoff time.Duration `yaml:"retry_backoff" json:"retry_backoff"`
+	// ErrorPolicy of the stage, one of `drop` (default), `halt` or `dead_letter`.
+	OnError string `yaml:"on_error" json:"on_error"`
+}
+
+// ColumnPredicate is a condition on a column value of the changed row. The row
+// values are the new values of a changeset, or the old values of a delete.
+type ColumnPredicate struct {
+	Column string `yaml:"column" json:"column"`
+	// Op is one of the Predicate constants. Defaults to `eq`.
+	Op string `yaml:"op" json:"op"`
+	// Value compared to the column value by `eq` and `ne`.
+	Value interface{} `yaml:"value" json:"value"`
+}
+
+// LoadPipelineConfig reads a pipeline configuration from a YAML or JSON file.
+func LoadPipelineConfig(path string) (*PipelineConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline config: %w", err)
+	}
+
+	return ParsePipelineConfig(data)
+}
+
+// ParsePipelineConfig parses a pipeline configuration in YAML or JSON, and
+// validates its stages.
+func ParsePipelineConfig(data []byte) (*PipelineConfig, error) {
+	var config PipelineConfig
+	err := yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config: %w", err)
+	}
+
+	for _, stage := range config.Stages {
+		_, err := newConfiguredStage(stage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+// NewPipelineFromConfig returns a new Pipeline made of the configured stages.
+func NewPipelineFromConfig(config *PipelineConfig) (*Pipeline, error) {
+	p := NewPipeline()
+	for _, stage := range config.Stages {
+		err := p.AddStageConfig(stage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// AddStageConfig adds a new built-in Stage to the pipeline. The options apply
+// before the retries and error policy of the configuration.
+func (p *Pipeline) AddStageConfig(config StageConfig, opts ...StageOption) error {
+	stage, err := newConfiguredStage(config, opts...)
+	if err != nil {
+		return err
+	}
+
+	p.stages = append(p.stages, stage)
+	return nil
+}
+
+func newConfiguredStage(config StageConfig, opts ...StageOption) (*Stage, error) {
+	name := config.Name
+	if name == "" {
+		name = config.Type
+	}
+
+	fn, err := newStageFunc(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline stage `%s`: %w", name, err)
+	}
+
+	if config.Retries > 0 {
+		opts = append(opts, StageRetry(config.Retries, config.RetryBackoff))
+	}
+
+	if config.OnError != "" {
+		policy, err := ParseErrorPolicy(config.OnError)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pipeline stage `%s`: %w", name, err)
+		}
+		opts = append(opts, StageOnError(policy))
+	}
+
+	return &Stage{
+		Name: name,
+		Fn:   makeStageFunc(name, fn, opts...),
+	}, nil
+}
+
+func newStageFunc(config StageConfig) (StageFunc, error) {
+	matches, err := newStageMatcher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var apply func(*Changeset)
+	switch config.Type {
+	case StageTypeFilter:
+		return func(change *Changeset) (*Changeset, error) {
+			ok, err := matches(change)
+			if err != nil {
+				return nil, err
+			}
+			if ok == config.Drop {
+				return nil, nil
+			}
+			return change, nil
+		}, nil
+	case StageTypeDropColumns:
+		if len(config.Columns) == 0 {
+			return nil, fmt.Errorf("`columns` is required")
+		}
+		columns := stringSet(config.Columns)
+		apply = func(change *Changeset) {
+			change.NewValues = dropColumns(change.NewValues, columns)
+			change.OldValues = dropColumns(change.OldValues, columns)
+		}
+	case StageTypeRenameColumns:
+		if len(config.Rename) == 0 {
+			return nil, fmt.Errorf("`rename` is required")
+		}
+		apply = func(change *Changeset) {
+			renameColumns(change.NewValues, config.Rename)
+			renameColumns(change.OldValues, config.Rename)
+		}
+	case StageTypeHashColumns:
+		if len(config.Columns) == 0 {
+			return nil, fmt.Errorf("`columns` is required")
+		}
+		if config.Secret == "" {
+			return nil, fmt.Errorf("`secret` is required")
+		}
+		columns := stringSet(config.Columns)
+		hash := makeHashValue([]byte(config.Secret))
+		apply = func(change *Changeset) {
+			mapColumnValues(change.NewValues, columns, hash)
+			mapColumnValues(change.OldValues, columns, hash)
+		}
+	case StageTypeRedactColumns:
+		if len(config.Columns) == 0 {
+			return nil, fmt.Errorf("`columns` is required")
+		}
+		columns := stringSet(config.Columns)
+		replacement := config.Replacement
+		if replacement == "" {
+			replacement = defaultRedactReplacement
+		}
+		redact := func(v interface{}) interface{} {
+			if v == nil {
+				return nil
+			}
+			return replacement
+		}
+		apply = func(change *Changeset) {
+			mapColumnValues(change.NewValues, columns, redact)
+			mapColumnValues(change.OldValues, columns, redact)
+		}
+	case StageTypeAddFields:
+		if len(config.Values) == 0 {
+			return nil, fmt.Errorf("`values` is required")
+		}
+		for column, value := range config.Values {
+			switch value.(type) {
+			case nil, string, bool, int, int64, float64:
+			default:
+				return nil, fmt.Errorf("value of `%s` must be a string, number, boolean or null", column)
+			}
+		}
+		apply = func(change *Changeset) {
+			if change.NewValues == nil {
+				return
+			}
+			for column, value := range config.Values {
+				change.NewValues = setColumnValue(change.NewValues, column, value)
+			}
+		}
+	case StageTypeRenameSchema:
+		if len(config.Rename) == 0 {
+			return nil, fmt.Errorf("`rename` is required")
+		}
+		apply = func(change *Changeset) {
+			if schema, ok := config.Rename[change.Schema]; ok {
+				change.Schema = schema
+			}
+		}
+	case StageTypeRenameTable:
+		if len(config.Rename) == 0 {
+			return nil, fmt.Errorf("`rename` is required")
+		}
+		apply = func(change *Changeset) {
+			if table, ok := config.Rename[change.Schema+"."+change.Table]; ok {
+				change.Table = table
+			} else if table, ok := config.Rename[change.Table]; ok {
+				change.Table = table
+			}
+		}
+	case "":
+		return nil, fmt.Errorf("`type` is required")
+	default:
+		return nil, fmt.Errorf("unknown stage type `%s`", config.Type)
+	}
+
+	return func(change *Changeset) (*Changeset, error) {
+		ok, err := matches(change)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			apply(change)
+		}
+		return change, nil
+	}, nil
+}
+
+// newStageMatcher returns a function reporting whether a changeset is selected
+// by the kinds, tables, predicates and expression of a stage.
+func newStageMatcher(config StageConfig) (func(*Changeset) (bool, error), error) {
+	kinds := make(map[ChangesetKind]bool)
+	for _, k := range config.Kinds {
+		kind := ParseChangesetKind(k)
+		if kind == "" {
+			return nil, fmt.Errorf("'%s' is not a valid changeset kind", k)
+		}
+		kinds[kind] = true
+	}
+
+	for _, pred := range config.Where {
+		if pred.Column == "" {
+			return nil, fmt.Errorf("`column` is required in predicates")
+		}
+		switch pred.Op {
+		case "", PredicateEquals, PredicateNotEquals, PredicateExists, PredicateMissing:
+		default:
+			return nil, fmt.Errorf("unknown predicate operator `%s`", pred.Op)
+		}
+	}
+
+	var filter *expr.Program
+	if config.Expr != "" {
+		var err error
+		filter, err = compileFilter(config.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(change *Changeset) (bool, error) {
+		if len(kinds) > 0 && !kinds[change.Kind] {
+			return false, nil
+		}
+
+		if len(config.Tables) > 0 && !matchTables(config.Tables, change.Schema, change.Table) {
+			return false, nil
+		}
+
+		for _, pred := range config.Where {
+			if !pred.matches(change) {
+				return false, nil
+			}
+		}
+
+		if filter != nil {
+			return filter.Eval(changesetRow{change})
+		}
+
+		return true, nil
+	}, nil
+}
+
+func (p ColumnPredicate) matches(change *Changeset) bool {
+	values := change.NewValues
+	if change.Kind == ChangesetKindDelete {
+		values = change.OldValues
+	}
+	value, ok := change.getColumnValue(values, p.Column)
+
+	switch p.Op {
+	case PredicateExists:
+		return ok
+	case PredicateMissing:
+		return !ok
+	case PredicateNotEquals:
+		return !ok || !valuesEqual(value, p.Value)
+	default:
+		return ok && valuesEqual(value, p.Value)
+	}
+}
+
+// valuesEqual compares a changeset value to a configured value. Values are
+// compared by their string form, since numbers decoded from changesets and
+// from configs have different types.
+func valuesEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return valueText(a) == valueText(b)
+}
+
+// valueText returns the string form of a value, formatting raw JSON as its
+// text rather than its bytes, and binary values as their Postgres hex text.
+func valueText(v interface{}) string {
+	switch v := v.(type) {
+	case json.RawMessage:
+		return string(v)
+	case []byte:
+		return `\x` + hex.EncodeToString(v)
+	}
+	return fmt.Sprint(v)
+}
+
+// matchTables returns true if the table matches any of the patterns, in the
+// formats accepted by WhitelistTables().
+func matchTables(patterns []string, schema, table string) bool {
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, ".")
+		// <schema>.<table>
+		if len(parts) == 2 {
+			if parts[0] == schema && (parts[1] == "*" || parts[1] == table) {
+				return true
+			}
+			// <table>
+		} else if parts[0] == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func dropColumns(values []*ChangesetColumn, columns map[string]bool) []*ChangesetColumn {
+	if values == nil {
+		return nil
+	}
+
+	kept := make([]*ChangesetColumn, 0, len(values))
+	for _, v := range values {
+		if !columns[v.Column] {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func renameColumns(values []*ChangesetColumn, rename map[string]string) {
+	for _, v := range values {
+		if name, ok := rename[v.Column]; ok {
+			v.Column = name
+		}
+	}
+}
+
+func mapColumnValues(values []*ChangesetColumn, columns map[string]bool, fn func(interface{}) interface{}) {
+	for _, v := range values {
+		if columns[v.Column] {
+			v.Value = fn(v.Value)
+		}
+	}
+}
+
+func setColumnValue(values []*ChangesetColumn, column string, value interface{}) []*ChangesetColumn {
+	for _, v := range values {
+		if v.Column == column {
+			v.Value = value
+			return values
+		}
+	}
+
+	return append(values, &ChangesetColumn{Column: column, Value: value})
+}
+
+// makeHashValue returns a function replacing values by the hex encoded
+// HMAC-SHA256 of their text, keyed by secret.
+func makeHashValue(secret []byte) func(interface{}) interface{} {
+	return func(v interface{}) interface{} {
+		if v == nil {
+			return nil
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(valueText(v)))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
@@ -0,0 +1,133 @@
+package warppipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUserChangeset(kind ChangesetKind) *Changeset {
+	return &Changeset{
+		Kind:   kind,
+		Schema: "public",
+		Table:  "users",
+		NewValues: []*ChangesetColumn{
+			{Column: "id", Value: float64(1)},
+			{Column: "email", Value: "bob@example.com"},
+			{Column: "password", Value: "hunter2"},
+			{Column: "is_test", Value: false},
+		},
+	}
+}
+
+func mustStageFunc(t *testing.T, config StageConfig) StageFunc {
+	fn, err := newStageFunc(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestParsePipelineConfig(t *testing.T) {
+	config, err := ParsePipelineConfig([]byte(`
+stages:
+  - name: drop_test_users
+    type: filter
+    drop: true
+    where:
+      - column: is_test
+        value: true
+  - type: hash_columns
+    tables: [public.users]
+    columns: [email]
+    secret: s3cret
+`))
+	assert.NoError(t, err)
+	assert.Len(t, config.Stages, 2)
+	assert.Equal(t, "drop_test_users", config.Stages[0].Name)
+	assert.Equal(t, []string{"email"}, config.Stages[1].Columns)
+
+	config, err = ParsePipelineConfig([]byte(`{"stages": [{"type": "rename_schema", "rename": {"public": "app"}}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"public": "app"}, config.Stages[0].Rename)
+
+	config, err = ParsePipelineConfig([]byte(`stages: [{type: drop_columns, columns: [a], retries: 3, retry_backoff: 100ms, on_error: halt}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, config.Stages[0].RetryBackoff)
+	assert.Equal(t, "halt", config.Stages[0].OnError)
+
+	testCases := []string{
+		`stages: [{type: unknown}]`,
+		`stages: [{type: drop_columns, columns: [a], on_error: ignore}]`,
+		`stages: [{type: drop_columns}]`,
+		`stages: [{type: hash_columns, columns: [a]}]`,
+		`stages: [{type: filter, kinds: [truncate]}]`,
+		`stages: [{type: filter, where: [{column: id, op: gt}]}]`,
+		`stages: [{type: add_fields, values: {tags: [a, b]}}]`,
+		`stages: [{type: filter, unknown_field: true}]`,
+	}
+	for _, tc := range testCases {
+		_, err = ParsePipelineConfig([]byte(tc))
+		assert.Error(t, err, tc)
+	}
+}
+
+func TestFilterStage(t *testing.T) {
+	keepUsers := mustStageFunc(t, StageConfig{Type: StageTypeFilter, Tables: []string{"public.users"}, Kinds: []string{"insert"}})
+	change, _ := keepUsers(newTestUserChangeset(ChangesetKindInsert))
+	assert.NotNil(t, change)
+	change, _ = keepUsers(newTestUserChangeset(ChangesetKindUpdate))
+	assert.Nil(t, change)
+
+	dropTestUsers := mustStageFunc(t, StageConfig{
+		Type:  StageTypeFilter,
+		Drop:  true,
+		Where: []ColumnPredicate{{Column: "id", Value: 1}},
+	})
+	change, _ = dropTestUsers(newTestUserChangeset(ChangesetKindInsert))
+	assert.Nil(t, change)
+
+	exprFilter := mustStageFunc(t, StageConfig{Type: StageTypeFilter, Expr: `table == "users" && new("is_test") == false`})
+	change, _ = exprFilter(newTestUserChangeset(ChangesetKindInsert))
+	assert.NotNil(t, change)
+
+	_, err := newStageFunc(StageConfig{Type: StageTypeFilter, Expr: `tabel == "users"`})
+	assert.EqualError(t, err, "invalid filter expression: unknown field `tabel` at offset 0 in `tabel == \"users\"`")
+
+	dropMissing := mustStageFunc(t, StageConfig{
+		Type:  StageTypeFilter,
+		Drop:  true,
+		Where: []ColumnPredicate{{Column: "deleted_at", Op: PredicateExists}},
+	})
+	change, _ = dropMissing(newTestUserChangeset(ChangesetKindInsert))
+	assert.NotNil(t, change)
+}
+
+func TestColumnStages(t *testing.T) {
+	change := newTestUserChangeset(ChangesetKindInsert)
+	for _, config := range []StageConfig{
+		{Type: StageTypeDropColumns, Columns: []string{"is_test"}},
+		{Type: StageTypeRedactColumns, Columns: []string{"password"}},
+		{Type: StageTypeHashColumns, Columns: []string{"email"}, Secret: "s3cret"},
+		{Type: StageTypeRenameColumns, Rename: map[string]string{"email": "email_hash"}},
+		{Type: StageTypeAddFields, Values: map[string]interface{}{"source": "warp-pipe"}},
+		{Type: StageTypeRenameSchema, Rename: map[string]string{"public": "app"}},
+		{Type: StageTypeRenameTable, Rename: map[string]string{"app.users": "accounts"}},
+		// does not apply to the renamed table
+		{Type: StageTypeDropColumns, Tables: []string{"users"}, Columns: []string{"id"}},
+	} {
+		var err error
+		change, err = mustStageFunc(t, config)(change)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, "app", change.Schema)
+	assert.Equal(t, "accounts", change.Table)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: float64(1)},
+		{Column: "email_hash", Value: "3ee1d0650dc9ad001cb06b725dd88915905f760d8ecd7cc86a9d7880ccfcb236"},
+		{Column: "password", Value: "[REDACTED]"},
+		{Column: "source", Value: "warp-pipe"},
+	}, change.NewValues)
+}
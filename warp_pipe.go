@@ -2,12 +2,14 @@ package warppipe
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/jackc/pgx"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/perangel/warp-pipe/internal/store"
 )
 
 // Option is a WarpPipe option function
@@ -37,6 +39,35 @@ func WhitelistTables(tables []string) Option {
 	}
 }
 
+// Stages is an option for adding built-in stages to the pipeline, after the
+// changesets are filtered by WhitelistTables(), IgnoreTables() and Filter().
+func Stages(configs []StageConfig) Option {
+	return func(w *WarpPipe) {
+		w.stageConfigs = append(w.stageConfigs, configs...)
+	}
+}
+
+// DeadLetter is an option for sending the changesets that the Filter() and
+// Stages() stages fail to process to a DeadLetterSink, unless a stage sets its
+// own `on_error` policy.
+func DeadLetter(sink DeadLetterSink) Option {
+	return func(w *WarpPipe) {
+		w.deadLetter = sink
+	}
+}
+
+// Enrich is an option for enriching changesets with rows read from the database
+// at connConfig, such as a replica of the source database, or from the source
+// database if nil. The enrichment runs before the stages of Filter() and
+// Stages(). See Enricher.
+func Enrich(connConfig *pgx.ConnConfig, opts ...EnrichOption) Option {
+	return func(w *WarpPipe) {
+		w.enrich = true
+		w.enrichConnConfig = connConfig
+		w.enrichOpts = opts
+	}
+}
+
 // LogLevel is an option for setting the logging level.
 func LogLevel(level string) Option {
 	return func(w *WarpPipe) {
@@ -53,26 +84,31 @@ func LogLevel(level string) Option {
 // WarpPipe is a daemon that listens for database changes and transmits them
 // somewhere else.
 type WarpPipe struct {
-	connConfig      *pgx.ConnConfig
-	conn            *pgx.Conn
-	listener        Listener
-	ignoreTables    []string
-	whitelistTables []string
-	changesCh       <-chan *Changeset
-	errCh           chan error
-	logger          *log.Logger
+	connConfig       *pgx.ConnConfig
+	conn             *pgx.Conn
+	listener         Listener
+	ignoreTables     []string
+	whitelistTables  []string
+	filters          []string
+	stageConfigs     []StageConfig
+	stages           []*Stage
+	deadLetter       DeadLetterSink
+	enrich           bool
+	enrichConnConfig *pgx.ConnConfig
+	enrichOpts       []EnrichOption
+	lookupConn       *pgx.Conn
+	stopListening    context.CancelFunc
+	stoppedCh        <-chan struct{}
+	drainedCh        chan struct{}
+	changesCh        <-chan *Changeset
+	errCh            chan error
+	logger           *log.Logger
 }
 
 // NewWarpPipe initializes and returns a new WarpPipe.
 func NewWarpPipe(connConfig *pgx.ConnConfig, listener Listener, opts ...Option) (*WarpPipe, error) {
-	conn, err := pgx.Connect(*connConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the source database: %w", err)
-	}
-
 	w := &WarpPipe{
 		connConfig: connConfig,
-		conn:       conn,
 		listener:   listener,
 		logger:     log.New(),
 	}
@@ -81,6 +117,56 @@ func NewWarpPipe(connConfig *pgx.ConnConfig, listener Listener, opts ...Option)
 		opt(w)
 	}
 
+	var stageOpts []StageOption
+	if w.deadLetter != nil {
+		stageOpts = append(stageOpts, StageDeadLetter(w.deadLetter))
+	}
+
+	for _, filter := range w.filters {
+		program, err := compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		w.stages = append(w.stages, &Stage{
+			Name: "filter",
+			Fn:   makeStageFunc("filter", newFilterStageFunc(program), stageOpts...),
+		})
+	}
+
+	for _, config := range w.stageConfigs {
+		stage, err := newConfiguredStage(config, stageOpts...)
+		if err != nil {
+			return nil, err
+		}
+		w.stages = append(w.stages, stage)
+	}
+
+	conn, err := pgx.Connect(*connConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the source database: %w", err)
+	}
+	w.conn = conn
+
+	if w.enrich {
+		lookupConnConfig := w.enrichConnConfig
+		if lookupConnConfig == nil {
+			lookupConnConfig = connConfig
+		}
+
+		lookupConn, err := pgx.Connect(*lookupConnConfig)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to the enrichment database: %w", err)
+		}
+		w.lookupConn = lookupConn
+
+		enricher := NewEnricher(NewSQLRowLookup(lookupConn), w.enrichOpts...)
+		w.stages = append([]*Stage{{
+			Name: "enrich",
+			Fn:   makeBatchStageContextFunc("enrich", enricher.EnrichContext, stageOpts...),
+		}}, w.stages...)
+	}
+
 	return w, nil
 }
 
@@ -90,85 +176,138 @@ func (w *WarpPipe) Open() error {
 }
 
 // ListenForChanges starts the listener listening for database changesets.
-// It returns two channels, on for Changesets, another for errors.
+// It returns two channels, on for Changesets, another for the errors of both
+// the listener and the pipeline. Pipeline errors are reported as *StageError.
+// The changesets channel is closed once the WarpPipe is shut down and drained,
+// see Shutdown(). Cancelling ctx stops the listener and the pipeline without
+// draining the changesets in flight.
 func (w *WarpPipe) ListenForChanges(ctx context.Context) (<-chan *Changeset, <-chan error) {
 	P := NewPipeline()
 
 	if w.whitelistTables != nil {
 		P.AddStage("whitelist_tables", func(change *Changeset) (*Changeset, error) {
-			for _, table := range w.whitelistTables {
-				parts := strings.Split(table, ".")
-				// <schema>.<table>
-				if len(parts) == 2 {
-					if parts[0] == change.Schema {
-						if parts[1] == "*" {
-							return change, nil
-						} else if parts[1] == change.Table {
-							return change, nil
-						}
-					}
-					// <table>
-				} else {
-					if parts[0] == change.Table {
-						return change, nil
-					}
-				}
+			if matchTables(w.whitelistTables, change.Schema, change.Table) {
+				return change, nil
 			}
-
 			return nil, nil
 		})
 	}
 
 	if w.ignoreTables != nil {
 		P.AddStage("ignore_tables", func(change *Changeset) (*Changeset, error) {
-			for _, table := range w.ignoreTables {
-				parts := strings.Split(table, ".")
-				// <schema>.<table>
-				if len(parts) == 2 {
-					if parts[0] == change.Schema {
-						if parts[1] == "*" {
-							return nil, nil
-						} else if parts[1] == change.Table {
-							return nil, nil
-						}
-					}
-					// <table>
-				} else {
-					if parts[0] == change.Table {
-						return nil, nil
-					}
-				}
+			if matchTables(w.ignoreTables, change.Schema, change.Table) {
+				return nil, nil
 			}
 			return change, nil
 		})
 	}
 
-	// listen for changes
-	changeCh, errCh := w.listener.ListenForChanges(ctx)
-	w.errCh = errCh
+	P.stages = append(P.stages, w.stages...)
+
+	// listen for changes, until shutdown
+	listenCtx, stopListening := context.WithCancel(ctx)
+	w.stopListening = stopListening
+	w.stoppedCh = ctx.Done()
+	changeCh, listenerErrCh := w.listener.ListenForChanges(listenCtx)
 
 	// starts a pipeline
-	outCh, _ := P.Start(ctx, changeCh)
-	w.changesCh = outCh
+	outCh, pipelineErrCh := P.Start(ctx, changeCh)
+	w.errCh = mergeErrors(ctx, listenerErrCh, pipelineErrCh)
+
+	changesCh := make(chan *Changeset)
+	w.drainedCh = make(chan struct{})
+	go w.forwardChanges(ctx, outCh, changesCh)
+	w.changesCh = changesCh
 
 	return w.changesCh, w.errCh
 }
 
-// Close will close the listener and try to gracefully shutdown the WarpPipe.
+// forwardChanges forwards the output of the pipeline, and marks the WarpPipe as
+// drained once the pipeline is closed and its last changeset is received.
+func (w *WarpPipe) forwardChanges(ctx context.Context, outCh <-chan *Changeset, changesCh chan *Changeset) {
+	defer close(changesCh)
+
+	for {
+		select {
+		case change, ok := <-outCh:
+			if !ok {
+				close(w.drainedCh)
+				return
+			}
+			select {
+			case changesCh <- change:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// mergeErrors forwards the errors of each channel to a single channel, until
+// the context is cancelled.
+func mergeErrors(ctx context.Context, errChs ...<-chan error) chan error {
+	errCh := make(chan error)
+	for _, ch := range errChs {
+		go func(ch <-chan error) {
+			for {
+				select {
+				case err, ok := <-ch:
+					if !ok {
+						return
+					}
+					select {
+					case errCh <- err:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(ch)
+	}
+	return errCh
+}
+
+// Shutdown gracefully shuts down the WarpPipe. It stops reading changesets from
+// the source, waits until the changesets in flight have been processed by the
+// pipeline and received from ListenForChanges(), persists the final checkpoint
+// of the listener if it implements Checkpointer, then closes the connections.
+// If ctx is done before the pipeline is drained, the connections are closed
+// without persisting the checkpoint, and the changesets in flight are lost.
+func (w *WarpPipe) Shutdown(ctx context.Context) error {
+	err := w.drain(ctx)
+	if err != nil {
+		w.logger.WithError(err).Warn("unable to gracefully shutdown warp pipe")
+	}
+
+	closeErr := w.shutdown()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops the listener and closes the connections, without draining the
+// pipeline. See Shutdown() for a graceful shutdown.
 func (w *WarpPipe) Close() error {
+	w.stop()
+
 	err := w.shutdown()
 	if err != nil {
-		w.logger.WithError(err).Warn("unable to gracefully shutdown warp pipe")
+		w.logger.WithError(err).Warn("unable to close warp pipe")
 		return err
 	}
 	return nil
 }
 
 // IsLatestChangeSet returns true if the id argument matches that of the last record in the changeset table.
-// TODO: This feature only supports the notify listener. It needs to support others.
+// TODO: This feature only supports the audit listeners. It needs to support others.
 func (w *WarpPipe) IsLatestChangeSet(id int64) (bool, error) {
 	switch w.listener.(type) {
-	case *NotifyListener:
+	case *NotifyListener, *PollingListener:
 		rows, err := w.conn.Query("SELECT id FROM warp_pipe.changesets ORDER BY id DESC LIMIT 1")
 		if err != nil {
 			return false, fmt.Errorf("failed to query latest changeset record: %w", err)
@@ -189,7 +328,76 @@ func (w *WarpPipe) IsLatestChangeSet(id int64) (bool, error) {
 	return false, nil
 }
 
+// Acknowledge records that the named consumer has processed all changesets up
+// to and including id, allowing them to be pruned once every registered
+// consumer has acknowledged them.
+// TODO: This feature only supports the audit listeners. It needs to support others.
+func (w *WarpPipe) Acknowledge(ctx context.Context, consumer string, id int64) error {
+	switch w.listener.(type) {
+	case *NotifyListener, *PollingListener:
+		err := store.NewChangesetStore(w.conn).AckConsumer(ctx, consumer, id)
+		if err != nil {
+			return fmt.Errorf("failed to acknowledge changeset %d for consumer %s: %w", id, consumer, err)
+		}
+	default:
+		return fmt.Errorf("unsupported listener. unable to acknowledge changeset")
+	}
+	return nil
+}
+
+// stop stops the listener reading changesets from the source, so the pipeline
+// drains and closes the changesets channel.
+func (w *WarpPipe) stop() {
+	if w.stopListening != nil {
+		w.stopListening()
+	}
+}
+
+// drain stops the listener, waits for the pipeline to be drained, and persists
+// the listener's checkpoint.
+func (w *WarpPipe) drain(ctx context.Context) error {
+	if w.stopListening == nil {
+		return nil
+	}
+
+	w.logger.Info("draining the pipeline...")
+	w.stop()
+
+	select {
+	case <-w.drainedCh:
+	case <-w.stoppedCh:
+		return errors.New("failed to drain the pipeline: the pipeline was stopped")
+	case <-ctx.Done():
+		return fmt.Errorf("failed to drain the pipeline: %w", ctx.Err())
+	}
+
+	if c, ok := w.listener.(Checkpointer); ok {
+		err := c.Checkpoint(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to persist the final checkpoint: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (w *WarpPipe) shutdown() error {
-	// TODO: implement any state preservation
-	return w.listener.Close()
+	err := w.listener.Close()
+	if err != nil {
+		return err
+	}
+
+	err = w.conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the source database connection: %w", err)
+	}
+
+	if w.lookupConn != nil {
+		err = w.lookupConn.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close the enrichment database connection: %w", err)
+		}
+	}
+
+	return nil
 }
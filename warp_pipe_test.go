@@ -0,0 +1,94 @@
+package warppipe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeListener emits changesets with increasing IDs until it is stopped.
+type fakeListener struct {
+	lastSentID   int64
+	checkpointed bool
+}
+
+func (l *fakeListener) Dial(*pgx.ConnConfig) error { return nil }
+
+func (l *fakeListener) ListenForChanges(ctx context.Context) (chan *Changeset, chan error) {
+	changesetsCh := make(chan *Changeset)
+	go func() {
+		defer close(changesetsCh)
+		for id := int64(0); ; id++ {
+			select {
+			case changesetsCh <- &Changeset{ID: id}:
+				l.lastSentID = id
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changesetsCh, make(chan error)
+}
+
+func (l *fakeListener) Checkpoint(context.Context) error {
+	l.checkpointed = true
+	return nil
+}
+
+func (l *fakeListener) Close() error { return nil }
+
+func TestWarpPipeDrain(t *testing.T) {
+	listener := &fakeListener{}
+	w := &WarpPipe{listener: listener, logger: log.New()}
+	w.stages = []*Stage{{
+		Name: "slow",
+		Fn:   makeStageFunc("slow", sleepStage(3), StageWorkers(4)),
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, _ := w.ListenForChanges(ctx)
+
+	var received []int64
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for change := range changes {
+			received = append(received, change.ID)
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelDrain()
+	assert.NoError(t, w.drain(drainCtx))
+	<-doneCh
+
+	// every changeset read from the source is emitted, in order
+	assert.NotEmpty(t, received)
+	for i, id := range received {
+		assert.Equal(t, int64(i), id)
+	}
+	assert.Equal(t, listener.lastSentID, received[len(received)-1])
+	assert.True(t, listener.checkpointed)
+}
+
+func TestWarpPipeDrainTimeout(t *testing.T) {
+	listener := &fakeListener{}
+	w := &WarpPipe{listener: listener, logger: log.New()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.ListenForChanges(ctx)
+
+	// nothing reads the changesets, so the pipeline cannot drain
+	time.Sleep(10 * time.Millisecond)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelDrain()
+	assert.EqualError(t, w.drain(drainCtx), "failed to drain the pipeline: context deadline exceeded")
+	assert.False(t, listener.checkpointed)
+}